@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/plpsy/iiocalibration/api"
+	"github.com/urfave/cli"
+)
+
+var cmdAnalyze = cli.Command{
+	Name:  "analyze",
+	Usage: "decode a raw iio_readdev capture file and print the offsets a calibration would write, without touching the hardware",
+	Description: `The layout file is JSON like {"device": "cf_axi_adc", "channels": [0, 1, 2], "type": "le:s24/32>>0"},
+   the channels in the order they are interleaved in the capture. The flags override it.`,
+	ArgsUsage: "<capture file> [layout file]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "device",
+			Usage: "device of the capture, all its channels if --channels is not given",
+		},
+		cli.StringFlag{
+			Name:  "channels",
+			Usage: "comma separated channels of the capture",
+		},
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "iio scan element type of the samples",
+			Value: api.SampleType,
+		},
+		cli.IntFlag{
+			Name:  "samples",
+			Usage: "samples per channel to analyze, default all samples of the file",
+		},
+		cli.Float64Flag{
+			Name:  "factor",
+			Usage: "part of the average written as offset, default calibration.factor of the config file",
+		},
+		cli.IntFlag{
+			Name:  "bins",
+			Usage: "histogram bins",
+			Value: 16,
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "output format, table or json",
+			Value: "table",
+		},
+	},
+	Action: actionAnalyze,
+}
+
+// captureLayout reads the layout file if given and applies the flags.
+func captureLayout(ctx *cli.Context) (api.CaptureLayout, error) {
+	var layout api.CaptureLayout
+	if ctx.NArg() > 1 {
+		data, err := ioutil.ReadFile(ctx.Args().Get(1))
+		if err != nil {
+			return layout, err
+		}
+		if err := json.Unmarshal(data, &layout); err != nil {
+			return layout, fmt.Errorf("%s: %v", ctx.Args().Get(1), err)
+		}
+	}
+	if ctx.IsSet("device") {
+		layout.Device = ctx.String("device")
+	}
+	if ctx.IsSet("channels") {
+		chanIds, err := parseChannels(ctx.String("channels"))
+		if err != nil {
+			return layout, err
+		}
+		layout.Channels = chanIds
+	}
+	if ctx.IsSet("type") || layout.Type == "" {
+		layout.Type = ctx.String("type")
+	}
+	if len(layout.Channels) == 0 && layout.Device != "" {
+		for _, d := range api.CurrentConfig().Devices {
+			if d.Name == layout.Device {
+				for id := 0; id < d.Channels; id++ {
+					layout.Channels = append(layout.Channels, id)
+				}
+			}
+		}
+	}
+	return layout, nil
+}
+
+func actionAnalyze(ctx *cli.Context) error {
+	if ctx.NArg() < 1 || ctx.NArg() > 2 {
+		return cli.NewExitError("usage: "+ctx.Command.HelpName+" "+ctx.Command.ArgsUsage, 1)
+	}
+	if f := ctx.String("output"); f != "table" && f != "json" {
+		return cli.NewExitError("--output must be table or json", 1)
+	}
+	layout, err := captureLayout(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	points, err := ioutil.ReadFile(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	factor := api.CurrentConfig().Calibration.Factor
+	if ctx.IsSet("factor") {
+		factor = ctx.Float64("factor")
+	}
+	result, err := api.AnalyzeCapture(points, layout, ctx.Int("samples"), factor, ctx.Int("bins"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if ctx.String("output") == "json" {
+		return printJSON(result)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHANNEL\tSAMPLES\tMEAN\tMIN\tMAX\tNOISE\tOFFSET\tMSB/MIB/LSB")
+	for _, a := range result {
+		fmt.Fprintf(tw, "%d\t%d\t%.1f\t%d\t%d\t%.1f\t%d\t%02x/%02x/%02x\n",
+			a.Channel, a.Samples, a.Mean, a.Min, a.Max, a.Noise, a.Offset, a.Registers[0], a.Registers[1], a.Registers[2])
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, a := range result {
+		fmt.Printf("\nchannel %d\n", a.Channel)
+		printHistogram(a.Histogram)
+	}
+	return nil
+}
+
+// printHistogram draws the bins as bars of at most 40 characters.
+func printHistogram(bins []api.HistogramBin) {
+	most := 0
+	for _, b := range bins {
+		if b.Count > most {
+			most = b.Count
+		}
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', tabwriter.AlignRight)
+	for _, b := range bins {
+		bar := strings.Repeat("#", (b.Count*40+most-1)/most)
+		fmt.Fprintf(tw, "%d\t..\t%d\t%d\t %s\n", b.Low, b.High, b.Count, bar)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"math"
+)
+
+// SampleType is the iio scan element type of the channels, the only one
+// decodeSamples understands.
+const SampleType = "le:s24/32>>0"
+
+// CaptureLayout describes a raw iio_readdev dump: the channels enabled for
+// the capture in their order in the file.
+type CaptureLayout struct {
+	Device   string `json:"device"`
+	Channels []int  `json:"channels"`
+	Type     string `json:"type"`
+}
+
+// HistogramBin counts the samples in [Low, High].
+type HistogramBin struct {
+	Low   int32 `json:"low"`
+	High  int32 `json:"high"`
+	Count int   `json:"count"`
+}
+
+// ChannelAnalysis is the statistics of the samples of a channel and the
+// offset a calibration would write for them.
+type ChannelAnalysis struct {
+	Channel int     `json:"channel"`
+	Samples int     `json:"samples"`
+	Mean    float64 `json:"mean"`
+	Min     int32   `json:"min"`
+	Max     int32   `json:"max"`
+	// standard deviation of the samples
+	Noise     float64        `json:"noise"`
+	Offset    int32          `json:"offset"`
+	Registers [3]uint8       `json:"registers"`
+	Histogram []HistogramBin `json:"histogram"`
+}
+
+func (l *CaptureLayout) validate() error {
+	if l.Type != SampleType {
+		return fmt.Errorf("sample type %q not supported, only %s", l.Type, SampleType)
+	}
+	if len(l.Channels) == 0 {
+		return fmt.Errorf("no channels")
+	}
+	seen := make(map[int]bool)
+	for _, id := range l.Channels {
+		if id < 0 || id > 7 {
+			return fmt.Errorf("channel %d out of range 0-7", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("channel %d listed twice", id)
+		}
+		seen[id] = true
+	}
+	if l.Device != "" {
+		if p := lookupKnownProfile(l.Device); p == nil {
+			return fmt.Errorf("device %s: unknown device", l.Device)
+		}
+	}
+	return nil
+}
+
+// AnalyzeCapture decodes a raw capture like calcAverage and returns for each
+// channel its statistics and would-be offset. samples 0 uses all complete
+// samples of the file, bins is the number of histogram bins.
+func AnalyzeCapture(points []byte, layout CaptureLayout, samples int, factor float64, bins int) ([]ChannelAnalysis, error) {
+	if err := layout.validate(); err != nil {
+		return nil, err
+	}
+	if bins < 1 {
+		return nil, fmt.Errorf("bins must be positive")
+	}
+	chanNum := len(layout.Channels)
+	if samples == 0 {
+		samples = len(points) / (chanNum * 4)
+	}
+	values, err := decodeSamples(points, chanNum, samples)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ChannelAnalysis, chanNum)
+	for idx, v := range values {
+		a := ChannelAnalysis{Channel: layout.Channels[idx], Samples: samples, Min: v[0], Max: v[0]}
+		var sum float64
+		for _, x := range v {
+			sum += float64(x)
+			if x < a.Min {
+				a.Min = x
+			}
+			if x > a.Max {
+				a.Max = x
+			}
+		}
+		a.Mean = sum / float64(samples)
+		var sq float64
+		for _, x := range v {
+			sq += (float64(x) - a.Mean) * (float64(x) - a.Mean)
+		}
+		a.Noise = math.Sqrt(sq / float64(samples))
+		a.Offset = channelOffset(v, float32(factor))
+		a.Registers = offsetBytes(a.Offset)
+		a.Histogram = histogram(v, a.Min, a.Max, bins)
+		result[idx] = a
+	}
+	return result, nil
+}
+
+func histogram(values []int32, lo, hi int32, bins int) []HistogramBin {
+	span := int64(hi) - int64(lo) + 1
+	if int64(bins) > span {
+		bins = int(span)
+	}
+	width := (span + int64(bins) - 1) / int64(bins)
+	h := make([]HistogramBin, (span+width-1)/width)
+	for i := range h {
+		h[i].Low = int32(int64(lo) + int64(i)*width)
+		h[i].High = int32(min(int64(lo)+int64(i+1)*width-1, int64(hi)))
+	}
+	for _, v := range values {
+		h[(int64(v)-int64(lo))/width].Count++
+	}
+	return h
+}
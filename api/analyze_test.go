@@ -0,0 +1,54 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestAnalyzeCapture(t *testing.T) {
+	b := newFakeBackend()
+	b.setLevel("cf_axi_adc", 2, -1000)
+	b.setLevel("cf_axi_adc", 5, 40)
+	points, _ := b.Capture("cf_axi_adc", []int{2, 5}, 8)
+	// one noisy sample of channel 5
+	points[3*8+4] = 48
+
+	layout := CaptureLayout{Device: "cf_axi_adc", Channels: []int{2, 5}, Type: SampleType}
+	result, err := AnalyzeCapture(points, layout, 0, 0.75, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	averages := calcAverage(testLog, points, 2, 8, 0.75)
+	for i, a := range result {
+		if a.Samples != 8 || a.Offset != averages[i] || a.Registers != offsetBytes(a.Offset) {
+			t.Fatalf("channel %d: %+v, calcAverage %d", a.Channel, a, averages[i])
+		}
+	}
+	if a := result[0]; a.Mean != -1000 || a.Noise != 0 || len(a.Histogram) != 1 || a.Histogram[0].Count != 8 {
+		t.Fatalf("channel 2: %+v", a)
+	}
+	if a := result[0]; a.Registers != [3]uint8{0xff, 0xfd, 0x12} {
+		t.Fatalf("channel 2 registers %02x", a.Registers)
+	}
+	a := result[1]
+	if a.Min != 40 || a.Max != 48 || a.Mean != 41 || a.Noise == 0 || a.Offset != 30 {
+		t.Fatalf("channel 5: %+v", a)
+	}
+	// 9 values in bins of 3
+	if len(a.Histogram) != 3 || a.Histogram[0].Count != 7 || a.Histogram[2].Count != 1 || a.Histogram[2].High != 48 {
+		t.Fatalf("channel 5 histogram %+v", a.Histogram)
+	}
+
+	for _, l := range []CaptureLayout{
+		{Channels: []int{2, 5}, Type: "le:s16/16>>0"},
+		{Channels: []int{2, 2}, Type: SampleType},
+		{Channels: []int{8}, Type: SampleType},
+		{Type: SampleType},
+	} {
+		if _, err := AnalyzeCapture(points, l, 0, 0.75, 4); err == nil {
+			t.Errorf("layout %+v: expected error", l)
+		}
+	}
+	if _, err := AnalyzeCapture(points, layout, 9, 0.75, 4); err == nil {
+		t.Error("expected error for more samples than the file has")
+	}
+}
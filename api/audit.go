@@ -0,0 +1,321 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/plpsy/iiocalibration/logfile"
+)
+
+const (
+	auditMaxSize    = 1 << 20
+	auditMaxBackups = 5
+	auditMaxBody    = 4096
+)
+
+// AuditEntry records one state changing operation.
+type AuditEntry struct {
+	Time      time.Time         `json:"time"`
+	RequestID string            `json:"requestId,omitempty"`
+	User      string            `json:"user"`
+	Role      Role              `json:"role"`
+	Remote    string            `json:"remote"`
+	Method    string            `json:"method,omitempty"`
+	Endpoint  string            `json:"endpoint"`
+	Action    string            `json:"action"`
+	Params    map[string]string `json:"params,omitempty"`
+	Body      json.RawMessage   `json:"body,omitempty"`
+	Before    interface{}       `json:"before,omitempty"`
+	After     interface{}       `json:"after,omitempty"`
+	Status    int               `json:"status,omitempty"`
+	Outcome   string            `json:"outcome"`
+	Error     string            `json:"error,omitempty"`
+}
+
+var (
+	auditMu  sync.Mutex
+	auditLog *logfile.File
+)
+
+// OpenAuditLog appends the audit entries to path, rotated at 1MB.
+func OpenAuditLog(path string) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	auditLog = logfile.New(path, auditMaxSize, auditMaxBackups)
+}
+
+// Audit appends an entry to the audit log.
+func Audit(e *AuditEntry) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditLog == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Outcome == "" {
+		e.Outcome = "success"
+		if e.Error != "" || e.Status >= 400 {
+			e.Outcome = "failure"
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		moduleLog("audit").WithError(err).Error("Audit marshal error")
+		return
+	}
+	if _, err = auditLog.Write(append(data, '\n')); err != nil {
+		moduleLog("audit").WithError(err).Error("Audit write error")
+	}
+}
+
+// auditState reads the hardware state recorded before and after an audited
+// operation.
+type auditState func(r *http.Request, params httprouter.Params) interface{}
+
+// OffsetState records the offset registers of all channels.
+func OffsetState(r *http.Request, params httprouter.Params) interface{} {
+	regs, err := getOffsetRegs(requestLog(r, "audit"))
+	if err != nil {
+		return map[string]string{"error": err.Error()}
+	}
+	return regs
+}
+
+// RegisterState records the register addressed by the route.
+func RegisterState(r *http.Request, params httprouter.Params) interface{} {
+	profile := lookupProfile(params.ByName("dev"))
+	if profile == nil {
+		return nil
+	}
+	off, err := profile.resolveReg(params.ByName("addr"))
+	if err != nil || !profile.validReg(off) || !profile.Policy.canRead(off) {
+		return nil
+	}
+	val, err := readDevReg(requestLog(r, "audit"), profile.Name, off)
+	if err != nil {
+		return map[string]string{"error": err.Error()}
+	}
+	return RegisterValue{Address: off, Value: val}
+}
+
+// RegisterSpaceState records the whole register space of all devices.
+func RegisterSpaceState(r *http.Request, params httprouter.Params) interface{} {
+	state := make(map[string][]RegisterValue)
+	for _, p := range profiles {
+		regs, err := readRegisterSpace(p)
+		if err != nil {
+			return map[string]string{"error": err.Error()}
+		}
+		state[p.Name] = regs
+	}
+	return state
+}
+
+type auditKey struct{}
+
+// setAuditError marks an audited request as failed, for the handlers
+// reporting errors with status 200.
+func setAuditError(r *http.Request, err error) {
+	if e, ok := r.Context().Value(auditKey{}).(*AuditEntry); ok && err != nil {
+		e.Error = err.Error()
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush lets the event stream through the recorders.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Audited wraps a state changing handler and appends an audit entry with
+// the caller, parameters, outcome and, if state is not nil, the hardware
+// state before and after the handler.
+func Audited(action string, state auditState, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		id := RequestIdentity(r)
+		e := &AuditEntry{
+			User:      id.Name,
+			Role:      id.Role,
+			Remote:    r.RemoteAddr,
+			RequestID: RequestIDOf(r),
+			Method:    r.Method,
+			Endpoint:  r.URL.Path,
+			Action:    action,
+			Params:    make(map[string]string),
+		}
+		for k, v := range r.URL.Query() {
+			e.Params[k] = strings.Join(v, ",")
+		}
+		for _, p := range params {
+			e.Params[p.Key] = p.Value
+		}
+		if r.Body != nil && r.ContentLength != 0 {
+			// 处理函数读到完整的请求体, 审计记录只保存开头
+			body, _ := ioutil.ReadAll(io.LimitReader(r.Body, auditMaxBody+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			e.Body = auditBody(body)
+		}
+		if state != nil {
+			e.Before = state(r, params)
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r.WithContext(context.WithValue(r.Context(), auditKey{}, e)), params)
+
+		if state != nil {
+			e.After = state(r, params)
+		}
+		e.Status = rec.status
+		Audit(e)
+	}
+}
+
+// auditBody returns the recorded request body: a JSON body, or the start of
+// a longer one as a string.
+func auditBody(body []byte) json.RawMessage {
+	if len(body) <= auditMaxBody {
+		if json.Valid(body) {
+			return body
+		}
+		return nil
+	}
+	start, _ := json.Marshal(string(body[:auditMaxBody]) + "...")
+	return start
+}
+
+// AuditQuery selects audit entries.
+type AuditQuery struct {
+	Since   time.Time
+	Until   time.Time
+	Actions []string
+	Limit   int
+}
+
+func (q *AuditQuery) match(e *AuditEntry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	if len(q.Actions) == 0 {
+		return true
+	}
+	for _, a := range q.Actions {
+		if a == e.Action {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryAudit returns the matching entries, oldest first. With a limit only
+// the newest entries are returned.
+func QueryAudit(q AuditQuery) ([]AuditEntry, error) {
+	auditMu.Lock()
+	log := auditLog
+	auditMu.Unlock()
+	entries := make([]AuditEntry, 0)
+	if log == nil {
+		return entries, nil
+	}
+	for _, path := range log.Files() {
+		fp, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(fp)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			var e AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if q.match(&e) {
+				entries = append(entries, e)
+			}
+		}
+		fp.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return entries, nil
+}
+
+// GetAudit returns the audit entries filtered by since/until (RFC3339),
+// action (comma separated) and limit.
+func GetAudit(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	vars := r.URL.Query()
+	var q AuditQuery
+	var err error
+	if s := vars.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "since must be RFC3339")
+			return
+		}
+	}
+	if s := vars.Get("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "until must be RFC3339")
+			return
+		}
+	}
+	if s := vars.Get("action"); s != "" {
+		q.Actions = strings.Split(s, ",")
+	}
+	if s := vars.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			writeErrorResponse(w, http.StatusBadRequest, "limit invalid")
+			return
+		}
+	}
+	entries, err := QueryAudit(q)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeResponse(w, entries)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAudited(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+	OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	defer func() { auditLog = nil }()
+	useAuthFile(t, testAuthFile)
+
+	b.WriteReg("cf_axi_adc", 0x1e, 0x01)
+	router := httprouter.New()
+	router.PUT("/devices/:dev/registers/:addr", Authorize(RoleOperator, Audited("register_write", RegisterState, WriteRegister)))
+	router.POST("/calibration", Authorize(RoleOperator, Audited("calibration", nil,
+		func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+			setAuditError(r, errors.New("iio_readdev failed"))
+			prettyJson(w, "iio_readdev failed")
+		})))
+
+	operator := http.Header{"X-Api-Key": {"operator-key"}}
+	rec := doRequest(router, "PUT", "/devices/cf_axi_adc/registers/CH0_OFFSET", `{"value": 2}`, operator)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("register write: %d %s", rec.Code, rec.Body.String())
+	}
+	doRequest(router, "PUT", "/devices/cf_axi_adc/registers/0x06", `{"value": 2}`, operator)
+	doRequest(router, "POST", "/calibration?channel=3", "", operator)
+
+	entries, err := QueryAudit(AuditQuery{Actions: []string{"register_write"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 register writes, got %+v", entries)
+	}
+	e := entries[0]
+	if e.User != "mes" || e.Role != RoleOperator || e.Outcome != "success" || e.Params["addr"] != "CH0_OFFSET" || string(e.Body) != `{"value":2}` {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	before, _ := json.Marshal(e.Before)
+	after, _ := json.Marshal(e.After)
+	if string(before) != `{"address":30,"value":1}` || string(after) != `{"address":30,"value":2}` {
+		t.Fatalf("unexpected before/after %s %s", before, after)
+	}
+	if entries[1].Outcome != "failure" || entries[1].Status != http.StatusForbidden {
+		t.Fatalf("forbidden write recorded as %+v", entries[1])
+	}
+
+	entries, _ = QueryAudit(AuditQuery{Actions: []string{"calibration"}})
+	if len(entries) != 1 || entries[0].Outcome != "failure" || entries[0].Error != "iio_readdev failed" || entries[0].Params["channel"] != "3" {
+		t.Fatalf("unexpected calibration entries %+v", entries)
+	}
+	entries, _ = QueryAudit(AuditQuery{Since: time.Now().Add(time.Minute)})
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries in the future, got %d", len(entries))
+	}
+	entries, _ = QueryAudit(AuditQuery{Limit: 1})
+	if len(entries) != 1 || entries[0].Action != "calibration" {
+		t.Fatalf("limit should keep the newest entry, got %+v", entries)
+	}
+
+	// the handler reads a body longer than the recorded start
+	router.PUT("/params", Authorize(RoleOperator, Audited("params_import", nil,
+		func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+			var p map[string][]int32
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeResponse(w, len(p["cf_axi_adc"]))
+		})))
+	body := `{"cf_axi_adc": [` + strings.Repeat("1234567, ", 1000) + `0]}`
+	if rec := doRequest(router, "PUT", "/params", body, operator); rec.Code != http.StatusOK || rec.Body.String() != "1001\n" {
+		t.Fatalf("large body: %d %s", rec.Code, rec.Body.String())
+	}
+	entries, _ = QueryAudit(AuditQuery{Actions: []string{"params_import"}})
+	var start string
+	if len(entries) != 1 || json.Unmarshal(entries[0].Body, &start) != nil || start != body[:auditMaxBody]+"..." {
+		t.Fatalf("large body recorded as %+v", entries)
+	}
+}
@@ -0,0 +1,320 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// Role is the privilege level of an API caller.
+type Role int
+
+const (
+	RoleViewer Role = iota
+	RoleOperator
+	RoleAdmin
+)
+
+var roleNames = []string{"viewer", "operator", "admin"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return "Role(" + strconv.Itoa(int(r)) + ")"
+	}
+	return roleNames[r]
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	for i, name := range roleNames {
+		if name == string(text) {
+			*r = Role(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role %q", text)
+}
+
+const (
+	// role of every caller while authentication is disabled by an empty
+	// auth file setting
+	disabledAuthRole = RoleOperator
+	// role of the callers without credentials while the auth file does not
+	// exist, they can only read
+	anonymousRole = RoleViewer
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+// AuthFile is the content of the auth file: static API keys, sent as
+// "Authorization: Bearer <key>" or "X-API-Key: <key>", and users for HTTP
+// Basic authentication with passwords hashed by HashPassword.
+type AuthFile struct {
+	Keys []struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+		Role Role   `json:"role"`
+	} `json:"keys"`
+	Users []struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Role     Role   `json:"role"`
+	} `json:"users"`
+}
+
+type authStore struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	enabled bool
+	file    AuthFile
+}
+
+var auth authStore
+
+type identityKey struct{}
+
+// LoadAuthFile enables authentication with the keys and users of path. An
+// empty path disables authentication, while the file does not exist callers
+// are anonymous viewers.
+func LoadAuthFile(path string) error {
+	auth.mu.Lock()
+	auth.path = path
+	auth.mu.Unlock()
+	return ReloadAuth()
+}
+
+// ReloadAuth reads the auth file again. On error the previous keys stay
+// active, also when the loaded file was removed.
+func ReloadAuth() (err error) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	defer func() { observeConfigLoad("auth", err) }()
+
+	if auth.path == "" {
+		auth.enabled = false
+		return nil
+	}
+	info, err := os.Stat(auth.path)
+	if os.IsNotExist(err) {
+		// 文件被删除或 SD 卡未挂载时不能关闭认证
+		auth.modTime = time.Time{}
+		if auth.enabled {
+			return fmt.Errorf("auth file %s removed, the loaded keys stay active", auth.path)
+		}
+		moduleLog("auth").WithField("file", auth.path).Warn("auth file not found, anonymous callers can only read")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// 解析失败也记录修改时间, 文件再次修改时才重新加载
+	auth.modTime = info.ModTime()
+
+	fp, err := os.Open(auth.path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var file AuthFile
+	if err = json.NewDecoder(fp).Decode(&file); err != nil {
+		return fmt.Errorf("auth file %s: %v", auth.path, err)
+	}
+	for _, u := range file.Users {
+		if _, _, _, err := parsePasswordHash(u.Password); err != nil {
+			return fmt.Errorf("auth file %s user %s: %v", auth.path, u.Name, err)
+		}
+	}
+	auth.file = file
+	auth.enabled = true
+	moduleLog("auth").WithFields(logrus.Fields{"file": auth.path, "keys": len(file.Keys), "users": len(file.Users)}).Info("auth file loaded")
+	return nil
+}
+
+// WatchAuthFile reloads the auth file whenever it is created, modified or
+// removed.
+func WatchAuthFile(interval time.Duration) {
+	for range time.Tick(interval) {
+		auth.mu.RLock()
+		path, modTime := auth.path, auth.modTime
+		auth.mu.RUnlock()
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) && modTime.IsZero() {
+			continue
+		}
+		if err == nil && info.ModTime().Equal(modTime) {
+			continue
+		}
+		if err := ReloadAuth(); err != nil {
+			moduleLog("auth").WithError(err).Error("WatchAuthFile reload error")
+		}
+	}
+}
+
+// authenticate returns the identity of the caller, ok is false if the
+// credentials are missing or wrong.
+func authenticate(r *http.Request) (id Identity, ok bool) {
+	auth.mu.RLock()
+	defer auth.mu.RUnlock()
+
+	if !auth.enabled {
+		return anonymousIdentity(), true
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		key = strings.TrimPrefix(h, "Bearer ")
+	}
+	if key != "" {
+		for _, k := range auth.file.Keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+				return Identity{Name: k.Name, Role: k.Role}, true
+			}
+		}
+		return id, false
+	}
+
+	if name, password, basic := r.BasicAuth(); basic {
+		for _, u := range auth.file.Users {
+			if u.Name == name && checkPassword(u.Password, password) {
+				return Identity{Name: u.Name, Role: u.Role}, true
+			}
+		}
+	}
+	return id, false
+}
+
+// Authorize wraps a handler so that it only runs for callers having at
+// least the given role. Unauthenticated callers get 401, callers with a
+// lower role 403.
+func Authorize(role Role, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		id, ok := authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="iiocalibration"`)
+			writeErrorResponse(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if id.Role < role {
+			writeErrorResponse(w, http.StatusForbidden, fmt.Sprintf("%s role required", role))
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)), params)
+	}
+}
+
+// RequestIdentity returns the caller identity set by Authorize.
+func RequestIdentity(r *http.Request) Identity {
+	if id, ok := r.Context().Value(identityKey{}).(Identity); ok {
+		return id
+	}
+	auth.mu.RLock()
+	defer auth.mu.RUnlock()
+	return anonymousIdentity()
+}
+
+// anonymousIdentity returns the identity of a caller while no keys are
+// loaded, auth.mu must be held.
+func anonymousIdentity() Identity {
+	if auth.path == "" {
+		return Identity{Name: "anonymous", Role: disabledAuthRole}
+	}
+	return Identity{Name: "anonymous", Role: anonymousRole}
+}
+
+func requestRole(r *http.Request) Role {
+	return RequestIdentity(r).Role
+}
+
+func ReloadAuthHandler(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := ReloadAuth(); err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeResponse(w, "auth file reloaded")
+}
+
+func WhoAmI(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	writeResponse(w, RequestIdentity(r))
+}
+
+const passwordIterations = 10000
+
+// HashPassword hashes password with PBKDF2-HMAC-SHA256 in the format used by
+// the auth file: pbkdf2-sha256$<iterations>$<salt>$<hash>.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := pbkdf2([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func parsePasswordHash(s string) (iterations int, salt, hash []byte, err error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return 0, nil, nil, fmt.Errorf("password hash format invalid")
+	}
+	if iterations, err = strconv.Atoi(parts[1]); err != nil || iterations <= 0 {
+		return 0, nil, nil, fmt.Errorf("password hash iterations invalid")
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, fmt.Errorf("password hash salt invalid")
+	}
+	if hash, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(hash) != sha256.Size {
+		return 0, nil, nil, fmt.Errorf("password hash invalid")
+	}
+	return iterations, salt, hash, nil
+}
+
+func checkPassword(encoded, password string) bool {
+	iterations, salt, hash, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iterations), hash) == 1
+}
+
+// pbkdf2 derives a single sha256 sized block (RFC 8018).
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const testAuthFile = `{
+	"keys": [
+		{"name": "dashboard", "key": "viewer-key", "role": "viewer"},
+		{"name": "mes", "key": "operator-key", "role": "operator"},
+		{"name": "engineer", "key": "admin-key", "role": "admin"}
+	]
+}`
+
+func useAuthFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadAuthFile(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { LoadAuthFile("") })
+	return path
+}
+
+func TestAuthorize(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := useAuthFile(t, `{
+		"keys": [{"name": "mes", "key": "operator-key", "role": "operator"}],
+		"users": [{"name": "alice", "password": "`+hash+`", "role": "admin"}]
+	}`)
+
+	router := httprouter.New()
+	router.POST("/reboot", Authorize(RoleOperator, WhoAmI))
+	router.POST("/restore", Authorize(RoleAdmin, WhoAmI))
+
+	for _, c := range []struct {
+		path   string
+		header http.Header
+		code   int
+	}{
+		{"/reboot", nil, http.StatusUnauthorized},
+		{"/reboot", http.Header{"X-Api-Key": {"guess"}}, http.StatusUnauthorized},
+		{"/reboot", http.Header{"Authorization": {"Bearer operator-key"}}, http.StatusOK},
+		{"/restore", http.Header{"X-Api-Key": {"operator-key"}}, http.StatusForbidden},
+		{"/restore", http.Header{"Authorization": {basicAuth("alice", "s3cret")}}, http.StatusOK},
+		{"/restore", http.Header{"Authorization": {basicAuth("alice", "wrong")}}, http.StatusUnauthorized},
+	} {
+		if rec := doRequest(router, "POST", c.path, "", c.header); rec.Code != c.code {
+			t.Errorf("%s %v: got %d, expected %d", c.path, c.header, rec.Code, c.code)
+		}
+	}
+
+	// keys are replaced on reload, a broken file keeps the previous ones
+	if err = ioutil.WriteFile(path, []byte(`{"keys": [{"name": "mes", "key": "new-key", "role": "operator"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ReloadAuth(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(router, "POST", "/reboot", "", http.Header{"X-Api-Key": {"operator-key"}}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old key after reload: %d", rec.Code)
+	}
+	ioutil.WriteFile(path, []byte(`{"keys": [`), 0600)
+	if err = ReloadAuth(); err == nil {
+		t.Error("expected reload error for broken auth file")
+	}
+	if rec := doRequest(router, "POST", "/reboot", "", http.Header{"X-Api-Key": {"new-key"}}); rec.Code != http.StatusOK {
+		t.Errorf("key after failed reload: %d", rec.Code)
+	}
+
+	// a removed auth file keeps the loaded keys
+	os.Remove(path)
+	if err = ReloadAuth(); err == nil {
+		t.Error("expected reload error for removed auth file")
+	}
+	if rec := doRequest(router, "POST", "/reboot", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous after auth file removed: %d", rec.Code)
+	}
+	if rec := doRequest(router, "POST", "/reboot", "", http.Header{"X-Api-Key": {"new-key"}}); rec.Code != http.StatusOK {
+		t.Errorf("key after auth file removed: %d", rec.Code)
+	}
+
+	// an empty auth file setting disables authentication
+	if err = LoadAuthFile(""); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(router, "POST", "/reboot", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("anonymous operator: %d", rec.Code)
+	}
+	if rec := doRequest(router, "POST", "/restore", "", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("anonymous admin route: %d", rec.Code)
+	}
+
+	// without auth file every caller is an anonymous viewer
+	if err = LoadAuthFile(path); err != nil {
+		t.Fatal(err)
+	}
+	router.GET("/whoami", Authorize(RoleViewer, WhoAmI))
+	if rec := doRequest(router, "GET", "/whoami", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("anonymous viewer: %d", rec.Code)
+	}
+	if rec := doRequest(router, "POST", "/reboot", "", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("anonymous operator route: %d", rec.Code)
+	}
+}
+
+func basicAuth(user, password string) string {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(user, password)
+	return req.Header.Get("Authorization")
+}
+
+func TestPasswordHash(t *testing.T) {
+	start := time.Now()
+	hash, err := HashPassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hash, "pw") || checkPassword(hash, "pW") {
+		t.Fatal("password check failed")
+	}
+	if checkPassword("sha1$abc", "pw") {
+		t.Fatal("accepted invalid hash")
+	}
+	t.Logf("hash %s took %v", hash, time.Since(start))
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Backend performs the raw register accesses and sample captures on the
+// iio devices.
+type Backend interface {
+	ReadReg(devName string, off int) (uint8, error)
+	WriteReg(devName string, off int, val uint8) error
+	// Capture reads samples interleaved samples of the channels, each a
+	// 32 bit little endian word.
+	Capture(devName string, chanIds []int, samples int) ([]byte, error)
+	// Devices returns the names of the available iio devices.
+	Devices() ([]string, error)
+	// Check reports whether the backend is usable.
+	Check() error
+}
+
+var backend Backend = iioBackend{}
+
+// SetBackend replaces the hardware backend, mainly for tests.
+func SetBackend(b Backend) {
+	backend = b
+}
+
+// iioBackend accesses the registers through the libiio iio_reg tool.
+type iioBackend struct{}
+
+var iioDevicesDir = "/sys/bus/iio/devices"
+
+func (iioBackend) Devices() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(iioDevicesDir, "iio:device*", "name"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		name, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, strings.TrimSpace(string(name)))
+	}
+	return names, nil
+}
+
+func (iioBackend) Check() error {
+	for _, tool := range []string{"iio_reg", "iio_readdev"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iioBackend) ReadReg(devName string, off int) (val uint8, err error) {
+	cmd := exec.Command("iio_reg", devName, fmt.Sprintf("0x%02x", off))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+	valBuff := new(bytes.Buffer)
+	cmd.Stdout = valBuff
+
+	if err = cmd.Start(); err != nil {
+		err = fmt.Errorf("readDevReg cmd.Start() failed: %s", err.Error())
+		moduleLog("backend").Error(err)
+		return
+	}
+
+	if err = cmd.Wait(); err != nil {
+		err = fmt.Errorf("readDevReg cmd.Wait() failed: %s", err.Error())
+		moduleLog("backend").Error(err)
+		return
+	}
+	varStr := strings.Replace(valBuff.String(), "\n", "", -1)
+	val64, err := strconv.ParseInt(varStr, 0, 64)
+	if err != nil {
+		err = fmt.Errorf("readDevReg strconv.ParseInt failed: %s", err.Error())
+		moduleLog("backend").Error(err)
+		return
+	}
+	val = (uint8)(val64)
+	return
+}
+
+func (iioBackend) WriteReg(devName string, off int, val uint8) error {
+	cmd := exec.Command("iio_reg", devName, fmt.Sprintf("0x%02x", off), fmt.Sprintf("%d", val))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	if err := cmd.Start(); err != nil {
+		err1 := fmt.Errorf("writeDevReg cmd.Start() failed: %s", err.Error())
+		moduleLog("backend").Error(err1)
+		return err1
+	}
+
+	if err := cmd.Wait(); err != nil {
+		err1 := fmt.Errorf("writeDevReg cmd.Wait() failed: %s", err.Error())
+		moduleLog("backend").Error(err1)
+		return err1
+	}
+	return nil
+}
+
+func (iioBackend) Capture(devName string, chanIds []int, samples int) ([]byte, error) {
+	var args []string
+	args = append(args, "-s", fmt.Sprintf("%d", samples), devName)
+	for _, id := range chanIds {
+		args = append(args, fmt.Sprintf("voltage%d", id))
+	}
+	log := moduleLog("backend").WithField("device", devName)
+	log.Debug("iio_readdev ", args)
+
+	cmd := exec.Command("iio_readdev", args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	samplePoints := new(bytes.Buffer)
+	cmd.Stdout = samplePoints
+
+	if err := cmd.Start(); err != nil {
+		err1 := fmt.Errorf("calibrationAll cmd.Start() failed: %s", err.Error())
+		moduleLog("backend").Error(err1)
+		return nil, err1
+	}
+	log.Debug("iio_readdev started")
+	if err := cmd.Wait(); err != nil {
+		err1 := fmt.Errorf("calibration cmd.Wait() failed: %s", err.Error())
+		moduleLog("backend").Error(err1)
+		return nil, err1
+	}
+	log.Debug("iio_readdev wait done")
+	return samplePoints.Bytes(), nil
+}
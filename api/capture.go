@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// 单次采集的最大采样点数
+const maxCaptureSamples = 1 << 16
+
+// Capture holds the samples of some channels of a device, Values[i] are the
+// samples of Channels[i].
+type Capture struct {
+	Device   string    `json:"device"`
+	Samples  int       `json:"samples"`
+	Channels []int     `json:"channels"`
+	Values   [][]int32 `json:"values"`
+}
+
+// decodeSamples splits the interleaved little endian 32 bit words of
+// iio_readdev into the signed 24 bit samples of each channel.
+func decodeSamples(points []byte, chanNum int, samples int) ([][]int32, error) {
+	if chanNum <= 0 || samples <= 0 {
+		return nil, fmt.Errorf("invalid capture layout: %d channels, %d samples", chanNum, samples)
+	}
+	if len(points) < samples*chanNum*4 {
+		return nil, fmt.Errorf("capture has %d bytes, expected %d samples of %d channels", len(points), samples, chanNum)
+	}
+	values := make([][]int32, chanNum)
+	for idx := range values {
+		values[idx] = make([]int32, samples)
+		for i := range values[idx] {
+			// 找到采样点偏移
+			off := i*chanNum*4 + idx*4
+			v := int32(binary.LittleEndian.Uint32(points[off : off+4]))
+			// 24位补码表示的有符号采样值,转换为32位有符号整数
+			values[idx][i] = v << 8 >> 8
+		}
+	}
+	return values, nil
+}
+
+// checkCapture validates the channels and sample count of a capture, no
+// channels means all channels of the device.
+func (p *DeviceProfile) checkCapture(chanIds []int, samples int) ([]int, error) {
+	if len(chanIds) == 0 {
+		chanIds = p.channelIds()
+	}
+	for _, id := range chanIds {
+		if id < 0 || id >= p.Channels {
+			return nil, fmt.Errorf("device %s has no channel %d", p.Name, id)
+		}
+	}
+	if samples < 1 || samples > maxCaptureSamples {
+		return nil, fmt.Errorf("samples must be 1-%d", maxCaptureSamples)
+	}
+	return chanIds, nil
+}
+
+func readCapture(devName string, chanIds []int, samples int) (*Capture, error) {
+	points, err := captureSamples(devName, chanIds, samples)
+	if err != nil {
+		return nil, err
+	}
+	values, err := decodeSamples(points, len(chanIds), samples)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{Device: devName, Samples: samples, Channels: chanIds, Values: values}, nil
+}
+
+// CaptureChannels reads samples of the channels of a device.
+func CaptureChannels(devName string, chanIds []int, samples int) (*Capture, error) {
+	p := lookupProfile(devName)
+	if p == nil {
+		return nil, fmt.Errorf("device %s not found", devName)
+	}
+	chanIds, err := p.checkCapture(chanIds, samples)
+	if err != nil {
+		return nil, err
+	}
+	end, err := beginOp("capture")
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	return readCapture(devName, chanIds, samples)
+}
+
+// GetCapture captures ?samples= (default 256) samples of the ?channels=
+// (comma separated, default all) of a device.
+func GetCapture(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	p := lookupProfile(params.ByName("dev"))
+	if p == nil {
+		writeErrorResponse(w, http.StatusNotFound, "device not found")
+		return
+	}
+	vars := r.URL.Query()
+	samples := 256
+	if s := vars.Get("samples"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "samples invalid")
+			return
+		}
+		samples = n
+	}
+	var chanIds []int
+	if s := vars.Get("channels"); s != "" {
+		for _, f := range strings.Split(s, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(f))
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("channel %q invalid", f))
+				return
+			}
+			chanIds = append(chanIds, id)
+		}
+	}
+	chanIds, err := p.checkCapture(chanIds, samples)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	end, err := beginOp("capture")
+	if err != nil {
+		writeErrorResponse(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer end()
+	c, err := readCapture(p.Name, chanIds, samples)
+	if err != nil {
+		requestLog(r, "backend").WithField("device", p.Name).WithError(err).Error("capture error")
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeResponse(w, c)
+}
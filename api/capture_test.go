@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestDecodeSamples(t *testing.T) {
+	// 2 samples of 2 channels: 1, -1, -8388608, 8388607
+	points := []byte{
+		1, 0, 0, 0, 0xff, 0xff, 0xff, 0,
+		0, 0, 0x80, 0, 0xff, 0xff, 0x7f, 0,
+	}
+	values, err := decodeSamples(points, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int32{{1, -8388608}, {-1, 8388607}}
+	for i := range expected {
+		for j := range expected[i] {
+			if values[i][j] != expected[i][j] {
+				t.Fatalf("values = %v, expected %v", values, expected)
+			}
+		}
+	}
+	if _, err := decodeSamples(points[:12], 2, 2); err == nil {
+		t.Fatal("expected error for short capture")
+	}
+	if _, err := decodeSamples(points, 0, 2); err == nil {
+		t.Fatal("expected error for no channels")
+	}
+}
+
+func TestGetCapture(t *testing.T) {
+	b := newFakeBackend()
+	b.setLevel("cf_axi_adc", 1, -42)
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+
+	router := httprouter.New()
+	router.GET("/devices/:dev/capture", GetCapture)
+
+	rec := doRequest(router, "GET", "/devices/cf_axi_adc/capture?channels=1,3&samples=4", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var c Capture
+	if err := json.NewDecoder(rec.Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Values) != 2 || len(c.Values[0]) != 4 || c.Values[0][0] != -42 || c.Values[1][3] != 0 {
+		t.Fatalf("capture %+v", c)
+	}
+
+	for url, code := range map[string]int{
+		"/devices/nodev/capture":                 http.StatusNotFound,
+		"/devices/cf_axi_adc/capture?channels=7": http.StatusBadRequest,
+		"/devices/cf_axi_adc/capture?samples=0":  http.StatusBadRequest,
+		"/devices/cf_axi_adc/capture?samples=x":  http.StatusBadRequest,
+	} {
+		if rec := doRequest(router, "GET", url, "", nil); rec.Code != code {
+			t.Errorf("GET %s: status %d, expected %d", url, rec.Code, code)
+		}
+	}
+}
+
+func TestPutParams(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+	oldPath := cfgFilePath
+	cfgFilePath = filepath.Join(t.TempDir(), "calibration.json")
+	defer func() { cfgFilePath = oldPath }()
+	if err := saveParams(Params{"cf_axi_adc": {0: 11, 1: 12}}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := httprouter.New()
+	router.PUT("/params", PutParams)
+
+	rec := doRequest(router, "PUT", "/params", `{"cf_axi_adc": {"1": -500}, "cf_axi_adc_1": {"7": 300}}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	stored, err := StoredParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored["cf_axi_adc"][0] != 11 || stored["cf_axi_adc"][1] != -500 || stored["cf_axi_adc_1"][7] != 300 {
+		t.Fatalf("stored params %v", stored)
+	}
+	if offset, _ := getDevOffset(testLog, "cf_axi_adc_1", 7); offset != 300 {
+		t.Fatalf("offset register %d, expected 300", offset)
+	}
+
+	for _, body := range []string{
+		`{"nodev": {"0": 1}}`,
+		`{"cf_axi_adc": {"7": 1}}`,
+		`{"cf_axi_adc": {"0": 8388608}}`,
+		`[]`,
+	} {
+		if rec := doRequest(router, "PUT", "/params", body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: status %d, expected 400", body, rec.Code)
+		}
+	}
+}
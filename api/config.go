@@ -0,0 +1,386 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Duration is a time.Duration written as "5s" in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Config is the configuration file of the server command. Only the
+// calibration, schedule, drift, compensation, webhook, mqtt and modbus
+// settings are applied on reload, the others need a restart.
+type Config struct {
+	Server      ServerConfig      `json:"server"`
+	Storage     StorageConfig     `json:"storage"`
+	Calibration CalibrationConfig `json:"calibration"`
+	// adc devices in the order of the global channel numbers
+	Devices []DeviceConfig `json:"devices"`
+	// sleep around the writes of the sync sequence
+	SyncDelay    Duration           `json:"syncDelay"`
+	Drift        DriftConfig        `json:"drift"`
+	Compensation CompensationConfig `json:"compensation"`
+	Webhooks     []WebhookConfig    `json:"webhooks,omitempty"`
+	MQTT         MQTTConfig         `json:"mqtt"`
+	Modbus       ModbusConfig       `json:"modbus"`
+}
+
+// ServerConfig holds the settings that can be overridden by the global
+// command line flags of the same name.
+type ServerConfig struct {
+	Listen          string   `json:"listen"`
+	AuthFile        string   `json:"authFile"`
+	AuditLog        string   `json:"auditLog"`
+	TLSCert         string   `json:"tlsCert"`
+	TLSKey          string   `json:"tlsKey"`
+	ClientCA        string   `json:"clientCA"`
+	TLSGenerate     bool     `json:"tlsGenerate"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	Debug           bool     `json:"debug"`
+	// "text" or "json"
+	LogFormat string `json:"logFormat"`
+	// level of each log module, "main" is the log of the commands
+	LogLevels map[string]string `json:"logLevels,omitempty"`
+	// address of the gRPC API, e.g. ":50051", empty disables it
+	GRPCListen string `json:"grpcListen"`
+	// simulated adc devices instead of the hardware, see SimBackend
+	Simulate bool `json:"simulate,omitempty"`
+	// locked by the server, local subcommands refuse to touch the hardware
+	// while it is held, empty disables it
+	LockFile string `json:"lockFile"`
+}
+
+type StorageConfig struct {
+	CalibrationFile string `json:"calibrationFile"`
+	RegmapDir       string `json:"regmapDir"`
+	SnapshotDir     string `json:"snapshotDir"`
+	HistoryFile     string `json:"historyFile"`
+	DriftDir        string `json:"driftDir"`
+	OffsetTable     string `json:"offsetTable"`
+	OutboxDir       string `json:"outboxDir"`
+}
+
+type CalibrationConfig struct {
+	// samples per channel captured for the average
+	Samples int `json:"samples"`
+	// wait for fresh samples after clearing the offsets
+	SettleDelay Duration `json:"settleDelay"`
+	// part of the measured average written as offset
+	Factor float64 `json:"factor"`
+	// periodic recalibrations
+	Schedule []ScheduleConfig `json:"schedule,omitempty"`
+}
+
+type DeviceConfig struct {
+	Name        string             `json:"name"`
+	Channels    int                `json:"channels"`
+	Temperature *TemperatureSource `json:"temperature,omitempty"`
+}
+
+const DefaultConfigFile = "/media/sd-mmcblk1p2/iiocalibration.json"
+
+// DefaultConfig returns the settings used without config file.
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:          ":80",
+			LogFormat:       "text",
+			AuthFile:        "/media/sd-mmcblk1p2/auth.json",
+			AuditLog:        "/media/sd-mmcblk1p2/audit/audit.log",
+			ShutdownTimeout: Duration{60 * time.Second},
+			LockFile:        "/var/run/iiocalibration.lock",
+		},
+		Storage: StorageConfig{
+			CalibrationFile: "/media/sd-mmcblk1p2/calibration.json",
+			RegmapDir:       "/media/sd-mmcblk1p2/regmaps",
+			SnapshotDir:     "/media/sd-mmcblk1p2/snapshots",
+			HistoryFile:     "/media/sd-mmcblk1p2/history.jsonl",
+			DriftDir:        "/media/sd-mmcblk1p2/drift",
+			OffsetTable:     "/media/sd-mmcblk1p2/offset-table.json",
+			OutboxDir:       "/media/sd-mmcblk1p2/outbox",
+		},
+		Calibration: CalibrationConfig{
+			Samples:     1024,
+			SettleDelay: Duration{5 * time.Second},
+			Factor:      0.75,
+		},
+		Devices: []DeviceConfig{
+			{Name: "cf_axi_adc", Channels: 7},
+			{Name: "cf_axi_adc_1", Channels: 8},
+		},
+		SyncDelay: Duration{20 * time.Millisecond},
+		Drift: DriftConfig{
+			Samples:     1024,
+			Threshold:   2000,
+			SlopeLimit:  500,
+			SlopeWindow: Duration{6 * time.Hour},
+			Retention:   Duration{7 * 24 * time.Hour},
+		},
+		Compensation: CompensationConfig{
+			Hysteresis: 2,
+			MinChange:  16,
+			Resolution: 1,
+		},
+		MQTT: MQTTConfig{
+			QoS:            1,
+			KeepAlive:      Duration{30 * time.Second},
+			StatusInterval: Duration{time.Minute},
+		},
+	}
+}
+
+// LoadConfigFile reads path over the default settings, a missing file
+// leaves the defaults.
+func LoadConfigFile(path string) (cfg *Config, err error) {
+	defer func() { observeConfigLoad("config", err) }()
+
+	cfg = DefaultConfig()
+	fp, err := os.Open(path)
+	if os.IsNotExist(err) {
+		moduleLog("config").WithField("file", path).Info("config file not found, using defaults")
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	dec := json.NewDecoder(fp)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the settings before they are applied.
+func (c *Config) Validate() error {
+	if c.Server.Listen == "" {
+		return fmt.Errorf("server.listen is empty")
+	}
+	if c.Server.TLSKey != "" && c.Server.TLSCert == "" {
+		return fmt.Errorf("server.tlsKey without server.tlsCert")
+	}
+	if c.Server.ShutdownTimeout.Duration <= 0 {
+		return fmt.Errorf("server.shutdownTimeout must be positive")
+	}
+	if f := c.Server.LogFormat; f != "text" && f != "json" {
+		return fmt.Errorf("server.logFormat %q must be text or json", f)
+	}
+	if err := checkLogLevels(c.Server.LogLevels); err != nil {
+		return fmt.Errorf("server.logLevels: %v", err)
+	}
+	for name, path := range map[string]string{
+		"storage.calibrationFile": c.Storage.CalibrationFile,
+		"storage.regmapDir":       c.Storage.RegmapDir,
+		"storage.snapshotDir":     c.Storage.SnapshotDir,
+		"storage.historyFile":     c.Storage.HistoryFile,
+		"storage.driftDir":        c.Storage.DriftDir,
+		"storage.offsetTable":     c.Storage.OffsetTable,
+		"storage.outboxDir":       c.Storage.OutboxDir,
+	} {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("%s %q is not an absolute path", name, path)
+		}
+	}
+	if err := c.Calibration.validate(); err != nil {
+		return err
+	}
+	if len(c.Devices) == 0 {
+		return fmt.Errorf("no devices")
+	}
+	seen := make(map[string]bool)
+	channels := 0
+	for _, d := range c.Devices {
+		p := lookupKnownProfile(d.Name)
+		if p == nil {
+			return fmt.Errorf("device %s: unknown device", d.Name)
+		}
+		if seen[d.Name] {
+			return fmt.Errorf("device %s listed twice", d.Name)
+		}
+		seen[d.Name] = true
+		if d.Channels < 1 || d.Channels > len(p.OffsetRegs) {
+			return fmt.Errorf("device %s: channels must be 1-%d", d.Name, len(p.OffsetRegs))
+		}
+		if d.Temperature != nil {
+			if err := d.Temperature.validate(); err != nil {
+				return fmt.Errorf("device %s temperature: %v", d.Name, err)
+			}
+		}
+		channels += d.Channels
+	}
+	names := make(map[string]bool)
+	for i := range c.Calibration.Schedule {
+		s := &c.Calibration.Schedule[i]
+		if err := s.validate(channels); err != nil {
+			return fmt.Errorf("calibration.schedule: %v", err)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("calibration.schedule: %s listed twice", s.Name)
+		}
+		names[s.Name] = true
+	}
+	if c.SyncDelay.Duration < 0 || c.SyncDelay.Duration > time.Second {
+		return fmt.Errorf("syncDelay must be 0-1s")
+	}
+	if err := c.Drift.validate(); err != nil {
+		return err
+	}
+	hooks := make(map[string]bool)
+	for i := range c.Webhooks {
+		if err := c.Webhooks[i].validate(); err != nil {
+			return err
+		}
+		if hooks[c.Webhooks[i].Name] {
+			return fmt.Errorf("webhook %s listed twice", c.Webhooks[i].Name)
+		}
+		hooks[c.Webhooks[i].Name] = true
+	}
+	if err := c.MQTT.validate(); err != nil {
+		return err
+	}
+	if err := c.Modbus.validate(); err != nil {
+		return err
+	}
+	return c.Compensation.validate()
+}
+
+func (c *CalibrationConfig) validate() error {
+	if c.Samples < 1 || c.Samples > 1<<20 {
+		return fmt.Errorf("calibration.samples must be 1-%d", 1<<20)
+	}
+	if c.SettleDelay.Duration < 0 || c.SettleDelay.Duration > 10*time.Minute {
+		return fmt.Errorf("calibration.settleDelay must be 0-10m")
+	}
+	if c.Factor <= 0 || c.Factor > 2 {
+		return fmt.Errorf("calibration.factor must be in (0, 2]")
+	}
+	return nil
+}
+
+// 当前生效的配置, 硬件和存储相关的设置只在启动时应用
+var config = struct {
+	sync.RWMutex
+	path string
+	cfg  *Config
+}{cfg: DefaultConfig()}
+
+// ApplyConfig validates cfg and makes it the running configuration, path is
+// the file read again by ReloadConfig.
+func ApplyConfig(path string, cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	var devs []*DeviceProfile
+	for _, d := range cfg.Devices {
+		// 复制一份, knownProfiles 保持内置的设置
+		p := *lookupKnownProfile(d.Name)
+		p.Channels = d.Channels
+		p.Temperature = d.Temperature
+		devs = append(devs, &p)
+	}
+
+	config.Lock()
+	defer config.Unlock()
+	config.path = path
+	config.cfg = cfg
+	profiles = devs
+	cfgFilePath = cfg.Storage.CalibrationFile
+	regmapDir = cfg.Storage.RegmapDir
+	snapshotDir = cfg.Storage.SnapshotDir
+	historyFile = cfg.Storage.HistoryFile
+	driftDir = cfg.Storage.DriftDir
+	offsetTableFile = cfg.Storage.OffsetTable
+	outboxDir = cfg.Storage.OutboxDir
+	syncDelay = cfg.SyncDelay.Duration
+	return nil
+}
+
+// ReloadConfig reads the config file again, applies the calibration, drift,
+// compensation, webhook, mqtt and modbus settings and restarts their loops.
+// Changes of the other settings are logged and ignored.
+func ReloadConfig() error {
+	config.RLock()
+	path, running := config.path, config.cfg
+	config.RUnlock()
+	if path == "" {
+		return nil
+	}
+	cfg, err := LoadConfigFile(path)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		return err
+	}
+	old, _ := json.Marshal(configNeedingRestart(running))
+	cur, _ := json.Marshal(configNeedingRestart(cfg))
+	if string(old) != string(cur) {
+		moduleLog("config").WithField("file", path).Warn("storage, device and sync changes need a restart")
+	}
+
+	config.Lock()
+	updated := *config.cfg
+	updated.Calibration = cfg.Calibration
+	updated.Drift = cfg.Drift
+	updated.Compensation = cfg.Compensation
+	updated.Webhooks = cfg.Webhooks
+	updated.MQTT = cfg.MQTT
+	updated.Modbus = cfg.Modbus
+	config.cfg = &updated
+	config.Unlock()
+	moduleLog("config").WithField("file", path).Infof("config file reloaded, calibration %+v", cfg.Calibration)
+	if schedulerStarted() {
+		StartScheduler()
+	}
+	if driftMonitorStarted() {
+		StartDriftMonitor()
+	}
+	if compensationStarted() {
+		StartCompensation()
+	}
+	if mqttStarted() {
+		StartMQTT()
+	}
+	if modbusStarted() {
+		if err := StartModbus(); err != nil {
+			moduleLog("modbus").WithError(err).Error("modbus listen error")
+		}
+	}
+	return nil
+}
+
+func configNeedingRestart(c *Config) interface{} {
+	return []interface{}{c.Storage, c.Devices, c.SyncDelay}
+}
+
+// CurrentConfig returns the running configuration.
+func CurrentConfig() *Config {
+	config.RLock()
+	defer config.RUnlock()
+	return config.cfg
+}
+
+func calibrationConfig() CalibrationConfig {
+	return CurrentConfig().Calibration
+}
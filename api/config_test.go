@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "iiocalibration.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	cfg, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || cfg.Calibration.Samples != 1024 || cfg.Calibration.Factor != 0.75 {
+		t.Fatalf("defaults: %+v %v", cfg, err)
+	}
+
+	path := writeConfigFile(t, `{
+		"calibration": {"samples": 4096, "settleDelay": "2s"},
+		"devices": [{"name": "cf_axi_adc_1", "channels": 4}]
+	}`)
+	cfg, err = LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Calibration.Samples != 4096 || cfg.Calibration.SettleDelay.Duration != 2*time.Second || cfg.Calibration.Factor != 0.75 {
+		t.Fatalf("unexpected calibration config %+v", cfg.Calibration)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfigFile(writeConfigFile(t, `{"calibraton": {}}`)); err == nil {
+		t.Fatal("unknown field accepted")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		modify   func(c *Config)
+		expected string
+	}{
+		{func(c *Config) { c.Calibration.Samples = 0 }, "calibration.samples"},
+		{func(c *Config) { c.Calibration.Factor = 0 }, "calibration.factor"},
+		{func(c *Config) { c.Storage.CalibrationFile = "calibration.json" }, "absolute"},
+		{func(c *Config) { c.Devices = append(c.Devices, DeviceConfig{Name: "ad9361", Channels: 2}) }, "unknown device"},
+		{func(c *Config) { c.Devices[1].Channels = 9 }, "channels must be 1-8"},
+		{func(c *Config) { c.Devices[1].Name = "cf_axi_adc" }, "listed twice"},
+	} {
+		c := DefaultConfig()
+		tc.modify(c)
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected %q error, got %v", tc.expected, err)
+		}
+	}
+}
+
+func TestApplyAndReloadConfig(t *testing.T) {
+	defer ApplyConfig("", DefaultConfig())
+	path := writeConfigFile(t, `{"devices": [{"name": "cf_axi_adc_1", "channels": 4}, {"name": "cf_axi_adc", "channels": 2}]}`)
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfig(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	for chanId, expected := range map[int]string{0: "cf_axi_adc_1/0", 3: "cf_axi_adc_1/3", 5: "cf_axi_adc/1"} {
+		devName, id, err := globalChannel(chanId)
+		if err != nil || fmt.Sprintf("%s/%d", devName, id) != expected {
+			t.Errorf("channel %d: %s/%d %v, expected %s", chanId, devName, id, err, expected)
+		}
+	}
+	if _, _, err := globalChannel(6); err == nil {
+		t.Error("channel 6 accepted")
+	}
+	if p := lookupKnownProfile("cf_axi_adc_1"); p.Channels != 8 {
+		t.Errorf("known profile changed to %d channels", p.Channels)
+	}
+
+	// only the calibration settings change on reload
+	if err := ioutil.WriteFile(path, []byte(`{"calibration": {"factor": 1}, "devices": [{"name": "cf_axi_adc", "channels": 7}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if f := calibrationConfig().Factor; f != 1 {
+		t.Errorf("factor after reload %v", f)
+	}
+	if devs := CurrentConfig().Devices; len(devs) != 2 || len(profiles) != 2 || profiles[0].Name != "cf_axi_adc_1" {
+		t.Errorf("devices changed on reload: %+v", devs)
+	}
+}
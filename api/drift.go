@@ -0,0 +1,445 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+var driftDir = "/media/sd-mmcblk1p2/drift"
+
+// DriftConfig sets up the drift monitor, which periodically captures the
+// channels and records the residual offset left by the offset registers.
+type DriftConfig struct {
+	// 0 disables the monitor
+	Interval Duration `json:"interval"`
+	Samples  int      `json:"samples"`
+	// alert when the absolute residual exceeds it, 0 disables the alert
+	Threshold int32 `json:"threshold"`
+	// alert when the residual changes faster, in LSB per hour, over
+	// SlopeWindow, 0 disables the alert
+	SlopeLimit  float64  `json:"slopeLimit"`
+	SlopeWindow Duration `json:"slopeWindow"`
+	// points older than that are dropped
+	Retention Duration `json:"retention"`
+}
+
+func (c *DriftConfig) validate() error {
+	if c.Interval.Duration != 0 && c.Interval.Duration < 10*time.Second {
+		return fmt.Errorf("drift.interval must be 0 or at least 10s")
+	}
+	if c.Samples < 1 || c.Samples > maxCaptureSamples {
+		return fmt.Errorf("drift.samples must be 1-%d", maxCaptureSamples)
+	}
+	if c.Threshold < 0 || c.SlopeLimit < 0 {
+		return fmt.Errorf("drift.threshold and drift.slopeLimit must not be negative")
+	}
+	if c.SlopeWindow.Duration <= 0 || c.Retention.Duration < c.SlopeWindow.Duration {
+		return fmt.Errorf("drift.slopeWindow must be positive and not longer than drift.retention")
+	}
+	return nil
+}
+
+// DriftPoint is a residual offset measured with the offset register value
+// applied at that time.
+type DriftPoint struct {
+	Time     time.Time `json:"t"`
+	Residual int32     `json:"residual"`
+	Offset   int32     `json:"offset"`
+}
+
+// DriftAlert is raised while the drift of a channel is beyond the limits.
+type DriftAlert struct {
+	Device  string `json:"device"`
+	Channel int    `json:"channel"`
+	// "threshold" and/or "slope"
+	Kinds    []string  `json:"kinds"`
+	Residual int32     `json:"residual"`
+	Slope    float64   `json:"slope"`
+	Since    time.Time `json:"since"`
+}
+
+type driftSeries struct {
+	device  string
+	channel int
+	points  []DriftPoint
+	// points dropped from memory but still in the file
+	pruned int
+	alert  *DriftAlert
+}
+
+// 漂移监测的时间序列, 每个通道一个文件
+var drift = struct {
+	sync.Mutex
+	series  map[string]*driftSeries
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}{series: make(map[string]*driftSeries)}
+
+func driftConfig() DriftConfig {
+	return CurrentConfig().Drift
+}
+
+func driftFile(devName string, chanId int) string {
+	return filepath.Join(driftDir, fmt.Sprintf("%s_%d.jsonl", devName, chanId))
+}
+
+// loadDrift reads the series of all channels from driftDir, without the
+// points older than the retention.
+func loadDrift() error {
+	cutoff := time.Now().Add(-driftConfig().Retention.Duration)
+	files, err := filepath.Glob(filepath.Join(driftDir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	series := make(map[string]*driftSeries)
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".jsonl")
+		i := strings.LastIndex(name, "_")
+		chanId, err := strconv.Atoi(name[i+1:])
+		if i < 0 || err != nil {
+			continue
+		}
+		s := &driftSeries{device: name[:i], channel: chanId}
+		fp, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(fp)
+		for scanner.Scan() {
+			var p DriftPoint
+			if json.Unmarshal(scanner.Bytes(), &p) != nil {
+				continue
+			}
+			if p.Time.Before(cutoff) {
+				s.pruned++
+				continue
+			}
+			s.points = append(s.points, p)
+		}
+		fp.Close()
+		series[name] = s
+	}
+	drift.Lock()
+	drift.series = series
+	drift.Unlock()
+	return nil
+}
+
+// slope fits a line to the points within window before the last point and
+// returns its slope in LSB per hour, 0 with less than 3 points.
+func (s *driftSeries) slope(window time.Duration) float64 {
+	if len(s.points) == 0 {
+		return 0
+	}
+	last := s.points[len(s.points)-1].Time
+	var n, sx, sy, sxx, sxy float64
+	for _, p := range s.points {
+		if last.Sub(p.Time) > window {
+			continue
+		}
+		x := p.Time.Sub(last).Hours()
+		y := float64(p.Residual)
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	d := n*sxx - sx*sx
+	if n < 3 || d == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / d
+}
+
+// add appends p to the series and its file and drops the points older than
+// the retention, the file is rewritten when enough points were dropped.
+func (s *driftSeries) add(p DriftPoint, retention time.Duration) error {
+	s.points = append(s.points, p)
+	i := 0
+	for i < len(s.points) && p.Time.Sub(s.points[i].Time) > retention {
+		i++
+	}
+	s.points = s.points[i:]
+	s.pruned += i
+
+	file := driftFile(s.device, s.channel)
+	if s.pruned < 100 && s.pruned < len(s.points) {
+		line, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		fp, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		_, err = fp.Write(append(line, '\n'))
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, p := range s.points {
+		enc.Encode(p)
+	}
+	if err := ioutil.WriteFile(file+".tmp", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	s.pruned = 0
+	return nil
+}
+
+// check compares the last point with the limits and returns the alert
+// event to send, "" if the alert state did not change.
+func (s *driftSeries) check(cfg DriftConfig) (event string, alert DriftAlert) {
+	p := s.points[len(s.points)-1]
+	slope := s.slope(cfg.SlopeWindow.Duration)
+	var kinds []string
+	if cfg.Threshold > 0 && (p.Residual > cfg.Threshold || p.Residual < -cfg.Threshold) {
+		kinds = append(kinds, "threshold")
+	}
+	if cfg.SlopeLimit > 0 && math.Abs(slope) > cfg.SlopeLimit {
+		kinds = append(kinds, "slope")
+	}
+	if len(kinds) == 0 {
+		if s.alert == nil {
+			return "", alert
+		}
+		alert = *s.alert
+		alert.Residual, alert.Slope = p.Residual, slope
+		s.alert = nil
+		return EventDriftCleared, alert
+	}
+	raised := s.alert == nil || strings.Join(s.alert.Kinds, ",") != strings.Join(kinds, ",")
+	if raised {
+		s.alert = &DriftAlert{Device: s.device, Channel: s.channel, Kinds: kinds, Since: p.Time}
+	}
+	s.alert.Residual, s.alert.Slope = p.Residual, slope
+	if raised {
+		return EventDriftAlert, *s.alert
+	}
+	return "", alert
+}
+
+// sampleDrift captures every channel once and records its residual offset.
+func sampleDrift(log *logrus.Entry) error {
+	cfg := driftConfig()
+	for _, p := range profiles {
+		chanIds := p.channelIds()
+		points, err := captureSamples(p.Name, chanIds, cfg.Samples)
+		if err != nil {
+			return err
+		}
+		values, err := decodeSamples(points, len(chanIds), cfg.Samples)
+		if err != nil {
+			return err
+		}
+		for idx, id := range chanIds {
+			offset, err := getDevOffset(log, p.Name, id)
+			if err != nil {
+				return err
+			}
+			point := DriftPoint{Time: time.Now(), Residual: channelOffset(values[idx], 1), Offset: offset}
+			observeDrift(p.Name, id, point.Residual)
+			if err := recordDrift(log, cfg, p.Name, id, point); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func recordDrift(log *logrus.Entry, cfg DriftConfig, devName string, chanId int, point DriftPoint) error {
+	drift.Lock()
+	key := fmt.Sprintf("%s_%d", devName, chanId)
+	s := drift.series[key]
+	if s == nil {
+		s = &driftSeries{device: devName, channel: chanId}
+		drift.series[key] = s
+	}
+	err := s.add(point, cfg.Retention.Duration)
+	event, alert := s.check(cfg)
+	slope := s.slope(cfg.SlopeWindow.Duration)
+	drift.Unlock()
+	mqttDrift(devName, chanId, point, slope)
+
+	if event == "" {
+		return err
+	}
+	log = log.WithFields(logrus.Fields{"device": devName, "channel": chanId, "kinds": alert.Kinds,
+		"residual": alert.Residual, "slope": alert.Slope})
+	if event == EventDriftAlert {
+		log.Warn("offset drift alert")
+	} else {
+		log.Info("offset drift alert cleared")
+	}
+	emitEvent(event, alert)
+	return err
+}
+
+// DriftAlerts returns the raised drift alerts.
+func DriftAlerts() []DriftAlert {
+	drift.Lock()
+	defer drift.Unlock()
+	alerts := []DriftAlert{}
+	for _, s := range drift.series {
+		if s.alert != nil {
+			alerts = append(alerts, *s.alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Device != alerts[j].Device {
+			return alerts[i].Device < alerts[j].Device
+		}
+		return alerts[i].Channel < alerts[j].Channel
+	})
+	return alerts
+}
+
+// StartDriftMonitor loads the recorded series and samples the drift every
+// drift.interval until StopDriftMonitor. It restarts a running monitor.
+func StartDriftMonitor() {
+	StopDriftMonitor()
+	log := moduleLog("calibration").WithField("monitor", "drift")
+	if err := loadDrift(); err != nil {
+		log.WithError(err).Error("load drift series error")
+	}
+	drift.Lock()
+	defer drift.Unlock()
+	drift.started = true
+	interval := driftConfig().Interval.Duration
+	if interval == 0 {
+		return
+	}
+	if err := os.MkdirAll(driftDir, 0755); err != nil {
+		log.WithError(err).Error("create drift directory error")
+	}
+	drift.stop = make(chan struct{})
+	drift.done = make(chan struct{})
+	go runDriftMonitor(log, interval, drift.stop, drift.done)
+	log.WithField("interval", interval.String()).Info("drift monitor started")
+}
+
+// StopDriftMonitor stops the monitor and waits for a running capture.
+func StopDriftMonitor() {
+	drift.Lock()
+	stop, done := drift.stop, drift.done
+	drift.stop, drift.done = nil, nil
+	drift.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func driftMonitorStarted() bool {
+	drift.Lock()
+	defer drift.Unlock()
+	return drift.started
+}
+
+func runDriftMonitor(log *logrus.Entry, interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// 校准过程中偏移在变化, beginOp 拒绝, 跳过
+		end, err := beginOp("drift")
+		if err != nil {
+			log.WithError(err).Debug("drift sample skipped")
+			continue
+		}
+		if err := sampleDrift(log); err != nil {
+			log.WithError(err).Error("drift sample error")
+		}
+		end()
+	}
+}
+
+// DriftSeries is the recorded drift of a channel.
+type DriftSeries struct {
+	Device  string `json:"device"`
+	Channel int    `json:"channel"`
+	// LSB per hour over drift.slopeWindow
+	Slope  float64      `json:"slope"`
+	Alert  *DriftAlert  `json:"alert,omitempty"`
+	Points []DriftPoint `json:"points"`
+}
+
+// GetDrift returns the drift series of the channels for plotting, filtered
+// by ?device=, ?channel= and ?since= (a duration like 24h).
+func GetDrift(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	vars := r.URL.Query()
+	chanId := -1
+	if s := vars.Get("channel"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeErrorResponse(w, http.StatusBadRequest, "channel invalid")
+			return
+		}
+		chanId = n
+	}
+	var since time.Time
+	if s := vars.Get("since"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			writeErrorResponse(w, http.StatusBadRequest, "since invalid")
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+	devName := vars.Get("device")
+	window := driftConfig().SlopeWindow.Duration
+
+	drift.Lock()
+	result := []DriftSeries{}
+	for _, s := range drift.series {
+		if (devName != "" && s.device != devName) || (chanId >= 0 && s.channel != chanId) {
+			continue
+		}
+		ds := DriftSeries{Device: s.device, Channel: s.channel, Slope: s.slope(window), Points: []DriftPoint{}}
+		if s.alert != nil {
+			alert := *s.alert
+			ds.Alert = &alert
+		}
+		for _, p := range s.points {
+			if !p.Time.Before(since) {
+				ds.Points = append(ds.Points, p)
+			}
+		}
+		result = append(result, ds)
+	}
+	drift.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Device != result[j].Device {
+			return result[i].Device < result[j].Device
+		}
+		return result[i].Channel < result[j].Channel
+	})
+	writeResponse(w, result)
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestDriftMonitor(t *testing.T) {
+	events := make(chan string, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Event string }
+		json.NewDecoder(r.Body).Decode(&body)
+		events <- body.Event
+	}))
+	defer hook.Close()
+
+	b, cfg := setupTestServer(t, func(cfg *Config) {
+		cfg.Storage.DriftDir = t.TempDir()
+		cfg.Drift.Samples = 16
+		cfg.Drift.Threshold = 1000
+		cfg.Drift.SlopeLimit = 50
+		cfg.Drift.SlopeWindow = Duration{4 * time.Hour}
+		cfg.Drift.Retention = Duration{4 * time.Hour}
+		cfg.Webhooks = []WebhookConfig{{Name: "mes", URL: hook.URL, Events: []string{EventDriftAlert, EventDriftCleared}}}
+	})
+	b.setLevel("cf_axi_adc", 1, 1200)
+	b.setLevel("cf_axi_adc_1", 2, 300)
+	StartWebhooks()
+	defer StopWebhooks()
+	if err := loadDrift(); err != nil {
+		t.Fatal(err)
+	}
+
+	// channel 2 rising by 60 LSB per hour
+	start := time.Now().Add(-10*time.Hour - 30*time.Minute)
+	for i := 0; i <= 5; i++ {
+		p := DriftPoint{Time: start.Add(time.Duration(i) * time.Hour), Residual: int32(i * 60)}
+		if err := recordDrift(testLog, cfg.Drift, "cf_axi_adc_1", 2, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e := <-events; e != EventDriftAlert {
+		t.Fatalf("webhook event %s", e)
+	}
+	if alerts := DriftAlerts(); len(alerts) != 1 || alerts[0].Kinds[0] != "slope" || alerts[0].Slope != 60 {
+		t.Fatalf("alerts %+v", alerts)
+	}
+	// flat again
+	for i := 6; i <= 10; i++ {
+		p := DriftPoint{Time: start.Add(time.Duration(i) * time.Hour), Residual: 300}
+		recordDrift(testLog, cfg.Drift, "cf_axi_adc_1", 2, p)
+	}
+	if e := <-events; e != EventDriftCleared {
+		t.Fatalf("webhook event %s", e)
+	}
+
+	if err := sampleDrift(testLog); err != nil {
+		t.Fatal(err)
+	}
+	alerts := DriftAlerts()
+	if len(alerts) != 1 || alerts[0].Device != "cf_axi_adc" || alerts[0].Channel != 1 || alerts[0].Kinds[0] != "threshold" {
+		t.Fatalf("alerts %+v", alerts)
+	}
+	if e := <-events; e != EventDriftAlert {
+		t.Fatalf("webhook event %s", e)
+	}
+
+	// the series survive a restart, without the points beyond the retention
+	if err := loadDrift(); err != nil {
+		t.Fatal(err)
+	}
+	router := httprouter.New()
+	router.GET("/drift", GetDrift)
+	rec := doRequest(router, "GET", "/drift?device=cf_axi_adc_1&channel=2", "", nil)
+	var series []DriftSeries
+	if err := json.NewDecoder(rec.Body).Decode(&series); err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || len(series[0].Points) != 5 || series[0].Points[0].Residual != 300 || series[0].Points[4].Residual != 300 {
+		t.Fatalf("series %+v", series)
+	}
+	rec = doRequest(router, "GET", "/drift?since=1h", "", nil)
+	series = nil
+	json.NewDecoder(rec.Body).Decode(&series)
+	if len(series) != 15 || len(series[1].Points) != 1 {
+		t.Fatalf("%d series, channel 1 %+v", len(series), series[1])
+	}
+	if m, _ := filepath.Glob(filepath.Join(cfg.Storage.DriftDir, "*.jsonl")); len(m) != 15 {
+		t.Fatalf("drift files %v", m)
+	}
+}
@@ -0,0 +1,348 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/plpsy/iiocalibration/calibrationpb"
+	"github.com/plpsy/iiocalibration/grpc"
+	"github.com/sirupsen/logrus"
+)
+
+// 采集流两帧之间的最大间隔, 关机时最多等待这么久
+const maxCaptureInterval = time.Minute
+
+// GRPCServer returns the gRPC Calibration service of calibrationpb, served
+// beside the HTTP API with the same authentication, audit log and hardware
+// operations.
+func GRPCServer() *grpc.Server {
+	s := grpc.NewServer()
+	s.Handle(calibrationpb.MethodCalibrate, grpcMethod(RoleOperator, grpcCalibrate))
+	s.Handle(calibrationpb.MethodGetOffsetRegisters, grpcMethod(RoleViewer, grpcGetOffsetRegisters))
+	s.Handle(calibrationpb.MethodClearOffsetRegisters, grpcMethod(RoleOperator, grpcClearOffsetRegisters))
+	s.Handle(calibrationpb.MethodGetParams, grpcMethod(RoleViewer, grpcGetParams))
+	s.Handle(calibrationpb.MethodCapture, grpcMethod(RoleViewer, grpcCapture))
+	s.Handle(calibrationpb.MethodGetStatus, grpcMethod(RoleViewer, grpcGetStatus))
+	return s
+}
+
+// grpcMethod wraps a handler like RequestID, Instrument and Authorize wrap
+// the HTTP handlers: the call gets a request id from the x-request-id
+// metadata, is authorized, logged and counted.
+func grpcMethod(role Role, h func(s grpcStream) error) grpc.Handler {
+	return func(s *grpc.Stream) (err error) {
+		r := s.Request()
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRe.MatchString(id) {
+			id = newID()
+		}
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		start := time.Now()
+		defer func() {
+			code := grpc.StatusOf(err).Code
+			grpcRequests.Inc(s.Method(), code.String())
+			grpcDuration.Observe(time.Since(start).Seconds(), s.Method())
+			moduleLog("grpc").WithFields(logrus.Fields{
+				"request_id": id,
+				"method":     s.Method(),
+				"remote":     r.RemoteAddr,
+				"code":       code.String(),
+				"duration":   time.Since(start).String(),
+			}).Info("call")
+		}()
+
+		caller, ok := authenticate(r)
+		if !ok {
+			return grpc.Errorf(grpc.Unauthenticated, "authentication required")
+		}
+		if caller.Role < role {
+			return grpc.Errorf(grpc.PermissionDenied, "%s role required", role)
+		}
+		ctx = context.WithValue(ctx, identityKey{}, caller)
+		return h(grpcStream{s, r.WithContext(ctx)})
+	}
+}
+
+// grpcStream is a stream whose request carries the request id and the
+// caller identity.
+type grpcStream struct {
+	*grpc.Stream
+	req *http.Request
+}
+
+func (s grpcStream) Request() *http.Request {
+	return s.req
+}
+
+// grpcAuditEntry starts the audit entry of a state changing call.
+func grpcAuditEntry(r *http.Request, action string, params map[string]string) *AuditEntry {
+	id := RequestIdentity(r)
+	return &AuditEntry{
+		User:      id.Name,
+		Role:      id.Role,
+		Remote:    r.RemoteAddr,
+		RequestID: RequestIDOf(r),
+		Endpoint:  r.URL.Path,
+		Action:    action,
+		Params:    params,
+		Before:    OffsetState(r, nil),
+	}
+}
+
+func toOffsets(params Params) calibrationpb.Offsets {
+	return calibrationpb.Offsets(params)
+}
+
+func toInt32s(v []int) []int32 {
+	result := make([]int32, len(v))
+	for i, x := range v {
+		result[i] = int32(x)
+	}
+	return result
+}
+
+func toInts(v []int32) []int {
+	var result []int
+	for _, x := range v {
+		result = append(result, int(x))
+	}
+	return result
+}
+
+func toProgress(p CalibrationProgress) *calibrationpb.CalibrationProgress {
+	return &calibrationpb.CalibrationProgress{JobID: p.JobID, Origin: p.Origin, Started: p.Started,
+		Channels: toInt32s(p.Channels), Done: toInt32s(p.Done), Step: p.Step, Device: p.Device, Error: p.Error}
+}
+
+// grpcCalibrate streams the progress of a calibration. A canceled call does
+// not stop the calibration, its result is in the history.
+func grpcCalibrate(s grpcStream) error {
+	var req calibrationpb.CalibrateRequest
+	if err := s.RecvRequest(&req); err != nil {
+		return err
+	}
+	channels := toInts(req.Channels)
+	r := s.Request()
+	e := grpcAuditEntry(r, "calibration", map[string]string{"channels": fmt.Sprint(channels)})
+	for _, ch := range channels {
+		if _, _, err := globalChannel(ch); err != nil {
+			e.Error = err.Error()
+			Audit(e)
+			return grpc.Errorf(grpc.InvalidArgument, "%v", err)
+		}
+	}
+	end, err := beginOp("calibration")
+	if err != nil {
+		e.Error = err.Error()
+		Audit(e)
+		return grpc.Errorf(grpc.Unavailable, "%v", err)
+	}
+	jobID := newID()
+	e.Params["job_id"] = jobID
+	log := requestLog(r, "calibration").WithField("job_id", jobID)
+	updates, stop := watchProgress(jobID)
+	defer stop()
+	type result struct {
+		err     error
+		offsets Params
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer end()
+		err := runCalibration(log, jobID, OriginGRPC, RequestIDOf(r), "", channels)
+		offsets, _ := getOffsetRegs(log)
+		if err != nil {
+			e.Error = err.Error()
+		}
+		e.After = OffsetState(r, nil)
+		Audit(e)
+		done <- result{err, offsets}
+	}()
+
+	last := CalibrationProgress{JobID: jobID, Origin: OriginGRPC, Channels: channels}
+	// forward sends a progress update, the finished one is sent with the
+	// offsets
+	forward := func(p CalibrationProgress) error {
+		last = p
+		if p.Step == "finished" || p.Step == "failed" {
+			return nil
+		}
+		return s.Send(toProgress(p))
+	}
+	for {
+		select {
+		case p, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			if err := forward(p); err != nil {
+				return err
+			}
+		case res := <-done:
+			// 校准结束前的进度都已在通道中, 通道在结束时关闭
+			for updates != nil {
+				p, ok := <-updates
+				if !ok {
+					break
+				}
+				if err := forward(p); err != nil {
+					return err
+				}
+			}
+			last.Step, last.Device, last.Error = "finished", "", ""
+			if res.err != nil {
+				last.Step, last.Error = "failed", res.err.Error()
+			}
+			final := toProgress(last)
+			final.Offsets = toOffsets(res.offsets)
+			if err := s.Send(final); err != nil {
+				return err
+			}
+			if res.err == nil {
+				return nil
+			}
+			if errors.Is(res.err, errInterrupted) {
+				return grpc.Errorf(grpc.Aborted, "%v", res.err)
+			}
+			return grpc.Errorf(grpc.Internal, "%v", res.err)
+		case <-s.Context().Done():
+			log.Info("calibration call canceled, calibration goes on")
+			return s.Context().Err()
+		}
+	}
+}
+
+func grpcGetOffsetRegisters(s grpcStream) error {
+	if err := s.RecvRequest(&calibrationpb.Empty{}); err != nil {
+		return err
+	}
+	offsets, err := getOffsetRegs(requestLog(s.Request(), "registers"))
+	if err != nil {
+		return grpc.Errorf(grpc.Internal, "%v", err)
+	}
+	resp := toOffsets(offsets)
+	return s.Send(&resp)
+}
+
+func grpcClearOffsetRegisters(s grpcStream) error {
+	if err := s.RecvRequest(&calibrationpb.Empty{}); err != nil {
+		return err
+	}
+	r := s.Request()
+	e := grpcAuditEntry(r, "clear_regs", nil)
+	defer Audit(e)
+	end, err := beginOp("clear_regs")
+	if err != nil {
+		e.Error = err.Error()
+		return grpc.Errorf(grpc.Unavailable, "%v", err)
+	}
+	defer end()
+	log := requestLog(r, "calibration")
+	err = clearOffsetRegs(log)
+	e.After = OffsetState(r, nil)
+	if err != nil {
+		e.Error = err.Error()
+		return grpc.Errorf(grpc.Internal, "%v", err)
+	}
+	offsets, err := getOffsetRegs(log)
+	if err != nil {
+		return grpc.Errorf(grpc.Internal, "%v", err)
+	}
+	resp := toOffsets(offsets)
+	return s.Send(&resp)
+}
+
+func grpcGetParams(s grpcStream) error {
+	if err := s.RecvRequest(&calibrationpb.Empty{}); err != nil {
+		return err
+	}
+	params, err := StoredParams()
+	if err != nil {
+		return grpc.Errorf(grpc.Internal, "%v", err)
+	}
+	resp := toOffsets(params)
+	return s.Send(&resp)
+}
+
+// grpcCapture streams captures of a device until the count of the request
+// is reached, the call is canceled or the server shuts down.
+func grpcCapture(s grpcStream) error {
+	var req calibrationpb.CaptureRequest
+	if err := s.RecvRequest(&req); err != nil {
+		return err
+	}
+	p := lookupProfile(req.Device)
+	if p == nil {
+		return grpc.Errorf(grpc.NotFound, "device %s not found", req.Device)
+	}
+	samples := 256
+	if req.Samples != 0 {
+		samples = int(req.Samples)
+	}
+	chanIds, err := p.checkCapture(toInts(req.Channels), samples)
+	if err != nil {
+		return grpc.Errorf(grpc.InvalidArgument, "%v", err)
+	}
+	interval := time.Duration(req.IntervalMS) * time.Millisecond
+	if req.Count < 0 || interval < 0 || interval > maxCaptureInterval {
+		return grpc.Errorf(grpc.InvalidArgument, "count must not be negative and interval_ms 0-%d", maxCaptureInterval.Milliseconds())
+	}
+	log := requestLog(s.Request(), "backend").WithField("device", p.Name)
+	for seq := int32(0); req.Count == 0 || seq < req.Count; seq++ {
+		if seq > 0 && interval > 0 {
+			select {
+			case <-s.Context().Done():
+				return s.Context().Err()
+			case <-time.After(interval):
+			}
+		}
+		end, err := beginOp("capture")
+		if err != nil {
+			return grpc.Errorf(grpc.Unavailable, "%v", err)
+		}
+		c, err := readCapture(p.Name, chanIds, samples)
+		end()
+		if err != nil {
+			log.WithError(err).Error("capture error")
+			return grpc.Errorf(grpc.Internal, "%v", err)
+		}
+		frame := &calibrationpb.CaptureFrame{Device: c.Device, Samples: int32(c.Samples), Sequence: seq, Time: time.Now()}
+		for i, ch := range c.Channels {
+			frame.Channels = append(frame.Channels, calibrationpb.ChannelSamples{Channel: int32(ch), Values: c.Values[i]})
+		}
+		if err := s.Send(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func grpcGetStatus(s grpcStream) error {
+	if err := s.RecvRequest(&calibrationpb.Empty{}); err != nil {
+		return err
+	}
+	st := currentStatus()
+	resp := &calibrationpb.Status{
+		Version:            st.Version,
+		Started:            st.Started,
+		Uptime:             st.Uptime,
+		Operations:         make(map[string]int32),
+		SupervisorRestarts: int32(st.Supervisor.Restarts),
+		SupervisorLastExit: st.Supervisor.LastExit,
+	}
+	for kind, n := range st.Operations {
+		resp.Operations[kind] = int32(n)
+	}
+	if st.PendingReboot != nil {
+		resp.PendingReboot = &calibrationpb.PendingReboot{At: st.PendingReboot.At, RequestedBy: st.PendingReboot.RequestedBy}
+	}
+	for _, a := range st.DriftAlerts {
+		resp.DriftAlerts = append(resp.DriftAlerts, calibrationpb.DriftAlert{Device: a.Device, Channel: int32(a.Channel),
+			Kinds: a.Kinds, Residual: a.Residual, Slope: a.Slope, Since: a.Since})
+	}
+	return s.Send(resp)
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/plpsy/iiocalibration/calibrationpb"
+	"github.com/plpsy/iiocalibration/grpc"
+)
+
+func TestGRPC(t *testing.T) {
+	b, _ := setupTestServer(t, nil)
+	b.setLevel("cf_axi_adc_1", 1, -400)
+
+	dir := t.TempDir()
+	authFile := filepath.Join(dir, "auth.json")
+	ioutil.WriteFile(authFile, []byte(`{"keys": [{"name": "plc", "key": "op", "role": "operator"},
+		{"name": "hmi", "key": "view", "role": "viewer"}]}`), 0600)
+	if err := LoadAuthFile(authFile); err != nil {
+		t.Fatal(err)
+	}
+	defer LoadAuthFile("")
+	OpenAuditLog(filepath.Join(dir, "audit.log"))
+	defer func() { auditLog = nil }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: GRPCServer(), Protocols: grpc.Protocols()}
+	go server.Serve(ln)
+	defer server.Close()
+	url := "http://" + ln.Addr().String()
+	c := calibrationpb.NewClient(url, "op")
+	ctx := context.Background()
+
+	if _, err := calibrationpb.NewClient(url, "").GetStatus(ctx); grpc.StatusOf(err).Code != grpc.Unauthenticated {
+		t.Errorf("status without key: %v", err)
+	}
+	if _, err := calibrationpb.NewClient(url, "view").ClearOffsetRegisters(ctx); grpc.StatusOf(err).Code != grpc.PermissionDenied {
+		t.Errorf("clearing as viewer: %v", err)
+	}
+
+	var steps []string
+	last, err := c.Calibrate(ctx, &calibrationpb.CalibrateRequest{Channels: []int32{8}}, func(p *calibrationpb.CalibrationProgress) {
+		steps = append(steps, p.Step)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs, err := OffsetRegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) < 2 || last.Step != "finished" || last.Origin != OriginGRPC || len(last.Done) != 1 || last.Done[0] != 8 {
+		t.Errorf("progress %v, last %+v", steps, last)
+	}
+	if off := last.Offsets["cf_axi_adc_1"][1]; off == 0 || off != regs["cf_axi_adc_1"][1] || len(last.Offsets["cf_axi_adc"]) != 7 {
+		t.Errorf("offsets %v, registers %v", last.Offsets, regs)
+	}
+	history, _ := CalibrationHistory()
+	if len(history) != 1 || history[0].Origin != OriginGRPC || history[0].JobID != last.JobID {
+		t.Errorf("history %+v", history)
+	}
+	if _, err := c.Calibrate(ctx, &calibrationpb.CalibrateRequest{Channels: []int32{99}}, nil); grpc.StatusOf(err).Code != grpc.InvalidArgument {
+		t.Errorf("calibrating channel 99: %v", err)
+	}
+
+	offsets, err := c.GetOffsetRegisters(ctx)
+	if err != nil || offsets["cf_axi_adc_1"][1] != regs["cf_axi_adc_1"][1] {
+		t.Errorf("offset registers %v, %v", offsets, err)
+	}
+	params, err := c.GetParams(ctx)
+	if err != nil || params["cf_axi_adc_1"][1] != regs["cf_axi_adc_1"][1] {
+		t.Errorf("params %v, %v", params, err)
+	}
+
+	var frames []*calibrationpb.CaptureFrame
+	err = c.Capture(ctx, &calibrationpb.CaptureRequest{Device: "cf_axi_adc_1", Channels: []int32{1, 2}, Samples: 16, Count: 3},
+		func(f *calibrationpb.CaptureFrame) bool {
+			frames = append(frames, f)
+			return true
+		})
+	if err != nil || len(frames) != 3 || frames[2].Sequence != 2 {
+		t.Fatalf("%d frames, %v", len(frames), err)
+	}
+	if ch := frames[0].Channels; len(ch) != 2 || ch[0].Channel != 1 || len(ch[0].Values) != 16 || ch[0].Values[5] != -400 || ch[1].Values[0] != 0 {
+		t.Errorf("frame %+v", frames[0])
+	}
+	n := 0
+	err = c.Capture(ctx, &calibrationpb.CaptureRequest{Device: "cf_axi_adc", IntervalMS: 10}, func(f *calibrationpb.CaptureFrame) bool {
+		n++
+		return n < 2
+	})
+	if err != nil || n != 2 {
+		t.Errorf("endless capture stopped after %d frames: %v", n, err)
+	}
+	if err := c.Capture(ctx, &calibrationpb.CaptureRequest{Device: "nope"}, nil); grpc.StatusOf(err).Code != grpc.NotFound {
+		t.Errorf("capture of unknown device: %v", err)
+	}
+	if err := c.Capture(ctx, &calibrationpb.CaptureRequest{Device: "cf_axi_adc", Samples: -1}, nil); grpc.StatusOf(err).Code != grpc.InvalidArgument {
+		t.Errorf("capture of -1 samples: %v", err)
+	}
+
+	cleared, err := c.ClearOffsetRegisters(ctx)
+	if err != nil || len(cleared["cf_axi_adc_1"]) != 8 || cleared["cf_axi_adc_1"][1] != 0 {
+		t.Errorf("cleared %v, %v", cleared, err)
+	}
+	status, err := c.GetStatus(ctx)
+	if err != nil || status.Uptime == "" || status.Started.IsZero() {
+		t.Errorf("status %+v, %v", status, err)
+	}
+
+	entries, err := QueryAudit(AuditQuery{Actions: []string{"calibration", "clear_regs"}})
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("audit %+v, %v", entries, err)
+	}
+	if e := entries[0]; e.User != "plc" || e.Endpoint != calibrationpb.MethodCalibrate || e.Outcome != "success" || e.Params["job_id"] != last.JobID {
+		t.Errorf("calibration audit %+v", e)
+	}
+	if e := entries[2]; e.Action != "clear_regs" || e.After.(map[string]interface{})["cf_axi_adc_1"] == nil {
+		t.Errorf("clear audit %+v", e)
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// HealthCheck is the result of one readiness check.
+type HealthCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Message  string `json:"message,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Health is the result of all readiness checks.
+type Health struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// 启动时恢复校准参数的结果
+var offsetsApplied = struct {
+	sync.Mutex
+	done bool
+	err  error
+}{}
+
+func recordOffsetsApplied(err error) {
+	offsetsApplied.Lock()
+	offsetsApplied.done = true
+	offsetsApplied.err = err
+	offsetsApplied.Unlock()
+}
+
+func checkDevices() error {
+	names, err := backend.Devices()
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(names))
+	for _, name := range names {
+		found[name] = true
+	}
+	for _, p := range profiles {
+		if !found[p.Name] {
+			return fmt.Errorf("device %s not found", p.Name)
+		}
+	}
+	return nil
+}
+
+// checkStorage checks that the calibration storage is a mounted, writable
+// file system.
+func checkStorage() error {
+	dir := filepath.Dir(cfgFilePath)
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return err
+	}
+	if err := syscall.Stat(filepath.Dir(dir), &parent); err != nil {
+		return err
+	}
+	if st.Dev == parent.Dev && st.Ino != parent.Ino {
+		return fmt.Errorf("%s is not mounted", dir)
+	}
+	fp, err := ioutil.TempFile(dir, ".readyz")
+	if err != nil {
+		return err
+	}
+	fp.Close()
+	return os.Remove(fp.Name())
+}
+
+func checkOffsets() error {
+	offsetsApplied.Lock()
+	defer offsetsApplied.Unlock()
+	if !offsetsApplied.done {
+		return fmt.Errorf("stored offsets not applied yet")
+	}
+	return offsetsApplied.err
+}
+
+var readinessChecks = []struct {
+	name  string
+	check func() error
+}{
+	{"devices", checkDevices},
+	{"storage", checkStorage},
+	{"offsets", checkOffsets},
+	{"backend", func() error { return backend.Check() }},
+}
+
+// Readiness runs all readiness checks.
+func Readiness() Health {
+	h := Health{Status: "ok", Checks: make([]HealthCheck, 0, len(readinessChecks))}
+	for _, c := range readinessChecks {
+		start := time.Now()
+		err := c.check()
+		hc := HealthCheck{Name: c.name, OK: err == nil, Duration: time.Since(start).String()}
+		if err != nil {
+			hc.Message = err.Error()
+			h.Status = "fail"
+		}
+		h.Checks = append(h.Checks, hc)
+	}
+	return h
+}
+
+// Healthz reports that the process is alive.
+func Healthz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	writeResponse(w, Health{Status: "ok", Checks: []HealthCheck{}})
+}
+
+// Readyz reports whether the service is ready, with 503 if a check fails.
+func Readyz(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h := Readiness()
+	w.Header().Set("Content-Type", "application/json")
+	if h.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	prettyJson(w, h)
+}
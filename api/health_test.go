@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+
+	recordOffsetsApplied(errors.New("cf_axi_adc channel 0 offset is 0, expected 12"))
+	rec := doRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Readyz(w, r, nil)
+	}), "GET", "/readyz", "", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz with unverified offsets: %d", rec.Code)
+	}
+	var h Health
+	if err := json.NewDecoder(rec.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	checks := make(map[string]HealthCheck)
+	for _, c := range h.Checks {
+		checks[c.Name] = c
+	}
+	if !checks["devices"].OK || !checks["backend"].OK || checks["offsets"].OK || checks["offsets"].Message == "" {
+		t.Fatalf("unexpected checks %+v", h.Checks)
+	}
+
+	recordOffsetsApplied(nil)
+	if err := checkOffsets(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// 校准历史只保留最近的记录
+const maxHistoryRecords = 1000
+
+var historyFile = "/media/sd-mmcblk1p2/history.jsonl"
+
+// historyMu serializes the updates of the history file.
+var historyMu sync.Mutex
+
+// Origins of a calibration.
+const (
+	OriginAPI       = "api"
+	OriginCLI       = "cli"
+	OriginScheduled = "scheduled"
+	OriginMQTT      = "mqtt"
+	OriginGRPC      = "grpc"
+	OriginModbus    = "modbus"
+)
+
+// CalibrationRecord is a calibration in the history.
+type CalibrationRecord struct {
+	JobID  string `json:"jobId"`
+	Origin string `json:"origin"`
+	// X-Request-ID of the API request starting the calibration
+	RequestID string `json:"requestId,omitempty"`
+	// name of the schedule of a scheduled calibration
+	Schedule string `json:"schedule,omitempty"`
+	// global channel numbers, empty for all channels
+	Channels []int     `json:"channels,omitempty"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	// offset registers after the calibration
+	Offsets Params `json:"offsets,omitempty"`
+	// board temperature of the devices with a temperature source
+	Temperatures map[string]float64 `json:"temperatures,omitempty"`
+	Error        string             `json:"error,omitempty"`
+}
+
+// runCalibration calibrates all channels, or the given global channels one
+// after the other, and records the result in the history.
+func runCalibration(log *logrus.Entry, jobID, origin, requestID, schedule string, channels []int) error {
+	rec := CalibrationRecord{JobID: jobID, Origin: origin, RequestID: requestID, Schedule: schedule, Channels: channels, Started: time.Now()}
+	emitEvent(EventCalibrationStarted, rec)
+	startProgress(rec)
+	var err error
+	if len(channels) == 0 {
+		err = calibrationAll(log)
+	}
+	for _, ch := range channels {
+		if err = calibrationOne(log, ch); err != nil {
+			break
+		}
+	}
+	rec.Duration = time.Since(rec.Started).Truncate(time.Millisecond).String()
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if offsets, err1 := getOffsetRegs(log); err1 == nil {
+		rec.Offsets = offsets
+	}
+	if temps := Temperatures(); len(temps) > 0 {
+		rec.Temperatures = temps
+	}
+	if err1 := appendHistory(rec); err1 != nil {
+		log.WithError(err1).Error("runCalibration append history error")
+	}
+	finishProgress(jobID, err)
+	if err != nil {
+		emitEvent(EventCalibrationFailed, rec)
+	} else {
+		emitEvent(EventCalibrationSucceeded, rec)
+	}
+	return err
+}
+
+// CalibrationHistory returns the recorded calibrations, oldest first.
+func CalibrationHistory() ([]CalibrationRecord, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return readHistory()
+}
+
+func readHistory() ([]CalibrationRecord, error) {
+	fp, err := os.Open(historyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var records []CalibrationRecord
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var rec CalibrationRecord
+		// 跳过掉电时写坏的行
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// appendHistory adds rec to the history file and drops the oldest records
+// beyond maxHistoryRecords.
+func appendHistory(rec CalibrationRecord) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	records, err := readHistory()
+	if err != nil {
+		return err
+	}
+	if len(records) < maxHistoryRecords {
+		fp, err := os.OpenFile(historyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		_, err = fp.Write(append(line, '\n'))
+		return err
+	}
+
+	records = append(records[len(records)-maxHistoryRecords+1:], rec)
+	tmp := historyFile + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err = enc.Encode(r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err1 := fp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, historyFile)
+}
+
+// GetHistory returns the last ?limit= (default 100) calibrations, newest
+// first, optionally only those of ?origin=.
+func GetHistory(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	vars := r.URL.Query()
+	limit := 100
+	if s := vars.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeErrorResponse(w, http.StatusBadRequest, "limit invalid")
+			return
+		}
+		limit = n
+	}
+	records, err := CalibrationHistory()
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	origin, requestID := vars.Get("origin"), vars.Get("requestId")
+	result := []CalibrationRecord{}
+	for i := len(records) - 1; i >= 0 && len(result) < limit; i-- {
+		if (origin == "" || records[i].Origin == origin) && (requestID == "" || records[i].RequestID == requestID) {
+			result = append(result, records[i])
+		}
+	}
+	writeResponse(w, result)
+}
+
+// RollbackCalibration writes back the offsets recorded by the successful
+// calibration :job and stores them in the calibration file.
+func RollbackCalibration(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	records, err := CalibrationHistory()
+	if err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var rec *CalibrationRecord
+	for i := range records {
+		if records[i].JobID == params.ByName("job") {
+			rec = &records[i]
+		}
+	}
+	if rec == nil {
+		writeErrorResponse(w, http.StatusNotFound, "calibration not found")
+		return
+	}
+	// 失败的校准记录的偏移可能只写了一部分
+	if rec.Error != "" || len(rec.Offsets) == 0 {
+		err := fmt.Errorf("calibration %s has no complete offsets", rec.JobID)
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err := rec.Offsets.validate(); err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	end, err := beginOp("params_import")
+	if err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, opErrorCode(err), err.Error())
+		return
+	}
+	defer end()
+	log := requestLog(r, "calibration").WithField("job_id", rec.JobID)
+	if err := importParams(log, rec.Offsets); err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Info("offsets rolled back to calibration")
+	writeResponse(w, rec.Offsets)
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// EventCalibrationProgress is streamed on GET /events while a calibration
+// runs, it is not posted to the webhooks.
+const EventCalibrationProgress = "calibration.progress"
+
+// keep alive comment of the event stream, proxies close idle connections
+var liveKeepAlive = 15 * time.Second
+
+type liveEvent struct {
+	event string
+	data  []byte
+}
+
+// 事件流的订阅者, 跟不上的订阅者被断开, 客户端重连后重新读取状态
+var live = struct {
+	sync.Mutex
+	subs map[chan liveEvent]bool
+}{subs: make(map[chan liveEvent]bool)}
+
+// broadcast sends an event to the GET /events streams.
+func broadcast(event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		moduleLog("http").WithError(err).WithField("event", event).Error("encode live event error")
+		return
+	}
+	live.Lock()
+	defer live.Unlock()
+	for ch := range live.subs {
+		select {
+		case ch <- liveEvent{event, payload}:
+		default:
+			delete(live.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func subscribeLive() chan liveEvent {
+	ch := make(chan liveEvent, 64)
+	live.Lock()
+	live.subs[ch] = true
+	live.Unlock()
+	return ch
+}
+
+func unsubscribeLive(ch chan liveEvent) {
+	live.Lock()
+	defer live.Unlock()
+	if live.subs[ch] {
+		delete(live.subs, ch)
+		close(ch)
+	}
+}
+
+// disconnectLive ends the event streams so that the HTTP server can shut
+// down.
+func disconnectLive() {
+	live.Lock()
+	defer live.Unlock()
+	for ch := range live.subs {
+		delete(live.subs, ch)
+		close(ch)
+	}
+}
+
+// GetEvents streams the events and the calibration progress as server-sent
+// events until the client disconnects.
+func GetEvents(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrorResponse(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	ch := subscribeLive()
+	defer unsubscribeLive(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// 先发送正在进行的校准, 客户端不用再单独查询
+	for _, p := range CalibrationsInProgress() {
+		data, _ := json.Marshal(p)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", EventCalibrationProgress, data)
+	}
+	flusher.Flush()
+	ticker := time.NewTicker(liveKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.event, e.data)
+		}
+		flusher.Flush()
+	}
+}
+
+// CalibrationProgress is the state of a running calibration.
+type CalibrationProgress struct {
+	JobID   string    `json:"jobId"`
+	Origin  string    `json:"origin"`
+	Started time.Time `json:"started"`
+	// global channel numbers to calibrate and those done
+	Channels []int `json:"channels"`
+	Done     []int `json:"done"`
+	// settle, capture, finished or failed
+	Step   string `json:"step"`
+	Device string `json:"device,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+var progress = struct {
+	sync.Mutex
+	jobs map[string]*CalibrationProgress
+	// 按 job id 订阅进度的 gRPC 流, job 结束时关闭
+	watchers map[string][]chan CalibrationProgress
+}{jobs: make(map[string]*CalibrationProgress), watchers: make(map[string][]chan CalibrationProgress)}
+
+// updateProgress changes the progress of a job and streams it.
+func updateProgress(jobID string, update func(p *CalibrationProgress)) {
+	progress.Lock()
+	p := progress.jobs[jobID]
+	if p == nil {
+		progress.Unlock()
+		return
+	}
+	update(p)
+	snapshot := *p
+	snapshot.Done = append([]int{}, p.Done...)
+	finished := p.Step == "finished" || p.Step == "failed"
+	for _, ch := range progress.watchers[jobID] {
+		// 跟不上的订阅者丢失中间进度, 结束状态由调用者自己得到
+		select {
+		case ch <- snapshot:
+		default:
+		}
+		if finished {
+			close(ch)
+		}
+	}
+	if finished {
+		delete(progress.jobs, jobID)
+		delete(progress.watchers, jobID)
+	}
+	progress.Unlock()
+	broadcast(EventCalibrationProgress, snapshot)
+}
+
+// watchProgress returns the progress updates of a job which has not started
+// yet, the channel is closed when it is finished or stop is called.
+func watchProgress(jobID string) (updates <-chan CalibrationProgress, stop func()) {
+	ch := make(chan CalibrationProgress, 16)
+	progress.Lock()
+	progress.watchers[jobID] = append(progress.watchers[jobID], ch)
+	progress.Unlock()
+	return ch, func() {
+		progress.Lock()
+		defer progress.Unlock()
+		watchers := progress.watchers[jobID]
+		for i, w := range watchers {
+			if w == ch {
+				progress.watchers[jobID] = append(watchers[:i:i], watchers[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+		if len(progress.watchers[jobID]) == 0 {
+			delete(progress.watchers, jobID)
+		}
+	}
+}
+
+func startProgress(rec CalibrationRecord) {
+	channels := rec.Channels
+	if len(channels) == 0 {
+		for _, p := range profiles {
+			for _, id := range p.channelIds() {
+				channels = append(channels, globalChannelOf(p.Name, id))
+			}
+		}
+	}
+	progress.Lock()
+	progress.jobs[rec.JobID] = &CalibrationProgress{JobID: rec.JobID, Origin: rec.Origin, Started: rec.Started,
+		Channels: channels, Done: []int{}, Step: "settle"}
+	progress.Unlock()
+	updateProgress(rec.JobID, func(p *CalibrationProgress) {})
+}
+
+func finishProgress(jobID string, err error) {
+	updateProgress(jobID, func(p *CalibrationProgress) {
+		p.Step, p.Device = "finished", ""
+		if err != nil {
+			p.Step, p.Error = "failed", err.Error()
+		}
+	})
+}
+
+// progressJob returns the job id runCalibration put in the log entry.
+func progressJob(log *logrus.Entry) string {
+	id, _ := log.Data["job_id"].(string)
+	return id
+}
+
+func progressStep(log *logrus.Entry, step, devName string) {
+	updateProgress(progressJob(log), func(p *CalibrationProgress) {
+		p.Step, p.Device = step, devName
+	})
+}
+
+func progressApplied(log *logrus.Entry, devName string, chanIds []int) {
+	updateProgress(progressJob(log), func(p *CalibrationProgress) {
+		for _, id := range chanIds {
+			p.Done = append(p.Done, globalChannelOf(devName, id))
+		}
+	})
+}
+
+// CalibrationsInProgress returns the running calibrations, oldest first.
+func CalibrationsInProgress() []CalibrationProgress {
+	progress.Lock()
+	defer progress.Unlock()
+	result := []CalibrationProgress{}
+	for _, p := range progress.jobs {
+		c := *p
+		c.Done = append([]int{}, p.Done...)
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.Before(result[j].Started) })
+	return result
+}
+
+// GetCalibrationProgress returns the running calibrations.
+func GetCalibrationProgress(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	writeResponse(w, CalibrationsInProgress())
+}
+
+// DeviceInfo describes a calibrated device for the clients.
+type DeviceInfo struct {
+	Name     string `json:"name"`
+	Channels int    `json:"channels"`
+	// global number of channel 0, the channels of the devices are counted
+	// one after the other
+	FirstChannel int  `json:"firstChannel"`
+	Temperature  bool `json:"temperature"`
+}
+
+// GetDevices lists the devices in the order of the global channel numbers.
+func GetDevices(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	result := []DeviceInfo{}
+	first := 0
+	for _, p := range profiles {
+		result = append(result, DeviceInfo{Name: p.Name, Channels: p.Channels, FirstChannel: first, Temperature: p.Temperature != nil})
+		first += p.Channels
+	}
+	writeResponse(w, result)
+}
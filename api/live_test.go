@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// readEvents returns the events of a GET /events stream on a channel.
+func readEvents(t *testing.T, url string) (<-chan [2]string, func()) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	events := make(chan [2]string, 100)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var event string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				events <- [2]string{event, line[len("data: "):]}
+			}
+		}
+	}()
+	return events, func() { resp.Body.Close() }
+}
+
+func TestLiveEvents(t *testing.T) {
+	setupTestServer(t, nil)
+
+	router := httprouter.New()
+	router.GET("/events", RequestID(GetEvents))
+	router.GET("/devices", GetDevices)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var devices []DeviceInfo
+	json.Unmarshal(doRequest(router, "GET", "/devices", "", nil).Body.Bytes(), &devices)
+	if len(devices) != 2 || devices[1].Name != "cf_axi_adc_1" || devices[1].FirstChannel != 7 || devices[1].Channels != 8 {
+		t.Errorf("devices %+v", devices)
+	}
+
+	events, closeStream := readEvents(t, server.URL+"/events")
+	defer closeStream()
+	// 等待订阅生效
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		live.Lock()
+		n := len(live.subs)
+		live.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("event stream not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := Calibrate(8); err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	var last CalibrationProgress
+	timeout := time.After(5 * time.Second)
+	for last.Step != "finished" {
+		select {
+		case e := <-events:
+			if e[0] != EventCalibrationProgress {
+				continue
+			}
+			if err := json.Unmarshal([]byte(e[1]), &last); err != nil {
+				t.Fatal(err)
+			}
+			steps = append(steps, last.Step)
+		case <-timeout:
+			t.Fatalf("calibration not finished, steps %v", steps)
+		}
+	}
+	if strings.Join(steps, ",") != "settle,settle,capture,capture,finished" {
+		t.Errorf("steps %v", steps)
+	}
+	if len(last.Channels) != 1 || last.Channels[0] != 8 || len(last.Done) != 1 || last.Done[0] != 8 || last.Origin != OriginCLI {
+		t.Errorf("final progress %+v", last)
+	}
+	if p := CalibrationsInProgress(); len(p) != 0 {
+		t.Errorf("%d calibrations still in progress", len(p))
+	}
+
+	disconnectLive()
+	for range events {
+	}
+}
+
+func TestRollbackCalibration(t *testing.T) {
+	b, _ := setupTestServer(t, nil)
+
+	b.setLevel("cf_axi_adc_1", 1, 400)
+	if err := Calibrate(8); err != nil {
+		t.Fatal(err)
+	}
+	b.setLevel("cf_axi_adc_1", 1, 800)
+	if err := Calibrate(8); err != nil {
+		t.Fatal(err)
+	}
+	Calibrate(99)
+	records, _ := CalibrationHistory()
+	if len(records) != 3 {
+		t.Fatalf("%d records", len(records))
+	}
+	first := records[0]
+
+	router := httprouter.New()
+	router.POST("/history/:job/rollback", RollbackCalibration)
+	if rec := doRequest(router, "POST", "/history/nope/rollback", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d", rec.Code)
+	}
+	if rec := doRequest(router, "POST", "/history/"+records[2].JobID+"/rollback", "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("failed calibration: status %d", rec.Code)
+	}
+	if rec := doRequest(router, "POST", "/history/"+first.JobID+"/rollback", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("rollback: status %d %s", rec.Code, rec.Body)
+	}
+	regs, err := OffsetRegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := StoredParams()
+	want := first.Offsets["cf_axi_adc_1"][1]
+	if want == records[1].Offsets["cf_axi_adc_1"][1] {
+		t.Fatalf("both calibrations wrote %d", want)
+	}
+	if regs["cf_axi_adc_1"][1] != want || stored["cf_axi_adc_1"][1] != want {
+		t.Errorf("offset %d, stored %d, want %d", regs["cf_axi_adc_1"][1], stored["cf_axi_adc_1"][1], want)
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// 日志模块, 每个模块可以单独设置日志级别
+var logModuleNames = []string{"http", "auth", "audit", "backend", "calibration", "config", "reboot", "registers", "snapshot", "webhook", "mqtt", "grpc", "modbus"}
+
+var logModules = struct {
+	sync.Mutex
+	loggers map[string]*logrus.Logger
+	json    bool
+}{loggers: make(map[string]*logrus.Logger)}
+
+func init() {
+	for _, name := range logModuleNames {
+		l := logrus.New()
+		l.Out = logrus.StandardLogger().Out
+		logModules.loggers[name] = l
+	}
+}
+
+// moduleLog returns the logger of a module, the fields of its entries
+// always include the module name.
+func moduleLog(module string) *logrus.Entry {
+	logModules.Lock()
+	l := logModules.loggers[module]
+	logModules.Unlock()
+	if l == nil {
+		l = logrus.StandardLogger()
+	}
+	return l.WithField("module", module)
+}
+
+// SetLogFormat switches the standard and the module loggers to JSON or text
+// output.
+func SetLogFormat(format string) error {
+	var formatter logrus.Formatter
+	switch format {
+	case "", "text":
+		formatter = &logrus.TextFormatter{}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	logModules.Lock()
+	defer logModules.Unlock()
+	logModules.json = format == "json"
+	logrus.SetFormatter(formatter)
+	for _, l := range logModules.loggers {
+		l.Formatter = formatter
+	}
+	return nil
+}
+
+// SetLogLevel sets the level of a module, module "" sets the standard
+// logger and all modules.
+func SetLogLevel(module, level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logModules.Lock()
+	defer logModules.Unlock()
+	if module == "" {
+		logrus.SetLevel(lvl)
+		for _, l := range logModules.loggers {
+			l.SetLevel(lvl)
+		}
+		return nil
+	}
+	l, ok := logModules.loggers[module]
+	if !ok {
+		return fmt.Errorf("unknown log module %q", module)
+	}
+	l.SetLevel(lvl)
+	return nil
+}
+
+// LogSettings is the body of GET and PUT /admin/log.
+type LogSettings struct {
+	Format string            `json:"format,omitempty"`
+	Levels map[string]string `json:"levels"`
+}
+
+func logSettings() LogSettings {
+	logModules.Lock()
+	defer logModules.Unlock()
+	s := LogSettings{Format: "text", Levels: map[string]string{"main": logrus.GetLevel().String()}}
+	if logModules.json {
+		s.Format = "json"
+	}
+	for name, l := range logModules.loggers {
+		s.Levels[name] = l.GetLevel().String()
+	}
+	return s
+}
+
+func checkLogLevels(levels map[string]string) error {
+	for name, level := range levels {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return fmt.Errorf("module %s: %v", name, err)
+		}
+		if _, ok := logModules.loggers[name]; !ok && name != "main" {
+			return fmt.Errorf("unknown log module %q", name)
+		}
+	}
+	return nil
+}
+
+// ApplyLogLevels sets the levels of the modules in levels, "main" is the
+// standard logger. The levels are checked before any is set.
+func ApplyLogLevels(levels map[string]string) error {
+	if err := checkLogLevels(levels); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(levels))
+	for name := range levels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "main" {
+			lvl, _ := logrus.ParseLevel(levels[name])
+			logrus.SetLevel(lvl)
+			continue
+		}
+		SetLogLevel(name, levels[name])
+	}
+	return nil
+}
+
+// GetLogSettings returns the log format and the level of every module.
+func GetLogSettings(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	writeResponse(w, logSettings())
+}
+
+// PutLogSettings sets the levels of the modules given in the body, e.g.
+// {"levels": {"registers": "debug"}}.
+func PutLogSettings(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var body LogSettings
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if body.Format != "" {
+		setAuditError(r, fmt.Errorf("log format can not be changed at runtime"))
+		writeErrorResponse(w, http.StatusBadRequest, "log format can not be changed at runtime")
+		return
+	}
+	if err := ApplyLogLevels(body.Levels); err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	requestLog(r, "http").WithField("levels", body.Levels).Info("log levels changed")
+	writeResponse(w, logSettings())
+}
+
+type requestIDKey struct{}
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestID gives every request an id, taken from a valid X-Request-ID
+// header or generated, returns it in the response header and logs the
+// request when it is done.
+func RequestID(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRe.MatchString(id) {
+			id = newID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r, params)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		moduleLog("http").WithFields(logrus.Fields{
+			"request_id": id,
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"remote":     r.RemoteAddr,
+			"status":     rec.status,
+			"duration":   time.Since(start).String(),
+		}).Info("request")
+	}
+}
+
+// RequestIDOf returns the id given to r by RequestID.
+func RequestIDOf(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLog returns the logger of module for the handling of r.
+func requestLog(r *http.Request, module string) *logrus.Entry {
+	log := moduleLog(module)
+	if id := RequestIDOf(r); id != "" {
+		log = log.WithField("request_id", id)
+	}
+	return log
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// captureLog sends the output of module to a buffer in JSON format.
+func captureLog(t *testing.T, module string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	l := logModules.loggers[module]
+	out, formatter, level := l.Out, l.Formatter, l.GetLevel()
+	l.Out, l.Formatter = buf, &logrus.JSONFormatter{}
+	l.SetLevel(logrus.DebugLevel)
+	t.Cleanup(func() {
+		l.Out, l.Formatter = out, formatter
+		l.SetLevel(level)
+	})
+	return buf
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+	logs := captureLog(t, "registers")
+
+	router := httprouter.New()
+	router.PUT("/devices/:dev/registers/:addr", RequestID(WriteRegister))
+	rec := doRequest(router, "PUT", "/devices/cf_axi_adc/registers/0x1E", `{"value": 5}`, http.Header{"X-Request-Id": {"mes-42"}})
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Request-ID") != "mes-42" {
+		t.Fatalf("write register: %d, request id %q", rec.Code, rec.Header().Get("X-Request-ID"))
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log %q: %v", logs.String(), err)
+	}
+	for k, v := range map[string]interface{}{"request_id": "mes-42", "module": "registers", "device": "cf_axi_adc", "register": "0x1e", "value": 5.0} {
+		if entry[k] != v {
+			t.Errorf("log field %s = %v, expected %v", k, entry[k], v)
+		}
+	}
+
+	rec = doRequest(router, "PUT", "/devices/cf_axi_adc/registers/0x1E", `{"value": 5}`, http.Header{"X-Request-Id": {"bad id\n"}})
+	if id := rec.Header().Get("X-Request-ID"); len(id) != 16 {
+		t.Errorf("invalid request id not replaced: %q", id)
+	}
+}
+
+func TestPutLogSettings(t *testing.T) {
+	defer SetLogLevel("", logrus.GetLevel().String())
+	router := httprouter.New()
+	router.GET("/admin/log", GetLogSettings)
+	router.PUT("/admin/log", PutLogSettings)
+
+	if rec := doRequest(router, "PUT", "/admin/log", `{"levels": {"registers": "debug", "nope": "info"}}`, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown module: %d", rec.Code)
+	}
+	if logModules.loggers["registers"].GetLevel() == logrus.DebugLevel {
+		t.Fatal("levels applied despite error")
+	}
+	rec := doRequest(router, "PUT", "/admin/log", `{"levels": {"registers": "debug"}}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set level: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(router, "GET", "/admin/log", "", nil)
+	var settings LogSettings
+	json.NewDecoder(rec.Body).Decode(&settings)
+	if settings.Levels["registers"] != "debug" || settings.Levels["backend"] == "debug" {
+		t.Fatalf("unexpected levels %v", settings.Levels)
+	}
+	if settings.Format != "text" {
+		t.Errorf("unexpected format %q", settings.Format)
+	}
+}
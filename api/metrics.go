@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/plpsy/iiocalibration/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("iiocalibration_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	httpDuration = metrics.NewHistogramVec("iiocalibration_http_request_duration_seconds",
+		"HTTP request latency by route and method.", metrics.DefBuckets, "route", "method")
+	grpcRequests = metrics.NewCounterVec("iiocalibration_grpc_requests_total",
+		"gRPC calls by method and status code.", "method", "code")
+	grpcDuration = metrics.NewHistogramVec("iiocalibration_grpc_request_duration_seconds",
+		"gRPC call latency by method, streams included.", metrics.DefBuckets, "method")
+	modbusExceptions = metrics.NewCounterVec("iiocalibration_modbus_exceptions_total",
+		"Modbus exception responses by function and exception code.", "function", "code")
+	calibrationRuns = metrics.NewCounterVec("iiocalibration_calibration_runs_total",
+		"Calibration runs by device and result.", "device", "result")
+	lastCalibration = metrics.NewGaugeVec("iiocalibration_last_calibration_timestamp_seconds",
+		"Unix time of the last successful calibration of a device.", "device")
+	offsetRegister = metrics.NewGaugeVec("iiocalibration_offset_register",
+		"Offset register value of a channel, as last written or read.", "device", "channel")
+	backendDuration = metrics.NewHistogramVec("iiocalibration_backend_call_duration_seconds",
+		"Duration of the backend calls by operation.", metrics.DefBuckets, "op")
+	backendErrors = metrics.NewCounterVec("iiocalibration_backend_call_errors_total",
+		"Failed backend calls by operation.", "op")
+	configLoad = metrics.NewGaugeVec("iiocalibration_config_load_success",
+		"Whether the last load of a config file succeeded.", "file")
+	driftResidual = metrics.NewGaugeVec("iiocalibration_drift_residual",
+		"Residual offset of a channel measured by the drift monitor.", "device", "channel")
+	configLoadTime = metrics.NewGaugeVec("iiocalibration_config_load_timestamp_seconds",
+		"Unix time of the last load of a config file.", "file")
+)
+
+func observeBackend(op string, start time.Time, err error) {
+	backendDuration.Observe(time.Since(start).Seconds(), op)
+	if err != nil {
+		backendErrors.Inc(op)
+	}
+}
+
+func captureSamples(devName string, chanIds []int, samples int) ([]byte, error) {
+	start := time.Now()
+	points, err := backend.Capture(devName, chanIds, samples)
+	observeBackend("capture", start, err)
+	return points, err
+}
+
+func observeCalibration(devName string, err error) {
+	if err != nil {
+		calibrationRuns.Inc(devName, "failure")
+		return
+	}
+	calibrationRuns.Inc(devName, "success")
+	lastCalibration.Set(float64(time.Now().Unix()), devName)
+}
+
+func observeOffset(devName string, chanId int, offset int32) {
+	offsetRegister.Set(float64(offset), devName, strconv.Itoa(chanId))
+}
+
+func observeDrift(devName string, chanId int, residual int32) {
+	driftResidual.Set(float64(residual), devName, strconv.Itoa(chanId))
+}
+
+func observeConfigLoad(file string, err error) {
+	v := 1.0
+	if err != nil {
+		v = 0
+	}
+	configLoad.Set(v, file)
+	configLoadTime.Set(float64(time.Now().Unix()), file)
+}
+
+// Instrument wraps the handler of route to count the requests and measure
+// their latency.
+func Instrument(route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r, params)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.Inc(route, r.Method, strconv.Itoa(rec.status))
+		httpDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	}
+}
+
+func Metrics(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	metrics.Handler().ServeHTTP(w, r)
+}
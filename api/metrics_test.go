@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestMetrics(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+	b.setLevel("cf_axi_adc", 2, -100)
+
+	router := httprouter.New()
+	router.GET("/devices/:dev/registers/:addr", Instrument("/devices/:dev/registers/:addr", ReadRegister))
+	router.GET("/metrics", Instrument("/metrics", Metrics))
+
+	doRequest(router, "GET", "/devices/cf_axi_adc/registers/0x1e", "", nil)
+	doRequest(router, "GET", "/devices/nodev/registers/0x1e", "", nil)
+	if _, err := getDevOffset(testLog, "cf_axi_adc_1", 3); err != nil {
+		t.Fatal(err)
+	}
+	points, err := captureSamples("cf_axi_adc", []int{2}, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avg := calcAverage(testLog, points, 1, 1024, 0.75); avg[0] != -75 {
+		t.Fatalf("average of captured samples %d, expected -75", avg[0])
+	}
+	observeCalibration("cf_axi_adc", nil)
+
+	rec := doRequest(router, "GET", "/metrics", "", nil)
+	body := rec.Body.String()
+	for _, line := range []string{
+		`iiocalibration_http_requests_total{route="/devices/:dev/registers/:addr",method="GET",code="200"} 1`,
+		`iiocalibration_http_requests_total{route="/devices/:dev/registers/:addr",method="GET",code="404"} 1`,
+		`iiocalibration_http_request_duration_seconds_count{route="/devices/:dev/registers/:addr",method="GET"} 2`,
+		`iiocalibration_offset_register{device="cf_axi_adc_1",channel="3"} 0`,
+		`iiocalibration_backend_call_duration_seconds_count{op="capture"}`,
+		`iiocalibration_calibration_runs_total{device="cf_axi_adc",result="success"} 1`,
+		`iiocalibration_last_calibration_timestamp_seconds{device="cf_axi_adc"}`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics miss %s", line)
+		}
+	}
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
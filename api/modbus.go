@@ -0,0 +1,367 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/plpsy/iiocalibration/modbus"
+	"github.com/sirupsen/logrus"
+)
+
+// ModbusConfig is the Modbus TCP listener for PLCs. Channels are the global
+// channel numbers c, the 32 bit values take two registers, high word first.
+//
+//	holding registers (read only)
+//	  2c, 2c+1         offset register applied to channel c
+//	  1000+2c, +1      offset of channel c in the calibration file
+//	coils, written with Commands set
+//	  0                calibrate all channels, on while running
+//	  1                clear the offset registers
+//	  100+c            calibrate channel c, on while running
+//	input registers
+//	  0                0 idle, 1 calibrating, 2 shutting down or rebooting
+//	  1                last command 0 none, 1 running, 2 succeeded, 3 failed
+//	  2                sequence number of the last command
+//	  3                coil of the last command
+//	  4                0 stored offsets applied, 1 not applied
+//	  5                1 if a reboot is pending
+//	  6                number of drift alerts
+//	  7                number of channels
+//	  8, 9             uptime in seconds
+//
+// Writing 0 to a coil does nothing, one request starts at most one command.
+// Commands are answered with server device busy while a calibration runs,
+// whichever transport started it.
+type ModbusConfig struct {
+	// host:port, empty disables Modbus
+	Listen string `json:"listen,omitempty"`
+	// unit identifier answered, 0 answers all units
+	UnitID   byte `json:"unitId"`
+	Commands bool `json:"commands"`
+}
+
+func (c *ModbusConfig) validate() error {
+	if c.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("modbus.listen %q: %v", c.Listen, err)
+	}
+	if c.UnitID > 247 {
+		return fmt.Errorf("modbus.unitId must be 0-247")
+	}
+	return nil
+}
+
+func modbusConfig() ModbusConfig {
+	return CurrentConfig().Modbus
+}
+
+// 寄存器地址
+const (
+	modbusStoredBase   = 1000
+	modbusCoilAll      = 0
+	modbusCoilClear    = 1
+	modbusCoilChannels = 100
+	modbusInputCount   = 10
+)
+
+// 命令状态, 输入寄存器 1-3
+const (
+	modbusCmdNone = iota
+	modbusCmdRunning
+	modbusCmdSucceeded
+	modbusCmdFailed
+)
+
+// Modbus 监听, 配置重新加载时监听地址或单元标识变化才重建
+var modbusConn = struct {
+	sync.Mutex
+	server  *modbus.Server
+	cfg     ModbusConfig
+	addr    string
+	started bool
+}{}
+
+// 通过线圈启动的命令, 同时只运行一个
+var modbusCmd = struct {
+	sync.Mutex
+	coil   uint16
+	result uint16
+	seq    uint16
+}{}
+
+// StartModbus listens on the address of the modbus settings until
+// StopModbus. A running listener is kept if its settings did not change.
+func StartModbus() error {
+	modbusConn.Lock()
+	defer modbusConn.Unlock()
+	modbusConn.started = true
+	cfg := modbusConfig()
+	if modbusConn.server != nil {
+		if modbusConn.cfg.Listen == cfg.Listen && modbusConn.cfg.UnitID == cfg.UnitID {
+			return nil
+		}
+		modbusConn.server.Close()
+		modbusConn.server = nil
+	}
+	if cfg.Listen == "" {
+		return nil
+	}
+	log := moduleLog("modbus").WithField("listen", cfg.Listen)
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	s := &modbus.Server{
+		Handler:  modbusHandler{},
+		Unit:     cfg.UnitID,
+		ErrorLog: modbusError,
+	}
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			log.WithError(err).Error("modbus listener error")
+		}
+	}()
+	modbusConn.server = s
+	modbusConn.cfg = cfg
+	modbusConn.addr = ln.Addr().String()
+	log.WithFields(logrus.Fields{"addr": modbusConn.addr, "commands": cfg.Commands}).Info("modbus started")
+	return nil
+}
+
+// StopModbus closes the listener and the connections. Started commands go
+// on.
+func StopModbus() {
+	modbusConn.Lock()
+	defer modbusConn.Unlock()
+	if modbusConn.server != nil {
+		modbusConn.server.Close()
+		modbusConn.server = nil
+	}
+}
+
+func modbusStarted() bool {
+	modbusConn.Lock()
+	defer modbusConn.Unlock()
+	return modbusConn.started
+}
+
+func modbusError(r *modbus.Request, err error) {
+	code := modbus.ServerDeviceFailure
+	errors.As(err, &code)
+	modbusExceptions.Inc(strconv.Itoa(int(r.Function)), strconv.Itoa(int(code)))
+	moduleLog("modbus").WithFields(logrus.Fields{
+		"remote":   r.Remote,
+		"function": r.Function,
+		"address":  r.Address,
+		"quantity": r.Quantity,
+	}).WithError(err).Warn("modbus request error")
+}
+
+func modbusChannels() int {
+	n := 0
+	for _, p := range profiles {
+		n += p.Channels
+	}
+	return n
+}
+
+// modbusRange returns the part of values read by r, values start at base.
+func modbusRange(r *modbus.Request, base int, values []uint16) ([]uint16, error) {
+	first := int(r.Address) - base
+	if first < 0 || first+int(r.Quantity) > len(values) {
+		return nil, modbus.IllegalDataAddress
+	}
+	return values[first : first+int(r.Quantity)], nil
+}
+
+// modbusOffsets returns the offsets of the global channels as two registers
+// each.
+func modbusOffsets(params Params) []uint16 {
+	regs := make([]uint16, 2*modbusChannels())
+	for c := 0; c < len(regs)/2; c++ {
+		devName, chanId, _ := globalChannel(c)
+		v := uint32(params[devName][chanId])
+		regs[2*c], regs[2*c+1] = uint16(v>>16), uint16(v)
+	}
+	return regs
+}
+
+type modbusHandler struct{}
+
+func (modbusHandler) ReadHoldingRegisters(r *modbus.Request) ([]uint16, error) {
+	if r.Address >= modbusStoredBase {
+		params, err := StoredParams()
+		if err != nil {
+			return nil, err
+		}
+		return modbusRange(r, modbusStoredBase, modbusOffsets(params))
+	}
+	if _, err := modbusRange(r, 0, make([]uint16, 2*modbusChannels())); err != nil {
+		return nil, err
+	}
+	end, err := beginOp("modbus_offsets")
+	if err != nil {
+		return nil, modbus.ServerDeviceBusy
+	}
+	defer end()
+	offsets, err := getOffsetRegs(moduleLog("modbus"))
+	if err != nil {
+		return nil, err
+	}
+	return modbusRange(r, 0, modbusOffsets(offsets))
+}
+
+func (modbusHandler) ReadInputRegisters(r *modbus.Request) ([]uint16, error) {
+	regs := make([]uint16, modbusInputCount)
+	ops.Lock()
+	if ops.draining != "" {
+		regs[0] = 2
+	} else if ops.running["calibration"] > 0 {
+		regs[0] = 1
+	}
+	ops.Unlock()
+	modbusCmd.Lock()
+	regs[1], regs[2], regs[3] = modbusCmd.result, modbusCmd.seq, modbusCmd.coil
+	modbusCmd.Unlock()
+	if checkOffsets() != nil {
+		regs[4] = 1
+	}
+	if RebootPending() != nil {
+		regs[5] = 1
+	}
+	regs[6] = uint16(len(DriftAlerts()))
+	regs[7] = uint16(modbusChannels())
+	uptime := uint32(time.Since(startTime) / time.Second)
+	regs[8], regs[9] = uint16(uptime>>16), uint16(uptime)
+	return modbusRange(r, 0, regs)
+}
+
+// modbusCoil reports whether addr is a coil.
+func modbusCoil(addr int) bool {
+	return addr == modbusCoilAll || addr == modbusCoilClear ||
+		addr >= modbusCoilChannels && addr < modbusCoilChannels+modbusChannels()
+}
+
+func (modbusHandler) ReadCoils(r *modbus.Request) ([]bool, error) {
+	coils := make([]bool, r.Quantity)
+	modbusCmd.Lock()
+	defer modbusCmd.Unlock()
+	for i := range coils {
+		addr := int(r.Address) + i
+		if !modbusCoil(addr) {
+			return nil, modbus.IllegalDataAddress
+		}
+		coils[i] = modbusCmd.result == modbusCmdRunning && int(modbusCmd.coil) == addr
+	}
+	return coils, nil
+}
+
+func (modbusHandler) WriteCoils(r *modbus.Request) error {
+	command := -1
+	for i, on := range r.Coils {
+		addr := int(r.Address) + i
+		if !modbusCoil(addr) {
+			return modbus.IllegalDataAddress
+		}
+		if on && command >= 0 {
+			return modbus.IllegalDataValue
+		}
+		if on {
+			command = addr
+		}
+	}
+	if command < 0 {
+		return nil
+	}
+	if !modbusConfig().Commands {
+		return modbus.IllegalFunction
+	}
+	e := &AuditEntry{User: "modbus", Role: RoleOperator, Remote: r.Remote, Endpoint: "coil/" + strconv.Itoa(command)}
+	log := moduleLog("modbus").WithFields(logrus.Fields{"remote": r.Remote, "coil": command})
+	var channels []int
+	kind := "calibration"
+	switch command {
+	case modbusCoilClear:
+		kind = "clear_regs"
+	case modbusCoilAll:
+	default:
+		channels = []int{command - modbusCoilChannels}
+	}
+	e.Action = kind
+	if kind == "calibration" {
+		e.Params = map[string]string{"channels": fmt.Sprint(channels)}
+	}
+	end, err := beginModbusCommand(command, kind)
+	if err != nil {
+		e.Error = err.Error()
+		Audit(e)
+		return modbus.ServerDeviceBusy
+	}
+	e.Before = modbusOffsetState(log)
+
+	if kind == "clear_regs" {
+		defer end()
+		err := clearOffsetRegs(log)
+		e.After = modbusOffsetState(log)
+		if err != nil {
+			e.Error = err.Error()
+		}
+		Audit(e)
+		endModbusCommand(err)
+		return err
+	}
+	jobID := newID()
+	e.Params["job_id"] = jobID
+	// 校准要几分钟, PLC 轮询线圈或输入寄存器等待结束
+	go func() {
+		defer end()
+		err := runCalibration(log.WithField("job_id", jobID), jobID, OriginModbus, "", "", channels)
+		if err != nil {
+			e.Error = err.Error()
+		}
+		Audit(e)
+		endModbusCommand(err)
+	}()
+	log.WithField("job_id", jobID).Info("modbus calibration started")
+	return nil
+}
+
+// beginModbusCommand registers the hardware operation of the command of coil
+// and marks it running. Commands are refused while one is running.
+func beginModbusCommand(coil int, kind string) (end func(), err error) {
+	modbusCmd.Lock()
+	defer modbusCmd.Unlock()
+	if modbusCmd.result == modbusCmdRunning {
+		return nil, fmt.Errorf("modbus command of coil %d running", modbusCmd.coil)
+	}
+	if end, err = beginOp(kind); err != nil {
+		return nil, err
+	}
+	modbusCmd.seq++
+	modbusCmd.coil = uint16(coil)
+	modbusCmd.result = modbusCmdRunning
+	return end, nil
+}
+
+func endModbusCommand(err error) {
+	modbusCmd.Lock()
+	defer modbusCmd.Unlock()
+	modbusCmd.result = modbusCmdSucceeded
+	if err != nil {
+		modbusCmd.result = modbusCmdFailed
+	}
+}
+
+func modbusOffsetState(log *logrus.Entry) interface{} {
+	regs, err := getOffsetRegs(log)
+	if err != nil {
+		return map[string]string{"error": err.Error()}
+	}
+	return regs
+}
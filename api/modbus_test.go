@@ -0,0 +1,134 @@
+package api
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/plpsy/iiocalibration/modbus"
+)
+
+// waitCommand waits until the modbus command seq is no longer running and
+// returns the input registers 1-3.
+func waitCommand(t *testing.T, c *modbus.Client, seq uint16) []uint16 {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		regs, err := c.ReadInputRegisters(1, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if regs[1] == seq && regs[0] != modbusCmdRunning {
+			return regs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("modbus command %d still running: %v", seq, regs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func int32Of(regs []uint16) int32 {
+	return int32(uint32(regs[0])<<16 | uint32(regs[1]))
+}
+
+func TestModbus(t *testing.T) {
+	b, cfg := setupTestServer(t, func(cfg *Config) {
+		cfg.Modbus.Listen = "127.0.0.1:0"
+		cfg.Modbus.UnitID = 3
+	})
+	b.setLevel("cf_axi_adc_1", 1, -400)
+	OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	defer func() { auditLog = nil }()
+	if err := StartModbus(); err != nil {
+		t.Fatal(err)
+	}
+	defer StopModbus()
+
+	c, err := modbus.Dial(modbusConn.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Unit = 3
+
+	status, err := c.ReadInputRegisters(0, modbusInputCount)
+	if err != nil || status[0] != 0 || status[1] != modbusCmdNone || status[7] != 15 {
+		t.Errorf("input registers %v, %v", status, err)
+	}
+	if err := c.WriteSingleCoil(modbusCoilChannels+8, true); err != modbus.IllegalFunction {
+		t.Errorf("command without modbus.commands: %v", err)
+	}
+	cfg.Modbus.Commands = true
+	if err := ApplyConfig("", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteMultipleCoils(0, []bool{true, true}); err != modbus.IllegalDataValue {
+		t.Errorf("two commands: %v", err)
+	}
+	if _, err := c.ReadCoils(0, 3); err != modbus.IllegalDataAddress {
+		t.Errorf("reading coil 2: %v", err)
+	}
+	if _, err := c.ReadHoldingRegisters(29, 2); err != modbus.IllegalDataAddress {
+		t.Errorf("reading offset of channel 15: %v", err)
+	}
+	// 其他接口发起的校准
+	end, err := beginOp("calibration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteSingleCoil(modbusCoilClear, true); err != modbus.ServerDeviceBusy {
+		t.Errorf("clear during http calibration: %v", err)
+	}
+	end()
+
+	if err := c.WriteSingleCoil(modbusCoilChannels+8, true); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := waitCommand(t, c, 1); cmd[0] != modbusCmdSucceeded || cmd[2] != modbusCoilChannels+8 {
+		t.Errorf("command registers %v", cmd)
+	}
+	regs, err := OffsetRegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := c.ReadHoldingRegisters(0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := c.ReadHoldingRegisters(modbusStoredBase+16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off := int32Of(applied[16:]); off == 0 || off != regs["cf_axi_adc_1"][1] || int32Of(stored) != off {
+		t.Errorf("offset of channel 8 %d, stored %d, registers %v", off, int32Of(stored), regs)
+	}
+	history, _ := CalibrationHistory()
+	if len(history) != 1 || history[0].Origin != OriginModbus || len(history[0].Channels) != 1 || history[0].Channels[0] != 8 {
+		t.Errorf("history %+v", history)
+	}
+
+	if err := c.WriteMultipleCoils(0, []bool{false, true}); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := waitCommand(t, c, 2); cmd[0] != modbusCmdSucceeded || cmd[2] != modbusCoilClear {
+		t.Errorf("command registers %v", cmd)
+	}
+	if applied, err := c.ReadHoldingRegisters(16, 2); err != nil || int32Of(applied) != 0 {
+		t.Errorf("offset of channel 8 after clearing %v, %v", applied, err)
+	}
+
+	entries, err := QueryAudit(AuditQuery{Actions: []string{"calibration", "clear_regs"}})
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("audit %+v, %v", entries, err)
+	}
+	if e := entries[0]; e.Endpoint != "coil/1" || e.Outcome == "success" {
+		t.Errorf("refused clear audit %+v", e)
+	}
+	if e := entries[1]; e.User != "modbus" || e.Endpoint != "coil/108" || e.Outcome != "success" || e.Params["job_id"] != history[0].JobID || e.Before == nil {
+		t.Errorf("calibration audit %+v", e)
+	}
+	if e := entries[2]; e.Endpoint != "coil/1" || e.After.(map[string]interface{})["cf_axi_adc_1"] == nil {
+		t.Errorf("clear audit %+v", e)
+	}
+}
@@ -0,0 +1,349 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/plpsy/iiocalibration/mqtt"
+	"github.com/sirupsen/logrus"
+)
+
+// MQTTConfig is the connection to the plant MQTT broker. Under the topic
+// prefix the server publishes
+//
+//	status                 retained Status with "online", false in the last will
+//	offsets                retained offset registers
+//	calibration            retained CalibrationRecord of the last calibration
+//	drift/<device>/<chan>  retained last drift point
+//	events/<event>         the webhook events
+//
+// and with Commands set it calibrates on the requests of <prefix>/command,
+// answered on <prefix>/command/response.
+type MQTTConfig struct {
+	// tcp://host:port or tls://host:port, empty disables MQTT
+	Broker string `json:"broker,omitempty"`
+	// default iiocalibration-<hostname>
+	ClientID string `json:"clientId,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// CA certificates of a tls:// broker, the system roots if empty
+	CACert string `json:"caCert,omitempty"`
+	// default iiocalibration/<hostname>
+	TopicPrefix string `json:"topicPrefix,omitempty"`
+	// QoS of the published messages and of the command subscription, 0 or 1
+	QoS       byte     `json:"qos"`
+	KeepAlive Duration `json:"keepAlive"`
+	// status and offsets are published again at this interval
+	StatusInterval Duration `json:"statusInterval"`
+	Commands       bool     `json:"commands"`
+}
+
+func (c *MQTTConfig) validate() error {
+	if c.Broker == "" {
+		return nil
+	}
+	if !strings.HasPrefix(c.Broker, "tcp://") && !strings.HasPrefix(c.Broker, "tls://") {
+		return fmt.Errorf("mqtt.broker %q is not a tcp:// or tls:// URL", c.Broker)
+	}
+	if strings.ContainsAny(c.TopicPrefix, "+#") || strings.HasSuffix(c.TopicPrefix, "/") {
+		return fmt.Errorf("mqtt.topicPrefix %q must not contain wildcards or end with /", c.TopicPrefix)
+	}
+	if c.QoS > 1 {
+		return fmt.Errorf("mqtt.qos must be 0 or 1")
+	}
+	if c.KeepAlive.Duration < time.Second || c.KeepAlive.Duration > time.Hour {
+		return fmt.Errorf("mqtt.keepAlive must be 1s-1h")
+	}
+	if c.StatusInterval.Duration < time.Second {
+		return fmt.Errorf("mqtt.statusInterval must be at least 1s")
+	}
+	if c.CACert != "" && !filepath.IsAbs(c.CACert) {
+		return fmt.Errorf("mqtt.caCert %q is not an absolute path", c.CACert)
+	}
+	return nil
+}
+
+func mqttConfig() MQTTConfig {
+	return CurrentConfig().MQTT
+}
+
+// MQTT 连接, 配置重新加载时重建
+var mqttConn = struct {
+	sync.Mutex
+	client  *mqtt.Client
+	prefix  string
+	qos     byte
+	stop    chan struct{}
+	done    chan struct{}
+	started bool
+}{}
+
+type mqttStatus struct {
+	Online bool `json:"online"`
+	*Status
+}
+
+func mqttTLSConfig(cfg MQTTConfig) (*tls.Config, error) {
+	host := strings.TrimPrefix(cfg.Broker, "tls://")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if cfg.CACert == "" {
+		return tlsConfig, nil
+	}
+	pem, err := ioutil.ReadFile(cfg.CACert)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = x509.NewCertPool()
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %s", cfg.CACert)
+	}
+	return tlsConfig, nil
+}
+
+// StartMQTT connects to the broker of the mqtt settings and publishes until
+// StopMQTT, it restarts a running connection.
+func StartMQTT() {
+	StopMQTT()
+	mqttConn.Lock()
+	defer mqttConn.Unlock()
+	mqttConn.started = true
+	cfg := mqttConfig()
+	if cfg.Broker == "" {
+		return
+	}
+	log := moduleLog("mqtt").WithField("broker", cfg.Broker)
+	host, _ := os.Hostname()
+	if cfg.ClientID == "" {
+		cfg.ClientID = "iiocalibration-" + host
+	}
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = "iiocalibration/" + host
+	}
+	var tlsConfig *tls.Config
+	if strings.HasPrefix(cfg.Broker, "tls://") {
+		var err error
+		if tlsConfig, err = mqttTLSConfig(cfg); err != nil {
+			log.WithError(err).Error("mqtt TLS config error, not connecting")
+			return
+		}
+	}
+	offline, _ := json.Marshal(mqttStatus{Online: false})
+	connected := make(chan struct{}, 1)
+	mqttConn.prefix = cfg.TopicPrefix
+	mqttConn.qos = cfg.QoS
+	mqttConn.client = mqtt.NewClient(mqtt.Options{
+		Broker:    cfg.Broker,
+		TLSConfig: tlsConfig,
+		ClientID:  cfg.ClientID,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
+		// 掉线时由 broker 发布离线状态
+		Will:      &mqtt.Message{Topic: cfg.TopicPrefix + "/status", Payload: offline, QoS: cfg.QoS, Retain: true},
+		KeepAlive: cfg.KeepAlive.Duration,
+		OnConnect: func() {
+			log.Info("mqtt connected")
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		},
+		OnConnectionLost: func(err error) {
+			log.WithError(err).Warn("mqtt connection lost")
+		},
+	})
+	if cfg.Commands {
+		topic := cfg.TopicPrefix + "/command"
+		mqttConn.client.Subscribe(topic, cfg.QoS, func(m mqtt.Message) { mqttCommand(log, m) })
+	}
+	mqttConn.stop = make(chan struct{})
+	mqttConn.done = make(chan struct{})
+	go runMQTT(log, cfg.StatusInterval.Duration, connected, mqttConn.stop, mqttConn.done)
+	log.WithField("prefix", cfg.TopicPrefix).Info("mqtt started")
+}
+
+// StopMQTT publishes the offline status and disconnects.
+func StopMQTT() {
+	mqttConn.Lock()
+	client, stop, done := mqttConn.client, mqttConn.stop, mqttConn.done
+	mqttConn.client, mqttConn.stop, mqttConn.done = nil, nil, nil
+	prefix, qos := mqttConn.prefix, mqttConn.qos
+	mqttConn.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	// 正常断开时 broker 不发遗嘱, 自己发布离线状态
+	offline, _ := json.Marshal(mqttStatus{Online: false})
+	client.Publish(mqtt.Message{Topic: prefix + "/status", Payload: offline, QoS: qos, Retain: true})
+	client.Close()
+}
+
+func mqttStarted() bool {
+	mqttConn.Lock()
+	defer mqttConn.Unlock()
+	return mqttConn.started
+}
+
+func runMQTT(log *logrus.Entry, interval time.Duration, connected, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-connected:
+		case <-ticker.C:
+		}
+		mqttPublish("status", mqttStatus{Online: true, Status: currentStatus()}, true)
+		// 校准过程中寄存器在变化, beginOp 拒绝, 结束时随结果发布
+		end, err := beginOp("mqtt_offsets")
+		if err != nil {
+			continue
+		}
+		offsets, err := getOffsetRegs(log)
+		end()
+		if err != nil {
+			log.WithError(err).Warn("read offsets for mqtt error")
+			continue
+		}
+		mqttPublish("offsets", offsets, true)
+	}
+}
+
+// mqttPublish publishes v as JSON at <prefix>/<topic> if MQTT is enabled.
+func mqttPublish(topic string, v interface{}, retain bool) {
+	mqttConn.Lock()
+	client, prefix, qos := mqttConn.client, mqttConn.prefix, mqttConn.qos
+	mqttConn.Unlock()
+	if client == nil {
+		return
+	}
+	log := moduleLog("mqtt").WithField("topic", prefix+"/"+topic)
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.WithError(err).Error("encode mqtt message error")
+		return
+	}
+	if err := client.Publish(mqtt.Message{Topic: prefix + "/" + topic, Payload: payload, QoS: qos, Retain: retain}); err != nil {
+		log.WithError(err).Debug("mqtt publish error")
+	}
+}
+
+// mqttEvent publishes an event, with the result and the offsets of a
+// finished calibration.
+func mqttEvent(event string, data interface{}) {
+	mqttPublish("events/"+event, data, false)
+	if rec, ok := data.(CalibrationRecord); ok && event != EventCalibrationStarted {
+		mqttPublish("calibration", rec, true)
+		if rec.Offsets != nil {
+			mqttPublish("offsets", rec.Offsets, true)
+		}
+	}
+	mqttPublish("status", mqttStatus{Online: true, Status: currentStatus()}, true)
+}
+
+// mqttDriftPoint is published for every drift sample of a channel.
+type mqttDriftPoint struct {
+	DriftPoint
+	Slope float64 `json:"slope"`
+}
+
+func mqttDrift(devName string, chanId int, point DriftPoint, slope float64) {
+	mqttPublish("drift/"+devName+"/"+strconv.Itoa(chanId), mqttDriftPoint{point, slope}, true)
+}
+
+// MQTTCommand is a request on <prefix>/command.
+type MQTTCommand struct {
+	// echoed in the responses
+	ID      string `json:"id"`
+	Command string `json:"command"`
+	// global channel numbers to calibrate, all channels if empty
+	Channels []int `json:"channels,omitempty"`
+}
+
+// MQTTCommandResponse is published on <prefix>/command/response when a
+// command is accepted or rejected and when it is done.
+type MQTTCommandResponse struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
+	// accepted, rejected, busy while another calibration runs, succeeded or
+	// failed
+	Status string `json:"status"`
+	JobID  string `json:"jobId,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func mqttCommand(log *logrus.Entry, m mqtt.Message) {
+	// 保留的命令在每次重连时都会收到, 不执行
+	if m.Retain {
+		log.WithField("topic", m.Topic).Warn("retained mqtt command ignored")
+		return
+	}
+	var cmd MQTTCommand
+	resp := MQTTCommandResponse{Status: "rejected"}
+	if err := json.Unmarshal(m.Payload, &cmd); err != nil {
+		resp.Error = "invalid command: " + err.Error()
+		mqttPublish("command/response", resp, false)
+		return
+	}
+	resp.ID, resp.Command = cmd.ID, cmd.Command
+	e := &AuditEntry{User: "mqtt", Role: RoleOperator, Remote: mqttConfig().Broker, Endpoint: m.Topic,
+		Action: "calibration", Params: map[string]string{"id": cmd.ID, "channels": fmt.Sprint(cmd.Channels)}}
+	end, err := acceptMQTTCommand(cmd)
+	if err != nil {
+		if errors.Is(err, errBusy) {
+			resp.Status = "busy"
+		}
+		resp.Error = err.Error()
+		e.Error = resp.Error
+		Audit(e)
+		log.WithError(err).WithField("id", cmd.ID).Warn("mqtt command rejected")
+		mqttPublish("command/response", resp, false)
+		return
+	}
+	resp.Status, resp.JobID = "accepted", newID()
+	mqttPublish("command/response", resp, false)
+	// 校准要几分钟, 不能阻塞消息分发
+	go func() {
+		defer end()
+		jobLog := moduleLog("calibration").WithFields(logrus.Fields{"job_id": resp.JobID, "mqtt_id": cmd.ID})
+		err := runCalibration(jobLog, resp.JobID, OriginMQTT, "", "", cmd.Channels)
+		resp.Status = "succeeded"
+		if err != nil {
+			resp.Status, resp.Error = "failed", err.Error()
+			e.Error = resp.Error
+		}
+		e.Params["job_id"] = resp.JobID
+		Audit(e)
+		mqttPublish("command/response", resp, false)
+	}()
+}
+
+// acceptMQTTCommand checks a command and registers its calibration.
+func acceptMQTTCommand(cmd MQTTCommand) (end func(), err error) {
+	if cmd.Command != "calibrate" {
+		return nil, fmt.Errorf("unknown command %q", cmd.Command)
+	}
+	for _, ch := range cmd.Channels {
+		if _, _, err := globalChannel(ch); err != nil {
+			return nil, err
+		}
+	}
+	return beginOp("calibration")
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/plpsy/iiocalibration/mqtt"
+	"github.com/plpsy/iiocalibration/mqtt/mqtttest"
+)
+
+// waitRetained waits until topic has a retained message accepted by ok.
+func waitRetained(t *testing.T, broker *mqtttest.Server, topic string, v interface{}, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if m, found := broker.Retained(topic); found && json.Unmarshal(m.Payload, v) == nil && ok() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no expected retained message on %s", topic)
+}
+
+// waitResponses waits for n command responses.
+func waitResponses(t *testing.T, broker *mqtttest.Server, n int) []MQTTCommandResponse {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var responses []MQTTCommandResponse
+		for _, m := range broker.Published() {
+			if m.Topic == "plant/board1/command/response" {
+				var resp MQTTCommandResponse
+				json.Unmarshal(m.Payload, &resp)
+				responses = append(responses, resp)
+			}
+		}
+		if len(responses) >= n {
+			return responses
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d command responses, expected %d", len(responses), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	broker := mqtttest.NewServer()
+	defer broker.Close()
+	b, _ := setupTestServer(t, func(cfg *Config) {
+		cfg.MQTT.Broker = broker.URL()
+		cfg.MQTT.TopicPrefix = "plant/board1"
+		cfg.MQTT.Commands = true
+	})
+	StartMQTT()
+	defer StopMQTT()
+
+	var status struct {
+		Online     bool           `json:"online"`
+		Operations map[string]int `json:"operations"`
+	}
+	waitRetained(t, broker, "plant/board1/status", &status, func() bool { return status.Online && status.Operations != nil })
+	var offsets Params
+	waitRetained(t, broker, "plant/board1/offsets", &offsets, func() bool { return len(offsets["cf_axi_adc"]) == 7 })
+	if connects := broker.Connects(); connects[0].Will == nil || connects[0].Will.Topic != "plant/board1/status" {
+		t.Errorf("last will %+v", connects[0].Will)
+	}
+
+	b.setLevel("cf_axi_adc", 2, 1000)
+	broker.Publish(mqtt.Message{Topic: "plant/board1/command", Payload: []byte(`{"id": "c1", "command": "calibrate", "channels": [2]}`), QoS: 1})
+	responses := waitResponses(t, broker, 2)
+	if r := responses[0]; r.ID != "c1" || r.Status != "accepted" || r.JobID == "" {
+		t.Errorf("first response %+v", r)
+	}
+	if r := responses[1]; r.ID != "c1" || r.Status != "succeeded" || r.JobID != responses[0].JobID {
+		t.Errorf("second response %+v", r)
+	}
+	var rec CalibrationRecord
+	waitRetained(t, broker, "plant/board1/calibration", &rec, func() bool { return rec.JobID == responses[0].JobID })
+	if rec.Origin != OriginMQTT || rec.Offsets["cf_axi_adc"][2] == 0 {
+		t.Errorf("calibration record %+v", rec)
+	}
+	waitRetained(t, broker, "plant/board1/offsets", &offsets, func() bool { return offsets["cf_axi_adc"][2] == rec.Offsets["cf_axi_adc"][2] })
+	found := false
+	for _, m := range broker.Published() {
+		found = found || m.Topic == "plant/board1/events/"+EventCalibrationSucceeded
+	}
+	if !found {
+		t.Error("calibration.succeeded event not published")
+	}
+
+	broker.Publish(mqtt.Message{Topic: "plant/board1/command", Payload: []byte(`{"id": "c2", "command": "calibrate", "channels": [99]}`)})
+	broker.Publish(mqtt.Message{Topic: "plant/board1/command", Payload: []byte(`{"id": "c3", "command": "reboot"}`)})
+	responses = waitResponses(t, broker, 4)
+	if r := responses[2]; r.ID != "c2" || r.Status != "rejected" || r.Error == "" {
+		t.Errorf("out of range channel response %+v", r)
+	}
+	if r := responses[3]; r.ID != "c3" || r.Status != "rejected" {
+		t.Errorf("unknown command response %+v", r)
+	}
+
+	os.MkdirAll(driftDir, 0755)
+	point := DriftPoint{Time: time.Now(), Residual: 12, Offset: -40}
+	if err := recordDrift(testLog, driftConfig(), "cf_axi_adc", 1, point); err != nil {
+		t.Fatal(err)
+	}
+	var drift mqttDriftPoint
+	waitRetained(t, broker, "plant/board1/drift/cf_axi_adc/1", &drift, func() bool { return drift.Residual == 12 && drift.Offset == -40 })
+
+	StopMQTT()
+	waitRetained(t, broker, "plant/board1/status", &status, func() bool { return !status.Online })
+}
+
+func TestMQTTConfigValidate(t *testing.T) {
+	for _, c := range []MQTTConfig{
+		{Broker: "http://broker:1883", QoS: 1, KeepAlive: Duration{time.Minute}, StatusInterval: Duration{time.Minute}},
+		{Broker: "tcp://broker:1883", QoS: 2, KeepAlive: Duration{time.Minute}, StatusInterval: Duration{time.Minute}},
+		{Broker: "tcp://broker:1883", TopicPrefix: "plant/#", KeepAlive: Duration{time.Minute}, StatusInterval: Duration{time.Minute}},
+		{Broker: "tcp://broker:1883", KeepAlive: Duration{0}, StatusInterval: Duration{time.Minute}},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+	c := DefaultConfig().MQTT
+	if err := c.validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+	c.Broker = "tls://broker"
+	if err := c.validate(); err != nil {
+		t.Errorf("tls broker: %v", err)
+	}
+}
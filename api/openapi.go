@@ -0,0 +1,14 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/plpsy/iiocalibration/openapi"
+)
+
+// OpenAPI serves the OpenAPI document of the HTTP API.
+func OpenAPI(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(openapi.JSON())
+}
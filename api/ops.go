@@ -0,0 +1,155 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 正在进行的硬件操作, 重启和退出前需要等待它们完成
+var ops = struct {
+	sync.Mutex
+	running  map[string]int
+	draining string
+	idle     *sync.Cond
+}{running: make(map[string]int)}
+
+func init() {
+	ops.idle = sync.NewCond(&ops.Mutex)
+}
+
+// errBusy refuses an operation while a conflicting one runs.
+var errBusy = errors.New("busy")
+
+// errCalibrationRunning refuses a calibration while another one runs, both
+// would clear the offset registers captured by the other.
+var errCalibrationRunning = fmt.Errorf("%w, calibration already running", errBusy)
+
+// calibrationConflicts are the operations writing or sampling the offset
+// registers, a calibration clears and rewrites them so neither may start while
+// the other runs.
+var calibrationConflicts = map[string]bool{
+	"calibration":      true,
+	"clear_regs":       true,
+	"compensation":     true,
+	"drift":            true,
+	"mqtt_offsets":     true,
+	"params_import":    true,
+	"register_write":   true,
+	"snapshot_restore": true,
+}
+
+// conflicting returns the running operation kind conflicts with, "" if none.
+func conflicting(kind string) string {
+	if kind == "calibration" {
+		for running := range ops.running {
+			if calibrationConflicts[running] {
+				return running
+			}
+		}
+	} else if calibrationConflicts[kind] && ops.running["calibration"] > 0 {
+		return "calibration"
+	}
+	return ""
+}
+
+// beginOp registers a running hardware operation of the given kind, the
+// returned function must be called when it is done. New operations are
+// refused while draining for a reboot or shutdown, a calibration and the
+// operations in calibrationConflicts also while the other runs.
+func beginOp(kind string) (end func(), err error) {
+	ops.Lock()
+	defer ops.Unlock()
+	if ops.draining != "" {
+		return nil, fmt.Errorf("%s refused, %s in progress", kind, ops.draining)
+	}
+	switch running := conflicting(kind); {
+	case running == "":
+	case kind == "calibration" && running == kind:
+		return nil, errCalibrationRunning
+	default:
+		return nil, fmt.Errorf("%s refused: %w, %s running", kind, errBusy, running)
+	}
+	ops.running[kind]++
+	return func() {
+		ops.Lock()
+		defer ops.Unlock()
+		if ops.running[kind]--; ops.running[kind] == 0 {
+			delete(ops.running, kind)
+		}
+		if len(ops.running) == 0 {
+			ops.idle.Broadcast()
+		}
+	}, nil
+}
+
+// RunningOps returns the number of running hardware operations by kind.
+func RunningOps() map[string]int {
+	ops.Lock()
+	defer ops.Unlock()
+	running := make(map[string]int, len(ops.running))
+	for kind, n := range ops.running {
+		running[kind] = n
+	}
+	return running
+}
+
+// drainOps refuses new operations and waits up to timeout for the running
+// ones to finish. It returns false on timeout, the caller must call
+// undrainOps when it does not go on with the reason of draining.
+func drainOps(reason string, timeout time.Duration) bool {
+	ops.Lock()
+	defer ops.Unlock()
+	ops.draining = reason
+	timer := time.AfterFunc(timeout, func() {
+		ops.Lock()
+		ops.idle.Broadcast()
+		ops.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	for len(ops.running) > 0 && time.Now().Before(deadline) {
+		ops.idle.Wait()
+	}
+	return len(ops.running) == 0
+}
+
+func undrainOps() {
+	ops.Lock()
+	ops.draining = ""
+	ops.Unlock()
+}
+
+// errInterrupted is returned by hardware operations that stopped early
+// because the operations are drained.
+var errInterrupted = errors.New("interrupted")
+
+// interrupted returns an error wrapping errInterrupted while the operations
+// are drained for a reboot or shutdown.
+func interrupted() error {
+	ops.Lock()
+	defer ops.Unlock()
+	if ops.draining != "" {
+		return fmt.Errorf("%w, %s in progress", errInterrupted, ops.draining)
+	}
+	return nil
+}
+
+// Shutdown refuses new hardware operations and waits up to timeout for the
+// running ones to finish or roll back. It returns false on timeout.
+func Shutdown(timeout time.Duration) bool {
+	CancelReboot()
+	disconnectLive()
+	if !drainOps("shutdown", timeout) {
+		moduleLog("reboot").WithField("running", RunningOps()).Error("shutdown: operations still running")
+		return false
+	}
+	StopScheduler()
+	StopDriftMonitor()
+	StopCompensation()
+	StopWebhooks()
+	StopMQTT()
+	StopModbus()
+	return true
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/plpsy/iiocalibration/modbus"
+)
+
+func TestSetDevOffsetRollback(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+
+	if err := setDevOffset(testLog, "cf_axi_adc", 2, -1234); err != nil {
+		t.Fatal(err)
+	}
+	// the lsb write of the next offset fails after msb and mib are written
+	lsb := chanId2OffReg[2] + 2
+	failed := false
+	b.failWrite = func(devName string, off int, val uint8) error {
+		if off == lsb && !failed {
+			failed = true
+			return errors.New("iio_reg failed")
+		}
+		return nil
+	}
+	if err := setDevOffset(testLog, "cf_axi_adc", 2, 0x123456); err == nil {
+		t.Fatal("expected error")
+	}
+	if offset, err := getDevOffset(testLog, "cf_axi_adc", 2); err != nil || offset != -1234 {
+		t.Fatalf("offset after failed write = %d, %v; expected -1234", offset, err)
+	}
+}
+
+func TestCalibrationInterrupted(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+	if err := setDevOffset(testLog, "cf_axi_adc_1", 3, 4321); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- calibrationOne(testLog, 10) }()
+	time.Sleep(200 * time.Millisecond)
+	if !Shutdown(time.Second) {
+		t.Fatal("shutdown timed out")
+	}
+	defer undrainOps()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errInterrupted) {
+			t.Fatalf("calibration error %v, expected interruption", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("calibration not interrupted")
+	}
+	if offset, _ := getDevOffset(testLog, "cf_axi_adc_1", 3); offset != 4321 {
+		t.Fatalf("offset after interrupted calibration = %d, expected 4321", offset)
+	}
+	if _, err := beginOp("calibration"); err == nil {
+		t.Fatal("operation started during shutdown")
+	}
+}
+
+func TestCalibrationExclusive(t *testing.T) {
+	setupTestServer(t, func(cfg *Config) {
+		cfg.Calibration.SettleDelay = Duration{300 * time.Millisecond}
+		cfg.Modbus.Listen = "127.0.0.1:0"
+		cfg.Modbus.Commands = true
+	})
+	if err := StartModbus(); err != nil {
+		t.Fatal(err)
+	}
+	defer StopModbus()
+	c, err := modbus.Dial(modbusConn.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	router := httprouter.New()
+	router.POST("/calibration", Calibration)
+
+	// 校准在 Modbus 命令返回前已经登记
+	if err := c.WriteSingleCoil(modbusCoilAll, true); err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := c.ReadInputRegisters(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(router, "POST", "/calibration?channel=3", "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("http calibration during modbus calibration: %d %s", rec.Code, rec.Body.String())
+	}
+	if err := Calibrate(3); !errors.Is(err, errCalibrationRunning) {
+		t.Errorf("cli calibration during modbus calibration: %v", err)
+	}
+	if err := c.WriteSingleCoil(modbusCoilChannels+3, true); err != modbus.ServerDeviceBusy {
+		t.Errorf("modbus calibration during modbus calibration: %v", err)
+	}
+	if cmd := waitCommand(t, c, cmd[1]); cmd[0] != modbusCmdSucceeded {
+		t.Errorf("command registers %v", cmd)
+	}
+	if rec := doRequest(router, "POST", "/calibration?channel=3", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("http calibration after modbus calibration: %d %s", rec.Code, rec.Body.String())
+	}
+	history, _ := CalibrationHistory()
+	if len(history) != 2 || history[0].Origin != OriginModbus || history[1].Origin != OriginAPI {
+		t.Errorf("history %+v", history)
+	}
+}
+
+func TestCalibrationConflicts(t *testing.T) {
+	setupTestServer(t, nil)
+	router := httprouter.New()
+	router.POST("/calibration", Calibration)
+	router.DELETE("/regparams", ClearRegsParams)
+
+	for _, kind := range []string{"clear_regs", "compensation", "drift", "mqtt_offsets", "params_import", "register_write", "snapshot_restore"} {
+		end, err := beginOp(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := beginOp("calibration"); !errors.Is(err, errBusy) {
+			t.Errorf("calibration during %s: %v", kind, err)
+		}
+		end()
+
+		end, err = beginOp("calibration")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := beginOp(kind); !errors.Is(err, errBusy) {
+			t.Errorf("%s during calibration: %v", kind, err)
+		}
+		end()
+	}
+
+	end, err := beginOp("clear_regs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(router, "POST", "/calibration?channel=3", "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("http calibration during clear: %d %s", rec.Code, rec.Body.String())
+	}
+	end()
+	end, err = beginOp("calibration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(router, "DELETE", "/regparams", "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("http clear during calibration: %d %s", rec.Code, rec.Body.String())
+	}
+	if err := ClearOffsets(); !errors.Is(err, errBusy) {
+		t.Errorf("cli clear during calibration: %v", err)
+	}
+	end()
+}
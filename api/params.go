@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// Params are offsets by device and channel, as stored in the calibration
+// file and returned by /params and /regparams.
+type Params map[string]map[int]int32
+
+// StoredParams reads the calibration file, it is empty if the board was
+// never calibrated.
+func StoredParams() (Params, error) {
+	params := make(Params)
+	fp, err := os.Open(cfgFilePath)
+	if os.IsNotExist(err) {
+		return params, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	if err = json.NewDecoder(fp).Decode(&params); err != nil {
+		return nil, fmt.Errorf("calibration file %s: %v", cfgFilePath, err)
+	}
+	return params, nil
+}
+
+func saveParams(params Params) error {
+	fp, err := os.Create(cfgFilePath)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err = json.NewEncoder(fp).Encode(params); err != nil {
+		return fmt.Errorf("write json config err=%v", err)
+	}
+	return nil
+}
+
+func (params Params) validate() error {
+	for devName, devParams := range params {
+		p := lookupProfile(devName)
+		if p == nil {
+			return fmt.Errorf("device %s not found", devName)
+		}
+		for chanId, offset := range devParams {
+			if chanId < 0 || chanId >= p.Channels {
+				return fmt.Errorf("device %s has no channel %d", devName, chanId)
+			}
+			if offset < -1<<23 || offset >= 1<<23 {
+				return fmt.Errorf("%s channel %d offset %d out of 24 bit range", devName, chanId, offset)
+			}
+		}
+	}
+	return nil
+}
+
+// ImportParams writes a calibration set, e.g. exported from another board,
+// to the offset registers and stores it in the calibration file. Channels
+// not in params keep their stored offsets.
+func ImportParams(params Params) error {
+	if err := params.validate(); err != nil {
+		return err
+	}
+	end, err := beginOp("params_import")
+	if err != nil {
+		return err
+	}
+	defer end()
+	return importParams(moduleLog("calibration"), params)
+}
+
+func importParams(log *logrus.Entry, params Params) error {
+	stored, err := StoredParams()
+	if err != nil {
+		// 文件损坏时用导入的参数重建
+		log.WithError(err).Warn("importParams ignore stored params")
+		stored = make(Params)
+	}
+	if err = setOffsetRegs(log, params); err != nil {
+		return err
+	}
+	if err = verifyOffsetRegs(log, params); err != nil {
+		return err
+	}
+	for devName, devParams := range params {
+		if stored[devName] == nil {
+			stored[devName] = make(map[int]int32)
+		}
+		for chanId, offset := range devParams {
+			stored[devName][chanId] = offset
+		}
+	}
+	return saveParams(stored)
+}
+
+// PutParams imports the calibration set in the body.
+func PutParams(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var body Params
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if err := body.validate(); err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	end, err := beginOp("params_import")
+	if err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, opErrorCode(err), err.Error())
+		return
+	}
+	defer end()
+	if err := importParams(requestLog(r, "calibration"), body); err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeResponse(w, body)
+}
+
+// OffsetRegs reads the offset registers of all channels.
+func OffsetRegs() (Params, error) {
+	return getOffsetRegs(moduleLog("registers"))
+}
+
+// ClearOffsets writes 0 to the offset registers of all channels.
+func ClearOffsets() error {
+	end, err := beginOp("clear_regs")
+	if err != nil {
+		return err
+	}
+	defer end()
+	return clearOffsetRegs(moduleLog("calibration"))
+}
+
+// Calibrate calibrates all channels, or with channel >= 0 the channel with
+// that number counted over all devices.
+func Calibrate(channel int) error {
+	end, err := beginOp("calibration")
+	if err != nil {
+		return err
+	}
+	defer end()
+	jobID := newID()
+	log := moduleLog("calibration").WithField("job_id", jobID)
+	if channel < 0 {
+		return runCalibration(log, jobID, OriginCLI, "", "", nil)
+	}
+	return runCalibration(log, jobID, OriginCLI, "", "", []int{channel})
+}
@@ -0,0 +1,135 @@
+package api
+
+// RegRange is an inclusive range of register addresses.
+type RegRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+func (r RegRange) contains(off int) bool {
+	return off >= r.Start && off <= r.End
+}
+
+func inRanges(ranges []RegRange, off int) bool {
+	for _, r := range ranges {
+		if r.contains(off) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterPolicy decides which registers may be accessed through the
+// register API.
+type RegisterPolicy struct {
+	// registers operators are allowed to write, other writes need RoleAdmin
+	WriteAllow []RegRange `json:"writeAllow"`
+	// registers nobody may write, not even an admin
+	WriteDeny []RegRange `json:"writeDeny"`
+	// registers nobody may read
+	ReadDeny []RegRange `json:"readDeny"`
+}
+
+func (p *RegisterPolicy) canRead(off int) bool {
+	return !inRanges(p.ReadDeny, off)
+}
+
+func (p *RegisterPolicy) canWrite(off int, role Role) bool {
+	if inRanges(p.WriteDeny, off) {
+		return false
+	}
+	return role >= RoleAdmin || inRanges(p.WriteAllow, off)
+}
+
+// DeviceProfile describes one adc device handled by the calibration.
+type DeviceProfile struct {
+	Name       string         `json:"name"`
+	Channels   int            `json:"channels"`
+	OffsetRegs []int          `json:"offsetRegs"`
+	RegCount   int            `json:"regCount"`
+	Policy     RegisterPolicy `json:"policy"`
+	RegMap     *RegisterMap   `json:"regMap,omitempty"`
+	// order in which a snapshot restore writes the registers, registers
+	// not listed are never restored
+	RestoreOrder []RestoreStep `json:"restoreOrder"`
+	// board temperature recorded with the calibrations, nil if unknown
+	Temperature *TemperatureSource `json:"temperature,omitempty"`
+
+	// register map compiled into the binary, used when none is imported
+	builtinRegMap *RegisterMap
+}
+
+// RestoreStep is a register range written by a snapshot restore. With Sync
+// set every write is followed by the sync sequence of syncDev, as done when
+// writing the offsets.
+type RestoreStep struct {
+	Range RegRange `json:"range"`
+	Sync  bool     `json:"sync"`
+}
+
+func (p *DeviceProfile) channelIds() []int {
+	ids := make([]int, p.Channels)
+	for i := range ids {
+		ids[i] = i
+	}
+	return ids
+}
+
+func (p *DeviceProfile) validReg(off int) bool {
+	return off >= 0 && off < p.RegCount
+}
+
+// 两片adc芯片相同, 寄存器空间 0x00-0x59
+var adcPolicy = RegisterPolicy{
+	// 通道offset寄存器
+	WriteAllow: []RegRange{{0x1E, 0x35}},
+	// 状态和版本寄存器只读
+	WriteDeny: []RegRange{{0x09, 0x0A}},
+}
+
+var adcRegMap = mustBuiltinRegmap("ad7768.csv")
+
+// 先恢复通道/功耗/接口配置, 再恢复gain和offset(每次写入后同步)
+var adcRestoreOrder = []RestoreStep{
+	{Range: RegRange{0x00, 0x05}},
+	{Range: RegRange{0x07, 0x07}},
+	{Range: RegRange{0x0E, 0x0F}},
+	{Range: RegRange{0x11, 0x14}},
+	{Range: RegRange{0x56, 0x59}},
+	{Range: RegRange{0x36, 0x4D}, Sync: true},
+	{Range: RegRange{0x1E, 0x35}, Sync: true},
+	{Range: RegRange{0x4E, 0x55}, Sync: true},
+}
+
+// all devices known to the calibration
+var knownProfiles = []*DeviceProfile{
+	{Name: "cf_axi_adc", Channels: 7, OffsetRegs: chanId2OffReg, RegCount: 0x5A, Policy: adcPolicy, RegMap: adcRegMap, RestoreOrder: adcRestoreOrder},
+	{Name: "cf_axi_adc_1", Channels: 8, OffsetRegs: chanId2OffReg, RegCount: 0x5A, Policy: adcPolicy, RegMap: adcRegMap, RestoreOrder: adcRestoreOrder},
+}
+
+// devices of the configuration, in the order of the global channel numbers
+var profiles = knownProfiles
+
+func init() {
+	for _, p := range knownProfiles {
+		p.builtinRegMap = p.RegMap
+	}
+}
+
+func lookupProfile(devName string) *DeviceProfile {
+	for _, p := range profiles {
+		if p.Name == devName {
+			return p
+		}
+	}
+	return nil
+}
+
+func lookupKnownProfile(devName string) *DeviceProfile {
+	for _, p := range knownProfiles {
+		if p.Name == devName {
+			return p
+		}
+	}
+	return nil
+}
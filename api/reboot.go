@@ -0,0 +1,220 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rebootTokenTTL    = time.Minute
+	rebootDefaultWait = time.Second
+	rebootDrainTime   = 2 * time.Minute
+)
+
+// PendingReboot is a scheduled reboot.
+type PendingReboot struct {
+	At          time.Time `json:"at"`
+	RequestedBy string    `json:"requestedBy"`
+	timer       *time.Timer
+}
+
+type rebootToken struct {
+	user    string
+	expires time.Time
+}
+
+var (
+	errRebootToken   = fmt.Errorf("reboot confirmation token invalid or expired")
+	errRebootPending = fmt.Errorf("reboot already scheduled")
+)
+
+var reboot = struct {
+	sync.Mutex
+	tokens  map[string]rebootToken
+	pending *PendingReboot
+}{tokens: make(map[string]rebootToken)}
+
+// rebootCmd restarts the board.
+var rebootCmd = func() error {
+	return exec.Command("reboot").Run()
+}
+
+// RebootPending returns the scheduled reboot, nil if there is none.
+func RebootPending() *PendingReboot {
+	reboot.Lock()
+	defer reboot.Unlock()
+	if reboot.pending == nil {
+		return nil
+	}
+	p := *reboot.pending
+	return &p
+}
+
+func newRebootToken(user string) (string, time.Time, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+	expires := time.Now().Add(rebootTokenTTL)
+
+	reboot.Lock()
+	defer reboot.Unlock()
+	for t, rt := range reboot.tokens {
+		if time.Now().After(rt.expires) {
+			delete(reboot.tokens, t)
+		}
+	}
+	reboot.tokens[token] = rebootToken{user: user, expires: expires}
+	return token, expires, nil
+}
+
+// scheduleReboot consumes a confirmation token and schedules the reboot.
+func scheduleReboot(token, user string, at time.Time) (*PendingReboot, error) {
+	reboot.Lock()
+	defer reboot.Unlock()
+
+	rt, ok := reboot.tokens[token]
+	if !ok || rt.user != user || time.Now().After(rt.expires) {
+		return nil, errRebootToken
+	}
+	delete(reboot.tokens, token)
+	if reboot.pending != nil {
+		return nil, errRebootPending
+	}
+	p := &PendingReboot{At: at, RequestedBy: user}
+	p.timer = time.AfterFunc(time.Until(at), func() { executeReboot(p) })
+	reboot.pending = p
+	moduleLog("reboot").WithFields(logrus.Fields{"at": at.Format(time.RFC3339), "user": user}).Info("reboot scheduled")
+	return p, nil
+}
+
+// CancelReboot cancels the scheduled reboot, it returns false if there is
+// none or it is already executing.
+func CancelReboot() bool {
+	reboot.Lock()
+	defer reboot.Unlock()
+	if reboot.pending == nil || !reboot.pending.timer.Stop() {
+		return false
+	}
+	reboot.pending = nil
+	moduleLog("reboot").Info("reboot cancelled")
+	return true
+}
+
+func executeReboot(p *PendingReboot) {
+	moduleLog("reboot").Info("reboot: waiting for running operations")
+	if !drainOps("reboot", rebootDrainTime) {
+		moduleLog("reboot").WithField("running", RunningOps()).Error("reboot aborted, operations still running")
+		undrainOps()
+		reboot.Lock()
+		reboot.pending = nil
+		reboot.Unlock()
+		return
+	}
+	// 事件在发件箱中, 重启后投递
+	emitEvent(EventReboot, p)
+	// 重启前把校准参数等写入sd卡
+	syscall.Sync()
+	moduleLog("reboot").Info("reboot now")
+	if err := rebootCmd(); err != nil {
+		moduleLog("reboot").WithError(err).Error("reboot error")
+		undrainOps()
+		reboot.Lock()
+		reboot.pending = nil
+		reboot.Unlock()
+	}
+}
+
+// RestartSystem reboots the board in two steps: a request without token
+// returns a confirmation token, repeating the request with
+// {"token": ..., "delay": "5m"} or {"token": ..., "at": "<RFC3339>"}
+// schedules the reboot. Both are refused while hardware operations run.
+func RestartSystem(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var body struct {
+		Token string `json:"token"`
+		Delay string `json:"delay"`
+		At    string `json:"at"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "request body invalid")
+			return
+		}
+	}
+	if running := RunningOps(); len(running) > 0 {
+		writeErrorResponse(w, http.StatusConflict, fmt.Sprintf("reboot refused, operations running: %v", running))
+		return
+	}
+	user := RequestIdentity(r).Name
+
+	if body.Token == "" {
+		token, expires, err := newRebootToken(user)
+		if err != nil {
+			writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":   token,
+			"expires": expires,
+			"message": "confirm the reboot with POST /reboot {\"token\": \"" + token + "\"}",
+		})
+		return
+	}
+
+	at := time.Now().Add(rebootDefaultWait)
+	switch {
+	case body.At != "":
+		t, err := time.Parse(time.RFC3339, body.At)
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "at must be RFC3339")
+			return
+		}
+		at = t
+	case body.Delay != "":
+		d, err := time.ParseDuration(body.Delay)
+		if err != nil || d < 0 {
+			writeErrorResponse(w, http.StatusBadRequest, "delay invalid")
+			return
+		}
+		at = time.Now().Add(d)
+	}
+	p, err := scheduleReboot(body.Token, user, at)
+	if err == errRebootToken {
+		writeErrorResponse(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		writeErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeResponse(w, p)
+}
+
+func CancelRestart(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if !CancelReboot() {
+		writeErrorResponse(w, http.StatusNotFound, "no cancellable reboot scheduled")
+		return
+	}
+	writeResponse(w, "reboot cancelled")
+}
+
+// RebootNow flushes the storage and reboots the board at once, for the
+// reboot subcommand run on the board itself.
+func RebootNow() error {
+	emitEvent(EventReboot, PendingReboot{At: time.Now(), RequestedBy: "local"})
+	syscall.Sync()
+	moduleLog("reboot").Info("reboot now")
+	return rebootCmd()
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func rebootRouter() *httprouter.Router {
+	router := httprouter.New()
+	router.POST("/reboot", Authorize(RoleOperator, RestartSystem))
+	router.DELETE("/reboot", Authorize(RoleOperator, CancelRestart))
+	return router
+}
+
+func requestRebootToken(t *testing.T, router http.Handler, header http.Header) string {
+	rec := doRequest(router, "POST", "/reboot", "", header)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("reboot token: %d %s", rec.Code, rec.Body.String())
+	}
+	var body struct{ Token string }
+	json.NewDecoder(rec.Body).Decode(&body)
+	return body.Token
+}
+
+func TestRebootConfirmation(t *testing.T) {
+	rebooted := make(chan struct{}, 1)
+	defer func(cmd func() error) { rebootCmd = cmd }(rebootCmd)
+	rebootCmd = func() error {
+		rebooted <- struct{}{}
+		return nil
+	}
+	defer undrainOps()
+	defer func() { reboot.pending = nil }()
+	useAuthFile(t, testAuthFile)
+	router := rebootRouter()
+	mes := http.Header{"X-Api-Key": {"operator-key"}}
+	engineer := http.Header{"X-Api-Key": {"admin-key"}}
+
+	// tokens are bound to the caller and single use
+	token := requestRebootToken(t, router, mes)
+	if rec := doRequest(router, "POST", "/reboot", `{"token": "`+token+`"}`, engineer); rec.Code != http.StatusForbidden {
+		t.Fatalf("token of another caller: %d", rec.Code)
+	}
+	if rec := doRequest(router, "POST", "/reboot", `{"token": "`+token+`", "delay": "1h"}`, mes); rec.Code != http.StatusOK {
+		t.Fatalf("scheduled reboot: %d %s", rec.Code, rec.Body.String())
+	}
+	if p := RebootPending(); p == nil || p.RequestedBy != "mes" || time.Until(p.At) < 59*time.Minute {
+		t.Fatalf("unexpected pending reboot %+v", p)
+	}
+	if rec := doRequest(router, "POST", "/reboot", `{"token": "`+token+`"}`, mes); rec.Code != http.StatusForbidden {
+		t.Fatalf("reused token: %d", rec.Code)
+	}
+	if rec := doRequest(router, "DELETE", "/reboot", "", mes); rec.Code != http.StatusOK {
+		t.Fatalf("cancel reboot: %d", rec.Code)
+	}
+	if RebootPending() != nil {
+		t.Fatal("reboot still pending after cancel")
+	}
+
+	// refused while a calibration runs
+	end, err := beginOp("calibration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(router, "POST", "/reboot", "", mes); rec.Code != http.StatusConflict {
+		t.Fatalf("reboot during calibration: %d", rec.Code)
+	}
+	end()
+
+	token = requestRebootToken(t, router, mes)
+	if rec := doRequest(router, "POST", "/reboot", `{"token": "`+token+`", "delay": "10ms"}`, mes); rec.Code != http.StatusOK {
+		t.Fatalf("reboot: %d %s", rec.Code, rec.Body.String())
+	}
+	select {
+	case <-rebooted:
+	case <-time.After(time.Second):
+		t.Fatal("reboot not executed")
+	}
+	if _, err := beginOp("register_write"); err == nil {
+		t.Fatal("operation accepted while rebooting")
+	}
+}
@@ -0,0 +1,406 @@
+package api
+
+import (
+	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var regmapDir = "/media/sd-mmcblk1p2/regmaps"
+
+//go:embed regmaps/*.csv
+var builtinRegmaps embed.FS
+
+// RegisterField is a bitfield msb..lsb of a register.
+type RegisterField struct {
+	Name   string         `json:"name"`
+	Msb    int            `json:"msb"`
+	Lsb    int            `json:"lsb"`
+	Signed bool           `json:"signed,omitempty"`
+	Enum   map[int]string `json:"enum,omitempty"`
+}
+
+// RegisterDef is a named register of Width bits. Registers wider than 8 bits
+// span consecutive addresses with the most significant byte at Address.
+type RegisterDef struct {
+	Name    string          `json:"name"`
+	Address int             `json:"address"`
+	Width   int             `json:"width"`
+	Fields  []RegisterField `json:"fields,omitempty"`
+}
+
+func (d *RegisterDef) size() int {
+	return d.Width / 8
+}
+
+// RegisterMap is the register layout of a device, sorted by address.
+type RegisterMap struct {
+	Registers []RegisterDef `json:"registers"`
+}
+
+// DecodedField is the value of one bitfield.
+type DecodedField struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+	Label string `json:"label,omitempty"`
+}
+
+// DecodedRegister is a register value split into its named fields.
+type DecodedRegister struct {
+	Name    string         `json:"name"`
+	Address int            `json:"address"`
+	Width   int            `json:"width"`
+	Value   uint32         `json:"value"`
+	Fields  []DecodedField `json:"fields,omitempty"`
+}
+
+// lookup returns the register containing address off.
+func (m *RegisterMap) lookup(off int) *RegisterDef {
+	for i := range m.Registers {
+		d := &m.Registers[i]
+		if off >= d.Address && off < d.Address+d.size() {
+			return d
+		}
+	}
+	return nil
+}
+
+func (m *RegisterMap) lookupName(name string) *RegisterDef {
+	for i := range m.Registers {
+		if strings.EqualFold(m.Registers[i].Name, name) {
+			return &m.Registers[i]
+		}
+	}
+	return nil
+}
+
+func (m *RegisterMap) validate(regCount int) error {
+	sort.Slice(m.Registers, func(i, j int) bool {
+		return m.Registers[i].Address < m.Registers[j].Address
+	})
+	end := -1
+	names := make(map[string]bool)
+	for _, d := range m.Registers {
+		if d.Name == "" {
+			return fmt.Errorf("register 0x%02x has no name", d.Address)
+		}
+		if names[strings.ToUpper(d.Name)] {
+			return fmt.Errorf("register %s defined twice", d.Name)
+		}
+		names[strings.ToUpper(d.Name)] = true
+		if d.Width <= 0 || d.Width > 32 || d.Width%8 != 0 {
+			return fmt.Errorf("register %s width %d invalid", d.Name, d.Width)
+		}
+		if d.Address <= end {
+			return fmt.Errorf("register %s overlaps previous register", d.Name)
+		}
+		end = d.Address + d.size() - 1
+		if d.Address < 0 || (regCount > 0 && end >= regCount) {
+			return fmt.Errorf("register %s out of register space", d.Name)
+		}
+		for _, f := range d.Fields {
+			if f.Lsb < 0 || f.Msb < f.Lsb || f.Msb >= d.Width {
+				return fmt.Errorf("register %s field %s bits %d:%d invalid", d.Name, f.Name, f.Msb, f.Lsb)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *RegisterDef) decode(raw uint32) DecodedRegister {
+	reg := DecodedRegister{Name: d.Name, Address: d.Address, Width: d.Width, Value: raw}
+	for _, f := range d.Fields {
+		bits := uint(f.Msb - f.Lsb + 1)
+		v := int64((raw >> uint(f.Lsb)) & (1<<bits - 1))
+		if f.Signed && v&(1<<(bits-1)) != 0 {
+			v -= 1 << bits
+		}
+		reg.Fields = append(reg.Fields, DecodedField{Name: f.Name, Value: v, Label: f.Enum[int(v)]})
+	}
+	return reg
+}
+
+// Decode splits a register dump into named registers. Registers not fully
+// contained in the dump are left out.
+func (m *RegisterMap) Decode(regs []RegisterValue) []DecodedRegister {
+	values := make(map[int]uint8, len(regs))
+	for _, r := range regs {
+		values[r.Address] = r.Value
+	}
+	decoded := make([]DecodedRegister, 0)
+	for i := range m.Registers {
+		d := &m.Registers[i]
+		var raw uint32
+		complete := true
+		for off := d.Address; off < d.Address+d.size(); off++ {
+			v, ok := values[off]
+			if !ok {
+				complete = false
+				break
+			}
+			raw = raw<<8 | uint32(v)
+		}
+		if complete {
+			decoded = append(decoded, d.decode(raw))
+		}
+	}
+	return decoded
+}
+
+func parseEnum(s string) (map[int]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	enum := make(map[int]string)
+	for _, item := range strings.Split(s, ";") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("enum value %q invalid", item)
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(kv[0]), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("enum value %q invalid", item)
+		}
+		enum[int(v)] = strings.TrimSpace(kv[1])
+	}
+	return enum, nil
+}
+
+// ParseRegisterMapCSV reads a register map with one line per field. The
+// header names the columns: address, register, width, field, msb, lsb and
+// optionally signed and enum ("0=off;1=on"). Registers without fields have
+// an empty field column.
+func ParseRegisterMapCSV(r io.Reader) (*RegisterMap, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("register map csv empty")
+	}
+	cols := make(map[string]int)
+	for i, name := range records[0] {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"address", "register", "width"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("register map csv misses column %s", name)
+		}
+	}
+	col := func(rec []string, name string) string {
+		i, ok := cols[name]
+		if !ok || i >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[i])
+	}
+
+	m := &RegisterMap{}
+	index := make(map[string]int)
+	for n, rec := range records[1:] {
+		line := n + 2
+		name := col(rec, "register")
+		i, ok := index[name]
+		if !ok {
+			addr, err := strconv.ParseInt(col(rec, "address"), 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: address invalid", line)
+			}
+			width, err := strconv.Atoi(col(rec, "width"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: width invalid", line)
+			}
+			i = len(m.Registers)
+			index[name] = i
+			m.Registers = append(m.Registers, RegisterDef{Name: name, Address: int(addr), Width: width})
+		}
+		field := col(rec, "field")
+		if field == "" {
+			continue
+		}
+		f := RegisterField{Name: field}
+		if f.Msb, err = strconv.Atoi(col(rec, "msb")); err != nil {
+			return nil, fmt.Errorf("line %d: msb invalid", line)
+		}
+		if f.Lsb, err = strconv.Atoi(col(rec, "lsb")); err != nil {
+			return nil, fmt.Errorf("line %d: lsb invalid", line)
+		}
+		switch strings.ToLower(col(rec, "signed")) {
+		case "yes", "true", "1":
+			f.Signed = true
+		}
+		if f.Enum, err = parseEnum(col(rec, "enum")); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		m.Registers[i].Fields = append(m.Registers[i].Fields, f)
+	}
+	return m, nil
+}
+
+// subset of the IP-XACT component schema describing registers
+type ipxactComponent struct {
+	Registers []struct {
+		Name          string `xml:"name"`
+		AddressOffset string `xml:"addressOffset"`
+		Size          int    `xml:"size"`
+		Fields        []struct {
+			Name             string `xml:"name"`
+			BitOffset        int    `xml:"bitOffset"`
+			BitWidth         int    `xml:"bitWidth"`
+			Signed           bool   `xml:"signed"`
+			EnumeratedValues []struct {
+				Name  string `xml:"name"`
+				Value string `xml:"value"`
+			} `xml:"enumeratedValues>enumeratedValue"`
+		} `xml:"field"`
+	} `xml:"memoryMaps>memoryMap>addressBlock>register"`
+}
+
+// ParseRegisterMapXML reads the registers of an IP-XACT like component
+// description (memoryMaps/memoryMap/addressBlock/register/field).
+func ParseRegisterMapXML(r io.Reader) (*RegisterMap, error) {
+	var comp ipxactComponent
+	if err := xml.NewDecoder(r).Decode(&comp); err != nil {
+		return nil, err
+	}
+	m := &RegisterMap{}
+	for _, reg := range comp.Registers {
+		addr, err := strconv.ParseInt(strings.TrimSpace(reg.AddressOffset), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("register %s addressOffset invalid", reg.Name)
+		}
+		d := RegisterDef{Name: reg.Name, Address: int(addr), Width: reg.Size}
+		for _, field := range reg.Fields {
+			f := RegisterField{
+				Name:   field.Name,
+				Lsb:    field.BitOffset,
+				Msb:    field.BitOffset + field.BitWidth - 1,
+				Signed: field.Signed,
+			}
+			for _, e := range field.EnumeratedValues {
+				v, err := strconv.ParseInt(strings.TrimSpace(e.Value), 0, 32)
+				if err != nil {
+					return nil, fmt.Errorf("field %s.%s enumerated value %q invalid", reg.Name, field.Name, e.Value)
+				}
+				if f.Enum == nil {
+					f.Enum = make(map[int]string)
+				}
+				f.Enum[int(v)] = e.Name
+			}
+			d.Fields = append(d.Fields, f)
+		}
+		m.Registers = append(m.Registers, d)
+	}
+	return m, nil
+}
+
+// LoadRegisterMapFile reads a register map in csv, IP-XACT xml or json
+// format, chosen by the file extension.
+func LoadRegisterMapFile(path string) (*RegisterMap, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ParseRegisterMapCSV(fp)
+	case ".xml":
+		return ParseRegisterMapXML(fp)
+	case ".json":
+		m := &RegisterMap{}
+		if err := json.NewDecoder(fp).Decode(m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("register map %s: unknown format", path)
+}
+
+func mustBuiltinRegmap(name string) *RegisterMap {
+	fp, err := builtinRegmaps.Open("regmaps/" + name)
+	if err != nil {
+		panic(err)
+	}
+	defer fp.Close()
+	m, err := ParseRegisterMapCSV(fp)
+	if err == nil {
+		err = m.validate(0)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("builtin register map %s: %v", name, err))
+	}
+	return m
+}
+
+// LoadRegisterMaps replaces the builtin register maps by the ones imported
+// into the register map directory. Devices without imported map get their
+// builtin one back.
+func LoadRegisterMaps() {
+	for _, p := range profiles {
+		path := filepath.Join(regmapDir, p.Name+".json")
+		if _, err := os.Stat(path); err != nil {
+			p.RegMap = p.builtinRegMap
+			continue
+		}
+		m, err := LoadRegisterMapFile(path)
+		if err == nil {
+			err = m.validate(p.RegCount)
+		}
+		observeConfigLoad("regmap_"+p.Name, err)
+		if err != nil {
+			moduleLog("config").WithField("file", path).WithError(err).Error("LoadRegisterMaps error")
+			continue
+		}
+		p.RegMap = m
+		moduleLog("config").WithFields(logrus.Fields{"device": p.Name, "registers": len(m.Registers)}).Info("LoadRegisterMaps loaded")
+	}
+}
+
+// ImportRegisterMap validates the register map in path and stores it as the
+// register map of devName.
+func ImportRegisterMap(devName, path string) (*RegisterMap, error) {
+	p := lookupProfile(devName)
+	if p == nil {
+		return nil, fmt.Errorf("device %s not found", devName)
+	}
+	m, err := LoadRegisterMapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.validate(p.RegCount); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(regmapDir, 0755); err != nil {
+		return nil, err
+	}
+	fp, err := os.Create(filepath.Join(regmapDir, devName+".json"))
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	if err = json.NewEncoder(fp).Encode(m); err != nil {
+		return nil, err
+	}
+	p.RegMap = m
+	return m, nil
+}
+
+// DeviceRegisterMap returns the register map of devName.
+func DeviceRegisterMap(devName string) (*RegisterMap, error) {
+	p := lookupProfile(devName)
+	if p == nil {
+		return nil, fmt.Errorf("device %s not found", devName)
+	}
+	return p.RegMap, nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRegisterMapDecode(t *testing.T) {
+	regs := []RegisterValue{
+		{Address: 0x06, Value: 0x80},
+		{Address: 0x1e, Value: 0xff},
+		{Address: 0x1f, Value: 0xff},
+		{Address: 0x20, Value: 0xfe},
+		{Address: 0x21, Value: 0x00},
+	}
+	decoded := adcRegMap.Decode(regs)
+	if len(decoded) != 2 {
+		t.Fatalf("expected DATA_CONTROL and CH0_OFFSET, got %+v", decoded)
+	}
+	sync := decoded[0]
+	if sync.Name != "DATA_CONTROL" || sync.Fields[0].Name != "SPI_SYNC" || sync.Fields[0].Value != 1 || sync.Fields[0].Label != "release" {
+		t.Fatalf("unexpected DATA_CONTROL %+v", sync)
+	}
+	off := decoded[1]
+	if off.Name != "CH0_OFFSET" || off.Value != 0xfffffe || off.Fields[0].Value != -2 {
+		t.Fatalf("unexpected CH0_OFFSET %+v", off)
+	}
+}
+
+func TestParseRegisterMapXML(t *testing.T) {
+	doc := `<?xml version="1.0"?>
+<ipxact:component xmlns:ipxact="http://www.accellera.org/XMLSchema/IPXACT/1685-2014">
+  <ipxact:memoryMaps><ipxact:memoryMap><ipxact:addressBlock>
+    <ipxact:register>
+      <ipxact:name>DATA_CONTROL</ipxact:name>
+      <ipxact:addressOffset>0x06</ipxact:addressOffset>
+      <ipxact:size>8</ipxact:size>
+      <ipxact:field>
+        <ipxact:name>SPI_SYNC</ipxact:name>
+        <ipxact:bitOffset>7</ipxact:bitOffset>
+        <ipxact:bitWidth>1</ipxact:bitWidth>
+        <ipxact:enumeratedValues>
+          <ipxact:enumeratedValue><ipxact:name>assert</ipxact:name><ipxact:value>0</ipxact:value></ipxact:enumeratedValue>
+          <ipxact:enumeratedValue><ipxact:name>release</ipxact:name><ipxact:value>1</ipxact:value></ipxact:enumeratedValue>
+        </ipxact:enumeratedValues>
+      </ipxact:field>
+    </ipxact:register>
+  </ipxact:addressBlock></ipxact:memoryMap></ipxact:memoryMaps>
+</ipxact:component>`
+	m, err := ParseRegisterMapXML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.validate(0x5A); err != nil {
+		t.Fatal(err)
+	}
+	f := m.Registers[0].Fields[0]
+	if m.Registers[0].Address != 6 || f.Msb != 7 || f.Lsb != 7 || f.Enum[1] != "release" {
+		t.Fatalf("unexpected register %+v", m.Registers[0])
+	}
+}
+
+func TestRegisterMapValidate(t *testing.T) {
+	for _, doc := range []string{
+		"address,register,width\n0x00,A,12\n",
+		"address,register,width\n0x00,A,16\n0x01,B,8\n",
+		"address,register,width,field,msb,lsb\n0x00,A,8,F,8,0\n",
+		"address,register,width\n0x5A,A,8\n",
+	} {
+		m, err := ParseRegisterMapCSV(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = m.validate(0x5A); err == nil {
+			t.Errorf("expected %q to be invalid", doc)
+		}
+	}
+}
+
+func TestReadRegisterByName(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+	b.WriteReg("cf_axi_adc_1", 0x33, 0x00)
+	b.WriteReg("cf_axi_adc_1", 0x34, 0x01)
+	b.WriteReg("cf_axi_adc_1", 0x35, 0x02)
+
+	rec := doRequest(registerRouter(), "GET", "/devices/cf_axi_adc_1/registers/CH7_OFFSET?decode=true", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("read CH7_OFFSET: %d %s", rec.Code, rec.Body.String())
+	}
+	var reg DecodedRegister
+	if err := json.NewDecoder(rec.Body).Decode(&reg); err != nil {
+		t.Fatal(err)
+	}
+	if reg.Address != 0x33 || reg.Fields[0].Value != 0x0102 {
+		t.Fatalf("unexpected CH7_OFFSET %+v", reg)
+	}
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RegisterValue is the content of one device register.
+type RegisterValue struct {
+	Address int   `json:"address"`
+	Value   uint8 `json:"value"`
+}
+
+func parseRegAddr(s string) (int, error) {
+	off, err := strconv.ParseInt(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("register address %q invalid", s)
+	}
+	return int(off), nil
+}
+
+// resolveReg returns the address of a register given by address or by its
+// name in the register map.
+func (p *DeviceProfile) resolveReg(addr string) (int, error) {
+	off, err := parseRegAddr(addr)
+	if err != nil && p.RegMap != nil {
+		if def := p.RegMap.lookupName(addr); def != nil {
+			return def.Address, nil
+		}
+	}
+	return off, err
+}
+
+// registerTarget resolves the device profile and register address of a
+// request and writes the error response if either is invalid.
+func registerTarget(w http.ResponseWriter, params httprouter.Params) (*DeviceProfile, int, bool) {
+	profile := lookupProfile(params.ByName("dev"))
+	if profile == nil {
+		writeErrorResponse(w, http.StatusNotFound, "device not found")
+		return nil, 0, false
+	}
+	off, err := profile.resolveReg(params.ByName("addr"))
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return nil, 0, false
+	}
+	if !profile.validReg(off) {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("register 0x%02x out of range", off))
+		return nil, 0, false
+	}
+	return profile, off, true
+}
+
+func ReadRegister(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	profile, off, ok := registerTarget(w, params)
+	if !ok {
+		return
+	}
+	if queryBool(r, "decode") && profile.RegMap != nil {
+		if def := profile.RegMap.lookup(off); def != nil {
+			readDecodedRegister(w, r, profile, def)
+			return
+		}
+	}
+	if !profile.Policy.canRead(off) {
+		writeErrorResponse(w, http.StatusForbidden, fmt.Sprintf("register 0x%02x not readable", off))
+		return
+	}
+	val, err := readDevReg(requestLog(r, "registers"), profile.Name, off)
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeResponse(w, RegisterValue{Address: off, Value: val})
+}
+
+// readDecodedRegister reads all bytes of a multi-byte register and writes
+// its named fields.
+func readDecodedRegister(w http.ResponseWriter, r *http.Request, profile *DeviceProfile, def *RegisterDef) {
+	var raw uint32
+	for off := def.Address; off < def.Address+def.size(); off++ {
+		if !profile.Policy.canRead(off) {
+			writeErrorResponse(w, http.StatusForbidden, fmt.Sprintf("register 0x%02x not readable", off))
+			return
+		}
+		val, err := readDevReg(requestLog(r, "registers"), profile.Name, off)
+		if err != nil {
+			writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		raw = raw<<8 | uint32(val)
+	}
+	writeResponse(w, def.decode(raw))
+}
+
+func queryBool(r *http.Request, name string) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get(name))
+	return v
+}
+
+func GetRegisterMap(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	profile := lookupProfile(params.ByName("dev"))
+	if profile == nil {
+		writeErrorResponse(w, http.StatusNotFound, "device not found")
+		return
+	}
+	if profile.RegMap == nil {
+		writeErrorResponse(w, http.StatusNotFound, "device has no register map")
+		return
+	}
+	writeResponse(w, profile.RegMap)
+}
+
+func WriteRegister(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	profile, off, ok := registerTarget(w, params)
+	if !ok {
+		return
+	}
+	var body struct {
+		Value *int `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == nil {
+		writeErrorResponse(w, http.StatusBadRequest, "request body must be {\"value\": <0-255>}")
+		return
+	}
+	if *body.Value < 0 || *body.Value > 0xFF {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("value %d out of range", *body.Value))
+		return
+	}
+	if !profile.Policy.canWrite(off, requestRole(r)) {
+		writeErrorResponse(w, http.StatusForbidden, fmt.Sprintf("register 0x%02x not writable", off))
+		return
+	}
+	end, err := beginOp("register_write")
+	if err != nil {
+		writeErrorResponse(w, opErrorCode(err), err.Error())
+		return
+	}
+	defer end()
+	val := uint8(*body.Value)
+	if err := writeDevReg(requestLog(r, "registers"), profile.Name, off, val); err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeResponse(w, RegisterValue{Address: off, Value: val})
+}
+
+// DumpRegisters reads the registers start..end (inclusive, default the whole
+// register space), skipping the ones the policy does not allow to read. With
+// decode=true the dump is returned as named registers and fields.
+func DumpRegisters(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	profile := lookupProfile(params.ByName("dev"))
+	if profile == nil {
+		writeErrorResponse(w, http.StatusNotFound, "device not found")
+		return
+	}
+	start, end := 0, profile.RegCount-1
+	vars := r.URL.Query()
+	var err error
+	if s := vars.Get("start"); s != "" {
+		if start, err = parseRegAddr(s); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if s := vars.Get("end"); s != "" {
+		if end, err = parseRegAddr(s); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if start > end || !profile.validReg(start) || !profile.validReg(end) {
+		writeErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("register range 0x%02x-0x%02x invalid", start, end))
+		return
+	}
+
+	regs := make([]RegisterValue, 0, end-start+1)
+	for off := start; off <= end; off++ {
+		if !profile.Policy.canRead(off) {
+			continue
+		}
+		val, err := readDevReg(requestLog(r, "registers"), profile.Name, off)
+		if err != nil {
+			writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		regs = append(regs, RegisterValue{Address: off, Value: val})
+	}
+	if queryBool(r, "decode") && profile.RegMap != nil {
+		writeResponse(w, profile.RegMap.Decode(regs))
+		return
+	}
+	writeResponse(w, regs)
+}
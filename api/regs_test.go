@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var testLog = moduleLog("calibration")
+
+type fakeBackend struct {
+	mu   sync.Mutex
+	regs map[string]map[int]uint8
+	// constant sample value of each channel
+	levels map[string]map[int]int32
+	// failWrite, if set, is called before each register write
+	failWrite func(devName string, off int, val uint8) error
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{regs: make(map[string]map[int]uint8), levels: make(map[string]map[int]int32)}
+}
+
+func (b *fakeBackend) setLevel(devName string, chanId int, level int32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.levels[devName] == nil {
+		b.levels[devName] = make(map[int]int32)
+	}
+	b.levels[devName][chanId] = level
+}
+
+func (b *fakeBackend) Devices() ([]string, error) {
+	return []string{"ad7768-temp", "cf_axi_adc", "cf_axi_adc_1"}, nil
+}
+
+func (b *fakeBackend) Check() error {
+	return nil
+}
+
+func (b *fakeBackend) Capture(devName string, chanIds []int, samples int) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	points := make([]byte, 0, samples*len(chanIds)*4)
+	for i := 0; i < samples; i++ {
+		for _, id := range chanIds {
+			v := uint32(b.levels[devName][id]) & 0xffffff
+			points = append(points, byte(v), byte(v>>8), byte(v>>16), 0)
+		}
+	}
+	return points, nil
+}
+
+func (b *fakeBackend) ReadReg(devName string, off int) (uint8, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.regs[devName][off], nil
+}
+
+func (b *fakeBackend) WriteReg(devName string, off int, val uint8) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failWrite != nil {
+		if err := b.failWrite(devName, off, val); err != nil {
+			return err
+		}
+	}
+	if b.regs[devName] == nil {
+		b.regs[devName] = make(map[int]uint8)
+	}
+	b.regs[devName][off] = val
+	return nil
+}
+
+// setupTestServer sets a fake backend and applies the default config with
+// the files in a temporary directory and without settle and sync delays,
+// changed by configure if not nil. Both are restored when the test ends.
+func setupTestServer(t *testing.T, configure func(cfg *Config)) (*fakeBackend, *Config) {
+	t.Helper()
+	b := newFakeBackend()
+	SetBackend(b)
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.Storage = StorageConfig{
+		CalibrationFile: filepath.Join(dir, "calibration.json"),
+		RegmapDir:       filepath.Join(dir, "regmaps"),
+		SnapshotDir:     filepath.Join(dir, "snapshots"),
+		HistoryFile:     filepath.Join(dir, "history.jsonl"),
+		DriftDir:        filepath.Join(dir, "drift"),
+		OffsetTable:     filepath.Join(dir, "offset-table.json"),
+		OutboxDir:       filepath.Join(dir, "outbox"),
+	}
+	cfg.Calibration.SettleDelay = Duration{0}
+	cfg.SyncDelay = Duration{0}
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := ApplyConfig("", cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ApplyConfig("", DefaultConfig())
+		SetBackend(iioBackend{})
+	})
+	return b, cfg
+}
+
+func registerRouter() *httprouter.Router {
+	router := httprouter.New()
+	router.GET("/devices/:dev/registers", Authorize(RoleViewer, DumpRegisters))
+	router.GET("/devices/:dev/registers/:addr", Authorize(RoleViewer, ReadRegister))
+	router.PUT("/devices/:dev/registers/:addr", Authorize(RoleOperator, WriteRegister))
+	return router
+}
+
+func doRequest(h http.Handler, method, url, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRegisterReadWrite(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+	router := registerRouter()
+
+	rec := doRequest(router, "PUT", "/devices/cf_axi_adc/registers/0x1e", `{"value": 18}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("write offset register: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(router, "GET", "/devices/cf_axi_adc/registers/30", "", nil)
+	var reg RegisterValue
+	if err := json.NewDecoder(rec.Body).Decode(&reg); err != nil {
+		t.Fatal(err)
+	}
+	if reg.Address != 0x1e || reg.Value != 18 {
+		t.Fatalf("unexpected register %+v", reg)
+	}
+
+	rec = doRequest(router, "GET", "/devices/cf_axi_adc/registers?start=0x1e&end=0x20", "", nil)
+	var regs []RegisterValue
+	if err := json.NewDecoder(rec.Body).Decode(&regs); err != nil {
+		t.Fatal(err)
+	}
+	if len(regs) != 3 || regs[0].Value != 18 {
+		t.Fatalf("unexpected dump %+v", regs)
+	}
+
+	for _, c := range []struct {
+		url, body string
+		code      int
+	}{
+		{"/devices/nodev/registers/0x1e", `{"value": 1}`, http.StatusNotFound},
+		{"/devices/cf_axi_adc/registers/0x100", `{"value": 1}`, http.StatusBadRequest},
+		{"/devices/cf_axi_adc/registers/0x1e", `{"value": 256}`, http.StatusBadRequest},
+		{"/devices/cf_axi_adc/registers/0x06", `{"value": 1}`, http.StatusForbidden},
+	} {
+		if rec := doRequest(router, "PUT", c.url, c.body, nil); rec.Code != c.code {
+			t.Errorf("PUT %s: got %d, expected %d", c.url, rec.Code, c.code)
+		}
+	}
+}
+
+func TestRegisterAdminPolicy(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+	useAuthFile(t, testAuthFile)
+	router := registerRouter()
+
+	admin := http.Header{"X-Api-Key": []string{"admin-key"}}
+	if rec := doRequest(router, "PUT", "/devices/cf_axi_adc/registers/0x06", `{"value": 128}`, admin); rec.Code != http.StatusOK {
+		t.Fatalf("admin write: %d %s", rec.Code, rec.Body.String())
+	}
+	operator := http.Header{"X-Api-Key": []string{"operator-key"}}
+	if rec := doRequest(router, "PUT", "/devices/cf_axi_adc/registers/0x06", `{"value": 0}`, operator); rec.Code != http.StatusForbidden {
+		t.Fatalf("operator write outside allowlist: %d", rec.Code)
+	}
+	if rec := doRequest(router, "PUT", "/devices/cf_axi_adc/registers/0x0a", `{"value": 0}`, admin); rec.Code != http.StatusForbidden {
+		t.Fatalf("admin write to denied register: %d", rec.Code)
+	}
+	if v, _ := b.ReadReg("cf_axi_adc", 0x06); v != 128 {
+		t.Fatalf("register 0x06 = %d, expected 128", v)
+	}
+}
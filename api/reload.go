@@ -0,0 +1,19 @@
+package api
+
+// Reload rereads the configuration that can change while the server runs:
+// the calibration settings of the config file, the auth file and the
+// imported register maps of the device profiles.
+func Reload() error {
+	log := moduleLog("config")
+	log.Info("reload configuration")
+	err := ReloadConfig()
+	if err != nil {
+		log.WithError(err).Error("Reload config file error")
+	}
+	if err1 := ReloadAuth(); err1 != nil {
+		log.WithError(err1).Error("Reload auth file error")
+		err = err1
+	}
+	LoadRegisterMaps()
+	return err
+}
@@ -0,0 +1,450 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// ScheduleConfig is a periodic recalibration, run by cron expression or
+// interval when its precondition holds.
+type ScheduleConfig struct {
+	Name string `json:"name"`
+	// minute hour day-of-month month day-of-week, e.g. "30 2 * * 1-5"
+	Cron     string   `json:"cron,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+	// global channel numbers, empty for all channels
+	Channels     []int        `json:"channels,omitempty"`
+	Precondition Precondition `json:"precondition"`
+}
+
+// Precondition must hold when a scheduled calibration is due, otherwise the
+// run is skipped.
+type Precondition struct {
+	// the calibration window is opened by PUT /schedule/window
+	Window bool           `json:"window,omitempty"`
+	GPIO   *GPIOCondition `json:"gpio,omitempty"`
+}
+
+// GPIOCondition requires a sysfs gpio, e.g. the input mux select, to have
+// a value.
+type GPIOCondition struct {
+	Number int `json:"number"`
+	Value  int `json:"value"`
+}
+
+var gpioValuePath = "/sys/class/gpio/gpio%d/value"
+
+func readGPIO(number int) (int, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf(gpioValuePath, number))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (s *ScheduleConfig) validate(channels int) error {
+	if s.Name == "" {
+		return fmt.Errorf("schedule without name")
+	}
+	if (s.Cron == "") == (s.Interval.Duration == 0) {
+		return fmt.Errorf("schedule %s: set either cron or interval", s.Name)
+	}
+	if s.Cron != "" {
+		if _, err := parseCron(s.Cron); err != nil {
+			return fmt.Errorf("schedule %s: %v", s.Name, err)
+		}
+	} else if s.Interval.Duration < time.Minute {
+		return fmt.Errorf("schedule %s: interval must be at least 1m", s.Name)
+	}
+	for _, ch := range s.Channels {
+		if ch < 0 || ch >= channels {
+			return fmt.Errorf("schedule %s: channel %d out of range 0-%d", s.Name, ch, channels-1)
+		}
+	}
+	if g := s.Precondition.GPIO; g != nil && (g.Number < 0 || (g.Value != 0 && g.Value != 1)) {
+		return fmt.Errorf("schedule %s: gpio number must not be negative and value 0 or 1", s.Name)
+	}
+	return nil
+}
+
+// cronSchedule holds the allowed values of the five cron fields.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	// day of month and day of week are or-ed if both are restricted
+	domStar, dowStar bool
+}
+
+var cronShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	if s, ok := cronShortcuts[expr]; ok {
+		expr = s
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields", expr)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]map[int]bool
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expr, err)
+		}
+		sets[i] = set
+	}
+	// 0和7都表示周日
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	c := &cronSchedule{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	if !c.reachable() {
+		return nil, fmt.Errorf("cron %q never matches", expr)
+	}
+	return c, nil
+}
+
+// monthDays is the longest length of the months, 29 for February in leap
+// years.
+var monthDays = [13]int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// reachable reports whether c matches any time, a restricted day of week
+// occurs in every month but the days of month may not exist in the months.
+func (c *cronSchedule) reachable() bool {
+	if len(c.minute) == 0 || len(c.hour) == 0 {
+		return false
+	}
+	for month := range c.month {
+		if !c.dowStar {
+			return true
+		}
+		for day := range c.dom {
+			if day <= monthDays[month] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseCronField parses a list of *, n, a-b with optional /step.
+func parseCronField(f string, lo, hi int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		from, to := lo, hi
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if !c.domStar && !c.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first matching minute after t, zero if there is none
+// within 4 years.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(4, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if c.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// ScheduleRun is the outcome of a due scheduled calibration.
+type ScheduleRun struct {
+	Time  time.Time `json:"time"`
+	JobID string    `json:"jobId,omitempty"`
+	// reason the run was skipped
+	Skipped string `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type scheduledJob struct {
+	cfg  ScheduleConfig
+	cron *cronSchedule
+	next time.Time
+	last *ScheduleRun
+}
+
+func (j *scheduledJob) after(t time.Time) time.Time {
+	if j.cron != nil {
+		return j.cron.next(t)
+	}
+	return t.Add(j.cfg.Interval.Duration)
+}
+
+// 定时校准, 校准窗口由API打开, 可以设置自动关闭时间
+var scheduler = struct {
+	sync.Mutex
+	jobs        []*scheduledJob
+	started     bool
+	stop        chan struct{}
+	window      bool
+	windowUntil time.Time
+}{}
+
+func windowOpen(now time.Time) bool {
+	return scheduler.window && (scheduler.windowUntil.IsZero() || now.Before(scheduler.windowUntil))
+}
+
+// StartScheduler runs the schedules of the calibration config until
+// StopScheduler, it replaces running schedules.
+func StartScheduler() {
+	StopScheduler()
+	now := time.Now()
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	last := make(map[string]*ScheduleRun)
+	for _, j := range scheduler.jobs {
+		last[j.cfg.Name] = j.last
+	}
+	scheduler.jobs = nil
+	for _, s := range calibrationConfig().Schedule {
+		j := &scheduledJob{cfg: s, last: last[s.Name]}
+		if s.Cron != "" {
+			// 配置已经检查过
+			j.cron, _ = parseCron(s.Cron)
+		}
+		j.next = j.after(now)
+		scheduler.jobs = append(scheduler.jobs, j)
+	}
+	scheduler.started = true
+	if len(scheduler.jobs) == 0 {
+		return
+	}
+	scheduler.stop = make(chan struct{})
+	go runScheduler(scheduler.stop)
+	moduleLog("calibration").WithField("schedules", len(scheduler.jobs)).Info("scheduler started")
+}
+
+// StopScheduler stops the schedules. It does not wait for a running
+// scheduled calibration, the operations are drained before shutdown.
+func StopScheduler() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	if scheduler.stop != nil {
+		close(scheduler.stop)
+		scheduler.stop = nil
+	}
+}
+
+func schedulerStarted() bool {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	return scheduler.started
+}
+
+func schedulerRunning() bool {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	return scheduler.stop != nil
+}
+
+func runScheduler(stop chan struct{}) {
+	for {
+		scheduler.Lock()
+		var due *scheduledJob
+		for _, j := range scheduler.jobs {
+			if due == nil || j.next.Before(due.next) {
+				due = j
+			}
+		}
+		scheduler.Unlock()
+
+		timer := time.NewTimer(time.Until(due.next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		run := runScheduled(due.cfg)
+		scheduler.Lock()
+		due.last = run
+		due.next = due.after(time.Now())
+		// 校准期间调度被重新加载, 结果记到新的同名调度
+		for _, j := range scheduler.jobs {
+			if j != due && j.cfg.Name == due.cfg.Name {
+				j.last = run
+			}
+		}
+		scheduler.Unlock()
+	}
+}
+
+// runScheduled checks the precondition of a due schedule and calibrates.
+func runScheduled(s ScheduleConfig) *ScheduleRun {
+	run := &ScheduleRun{Time: time.Now()}
+	log := moduleLog("calibration").WithField("schedule", s.Name)
+	if reason := scheduleBlocked(s); reason != "" {
+		run.Skipped = reason
+		log.WithField("reason", reason).Info("scheduled calibration skipped")
+		return run
+	}
+	end, err := beginOp("calibration")
+	if err != nil {
+		run.Skipped = err.Error()
+		log.WithField("reason", run.Skipped).Info("scheduled calibration skipped")
+		return run
+	}
+	defer end()
+	run.JobID = newID()
+	log = log.WithField("job_id", run.JobID)
+	log.WithField("channels", s.Channels).Info("scheduled calibration")
+	if err := runCalibration(log, run.JobID, OriginScheduled, "", s.Name, s.Channels); err != nil {
+		run.Error = err.Error()
+		log.WithError(err).Error("scheduled calibration failed")
+	}
+	return run
+}
+
+// scheduleBlocked returns why a due schedule can not run now, "" if it can.
+func scheduleBlocked(s ScheduleConfig) string {
+	if RunningOps()["calibration"] > 0 {
+		return "calibration running"
+	}
+	if s.Precondition.Window {
+		scheduler.Lock()
+		open := windowOpen(time.Now())
+		scheduler.Unlock()
+		if !open {
+			return "calibration window closed"
+		}
+	}
+	if g := s.Precondition.GPIO; g != nil {
+		v, err := readGPIO(g.Number)
+		if err != nil {
+			return fmt.Sprintf("gpio %d: %v", g.Number, err)
+		}
+		if v != g.Value {
+			return fmt.Sprintf("gpio %d is %d, expected %d", g.Number, v, g.Value)
+		}
+	}
+	return ""
+}
+
+// CalibrationWindow is the state of the calibration window.
+type CalibrationWindow struct {
+	Open  bool       `json:"open"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// ScheduleStatus is a configured schedule and its last run.
+type ScheduleStatus struct {
+	ScheduleConfig
+	Next time.Time    `json:"next"`
+	Last *ScheduleRun `json:"last,omitempty"`
+}
+
+type scheduleResponse struct {
+	Running   bool              `json:"running"`
+	Window    CalibrationWindow `json:"window"`
+	Schedules []ScheduleStatus  `json:"schedules"`
+}
+
+func calibrationWindow() CalibrationWindow {
+	w := CalibrationWindow{Open: windowOpen(time.Now())}
+	if w.Open && !scheduler.windowUntil.IsZero() {
+		until := scheduler.windowUntil
+		w.Until = &until
+	}
+	return w
+}
+
+// GetSchedule returns the schedules, their next and last runs and the
+// calibration window.
+func GetSchedule(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	running := schedulerRunning()
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	resp := scheduleResponse{Running: running, Window: calibrationWindow(), Schedules: []ScheduleStatus{}}
+	for _, j := range scheduler.jobs {
+		resp.Schedules = append(resp.Schedules, ScheduleStatus{ScheduleConfig: j.cfg, Next: j.next, Last: j.last})
+	}
+	writeResponse(w, resp)
+}
+
+// PutCalibrationWindow opens or closes the calibration window, e.g.
+// {"open": true, "duration": "2h"}. Without duration it stays open until
+// closed.
+func PutCalibrationWindow(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var body struct {
+		Open     bool     `json:"open"`
+		Duration Duration `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if body.Duration.Duration < 0 || (!body.Open && body.Duration.Duration != 0) {
+		err := fmt.Errorf("duration must be positive and only given to open the window")
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	scheduler.Lock()
+	scheduler.window = body.Open
+	scheduler.windowUntil = time.Time{}
+	if body.Duration.Duration > 0 {
+		scheduler.windowUntil = time.Now().Add(body.Duration.Duration)
+	}
+	window := calibrationWindow()
+	scheduler.Unlock()
+	requestLog(r, "calibration").WithFields(logrus.Fields{"open": body.Open, "duration": body.Duration.String()}).Info("calibration window changed")
+	writeResponse(w, window)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestCronNext(t *testing.T) {
+	// 2026-10-16 is a Friday
+	from := time.Date(2026, 10, 16, 10, 7, 30, 0, time.Local)
+	for expr, expected := range map[string]string{
+		"*/15 * * * *":   "2026-10-16 10:15",
+		"30 2 * * *":     "2026-10-17 02:30",
+		"0 3 * * 1-5":    "2026-10-19 03:00",
+		"0 0 1 */3 *":    "2027-01-01 00:00",
+		"0 12 13 * 5":    "2026-10-16 12:00",
+		"@weekly":        "2026-10-18 00:00",
+		"5,10 10 16 * *": "2026-10-16 10:10",
+		"0 0 29 2 *":     "2028-02-29 00:00",
+		"0 0 31 2 5":     "2027-02-05 00:00",
+	} {
+		c, err := parseCron(expr)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if next := c.next(from).Format("2006-01-02 15:04"); next != expected {
+			t.Errorf("%s: next %s, expected %s", expr, next, expected)
+		}
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "5-1 * * * *", "*/0 * * * *", "0 0 31 2 *", "0 0 31 4,6,9,11 *", "x * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	for _, tc := range []struct {
+		schedule ScheduleConfig
+		expected string
+	}{
+		{ScheduleConfig{Name: "a"}, "either cron or interval"},
+		{ScheduleConfig{Name: "a", Cron: "@daily", Interval: Duration{time.Hour}}, "either cron or interval"},
+		{ScheduleConfig{Name: "a", Interval: Duration{time.Second}}, "at least 1m"},
+		{ScheduleConfig{Name: "a", Cron: "@daily", Channels: []int{15}}, "out of range 0-14"},
+		{ScheduleConfig{Name: "a", Cron: "@daily", Precondition: Precondition{GPIO: &GPIOCondition{Number: 3, Value: 2}}}, "value 0 or 1"},
+	} {
+		c := DefaultConfig()
+		c.Calibration.Schedule = []ScheduleConfig{tc.schedule}
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%+v: expected %q error, got %v", tc.schedule, tc.expected, err)
+		}
+	}
+	c := DefaultConfig()
+	c.Calibration.Schedule = []ScheduleConfig{{Name: "a", Cron: "@daily"}, {Name: "a", Interval: Duration{time.Hour}}}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "listed twice") {
+		t.Errorf("expected duplicate error, got %v", err)
+	}
+}
+
+func TestScheduledCalibration(t *testing.T) {
+	b, _ := setupTestServer(t, nil)
+	b.setLevel("cf_axi_adc", 3, 400)
+	dir := t.TempDir()
+	oldGPIO := gpioValuePath
+	gpioValuePath = filepath.Join(dir, "gpio%d")
+	defer func() { gpioValuePath = oldGPIO }()
+	ioutil.WriteFile(filepath.Join(dir, "gpio12"), []byte("0\n"), 0644)
+
+	s := ScheduleConfig{Name: "nightly", Cron: "@daily", Channels: []int{3},
+		Precondition: Precondition{Window: true, GPIO: &GPIOCondition{Number: 12, Value: 1}}}
+	if run := runScheduled(s); run.Skipped != "calibration window closed" {
+		t.Fatalf("run %+v, expected skip for closed window", run)
+	}
+
+	router := httprouter.New()
+	router.PUT("/schedule/window", PutCalibrationWindow)
+	router.GET("/history", GetHistory)
+	if rec := doRequest(router, "PUT", "/schedule/window", `{"open": true, "duration": "1h"}`, nil); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	defer func() { scheduler.window = false }()
+	if run := runScheduled(s); run.Skipped != "gpio 12 is 0, expected 1" {
+		t.Fatalf("run %+v, expected skip for gpio", run)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "gpio12"), []byte("1\n"), 0644)
+	run := runScheduled(s)
+	if run.Skipped != "" || run.Error != "" || run.JobID == "" {
+		t.Fatalf("run %+v", run)
+	}
+	if offset, _ := getDevOffset(testLog, "cf_axi_adc", 3); offset != 300 {
+		t.Fatalf("offset %d, expected 300", offset)
+	}
+
+	if err := Calibrate(3); err != nil {
+		t.Fatal(err)
+	}
+	rec := doRequest(router, "GET", "/history?origin=scheduled", "", nil)
+	var records []CalibrationRecord
+	if err := json.NewDecoder(rec.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].JobID != run.JobID || records[0].Schedule != "nightly" || records[0].Offsets["cf_axi_adc"][3] != 300 {
+		t.Fatalf("scheduled history %+v", records)
+	}
+	all, _ := CalibrationHistory()
+	if len(all) != 2 || all[1].Origin != OriginCLI {
+		t.Fatalf("history %+v", all)
+	}
+}
+
+func TestSchedulerReload(t *testing.T) {
+	_, cfg := setupTestServer(t, nil)
+	path := writeConfigFile(t, `{}`)
+	if err := ApplyConfig(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	StartScheduler()
+	defer StopScheduler()
+	if schedulerRunning() {
+		t.Fatal("scheduler running without schedules")
+	}
+
+	// 启动时没有定时校准, 重新加载后加上
+	if err := ioutil.WriteFile(path, []byte(`{"calibration": {"schedule": [{"name": "nightly", "cron": "@daily"}]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !schedulerRunning() {
+		t.Fatal("scheduler not started on reload")
+	}
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	if len(scheduler.jobs) != 1 || scheduler.jobs[0].cfg.Name != "nightly" || scheduler.jobs[0].next.IsZero() {
+		t.Errorf("jobs %+v", scheduler.jobs)
+	}
+}
@@ -1,25 +1,22 @@
 package api
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"os/exec"
 	"strconv"
-	"strings"
-	"syscall"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 )
 
-const (
+// 由配置文件设置, 见 ApplyConfig
+var (
 	cfgFilePath = "/media/sd-mmcblk1p2/calibration.json"
-	caliSamples = 1024
+	syncDelay   = 20 * time.Millisecond
 )
 
 var chanId2OffReg []int = []int{0x33, 0x30, 0x2D, 0x2A, 0x1E, 0x24, 0x21, 0x27}
@@ -40,7 +37,7 @@ func CalibrationParams(w http.ResponseWriter, r *http.Request, params httprouter
 }
 
 func GetRegsParams(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	caliParams, err := getOffsetRegs()
+	caliParams, err := getOffsetRegs(requestLog(r, "registers"))
 	if err != nil {
 		writeResponse(w, err.Error())
 		return
@@ -49,8 +46,16 @@ func GetRegsParams(w http.ResponseWriter, r *http.Request, params httprouter.Par
 }
 
 func ClearRegsParams(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	err := clearOffsetRegs()
+	end, err := beginOp("clear_regs")
 	if err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, opErrorCode(err), err.Error())
+		return
+	}
+	defer end()
+	err = clearOffsetRegs(requestLog(r, "calibration"))
+	if err != nil {
+		setAuditError(r, err)
 		writeResponse(w, err.Error())
 		return
 	}
@@ -73,12 +78,33 @@ func writeErrorResponse(w http.ResponseWriter, errorCode int, errorMsg string) {
 	json.NewEncoder(w).Encode(errorMsg)
 }
 
+// opErrorCode returns the status of an operation refused by beginOp, 409 while
+// a conflicting one runs and 503 while draining.
+func opErrorCode(err error) int {
+	if errors.Is(err, errBusy) {
+		return http.StatusConflict
+	}
+	return http.StatusServiceUnavailable
+}
+
 func Calibration(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	end, err := beginOp("calibration")
+	if err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, opErrorCode(err), err.Error())
+		return
+	}
+	defer end()
+
+	// 每次校准分配一个job id, 日志中可以找到同一次校准的所有寄存器操作
+	jobID := newID()
+	log := requestLog(r, "calibration").WithField("job_id", jobID)
 	vars := r.URL.Query()
 	channel, ok := vars["channel"]
 	if !ok {
-		err := calibrationAll()
+		err := runCalibration(log, jobID, OriginAPI, RequestIDOf(r), "", nil)
 		if err != nil {
+			setAuditError(r, err)
 			prettyJson(w, err.Error())
 		} else {
 			prettyJson(w, "Calibration done")
@@ -86,10 +112,13 @@ func Calibration(w http.ResponseWriter, r *http.Request, params httprouter.Param
 	} else {
 		chanId, err := strconv.Atoi(channel[0])
 		if err != nil {
+			setAuditError(r, err)
 			prettyJson(w, "channel invalid")
+			return
 		}
-		err = calibrationOne(chanId)
+		err = runCalibration(log, jobID, OriginAPI, RequestIDOf(r), "", []int{chanId})
 		if err != nil {
+			setAuditError(r, err)
 			prettyJson(w, err.Error())
 		} else {
 			prettyJson(w, "Calibration done")
@@ -97,52 +126,133 @@ func Calibration(w http.ResponseWriter, r *http.Request, params httprouter.Param
 	}
 }
 
-func calibrationAll() error {
+func calibrationAll(log *logrus.Entry) error {
+	// 记录校准前的偏移, 校准被中断时恢复还没有校准的设备
+	prev, err := getOffsetRegs(log)
+	if err != nil {
+		log.WithError(err).Error("calibrationAll call getOffsetRegs error")
+		return err
+	}
 	// 校准前先清零
-	err := clearOffsetRegs()
+	err = clearOffsetRegs(log)
 	if err != nil {
-		logrus.Error("calibrationAll call clearOffsetRegs error", err)
+		log.WithError(err).Error("calibrationAll call clearOffsetRegs error")
 		return err
 	}
 	// 等待新鲜的数据进来
-	logrus.Info("wait new data comming")
-	time.Sleep(5 * time.Second)
+	log.Info("wait new data comming")
+	if err = settle(calibrationConfig().SettleDelay.Duration); err != nil {
+		return restoreOffsets(log, prev, err)
+	}
 
-	err = calibration("cf_axi_adc", []int{0, 1, 2, 3, 4, 5, 6})
-	if err != nil {
-		return err
+	for _, p := range profiles {
+		err = calibration(log, p.Name, p.channelIds())
+		if errors.Is(err, errInterrupted) {
+			return restoreOffsets(log, prev, err)
+		}
+		if err != nil {
+			return err
+		}
+		delete(prev, p.Name)
 	}
-	err = calibration("cf_axi_adc_1", []int{0, 1, 2, 3, 4, 5, 6, 7})
-	return err
+	return nil
+}
+
+// restoreOffsets writes back the offsets of an interrupted calibration and
+// returns the interruption cause.
+func restoreOffsets(log *logrus.Entry, prev map[string]map[int]int32, cause error) error {
+	log.WithError(cause).Warn("calibration interrupted, restore previous offsets")
+	if err := setOffsetRegs(log, prev); err != nil {
+		return fmt.Errorf("%w, restore previous offsets failed: %v", cause, err)
+	}
+	return cause
+}
+
+// settle waits d for fresh samples after the offsets changed, it returns
+// early when the operations are drained.
+func settle(d time.Duration) error {
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		if err := interrupted(); err != nil {
+			return err
+		}
+		step := time.Until(deadline)
+		if step > 100*time.Millisecond {
+			step = 100 * time.Millisecond
+		}
+		time.Sleep(step)
+	}
+	return interrupted()
 }
 
 func LoadAndSetOffset() {
+	log := moduleLog("calibration").WithField("file", cfgFilePath)
 	var caliparams map[string]map[int]int32
+	defer func() {
+		result := map[string]interface{}{"file": cfgFilePath, "offsets": caliparams}
+		if err := checkOffsets(); err != nil {
+			result["error"] = err.Error()
+		}
+		emitEvent(EventStartupReconciled, result)
+	}()
 	fp, err := os.Open(cfgFilePath)
 	if err != nil {
-		logrus.Error("loadAndSetOffset open config error", err)
+		observeConfigLoad("calibration", err)
+		if os.IsNotExist(err) {
+			// 还没有校准过, 没有需要恢复的参数
+			recordOffsetsApplied(nil)
+		} else {
+			recordOffsetsApplied(err)
+		}
+		log.WithError(err).Error("loadAndSetOffset open config error")
 		return
 	}
 	defer fp.Close()
 	err = json.NewDecoder(fp).Decode(&caliparams)
+	observeConfigLoad("calibration", err)
 	if err != nil {
-		logrus.Error("loadAndSetOffset decode config error", err)
+		recordOffsetsApplied(err)
+		log.WithError(err).Error("loadAndSetOffset decode config error")
 		return
 	}
 
-	err = setOffsetRegs(caliparams)
+	err = setOffsetRegs(log, caliparams)
 	if err != nil {
-		logrus.Error("LoadAndSetOffset setOffsetRegs error", err)
+		recordOffsetsApplied(err)
+		log.WithError(err).Error("LoadAndSetOffset setOffsetRegs error")
+		return
+	}
+	err = verifyOffsetRegs(log, caliparams)
+	recordOffsetsApplied(err)
+	if err != nil {
+		log.WithError(err).Error("LoadAndSetOffset verifyOffsetRegs error")
+		return
+	}
+	log.Info("LoadAndSetOffset done")
+}
+
+// verifyOffsetRegs reads back the offset registers and compares them with
+// params.
+func verifyOffsetRegs(log *logrus.Entry, params map[string]map[int]int32) error {
+	for devName, devParams := range params {
+		for chanId, offset := range devParams {
+			live, err := getDevOffset(log, devName, chanId)
+			if err != nil {
+				return err
+			}
+			if live != offset {
+				return fmt.Errorf("%s channel %d offset is %d, expected %d", devName, chanId, live, offset)
+			}
+		}
 	}
-	logrus.Info("LoadAndSetOffset done")
+	return nil
 }
 
-func setOffsetRegs(params map[string]map[int]int32) error {
+func setOffsetRegs(log *logrus.Entry, params map[string]map[int]int32) error {
 	for devName, devParams := range params {
 		for chanId, offset := range devParams {
-			err := setDevOffset(devName, chanId, offset)
+			err := setDevOffset(log, devName, chanId, offset)
 			if err != nil {
-				logrus.Error("setOffsetRegs setDevOffset error", err)
+				log.WithError(err).Error("setOffsetRegs setDevOffset error")
 				return err
 			}
 		}
@@ -150,106 +260,90 @@ func setOffsetRegs(params map[string]map[int]int32) error {
 	return nil
 }
 
-func clearOffsetRegs() error {
+func clearOffsetRegs(log *logrus.Entry) error {
 	params := make(map[string]map[int]int32)
-	devName := "cf_axi_adc"
-	params[devName] = make(map[int]int32)
-	for i := 0; i < 7; i++ {
-		params[devName][i] = 0
-	}
-	devName = "cf_axi_adc_1"
-	params[devName] = make(map[int]int32)
-	for i := 0; i < 8; i++ {
-		params[devName][i] = 0
+	for _, p := range profiles {
+		params[p.Name] = make(map[int]int32)
+		for _, i := range p.channelIds() {
+			params[p.Name][i] = 0
+		}
 	}
-	return setOffsetRegs(params)
+	return setOffsetRegs(log, params)
 }
 
-func clearOffsetReg(devName string, chanId int) error {
+func clearOffsetReg(log *logrus.Entry, devName string, chanId int) error {
 	params := make(map[string]map[int]int32)
 
 	params[devName] = make(map[int]int32)
 	params[devName][chanId] = 0
 
-	return setOffsetRegs(params)
+	return setOffsetRegs(log, params)
 }
 
-func getOffsetRegs() (map[string]map[int]int32, error) {
+func getOffsetRegs(log *logrus.Entry) (map[string]map[int]int32, error) {
 	params := make(map[string]map[int]int32)
-	devName := "cf_axi_adc"
-	params[devName] = make(map[int]int32)
-	for i := 0; i < 7; i++ {
-		offset, err := getDevOffset(devName, i)
-		if err != nil {
-			logrus.Errorf("getOffsetRegs %s chanid=%d err", devName, i, err)
-			return nil, err
-		}
-		params[devName][i] = offset
-	}
-
-	devName = "cf_axi_adc_1"
-	params[devName] = make(map[int]int32)
-	for i := 0; i < 8; i++ {
-		offset, err := getDevOffset(devName, i)
-		if err != nil {
-			logrus.Errorf("getOffsetRegs %s chanid=%d err", devName, i, err)
-			return nil, err
+	for _, p := range profiles {
+		params[p.Name] = make(map[int]int32)
+		for _, i := range p.channelIds() {
+			offset, err := getDevOffset(log, p.Name, i)
+			if err != nil {
+				log.WithFields(logrus.Fields{"device": p.Name, "channel": i}).WithError(err).Error("getOffsetRegs error")
+				return nil, err
+			}
+			params[p.Name][i] = offset
 		}
-		params[devName][i] = offset
 	}
 	return params, nil
 }
 
-func calibration(devName string, chanIds []int) error {
-	var args []string
-	args = append(args, "-s", fmt.Sprintf("%d", caliSamples), devName)
-	for _, id := range chanIds {
-		args = append(args, fmt.Sprintf("voltage%d", id))
-	}
-	logrus.Info(args)
-
-	cmd := exec.Command("iio_readdev", args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Pdeathsig: syscall.SIGKILL,
-	}
-
-	samplePoints := new(bytes.Buffer)
-	cmd.Stdout = samplePoints
+func calibration(log *logrus.Entry, devName string, chanIds []int) (err error) {
+	defer func() { observeCalibration(devName, err) }()
+	log = log.WithField("device", devName)
 
-	if err := cmd.Start(); err != nil {
-		err1 := fmt.Errorf("calibrationAll cmd.Start() failed: %s", err.Error())
-		logrus.Errorf(err1.Error())
-		return err1
+	if err = interrupted(); err != nil {
+		return err
 	}
-	logrus.Info("iio_readdev started")
-	if err := cmd.Wait(); err != nil {
-		err1 := fmt.Errorf("calibration cmd.Wait() failed: %s", err.Error())
-		logrus.Errorf(err1.Error())
-		return err1
+	cfg := calibrationConfig()
+	temp, hasTemp := deviceTemperature(log, devName)
+	log.WithFields(logrus.Fields{"channels": chanIds, "samples": cfg.Samples}).Info("capture samples")
+	progressStep(log, "capture", devName)
+	samplePoints, err := captureSamples(devName, chanIds, cfg.Samples)
+	if err != nil {
+		return err
 	}
-	logrus.Info("iio_readdev wait done")
 
-	averages := calcAverage(samplePoints.Bytes(), len(chanIds))
+	averages := calcAverage(log, samplePoints, len(chanIds), cfg.Samples, float32(cfg.Factor))
 	if len(averages) != len(chanIds) {
 		err1 := fmt.Errorf("calibration calcAverage, len(averages)[%+v] != len(chanIds)[%+v]", averages, chanIds)
-		logrus.Errorf(err1.Error())
+		log.Error(err1)
 		return err1
 	}
 
 	for i, id := range chanIds {
-		err := setDevOffset(devName, id, averages[i])
+		err := setDevOffset(log, devName, id, averages[i])
 		if err != nil {
 			err1 := fmt.Errorf("calibration setDevOffset(%s) chanid(%d) failed: %s", devName, id, err.Error())
-			logrus.Errorf(err1.Error())
+			log.WithField("channel", id).Error(err1)
 			return err1
 		}
 		err = saveAverage(devName, id, averages[i])
 		if err != nil {
 			err1 := fmt.Errorf("calibration saveAverage(%s) chanid(%d) failed: %s", devName, id, err.Error())
-			logrus.Errorf(err1.Error())
+			log.WithField("channel", id).Error(err1)
 			return err1
 		}
 	}
+	progressApplied(log, devName, chanIds)
+	if hasTemp {
+		offsets := make(map[int]int32, len(chanIds))
+		for i, id := range chanIds {
+			offsets[id] = averages[i]
+		}
+		log.WithField("temperature", temp).Info("record offsets in the offset table")
+		if err := recordTableOffsets(devName, offsets, temp); err != nil {
+			log.WithError(err).Error("calibration recordTableOffsets error")
+		}
+	}
 	return nil
 }
 
@@ -292,215 +386,226 @@ func saveAverage(devName string, chanId int, offset int32) error {
 	return nil
 }
 
-func calcAverage(points []byte, chanNum int) []int32 {
-	samples := make([]int32, caliSamples)
+func calcAverage(log *logrus.Entry, points []byte, chanNum int, caliSamples int, factor float32) []int32 {
+	values, err := decodeSamples(points, chanNum, caliSamples)
+	if err != nil {
+		log.WithError(err).Error("calcAverage error")
+		return nil
+	}
 	averages := make([]int32, chanNum)
 
-	for idx := 0; idx < chanNum; idx++ {
-		for i := 0; i < caliSamples; i++ {
-			// 找到采样点偏移
-			off := i*chanNum*4 + idx*4
-			bytebuff := bytes.NewBuffer(points[off : off+4])
-			binary.Read(bytebuff, binary.LittleEndian, &samples[i])
-			// 24位补码表示的有符号采样值,转换为32位有符号整数
-			samples[i] <<= 8
-			samples[i] >>= 8
-		}
-		logrus.Info(samples[0:64])
-		var sum int64 = 0
-		for i := 0; i < caliSamples; i++ {
-			sum += (int64)(samples[i])
-		}
-		averages[idx] = (int32)(sum / (int64)(caliSamples))
-		averages[idx] = (int32)((float32)(averages[idx]) * 0.75)
-		//		averages[idx] = 0 - averages[idx]
+	for idx, samples := range values {
+		log.WithField("channel_index", idx).Debug("samples ", samples[0:min(64, len(samples))])
+		averages[idx] = channelOffset(samples, factor)
 	}
 
 	return averages
 }
 
-func getDevOffset(devName string, chanId int) (offset int32, err error) {
+// channelOffset is the offset written for the samples of a channel, the
+// truncated average scaled by factor.
+func channelOffset(samples []int32, factor float32) int32 {
+	var sum int64 = 0
+	for _, v := range samples {
+		sum += (int64)(v)
+	}
+	average := (int32)(sum / (int64)(len(samples)))
+	return (int32)((float32)(average) * factor)
+}
+
+func getDevOffset(log *logrus.Entry, devName string, chanId int) (offset int32, err error) {
 	var msb, mib, lsb uint8
 
 	chanId &= 0x7
 	off := chanId2OffReg[chanId]
 
-	msb, err = readDevReg(devName, off)
+	msb, err = readDevReg(log, devName, off)
 	if err != nil {
 		return
 	}
 	off += 1
-	mib, err = readDevReg(devName, off)
+	mib, err = readDevReg(log, devName, off)
 	if err != nil {
 		return
 	}
 	off += 1
-	lsb, err = readDevReg(devName, off)
+	lsb, err = readDevReg(log, devName, off)
 	if err != nil {
 		return
 	}
 	offset = ((int32)(msb) << 16) | ((int32)(mib) << 8) | (int32)(lsb)
 	offset <<= 8
 	offset >>= 8
+	observeOffset(devName, chanId, offset)
 
 	return
 }
 
-func readDevReg(devName string, off int) (val uint8, err error) {
-	var args []string
-
-	args = append(args, devName, fmt.Sprintf("0x%02x", off))
-	logrus.Info("readDevReg args:", args)
-
-	cmd := exec.Command("iio_reg", args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Pdeathsig: syscall.SIGKILL,
-	}
-	valBuff := new(bytes.Buffer)
-	cmd.Stdout = valBuff
-
-	if err = cmd.Start(); err != nil {
-		err = fmt.Errorf("readDevReg cmd.Start() failed: %s", err.Error())
-		logrus.Errorf(err.Error())
-		return
-	}
+// regLog returns log with the fields of a register access.
+func regLog(log *logrus.Entry, devName string, off int) *logrus.Entry {
+	return log.WithFields(logrus.Fields{"device": devName, "register": fmt.Sprintf("0x%02x", off)})
+}
 
-	if err = cmd.Wait(); err != nil {
-		err = fmt.Errorf("writeDevReg cmd.Wait() failed: %s", err.Error())
-		logrus.Errorf(err.Error())
-		return
-	}
-	varStr := strings.Replace(string(valBuff.Bytes()), "\n", "", -1)
-	val64, err := strconv.ParseInt(varStr, 0, 64)
+func readDevReg(log *logrus.Entry, devName string, off int) (val uint8, err error) {
+	start := time.Now()
+	val, err = backend.ReadReg(devName, off)
+	observeBackend("read_reg", start, err)
 	if err != nil {
-		err = fmt.Errorf("readDevReg strconv.ParseInt failed: %s", err.Error())
-		logrus.Errorf(err.Error())
+		regLog(log, devName, off).WithError(err).Error("readDevReg error")
 		return
 	}
-	val = (uint8)(val64)
+	regLog(log, devName, off).WithField("value", val).Debug("readDevReg")
 	return
 }
 
-func syncDev(devName string) error {
-	time.Sleep(20 * time.Millisecond)
-	if err := writeDevReg(devName, 0x06, 0); err != nil {
-		logrus.Error("syncDev write 0 error:", err)
+func syncDev(log *logrus.Entry, devName string) error {
+	time.Sleep(syncDelay)
+	if err := writeDevReg(log, devName, 0x06, 0); err != nil {
+		log.WithField("device", devName).WithError(err).Error("syncDev write 0 error")
 		return err
 	}
-	time.Sleep(20 * time.Millisecond)
-	if err := writeDevReg(devName, 0x06, 0x80); err != nil {
-		logrus.Error("syncDev write 1 error:", err)
+	time.Sleep(syncDelay)
+	if err := writeDevReg(log, devName, 0x06, 0x80); err != nil {
+		log.WithField("device", devName).WithError(err).Error("syncDev write 1 error")
 		return err
 	}
-	time.Sleep(20 * time.Millisecond)
+	time.Sleep(syncDelay)
 	return nil
 }
 
-func writeDevReg(devName string, off int, val uint8) error {
-	var args []string
-
-	args = append(args, devName, fmt.Sprintf("0x%02x", off), fmt.Sprintf("%d", val))
-	logrus.Info("writeDevReg args:", args)
-
-	cmd := exec.Command("iio_reg", args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Pdeathsig: syscall.SIGKILL,
-	}
-
-	if err := cmd.Start(); err != nil {
-		err1 := fmt.Errorf("writeDevReg cmd.Start() failed: %s", err.Error())
-		logrus.Errorf(err1.Error())
-		return err1
-	}
-
-	if err := cmd.Wait(); err != nil {
-		err1 := fmt.Errorf("writeDevReg cmd.Wait() failed: %s", err.Error())
-		logrus.Errorf(err1.Error())
-		return err1
+func writeDevReg(log *logrus.Entry, devName string, off int, val uint8) error {
+	start := time.Now()
+	err := backend.WriteReg(devName, off, val)
+	observeBackend("write_reg", start, err)
+	if err != nil {
+		regLog(log, devName, off).WithField("value", val).WithError(err).Error("writeDevReg error")
+		return err
 	}
-	logrus.Info("writeDevReg wait done")
+	regLog(log, devName, off).WithField("value", val).Info("writeDevReg")
 	return nil
 }
 
-func setDevOffset(devName string, chanId int, offset int32) error {
-	var msb, mib, lsb uint8
-
-	msb = (uint8)(offset >> 16)
+// offsetBytes returns the msb, mib and lsb register values of an offset.
+func offsetBytes(offset int32) [3]uint8 {
+	msb := (uint8)(offset >> 16)
 	if offset < 0 {
 		msb |= 0x80
 	}
-	mib = (uint8)(offset >> 8)
-	lsb = (uint8)(offset)
+	return [3]uint8{msb, (uint8)(offset >> 8), (uint8)(offset)}
+}
+
+// setDevOffset writes the offset of a channel msb first, with a sync after
+// each byte. A failed sequence writes back the previous offset so that the
+// channel is never left with a torn value.
+func setDevOffset(log *logrus.Entry, devName string, chanId int, offset int32) error {
+	b := offsetBytes(offset)
 
-	logrus.Infof("setDevOffset chanId=%d, offset=%d, msb/mib/lsb=(%02x/%02x/%02x)", chanId, offset, msb, mib, lsb)
 	chanId &= 7
-	off := chanId2OffReg[chanId]
-	err := writeDevReg(devName, off, msb)
+	log = log.WithFields(logrus.Fields{"device": devName, "channel": chanId})
+	log.WithField("value", offset).Infof("setDevOffset msb/mib/lsb=(%02x/%02x/%02x)", b[0], b[1], b[2])
+	prev, err := readOffsetBytes(log, devName, chanId)
 	if err != nil {
 		return err
 	}
-	err = syncDev(devName)
-	if err != nil {
-		return nil
-	}
-
-	off += 1
-	err = writeDevReg(devName, off, mib)
+	err = writeOffsetBytes(log, devName, chanId, b)
 	if err != nil {
+		log.WithError(err).Errorf("setDevOffset failed, restore %02x/%02x/%02x", prev[0], prev[1], prev[2])
+		if err1 := writeOffsetBytes(log, devName, chanId, prev); err1 != nil {
+			log.WithError(err1).Error("setDevOffset restore failed")
+			return fmt.Errorf("%v, restore previous offset failed: %v", err, err1)
+		}
 		return err
 	}
-	err = syncDev(devName)
-	if err != nil {
-		return nil
-	}
+	observeOffset(devName, chanId, offset)
+	return nil
+}
 
-	off += 1
-	err = writeDevReg(devName, off, lsb)
-	if err != nil {
-		return err
+func readOffsetBytes(log *logrus.Entry, devName string, chanId int) (b [3]uint8, err error) {
+	off := chanId2OffReg[chanId]
+	for i := range b {
+		b[i], err = readDevReg(log, devName, off+i)
+		if err != nil {
+			return
+		}
 	}
+	return
+}
 
-	return syncDev(devName)
+func writeOffsetBytes(log *logrus.Entry, devName string, chanId int, b [3]uint8) error {
+	off := chanId2OffReg[chanId]
+	for i := range b {
+		if err := writeDevReg(log, devName, off+i, b[i]); err != nil {
+			return err
+		}
+		if err := syncDev(log, devName); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func calibrationOne(chanId int) error {
-	if chanId < 0 || chanId > 14 {
-		return fmt.Errorf("chanid=%d error", chanId)
+func calibrationOne(log *logrus.Entry, chanId int) error {
+	devName, chanId, err := globalChannel(chanId)
+	if err != nil {
+		return err
 	}
-	var devName string
-	if chanId < 7 {
-		devName = "cf_axi_adc"
-	} else {
-		chanId -= 7
-		devName = "cf_axi_adc_1"
+	chanLog := log.WithFields(logrus.Fields{"device": devName, "channel": chanId})
+	chanLog.Info("calibrationOne")
+	prev, err := getDevOffset(log, devName, chanId)
+	if err != nil {
+		chanLog.WithError(err).Error("calibrationOne call getDevOffset error")
+		return err
 	}
-	logrus.Info("calibrationOne:", devName, chanId)
 	// 校准前先清零
-	err := clearOffsetReg(devName, chanId)
+	err = clearOffsetReg(log, devName, chanId)
 	if err != nil {
-		logrus.Error("calibrationOne call clearOffsetReg error", err)
+		chanLog.WithError(err).Error("calibrationOne call clearOffsetReg error")
 		return err
 	}
 	// 等待新鲜的数据进来
-	logrus.Info("wait new data comming...")
-	time.Sleep(5 * time.Second)
-	err = calibration(devName, []int{chanId})
+	chanLog.Info("wait new data comming...")
+	progressStep(log, "settle", devName)
+	err = settle(calibrationConfig().SettleDelay.Duration)
+	if err == nil {
+		err = calibration(log, devName, []int{chanId})
+	}
+	if errors.Is(err, errInterrupted) {
+		return restoreOffsets(log, map[string]map[int]int32{devName: {chanId: prev}}, err)
+	}
 	return err
 }
 
+// globalChannel maps a channel number counted over all devices to the
+// device and its channel.
+func globalChannel(chanId int) (string, int, error) {
+	if chanId >= 0 {
+		id := chanId
+		for _, p := range profiles {
+			if id < p.Channels {
+				return p.Name, id, nil
+			}
+			id -= p.Channels
+		}
+	}
+	return "", 0, fmt.Errorf("chanid=%d error", chanId)
+}
+
+// globalChannelOf returns the number counted over all devices of a channel
+// of devName.
+func globalChannelOf(devName string, chanId int) int {
+	first := 0
+	for _, p := range profiles {
+		if p.Name == devName {
+			break
+		}
+		first += p.Channels
+	}
+	return first + chanId
+}
+
 func prettyJson(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
 	enc.Encode(data)
 }
-
-func RestartSystem(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	cmd := exec.Command("reboot")
-
-	go func() {
-		time.Sleep(1 * time.Second)
-		cmd.Run()
-	}()
-	w.WriteHeader(http.StatusOK)
-}
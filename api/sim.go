@@ -0,0 +1,81 @@
+package api
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// SimBackend simulates the adc devices of the config in memory, to try the
+// API and the coordinator without a board. Each channel captures its own
+// constant level with a little noise, the offset registers do not change
+// the samples.
+type SimBackend struct {
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	regs   map[string]map[int]uint8
+	levels map[string]map[int]int32
+}
+
+// NewSimBackend returns a simulated board, the levels of the channels are
+// chosen by seed.
+func NewSimBackend(seed int64) *SimBackend {
+	return &SimBackend{
+		rnd:    rand.New(rand.NewSource(seed)),
+		regs:   make(map[string]map[int]uint8),
+		levels: make(map[string]map[int]int32),
+	}
+}
+
+func (b *SimBackend) Devices() ([]string, error) {
+	names := make([]string, 0, len(profiles))
+	for _, p := range profiles {
+		names = append(names, p.Name)
+	}
+	return names, nil
+}
+
+func (b *SimBackend) Check() error {
+	return nil
+}
+
+// level returns the level of a channel, b.mu must be held.
+func (b *SimBackend) level(devName string, chanId int) int32 {
+	if b.levels[devName] == nil {
+		b.levels[devName] = make(map[int]int32)
+	}
+	level, ok := b.levels[devName][chanId]
+	if !ok {
+		level = int32(b.rnd.Intn(4001) - 2000)
+		b.levels[devName][chanId] = level
+	}
+	return level
+}
+
+func (b *SimBackend) Capture(devName string, chanIds []int, samples int) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	points := make([]byte, 0, samples*len(chanIds)*4)
+	for i := 0; i < samples; i++ {
+		for _, id := range chanIds {
+			v := uint32(b.level(devName, id)+int32(b.rnd.Intn(7)-3)) & 0xffffff
+			points = append(points, byte(v), byte(v>>8), byte(v>>16), 0)
+		}
+	}
+	return points, nil
+}
+
+func (b *SimBackend) ReadReg(devName string, off int) (uint8, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.regs[devName][off], nil
+}
+
+func (b *SimBackend) WriteReg(devName string, off int, val uint8) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.regs[devName] == nil {
+		b.regs[devName] = make(map[int]uint8)
+	}
+	b.regs[devName][off] = val
+	return nil
+}
@@ -0,0 +1,340 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var snapshotDir = "/media/sd-mmcblk1p2/snapshots"
+
+var snapshotNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// Snapshot is the content of the register space of the devices at one time.
+type Snapshot struct {
+	Name    string                     `json:"name"`
+	Created time.Time                  `json:"created"`
+	Devices map[string][]RegisterValue `json:"devices"`
+}
+
+// snapshotRequestError is a snapshot error caused by the request itself.
+type snapshotRequestError string
+
+func (e snapshotRequestError) Error() string {
+	return string(e)
+}
+
+// RegisterDiff is a register whose live value differs from the snapshot.
+type RegisterDiff struct {
+	Device   string `json:"device"`
+	Address  int    `json:"address"`
+	Name     string `json:"name,omitempty"`
+	Snapshot uint8  `json:"snapshot"`
+	Live     uint8  `json:"live"`
+}
+
+func snapshotPath(name string) (string, error) {
+	if !snapshotNameRe.MatchString(name) {
+		return "", snapshotRequestError(fmt.Sprintf("snapshot name %q invalid", name))
+	}
+	return filepath.Join(snapshotDir, name+".json"), nil
+}
+
+func readRegisterSpace(p *DeviceProfile) ([]RegisterValue, error) {
+	regs := make([]RegisterValue, 0, p.RegCount)
+	for off := 0; off < p.RegCount; off++ {
+		if !p.Policy.canRead(off) {
+			continue
+		}
+		val, err := readDevReg(moduleLog("snapshot"), p.Name, off)
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, RegisterValue{Address: off, Value: val})
+	}
+	return regs, nil
+}
+
+func snapshotProfiles(devices []string) ([]*DeviceProfile, error) {
+	if len(devices) == 0 {
+		return profiles, nil
+	}
+	var ps []*DeviceProfile
+	for _, devName := range devices {
+		p := lookupProfile(devName)
+		if p == nil {
+			return nil, snapshotRequestError(fmt.Sprintf("device %s not found", devName))
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// CaptureSnapshot reads the register space of the devices (all devices if
+// empty) and stores it under name.
+func CaptureSnapshot(name string, devices []string) (*Snapshot, error) {
+	path, err := snapshotPath(name)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := snapshotProfiles(devices)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{Name: name, Created: time.Now(), Devices: make(map[string][]RegisterValue)}
+	for _, p := range ps {
+		regs, err := readRegisterSpace(p)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s read %s: %v", name, p.Name, err)
+		}
+		s.Devices[p.Name] = regs
+	}
+
+	if err = os.MkdirAll(snapshotDir, 0755); err != nil {
+		return nil, err
+	}
+	fp, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	if err = json.NewEncoder(fp).Encode(s); err != nil {
+		return nil, fmt.Errorf("write snapshot %s err=%v", name, err)
+	}
+	moduleLog("snapshot").WithField("snapshot", name).Info("CaptureSnapshot done")
+	return s, nil
+}
+
+// LoadSnapshot reads the snapshot name from disk.
+func LoadSnapshot(name string) (*Snapshot, error) {
+	path, err := snapshotPath(name)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	s := &Snapshot{}
+	if err = json.NewDecoder(fp).Decode(s); err != nil {
+		return nil, fmt.Errorf("read snapshot %s err=%v", name, err)
+	}
+	return s, nil
+}
+
+// ListSnapshots returns the names of the stored snapshots.
+func ListSnapshots() ([]string, error) {
+	files, err := ioutil.ReadDir(snapshotDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DeleteSnapshot removes the snapshot name.
+func DeleteSnapshot(name string) error {
+	path, err := snapshotPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// DiffSnapshot compares the snapshot with the live registers.
+func DiffSnapshot(s *Snapshot) ([]RegisterDiff, error) {
+	diffs := make([]RegisterDiff, 0)
+	for _, devName := range s.deviceNames() {
+		p := lookupProfile(devName)
+		if p == nil {
+			return nil, fmt.Errorf("snapshot device %s not found", devName)
+		}
+		for _, reg := range s.Devices[devName] {
+			if !p.validReg(reg.Address) || !p.Policy.canRead(reg.Address) {
+				continue
+			}
+			live, err := readDevReg(moduleLog("snapshot"), devName, reg.Address)
+			if err != nil {
+				return nil, err
+			}
+			if live != reg.Value {
+				diffs = append(diffs, RegisterDiff{
+					Device:   devName,
+					Address:  reg.Address,
+					Name:     p.regName(reg.Address),
+					Snapshot: reg.Value,
+					Live:     live,
+				})
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// RestoreSnapshot writes back the registers differing from the snapshot in
+// the restore order of the device profiles and returns the written ones.
+func RestoreSnapshot(s *Snapshot) ([]RegisterDiff, error) {
+	diffs, err := DiffSnapshot(s)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]map[int]RegisterDiff)
+	for _, d := range diffs {
+		if changed[d.Device] == nil {
+			changed[d.Device] = make(map[int]RegisterDiff)
+		}
+		changed[d.Device][d.Address] = d
+	}
+
+	log := moduleLog("snapshot").WithField("snapshot", s.Name)
+	written := make([]RegisterDiff, 0, len(diffs))
+	for _, devName := range s.deviceNames() {
+		p := lookupProfile(devName)
+		for _, step := range p.RestoreOrder {
+			for off := step.Range.Start; off <= step.Range.End; off++ {
+				d, ok := changed[devName][off]
+				if !ok || !p.Policy.canWrite(off, RoleAdmin) {
+					continue
+				}
+				if err := writeDevReg(log, devName, off, d.Snapshot); err != nil {
+					return written, err
+				}
+				if step.Sync {
+					if err := syncDev(log, devName); err != nil {
+						return written, err
+					}
+				}
+				written = append(written, d)
+			}
+		}
+	}
+	log.WithField("registers", len(written)).Info("RestoreSnapshot done")
+	return written, nil
+}
+
+func (s *Snapshot) deviceNames() []string {
+	names := make([]string, 0, len(s.Devices))
+	for devName := range s.Devices {
+		names = append(names, devName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *DeviceProfile) regName(off int) string {
+	if p.RegMap == nil {
+		return ""
+	}
+	if d := p.RegMap.lookup(off); d != nil {
+		return d.Name
+	}
+	return ""
+}
+
+func snapshotError(w http.ResponseWriter, err error) {
+	if _, ok := err.(snapshotRequestError); ok {
+		writeErrorResponse(w, http.StatusBadRequest, err.Error())
+	} else if os.IsNotExist(err) {
+		writeErrorResponse(w, http.StatusNotFound, "snapshot not found")
+	} else {
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func GetSnapshots(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	names, err := ListSnapshots()
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+	writeResponse(w, names)
+}
+
+func CreateSnapshot(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var body struct {
+		Name    string   `json:"name"`
+		Devices []string `json:"devices"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "request body must be {\"name\": ..., \"devices\": [...]}")
+		return
+	}
+	s, err := CaptureSnapshot(body.Name, body.Devices)
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+	writeResponse(w, s)
+}
+
+func GetSnapshot(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	s, err := LoadSnapshot(params.ByName("name"))
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+	writeResponse(w, s)
+}
+
+func GetSnapshotDiff(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	s, err := LoadSnapshot(params.ByName("name"))
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+	diffs, err := DiffSnapshot(s)
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+	writeResponse(w, diffs)
+}
+
+// PostSnapshotRestore restores a snapshot, this may write any register so
+// the route must require RoleAdmin.
+func PostSnapshotRestore(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	s, err := LoadSnapshot(params.ByName("name"))
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+	end, err := beginOp("snapshot_restore")
+	if err != nil {
+		writeErrorResponse(w, opErrorCode(err), err.Error())
+		return
+	}
+	defer end()
+	written, err := RestoreSnapshot(s)
+	if err != nil {
+		snapshotError(w, err)
+		return
+	}
+	writeResponse(w, written)
+}
+
+func RemoveSnapshot(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := DeleteSnapshot(params.ByName("name")); err != nil {
+		snapshotError(w, err)
+		return
+	}
+	writeResponse(w, "snapshot deleted")
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	b := newFakeBackend()
+	SetBackend(b)
+	defer SetBackend(iioBackend{})
+	defer func(dir string) { snapshotDir = dir }(snapshotDir)
+	snapshotDir = t.TempDir()
+
+	b.WriteReg("cf_axi_adc", 0x01, 0x0b)
+	b.WriteReg("cf_axi_adc", 0x1e, 0x12)
+	if _, err := CaptureSnapshot("before", []string{"cf_axi_adc"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CaptureSnapshot("../escape", nil); err == nil {
+		t.Fatal("expected invalid snapshot name error")
+	}
+
+	b.WriteReg("cf_axi_adc", 0x01, 0x00)
+	b.WriteReg("cf_axi_adc", 0x1e, 0x00)
+	b.WriteReg("cf_axi_adc", 0x09, 0x01)
+	s, err := LoadSnapshot("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := DiffSnapshot(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 3 || diffs[2].Name != "CH0_OFFSET" {
+		t.Fatalf("unexpected diff %+v", diffs)
+	}
+
+	written, err := RestoreSnapshot(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DEVICE_STATUS is not part of the restore order
+	if len(written) != 2 || written[0].Address != 0x01 || written[1].Address != 0x1e {
+		t.Fatalf("unexpected restore %+v", written)
+	}
+	if v, _ := b.ReadReg("cf_axi_adc", 0x1e); v != 0x12 {
+		t.Fatalf("register 0x1e = 0x%02x after restore", v)
+	}
+	if v, _ := b.ReadReg("cf_axi_adc", 0x06); v != 0x80 {
+		t.Fatalf("offset restore did not sync, register 0x06 = 0x%02x", v)
+	}
+}
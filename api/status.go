@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/plpsy/iiocalibration/version"
+)
+
+var startTime = time.Now()
+
+// SupervisorStatus reports the restarts of the server by the supervise
+// command.
+type SupervisorStatus struct {
+	Restarts int    `json:"restarts"`
+	LastExit string `json:"lastExit,omitempty"`
+}
+
+var supervisorStatus SupervisorStatus
+
+// SetSupervisorStatus sets the restart count passed by the supervisor.
+func SetSupervisorStatus(restarts int, lastExit string) {
+	supervisorStatus = SupervisorStatus{Restarts: restarts, LastExit: lastExit}
+}
+
+// Status is the runtime state of the service.
+type Status struct {
+	Version       string           `json:"version"`
+	Started       time.Time        `json:"started"`
+	Uptime        string           `json:"uptime"`
+	Operations    map[string]int   `json:"operations"`
+	PendingReboot *PendingReboot   `json:"pendingReboot"`
+	Supervisor    SupervisorStatus `json:"supervisor"`
+	DriftAlerts   []DriftAlert     `json:"driftAlerts"`
+}
+
+func currentStatus() *Status {
+	return &Status{
+		Version:       version.GetVersion(),
+		Started:       startTime,
+		Uptime:        time.Since(startTime).Truncate(time.Second).String(),
+		Operations:    RunningOps(),
+		PendingReboot: RebootPending(),
+		Supervisor:    supervisorStatus,
+		DriftAlerts:   DriftAlerts(),
+	}
+}
+
+func GetStatus(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	writeResponse(w, currentStatus())
+}
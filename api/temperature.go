@@ -0,0 +1,405 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// TemperatureSource is where the board temperature of a device is read,
+// either a hwmon sysfs file in millidegrees or a temperature channel of an
+// iio device.
+type TemperatureSource struct {
+	// e.g. /sys/class/hwmon/hwmon0/temp1_input
+	Hwmon string `json:"hwmon,omitempty"`
+	// iio device name and channel, e.g. "ad7768-temp" and "temp0"
+	IIODevice  string `json:"iioDevice,omitempty"`
+	IIOChannel string `json:"iioChannel,omitempty"`
+}
+
+func (t *TemperatureSource) validate() error {
+	if (t.Hwmon == "") == (t.IIODevice == "") {
+		return fmt.Errorf("set either hwmon or iioDevice")
+	}
+	if t.Hwmon != "" && !filepath.IsAbs(t.Hwmon) {
+		return fmt.Errorf("hwmon %q is not an absolute path", t.Hwmon)
+	}
+	if t.IIODevice != "" && !strings.HasPrefix(t.IIOChannel, "temp") {
+		return fmt.Errorf("iioChannel %q is not a temperature channel", t.IIOChannel)
+	}
+	return nil
+}
+
+func readSysfsFloat(path string) (float64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+}
+
+// iioDeviceDir returns the sysfs directory of the iio device named devName.
+func iioDeviceDir(devName string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(iioDevicesDir, "iio:device*", "name"))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		name, err := ioutil.ReadFile(f)
+		if err == nil && strings.TrimSpace(string(name)) == devName {
+			return filepath.Dir(f), nil
+		}
+	}
+	return "", fmt.Errorf("iio device %s not found", devName)
+}
+
+// Read returns the temperature in degrees Celsius.
+func (t *TemperatureSource) Read() (float64, error) {
+	if t.Hwmon != "" {
+		v, err := readSysfsFloat(t.Hwmon)
+		return v / 1000, err
+	}
+	dir, err := iioDeviceDir(t.IIODevice)
+	if err != nil {
+		return 0, err
+	}
+	prefix := filepath.Join(dir, "in_"+t.IIOChannel)
+	// 有_input时直接是毫度, 否则按 (raw + offset) * scale 计算
+	if v, err := readSysfsFloat(prefix + "_input"); err == nil {
+		return v / 1000, nil
+	}
+	raw, err := readSysfsFloat(prefix + "_raw")
+	if err != nil {
+		return 0, err
+	}
+	scale, err := readSysfsFloat(prefix + "_scale")
+	if err != nil {
+		return 0, err
+	}
+	offset, err := readSysfsFloat(prefix + "_offset")
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return (raw + offset) * scale / 1000, nil
+}
+
+// CompensationConfig sets up the temperature compensation, which applies
+// the offsets interpolated from the calibrations at other temperatures.
+type CompensationConfig struct {
+	// 0 disables the compensation loop
+	Interval Duration `json:"interval"`
+	// degrees the temperature has to move before the offsets are
+	// interpolated again
+	Hysteresis float64 `json:"hysteresis"`
+	// smaller offset changes are not written
+	MinChange int32 `json:"minChange"`
+	// calibrations within this many degrees replace each other in the
+	// offset table
+	Resolution float64 `json:"resolution"`
+}
+
+func (c *CompensationConfig) validate() error {
+	if c.Interval.Duration != 0 && c.Interval.Duration < time.Second {
+		return fmt.Errorf("compensation.interval must be 0 or at least 1s")
+	}
+	if c.Hysteresis < 0 || c.MinChange < 0 {
+		return fmt.Errorf("compensation.hysteresis and compensation.minChange must not be negative")
+	}
+	if c.Resolution <= 0 {
+		return fmt.Errorf("compensation.resolution must be positive")
+	}
+	return nil
+}
+
+var offsetTableFile = "/media/sd-mmcblk1p2/offset-table.json"
+
+// TablePoint is the offset calibrated at a temperature.
+type TablePoint struct {
+	Temperature float64   `json:"temperature"`
+	Offset      int32     `json:"offset"`
+	Time        time.Time `json:"time"`
+}
+
+// OffsetTable holds the calibrated offsets by device and channel, sorted by
+// temperature.
+type OffsetTable map[string]map[int][]TablePoint
+
+// 温度补偿表和补偿循环的状态
+var compensation = struct {
+	sync.Mutex
+	// temperature of the offsets last applied for each device
+	applied map[string]float64
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}{applied: make(map[string]float64)}
+
+func compensationConfig() CompensationConfig {
+	return CurrentConfig().Compensation
+}
+
+// LoadOffsetTable reads the offset table file, it is empty if there is
+// none.
+func LoadOffsetTable() (OffsetTable, error) {
+	table := make(OffsetTable)
+	data, err := ioutil.ReadFile(offsetTableFile)
+	if os.IsNotExist(err) {
+		return table, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("offset table %s: %v", offsetTableFile, err)
+	}
+	return table, nil
+}
+
+func saveOffsetTable(table OffsetTable) error {
+	data, err := json.MarshalIndent(table, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(offsetTableFile+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(offsetTableFile+".tmp", offsetTableFile)
+}
+
+// add records an offset calibrated at temp, replacing the point within
+// resolution degrees.
+func (t OffsetTable) add(devName string, chanId int, p TablePoint, resolution float64) {
+	if t[devName] == nil {
+		t[devName] = make(map[int][]TablePoint)
+	}
+	var points []TablePoint
+	for _, old := range t[devName][chanId] {
+		if math.Abs(old.Temperature-p.Temperature) >= resolution {
+			points = append(points, old)
+		}
+	}
+	points = append(points, p)
+	sort.Slice(points, func(i, j int) bool { return points[i].Temperature < points[j].Temperature })
+	t[devName][chanId] = points
+}
+
+// interpolate returns the offset at temp, linear between the neighbouring
+// points and clamped to the outermost ones.
+func interpolate(points []TablePoint, temp float64) int32 {
+	if temp <= points[0].Temperature {
+		return points[0].Offset
+	}
+	for i := 1; i < len(points); i++ {
+		lo, hi := points[i-1], points[i]
+		if temp <= hi.Temperature {
+			f := (temp - lo.Temperature) / (hi.Temperature - lo.Temperature)
+			return int32(math.Round(float64(lo.Offset) + f*float64(hi.Offset-lo.Offset)))
+		}
+	}
+	return points[len(points)-1].Offset
+}
+
+// deviceTemperature reads the temperature of a device, ok is false if the
+// device has no temperature source or it can not be read.
+func deviceTemperature(log *logrus.Entry, devName string) (temp float64, ok bool) {
+	p := lookupProfile(devName)
+	if p == nil || p.Temperature == nil {
+		return 0, false
+	}
+	temp, err := p.Temperature.Read()
+	if err != nil {
+		log.WithError(err).WithField("device", devName).Error("read temperature error")
+		return 0, false
+	}
+	return temp, true
+}
+
+// recordTableOffsets adds the offsets of a calibration at temp to the
+// offset table.
+func recordTableOffsets(devName string, offsets map[int]int32, temp float64) error {
+	compensation.Lock()
+	defer compensation.Unlock()
+	table, err := LoadOffsetTable()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for chanId, offset := range offsets {
+		table.add(devName, chanId, TablePoint{Temperature: temp, Offset: offset, Time: now}, compensationConfig().Resolution)
+	}
+	// 刚校准过的温度就是当前生效的温度
+	compensation.applied[devName] = temp
+	return saveOffsetTable(table)
+}
+
+// Temperatures reads the temperatures of the devices that have a source.
+func Temperatures() map[string]float64 {
+	temps := make(map[string]float64)
+	for _, p := range profiles {
+		if temp, ok := deviceTemperature(moduleLog("calibration"), p.Name); ok {
+			temps[p.Name] = temp
+		}
+	}
+	return temps
+}
+
+// compensate applies the table offsets of the devices whose temperature
+// moved by the hysteresis since their offsets were last applied.
+func compensate(log *logrus.Entry) error {
+	cfg := compensationConfig()
+	compensation.Lock()
+	defer compensation.Unlock()
+	table, err := LoadOffsetTable()
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		temp, ok := deviceTemperature(log, p.Name)
+		if !ok || len(table[p.Name]) == 0 {
+			continue
+		}
+		if last, ok := compensation.applied[p.Name]; ok && math.Abs(temp-last) < cfg.Hysteresis {
+			continue
+		}
+		devLog := log.WithFields(logrus.Fields{"device": p.Name, "temperature": temp})
+		for _, id := range p.channelIds() {
+			points := table[p.Name][id]
+			if len(points) == 0 {
+				continue
+			}
+			offset := interpolate(points, temp)
+			current, err := getDevOffset(devLog, p.Name, id)
+			if err != nil {
+				return err
+			}
+			if d := offset - current; d == 0 || (d < cfg.MinChange && -d < cfg.MinChange) {
+				continue
+			}
+			devLog.WithFields(logrus.Fields{"channel": id, "from": current, "to": offset}).Info("temperature compensation")
+			if err := setDevOffset(devLog, p.Name, id, offset); err != nil {
+				return err
+			}
+		}
+		compensation.applied[p.Name] = temp
+	}
+	return nil
+}
+
+// StartCompensation runs the temperature compensation every
+// compensation.interval until StopCompensation, it restarts a running loop.
+func StartCompensation() {
+	StopCompensation()
+	compensation.Lock()
+	defer compensation.Unlock()
+	compensation.started = true
+	interval := compensationConfig().Interval.Duration
+	if interval == 0 {
+		return
+	}
+	log := moduleLog("calibration").WithField("loop", "compensation")
+	compensation.stop = make(chan struct{})
+	compensation.done = make(chan struct{})
+	go runCompensation(log, interval, compensation.stop, compensation.done)
+	log.WithField("interval", interval.String()).Info("temperature compensation started")
+}
+
+// StopCompensation stops the compensation loop.
+func StopCompensation() {
+	compensation.Lock()
+	stop, done := compensation.stop, compensation.done
+	compensation.stop, compensation.done = nil, nil
+	compensation.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func compensationStarted() bool {
+	compensation.Lock()
+	defer compensation.Unlock()
+	return compensation.started
+}
+
+func runCompensation(log *logrus.Entry, interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// 校准时不能改偏移, beginOp 拒绝
+		end, err := beginOp("compensation")
+		if err != nil {
+			continue
+		}
+		if err := compensate(log); err != nil {
+			log.WithError(err).Error("temperature compensation error")
+		}
+		end()
+	}
+}
+
+type compensationResponse struct {
+	Temperatures map[string]float64 `json:"temperatures"`
+	// temperature of the offsets last applied by device
+	Applied map[string]float64 `json:"applied"`
+	Table   OffsetTable        `json:"table"`
+}
+
+// GetCompensation returns the current temperatures, the temperatures the
+// applied offsets belong to and the offset table.
+func GetCompensation(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	temps := Temperatures()
+	compensation.Lock()
+	defer compensation.Unlock()
+	table, err := LoadOffsetTable()
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	applied := make(map[string]float64, len(compensation.applied))
+	for devName, temp := range compensation.applied {
+		applied[devName] = temp
+	}
+	writeResponse(w, compensationResponse{Temperatures: temps, Applied: applied, Table: table})
+}
+
+// DeleteOffsetTable removes the offset table of ?device=, or of all
+// devices.
+func DeleteOffsetTable(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	devName := r.URL.Query().Get("device")
+	compensation.Lock()
+	defer compensation.Unlock()
+	table, err := LoadOffsetTable()
+	if err == nil {
+		if devName == "" {
+			table = make(OffsetTable)
+		} else {
+			delete(table, devName)
+		}
+		err = saveOffsetTable(table)
+	}
+	if err != nil {
+		setAuditError(r, err)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	requestLog(r, "calibration").WithField("device", devName).Info("offset table cleared")
+	writeResponse(w, table)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemperatureSource(t *testing.T) {
+	dir := t.TempDir()
+	oldDir := iioDevicesDir
+	iioDevicesDir = dir
+	defer func() { iioDevicesDir = oldDir }()
+	devDir := filepath.Join(dir, "iio:device2")
+	os.Mkdir(devDir, 0755)
+	for name, value := range map[string]string{
+		"name":            "ad7768-temp\n",
+		"in_temp0_raw":    "1000\n",
+		"in_temp0_offset": "-200\n",
+		"in_temp0_scale":  "50.5\n",
+		"temp1_input":     "41250\n",
+	} {
+		ioutil.WriteFile(filepath.Join(devDir, name), []byte(value), 0644)
+	}
+
+	temp, err := (&TemperatureSource{IIODevice: "ad7768-temp", IIOChannel: "temp0"}).Read()
+	if err != nil || temp != 40.4 {
+		t.Fatalf("iio temperature %v, %v", temp, err)
+	}
+	temp, err = (&TemperatureSource{Hwmon: filepath.Join(devDir, "temp1_input")}).Read()
+	if err != nil || temp != 41.25 {
+		t.Fatalf("hwmon temperature %v, %v", temp, err)
+	}
+	if _, err := (&TemperatureSource{IIODevice: "ad9361", IIOChannel: "temp0"}).Read(); err == nil {
+		t.Fatal("expected error for missing device")
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	points := []TablePoint{{Temperature: -20, Offset: 100}, {Temperature: 20, Offset: 300}, {Temperature: 60, Offset: -100}}
+	for temp, expected := range map[float64]int32{-40: 100, -20: 100, 0: 200, 20: 300, 50: 0, 85: -100} {
+		if offset := interpolate(points, temp); offset != expected {
+			t.Errorf("%v degrees: offset %d, expected %d", temp, offset, expected)
+		}
+	}
+}
+
+func TestTemperatureCompensation(t *testing.T) {
+	hwmon := filepath.Join(t.TempDir(), "temp1_input")
+	setTemp := func(milli string) { ioutil.WriteFile(hwmon, []byte(milli), 0644) }
+	b, _ := setupTestServer(t, func(cfg *Config) {
+		cfg.Devices[0].Temperature = &TemperatureSource{Hwmon: hwmon}
+		cfg.Calibration.Factor = 1
+	})
+	defer func() { compensation.applied = make(map[string]float64) }()
+
+	// calibrate channel 4 at 0 and 40 degrees, 40.4 replaces 40
+	for _, c := range []struct {
+		temp  string
+		level int32
+	}{{"0", 1000}, {"40000", 2000}, {"40400", 3000}} {
+		setTemp(c.temp)
+		clearOffsetReg(testLog, "cf_axi_adc", 4)
+		b.setLevel("cf_axi_adc", 4, c.level)
+		if err := calibrationOne(testLog, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	table, err := LoadOffsetTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points := table["cf_axi_adc"][4]; len(points) != 2 || points[0].Offset != 1000 || points[1].Temperature != 40.4 || points[1].Offset != 3000 {
+		t.Fatalf("offset table %+v", table)
+	}
+	if _, ok := table["cf_axi_adc_1"]; ok {
+		t.Fatal("device without temperature source in the offset table")
+	}
+
+	// within the hysteresis of 2 degrees of the last calibration
+	setTemp("39000")
+	if err := compensate(testLog); err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := getDevOffset(testLog, "cf_axi_adc", 4); offset != 3000 {
+		t.Fatalf("offset %d changed within the hysteresis", offset)
+	}
+	setTemp("20200")
+	if err := compensate(testLog); err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := getDevOffset(testLog, "cf_axi_adc", 4); offset != 2000 {
+		t.Fatalf("offset %d at 20.2 degrees, expected 2000", offset)
+	}
+	if compensation.applied["cf_axi_adc"] != 20.2 {
+		t.Fatalf("applied temperatures %v", compensation.applied)
+	}
+}
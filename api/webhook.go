@@ -0,0 +1,362 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// Events posted to the webhooks.
+const (
+	EventCalibrationStarted   = "calibration.started"
+	EventCalibrationSucceeded = "calibration.succeeded"
+	EventCalibrationFailed    = "calibration.failed"
+	EventReboot               = "reboot"
+	EventDriftAlert           = "drift.alert"
+	EventDriftCleared         = "drift.cleared"
+	EventStartupReconciled    = "startup.reconciled"
+)
+
+var webhookEvents = []string{EventCalibrationStarted, EventCalibrationSucceeded, EventCalibrationFailed,
+	EventReboot, EventDriftAlert, EventDriftCleared, EventStartupReconciled}
+
+// WebhookConfig is a receiver of event notifications.
+type WebhookConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// events to post, empty or "*" for all
+	Events []string `json:"events,omitempty"`
+	// key of the HMAC-SHA256 signature in the X-Iiocalibration-Signature
+	// header, no signature if empty
+	Secret string `json:"secret,omitempty"`
+}
+
+func (c *WebhookConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("webhook without name")
+	}
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("webhook %s: url %q is not a http or https URL", c.Name, c.URL)
+	}
+	for _, e := range c.Events {
+		if e != "*" && !containsString(webhookEvents, e) {
+			return fmt.Errorf("webhook %s: unknown event %q", c.Name, e)
+		}
+	}
+	return nil
+}
+
+func (c *WebhookConfig) wants(event string) bool {
+	return len(c.Events) == 0 || containsString(c.Events, "*") || containsString(c.Events, event)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var outboxDir = "/media/sd-mmcblk1p2/outbox"
+
+// 投递失败后的重试间隔, 超过最长时间的事件丢弃
+var (
+	webhookMinBackoff = 5 * time.Second
+	webhookMaxBackoff = 10 * time.Minute
+	webhookMaxAge     = 24 * time.Hour
+	webhookTimeout    = 10 * time.Second
+)
+
+// Delivery is an event waiting in the outbox to be posted to a webhook.
+type Delivery struct {
+	ID          string          `json:"id"`
+	Webhook     string          `json:"webhook"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Created     time.Time       `json:"created"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+func (d *Delivery) file() string {
+	return filepath.Join(outboxDir, d.ID+".json")
+}
+
+// save writes the delivery to the outbox, replacing the previous state.
+func (d *Delivery) save() error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(d.file()+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(d.file()+".tmp", d.file())
+}
+
+// 发件箱, 事件先写入文件再投递, 重启后继续
+var outbox = struct {
+	sync.Mutex
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+// eventPayload is the body posted to the webhooks.
+type eventPayload struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Host  string      `json:"host"`
+	Data  interface{} `json:"data"`
+}
+
+// emitEvent puts an event in the outbox of every webhook subscribed to it,
+// publishes it over MQTT and streams it on GET /events.
+func emitEvent(event string, data interface{}) {
+	mqttEvent(event, data)
+	broadcast(event, data)
+	log := moduleLog("webhook").WithField("event", event)
+	now := time.Now()
+	host, _ := os.Hostname()
+	queued := false
+	for _, c := range CurrentConfig().Webhooks {
+		if !c.wants(event) {
+			continue
+		}
+		id := fmt.Sprintf("%d-%s", now.UnixNano(), newID())
+		payload, err := json.Marshal(eventPayload{ID: id, Event: event, Time: now, Host: host, Data: data})
+		if err != nil {
+			log.WithError(err).Error("encode event error")
+			return
+		}
+		d := &Delivery{ID: id, Webhook: c.Name, Event: event, Payload: payload, Created: now, NextAttempt: now}
+		if err := os.MkdirAll(outboxDir, 0755); err != nil {
+			log.WithError(err).Error("create outbox error")
+			return
+		}
+		if err := d.save(); err != nil {
+			log.WithError(err).WithField("webhook", c.Name).Error("queue event error")
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case outbox.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pendingDeliveries reads the outbox, oldest first.
+func pendingDeliveries() ([]*Delivery, error) {
+	files, err := filepath.Glob(filepath.Join(outboxDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []*Delivery
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		d := new(Delivery)
+		if err := json.Unmarshal(data, d); err != nil {
+			// 掉电写坏的文件
+			moduleLog("webhook").WithError(err).WithField("file", f).Error("drop corrupt outbox entry")
+			os.Remove(f)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Created.Before(deliveries[j].Created) })
+	return deliveries, nil
+}
+
+func lookupWebhook(name string) *WebhookConfig {
+	for _, c := range CurrentConfig().Webhooks {
+		if c.Name == name {
+			return &c
+		}
+	}
+	return nil
+}
+
+// signPayload returns the X-Iiocalibration-Signature of a body.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postDelivery(c *WebhookConfig, d *Delivery) error {
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Iiocalibration-Event", d.Event)
+	req.Header.Set("X-Iiocalibration-Delivery", d.ID)
+	if c.Secret != "" {
+		req.Header.Set("X-Iiocalibration-Signature", signPayload(c.Secret, d.Payload))
+	}
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// deliverDue posts the due deliveries and returns when the next one is
+// due, zero if the outbox is empty. The events of a webhook are delivered
+// in order, a failed one holds back the later ones.
+func deliverDue(log *logrus.Entry) time.Time {
+	deliveries, err := pendingDeliveries()
+	if err != nil {
+		log.WithError(err).Error("read outbox error")
+		return time.Now().Add(webhookMinBackoff)
+	}
+	var next time.Time
+	blocked := make(map[string]bool)
+	for _, d := range deliveries {
+		if blocked[d.Webhook] {
+			continue
+		}
+		dlog := log.WithFields(logrus.Fields{"delivery": d.ID, "event": d.Event, "webhook": d.Webhook})
+		if time.Now().Before(d.NextAttempt) {
+			blocked[d.Webhook] = true
+			if next.IsZero() || d.NextAttempt.Before(next) {
+				next = d.NextAttempt
+			}
+			continue
+		}
+		c := lookupWebhook(d.Webhook)
+		if c == nil {
+			dlog.Warn("webhook no longer configured, drop event")
+			os.Remove(d.file())
+			continue
+		}
+		err := postDelivery(c, d)
+		if err == nil {
+			dlog.WithField("attempts", d.Attempts+1).Info("event delivered")
+			os.Remove(d.file())
+			continue
+		}
+		d.Attempts++
+		d.LastError = err.Error()
+		if time.Since(d.Created) > webhookMaxAge {
+			dlog.WithError(err).Error("event undeliverable, dropped")
+			os.Remove(d.file())
+			continue
+		}
+		backoff := webhookMinBackoff << uint(min(d.Attempts-1, 16))
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+		d.NextAttempt = time.Now().Add(backoff)
+		blocked[d.Webhook] = true
+		dlog.WithError(err).WithField("retry_in", backoff.String()).Warn("event delivery failed")
+		if err := d.save(); err != nil {
+			dlog.WithError(err).Error("update outbox error")
+		}
+		if next.IsZero() || d.NextAttempt.Before(next) {
+			next = d.NextAttempt
+		}
+	}
+	return next
+}
+
+// StartWebhooks delivers the events of the outbox, including those left
+// from before a restart, until StopWebhooks.
+func StartWebhooks() {
+	StopWebhooks()
+	outbox.Lock()
+	defer outbox.Unlock()
+	outbox.stop = make(chan struct{})
+	outbox.done = make(chan struct{})
+	go runOutbox(moduleLog("webhook"), outbox.stop, outbox.done)
+}
+
+// StopWebhooks stops the delivery, undelivered events stay in the outbox.
+func StopWebhooks() {
+	outbox.Lock()
+	stop, done := outbox.stop, outbox.done
+	outbox.stop, outbox.done = nil, nil
+	outbox.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func runOutbox(log *logrus.Entry, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		next := deliverDue(log)
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-outbox.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+type webhookStatus struct {
+	Name    string      `json:"name"`
+	URL     string      `json:"url"`
+	Events  []string    `json:"events,omitempty"`
+	Signed  bool        `json:"signed"`
+	Pending []*Delivery `json:"pending"`
+}
+
+// GetWebhooks returns the configured webhooks, without their secrets, and
+// their undelivered events.
+func GetWebhooks(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	deliveries, err := pendingDeliveries()
+	if err != nil {
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result := []webhookStatus{}
+	for _, c := range CurrentConfig().Webhooks {
+		s := webhookStatus{Name: c.Name, URL: c.URL, Events: c.Events, Signed: c.Secret != "", Pending: []*Delivery{}}
+		for _, d := range deliveries {
+			if d.Webhook == c.Name {
+				s.Pending = append(s.Pending, d)
+			}
+		}
+		result = append(result, s)
+	}
+	writeResponse(w, result)
+}
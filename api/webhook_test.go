@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	events   []string
+	received chan string
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("X-Iiocalibration-Signature") != signPayload("s3cret", body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if rcv.failures > 0 {
+		rcv.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var payload eventPayload
+	json.Unmarshal(body, &payload)
+	if payload.Event != r.Header.Get("X-Iiocalibration-Event") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rcv.events = append(rcv.events, payload.Event)
+	rcv.received <- payload.Event
+}
+
+func (rcv *webhookReceiver) wait(t *testing.T, expected string) {
+	select {
+	case e := <-rcv.received:
+		if e != expected {
+			t.Fatalf("received %s, expected %s", e, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s not received", expected)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	oldBackoff := webhookMinBackoff
+	webhookMinBackoff = 10 * time.Millisecond
+	defer func() { webhookMinBackoff = oldBackoff }()
+
+	rcv := &webhookReceiver{received: make(chan string, 10)}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	setupTestServer(t, func(cfg *Config) {
+		cfg.Webhooks = []WebhookConfig{
+			{Name: "mes", URL: server.URL, Secret: "s3cret", Events: []string{EventCalibrationStarted, EventCalibrationSucceeded, EventCalibrationFailed}},
+			{Name: "other", URL: server.URL + "/other", Events: []string{EventReboot}},
+		}
+	})
+
+	// queued while the server is down, delivered after the start
+	if err := Calibrate(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := Calibrate(99); err == nil {
+		t.Fatal("expected error for channel 99")
+	}
+	if pending, _ := pendingDeliveries(); len(pending) != 4 {
+		t.Fatalf("%d deliveries in the outbox, expected 4", len(pending))
+	}
+	router := httprouter.New()
+	router.GET("/webhooks", GetWebhooks)
+	rec := doRequest(router, "GET", "/webhooks", "", nil)
+	if strings.Contains(rec.Body.String(), "s3cret") || !strings.Contains(rec.Body.String(), `"signed":true`) {
+		t.Fatalf("webhooks %s", rec.Body)
+	}
+
+	rcv.failures = 2
+	StartWebhooks()
+	defer StopWebhooks()
+	for _, e := range []string{EventCalibrationStarted, EventCalibrationSucceeded, EventCalibrationStarted, EventCalibrationFailed} {
+		rcv.wait(t, e)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pending, _ := pendingDeliveries(); len(pending) != 0 {
+		t.Fatalf("%d deliveries left in the outbox", len(pending))
+	}
+
+	emitEvent(EventDriftAlert, nil)
+	select {
+	case e := <-rcv.received:
+		t.Fatalf("unsubscribed event %s received", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the webhook without secret fails the signature check of the receiver
+	// and its event is retried
+	emitEvent(EventReboot, PendingReboot{At: time.Now(), RequestedBy: "ops"})
+	time.Sleep(100 * time.Millisecond)
+	pending, _ := pendingDeliveries()
+	if len(pending) != 1 || pending[0].Attempts == 0 || pending[0].LastError != "status 401" {
+		t.Fatalf("outbox %+v", pending)
+	}
+}
+
+func TestWebhookConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		hooks    []WebhookConfig
+		expected string
+	}{
+		{[]WebhookConfig{{URL: "http://mes"}}, "without name"},
+		{[]WebhookConfig{{Name: "mes", URL: "mes:80"}}, "not a http"},
+		{[]WebhookConfig{{Name: "mes", URL: "http://mes", Events: []string{"calibration"}}}, "unknown event"},
+		{[]WebhookConfig{{Name: "mes", URL: "http://mes"}, {Name: "mes", URL: "http://mes2"}}, "listed twice"},
+	} {
+		c := DefaultConfig()
+		c.Webhooks = tc.hooks
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%+v: expected %q error, got %v", tc.hooks, tc.expected, err)
+		}
+	}
+}
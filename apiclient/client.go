@@ -0,0 +1,163 @@
+// Package apiclient is the HTTP API client generated from the OpenAPI
+// document served at /openapi.json, used by the --remote subcommands, the
+// coordinator and the services calling the board.
+// The methods and types are in generated.go, run go generate after changing
+// openapi/openapi.json.
+package apiclient
+
+//go:generate go run ../openapi/gen -o generated.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Error is a response with an error status code.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client calls the server at BaseURL, e.g. "http://10.0.0.5".
+type Client struct {
+	BaseURL string
+	// sent as X-API-Key if not empty
+	APIKey string
+	// sent with each request, e.g. an X-Request-ID
+	Header     http.Header
+	HTTPClient *http.Client
+}
+
+// New returns a client of the server at baseURL.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		APIKey:  apiKey,
+		// 校准需要清零后等待新数据, 耗时较长
+		HTTPClient: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// send sends a request and returns the response of a success status code.
+func (c *Client) send(method, path string, query url.Values, in interface{}, httpClient *http.Client) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		var msg string
+		if json.Unmarshal(data, &msg) != nil {
+			msg = strings.TrimSpace(string(data))
+		}
+		return nil, &Error{StatusCode: resp.StatusCode, Message: msg}
+	}
+	return resp, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// do returns the status code and the body of a successful request.
+func (c *Client) do(method, path string, query url.Values, in interface{}) (int, []byte, error) {
+	resp, err := c.send(method, path, query, in, c.httpClient())
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// call decodes the body of a successful request into out.
+func (c *Client) call(method, path string, query url.Values, in, out interface{}) error {
+	_, data, err := c.do(method, path, query, in)
+	if err != nil {
+		return err
+	}
+	if err := decode(data, out); err != nil {
+		return fmt.Errorf("%s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+// stream returns the body of a streamed response, the timeout of
+// HTTPClient does not apply.
+func (c *Client) stream(method, path string, query url.Values, in interface{}) (io.ReadCloser, error) {
+	httpClient := *c.httpClient()
+	httpClient.Timeout = 0
+	resp, err := c.send(method, path, query, in, &httpClient)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// decode decodes a JSON body. The legacy routes answer errors with status
+// 200 and the message as body, a message which is not the expected result
+// is returned as error.
+func decode(data []byte, out interface{}) error {
+	err := json.Unmarshal(data, out)
+	if err == nil {
+		return nil
+	}
+	var msg string
+	if json.Unmarshal(data, &msg) == nil {
+		return errors.New(msg)
+	}
+	return err
+}
+
+// expect returns the message as error if it is not the expected one.
+func expect(data []byte, expected string) error {
+	var msg string
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	if msg != expected {
+		return errors.New(msg)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package apiclient
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/plpsy/iiocalibration/openapi"
+)
+
+func TestGeneratedUpToDate(t *testing.T) {
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := doc.GenerateClient("apiclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := ioutil.ReadFile("generated.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, generated) {
+		t.Error("generated.go is out of date, run go generate")
+	}
+}
+
+func TestLegacyErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/params":
+			w.Write([]byte(`"open /calibration.json: permission denied"`))
+		case "/calibration":
+			w.Write([]byte(`"Calibration done"`))
+		case "/regparams":
+			w.Write([]byte(`"iio_reg failed"`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`"not found"`))
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL, "")
+	if _, err := c.GetParams(); err == nil || !strings.HasSuffix(err.Error(), "open /calibration.json: permission denied") {
+		t.Errorf("params: %v", err)
+	}
+	if err := c.Calibrate(nil); err != nil {
+		t.Errorf("calibration: %v", err)
+	}
+	if err := c.ClearRegParams(); err == nil || !strings.HasSuffix(err.Error(), "iio_reg failed") {
+		t.Errorf("clearing: %v", err)
+	}
+	if _, err := c.GetStatus(); err == nil || err.(*Error).StatusCode != 404 || err.(*Error).Message != "not found" {
+		t.Errorf("status: %v", err)
+	}
+}
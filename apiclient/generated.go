@@ -0,0 +1,882 @@
+// Code generated by openapi/gen from openapi/openapi.json. DO NOT EDIT.
+
+package apiclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type AuditEntry struct {
+	Time      time.Time         `json:"time"`
+	RequestID string            `json:"requestId,omitempty"`
+	User      string            `json:"user"`
+	Role      Role              `json:"role"`
+	Remote    string            `json:"remote"`
+	Method    string            `json:"method,omitempty"`
+	Endpoint  string            `json:"endpoint"`
+	Action    string            `json:"action"`
+	Params    map[string]string `json:"params,omitempty"`
+	Body      json.RawMessage   `json:"body,omitempty"`
+	Before    json.RawMessage   `json:"before,omitempty"`
+	After     json.RawMessage   `json:"after,omitempty"`
+	Status    int               `json:"status,omitempty"`
+	Outcome   string            `json:"outcome"`
+	Error     string            `json:"error,omitempty"`
+}
+
+type CalibrationProgress struct {
+	JobID   string    `json:"jobId"`
+	Origin  string    `json:"origin"`
+	Started time.Time `json:"started"`
+	// global channel numbers to calibrate
+	Channels []int `json:"channels"`
+	// global channel numbers calibrated
+	Done   []int  `json:"done"`
+	Step   string `json:"step"`
+	Device string `json:"device,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type CalibrationRecord struct {
+	JobID  string `json:"jobId"`
+	Origin string `json:"origin"`
+	// X-Request-ID of the API request starting the calibration
+	RequestID string `json:"requestId,omitempty"`
+	Schedule  string `json:"schedule,omitempty"`
+	// global channel numbers, all channels if empty
+	Channels     []int              `json:"channels,omitempty"`
+	Started      time.Time          `json:"started"`
+	Duration     string             `json:"duration"`
+	Offsets      Params             `json:"offsets,omitempty"`
+	Temperatures map[string]float64 `json:"temperatures,omitempty"`
+	Error        string             `json:"error,omitempty"`
+}
+
+type CalibrationWindow struct {
+	Open  bool       `json:"open"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+type CalibrationWindowRequest struct {
+	Open bool `json:"open"`
+	// close the window after a duration like 2h
+	Duration string `json:"duration,omitempty"`
+}
+
+type Capture struct {
+	Device   string `json:"device"`
+	Samples  int    `json:"samples"`
+	Channels []int  `json:"channels"`
+	// samples of each channel in the order of channels
+	Values [][]int32 `json:"values"`
+}
+
+type Compensation struct {
+	Temperatures map[string]float64 `json:"temperatures"`
+	// temperature of the applied offsets by device
+	Applied map[string]float64 `json:"applied"`
+	Table   OffsetTable        `json:"table"`
+}
+
+type DecodedField struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+	// enum label of the value
+	Label string `json:"label,omitempty"`
+}
+
+type DecodedRegister struct {
+	Name    string         `json:"name"`
+	Address int            `json:"address"`
+	Width   int            `json:"width"`
+	Value   int64          `json:"value"`
+	Fields  []DecodedField `json:"fields,omitempty"`
+}
+
+type Delivery struct {
+	ID          string          `json:"id"`
+	Webhook     string          `json:"webhook"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Created     time.Time       `json:"created"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+type DeviceInfo struct {
+	Name     string `json:"name"`
+	Channels int    `json:"channels"`
+	// global number of channel 0
+	FirstChannel int `json:"firstChannel"`
+	// the device has a temperature source
+	Temperature bool `json:"temperature"`
+}
+
+type DriftAlert struct {
+	Device   string   `json:"device"`
+	Channel  int      `json:"channel"`
+	Kinds    []string `json:"kinds"`
+	Residual int32    `json:"residual"`
+	// LSB per hour
+	Slope float64   `json:"slope"`
+	Since time.Time `json:"since"`
+}
+
+type DriftPoint struct {
+	Time     time.Time `json:"t"`
+	Residual int32     `json:"residual"`
+	Offset   int32     `json:"offset"`
+}
+
+type DriftSeries struct {
+	Device  string `json:"device"`
+	Channel int    `json:"channel"`
+	// LSB per hour
+	Slope  float64      `json:"slope"`
+	Alert  *DriftAlert  `json:"alert,omitempty"`
+	Points []DriftPoint `json:"points"`
+}
+
+type GPIOCondition struct {
+	Number int `json:"number"`
+	Value  int `json:"value"`
+}
+
+type Health struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Message  string `json:"message,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Identity struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+type LogSettings struct {
+	Format string `json:"format,omitempty"`
+	// level by module name
+	Levels map[string]string `json:"levels"`
+}
+
+// OffsetTable: calibrated offsets by device, channel and temperature
+type OffsetTable map[string]map[int][]TablePoint
+
+// Params: offsets by device name and channel number
+type Params map[string]map[int]int32
+
+type PendingReboot struct {
+	At          time.Time `json:"at"`
+	RequestedBy string    `json:"requestedBy"`
+}
+
+type Precondition struct {
+	Window bool           `json:"window,omitempty"`
+	GPIO   *GPIOCondition `json:"gpio,omitempty"`
+}
+
+type RebootRequest struct {
+	// confirmation token, none to request one
+	Token string `json:"token,omitempty"`
+	// reboot after a duration like 5m
+	Delay string `json:"delay,omitempty"`
+	// reboot at a time
+	At *time.Time `json:"at,omitempty"`
+}
+
+type RebootToken struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	Message string    `json:"message"`
+}
+
+type RegisterDef struct {
+	Name    string          `json:"name"`
+	Address int             `json:"address"`
+	Width   int             `json:"width"`
+	Fields  []RegisterField `json:"fields,omitempty"`
+}
+
+type RegisterDiff struct {
+	Device   string `json:"device"`
+	Address  int    `json:"address"`
+	Name     string `json:"name,omitempty"`
+	Snapshot int    `json:"snapshot"`
+	Live     int    `json:"live"`
+}
+
+type RegisterField struct {
+	Name   string         `json:"name"`
+	Msb    int            `json:"msb"`
+	Lsb    int            `json:"lsb"`
+	Signed bool           `json:"signed,omitempty"`
+	Enum   map[int]string `json:"enum,omitempty"`
+}
+
+type RegisterMap struct {
+	Registers []RegisterDef `json:"registers"`
+}
+
+type RegisterValue struct {
+	Address int `json:"address"`
+	Value   int `json:"value"`
+}
+
+type RegisterWrite struct {
+	Value int `json:"value"`
+}
+
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+type Schedule struct {
+	Running   bool              `json:"running"`
+	Window    CalibrationWindow `json:"window"`
+	Schedules []ScheduleStatus  `json:"schedules"`
+}
+
+type ScheduleRun struct {
+	Time  time.Time `json:"time"`
+	JobID string    `json:"jobId,omitempty"`
+	// reason the run was skipped
+	Skipped string `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ScheduleStatus struct {
+	Name         string       `json:"name"`
+	Cron         string       `json:"cron,omitempty"`
+	Interval     string       `json:"interval"`
+	Channels     []int        `json:"channels,omitempty"`
+	Precondition Precondition `json:"precondition"`
+	Next         time.Time    `json:"next"`
+	Last         *ScheduleRun `json:"last,omitempty"`
+}
+
+type Snapshot struct {
+	Name    string                     `json:"name"`
+	Created time.Time                  `json:"created"`
+	Devices map[string][]RegisterValue `json:"devices"`
+}
+
+type SnapshotRequest struct {
+	Name string `json:"name"`
+	// all devices if empty
+	Devices []string `json:"devices,omitempty"`
+}
+
+type Status struct {
+	Version string    `json:"version"`
+	Started time.Time `json:"started"`
+	Uptime  string    `json:"uptime"`
+	// running hardware operations by kind
+	Operations    map[string]int   `json:"operations"`
+	PendingReboot *PendingReboot   `json:"pendingReboot"`
+	Supervisor    SupervisorStatus `json:"supervisor"`
+	DriftAlerts   []DriftAlert     `json:"driftAlerts"`
+}
+
+type SupervisorStatus struct {
+	Restarts int    `json:"restarts"`
+	LastExit string `json:"lastExit,omitempty"`
+}
+
+type TablePoint struct {
+	Temperature float64   `json:"temperature"`
+	Offset      int32     `json:"offset"`
+	Time        time.Time `json:"time"`
+}
+
+type WebhookStatus struct {
+	Name    string     `json:"name"`
+	URL     string     `json:"url"`
+	Events  []string   `json:"events,omitempty"`
+	Signed  bool       `json:"signed"`
+	Pending []Delivery `json:"pending"`
+}
+
+// GetLogSettings calls GET /admin/log: log settings.
+//
+// Role admin.
+func (c *Client) GetLogSettings() (*LogSettings, error) {
+	var out LogSettings
+	if err := c.call("GET", "/admin/log", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetLogLevels calls PUT /admin/log: change log levels.
+//
+// Sets the levels of the given modules, the format can not be changed. Role
+// admin.
+func (c *Client) SetLogLevels(body LogSettings) (*LogSettings, error) {
+	var out LogSettings
+	if err := c.call("PUT", "/admin/log", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetAuditParams are the query parameters of GetAudit.
+type GetAuditParams struct {
+	Since *time.Time
+	Until *time.Time
+	// comma separated actions
+	Action string
+	// newest entries only, 0 for all
+	Limit *int
+}
+
+// GetAudit calls GET /audit: audit log.
+//
+// Role operator.
+func (c *Client) GetAudit(params *GetAuditParams) ([]AuditEntry, error) {
+	q := url.Values{}
+	if params != nil {
+		if params.Since != nil {
+			q.Set("since", params.Since.Format(time.RFC3339Nano))
+		}
+		if params.Until != nil {
+			q.Set("until", params.Until.Format(time.RFC3339Nano))
+		}
+		if params.Action != "" {
+			q.Set("action", params.Action)
+		}
+		if params.Limit != nil {
+			q.Set("limit", strconv.Itoa(*params.Limit))
+		}
+	}
+	var out []AuditEntry
+	err := c.call("GET", "/audit", q, nil, &out)
+	return out, err
+}
+
+// ReloadAuth calls POST /auth/reload: reload the auth file.
+//
+// Role admin.
+func (c *Client) ReloadAuth() error {
+	_, data, err := c.do("POST", "/auth/reload", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(data, "auth file reloaded")
+}
+
+// WhoAmI calls GET /auth/whoami: caller identity.
+//
+// Role viewer.
+func (c *Client) WhoAmI() (*Identity, error) {
+	var out Identity
+	if err := c.call("GET", "/auth/whoami", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CalibrateParams are the query parameters of Calibrate.
+type CalibrateParams struct {
+	// global channel number, all channels if omitted
+	Channel *int
+}
+
+// Calibrate calls POST /calibration: calibrate.
+//
+// Calibrates one channel or all channels and waits for the result, refused
+// while another calibration runs. Role operator.
+func (c *Client) Calibrate(params *CalibrateParams) error {
+	q := url.Values{}
+	if params != nil {
+		if params.Channel != nil {
+			q.Set("channel", strconv.Itoa(*params.Channel))
+		}
+	}
+	_, data, err := c.do("POST", "/calibration", q, nil)
+	if err != nil {
+		return err
+	}
+	return expect(data, "Calibration done")
+}
+
+// GetCalibrationProgress calls GET /calibration/progress: running
+// calibrations.
+//
+// Role viewer.
+func (c *Client) GetCalibrationProgress() ([]CalibrationProgress, error) {
+	var out []CalibrationProgress
+	err := c.call("GET", "/calibration/progress", nil, nil, &out)
+	return out, err
+}
+
+// GetCompensation calls GET /compensation: temperature compensation.
+//
+// Role viewer.
+func (c *Client) GetCompensation() (*Compensation, error) {
+	var out Compensation
+	if err := c.call("GET", "/compensation", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ClearOffsetTableParams are the query parameters of ClearOffsetTable.
+type ClearOffsetTableParams struct {
+	// only the points of this device
+	Device string
+}
+
+// ClearOffsetTable calls DELETE /compensation/table: clear the offset table.
+//
+// Role operator.
+func (c *Client) ClearOffsetTable(params *ClearOffsetTableParams) (OffsetTable, error) {
+	q := url.Values{}
+	if params != nil {
+		if params.Device != "" {
+			q.Set("device", params.Device)
+		}
+	}
+	var out OffsetTable
+	err := c.call("DELETE", "/compensation/table", q, nil, &out)
+	return out, err
+}
+
+// GetDevices calls GET /devices: calibrated devices.
+//
+// Lists the devices in the order of the global channel numbers. Role viewer.
+func (c *Client) GetDevices() ([]DeviceInfo, error) {
+	var out []DeviceInfo
+	err := c.call("GET", "/devices", nil, nil, &out)
+	return out, err
+}
+
+// GetCaptureParams are the query parameters of GetCapture.
+type GetCaptureParams struct {
+	// samples per channel, default 256
+	Samples *int
+	// comma separated channel numbers of the device, default all
+	Channels string
+}
+
+// GetCapture calls GET /devices/{dev}/capture: capture samples.
+//
+// Role viewer.
+func (c *Client) GetCapture(dev string, params *GetCaptureParams) (*Capture, error) {
+	q := url.Values{}
+	if params != nil {
+		if params.Samples != nil {
+			q.Set("samples", strconv.Itoa(*params.Samples))
+		}
+		if params.Channels != "" {
+			q.Set("channels", params.Channels)
+		}
+	}
+	var out Capture
+	if err := c.call("GET", "/devices/"+url.PathEscape(dev)+"/capture", q, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DumpRegistersParams are the query parameters of DumpRegisters.
+type DumpRegistersParams struct {
+	// first register address, decimal or 0x hex, default 0
+	Start string
+	// last register address, default the last register
+	End string
+	// decode the registers with the register map
+	Decode *bool
+}
+
+// DumpRegisters calls GET /devices/{dev}/registers: read a register range.
+//
+// Reads the readable registers of a range, decoded into named fields with
+// decode=true if the device has a register map. Role viewer.
+func (c *Client) DumpRegisters(dev string, params *DumpRegistersParams) (json.RawMessage, error) {
+	q := url.Values{}
+	if params != nil {
+		if params.Start != "" {
+			q.Set("start", params.Start)
+		}
+		if params.End != "" {
+			q.Set("end", params.End)
+		}
+		if params.Decode != nil {
+			q.Set("decode", strconv.FormatBool(*params.Decode))
+		}
+	}
+	var out json.RawMessage
+	err := c.call("GET", "/devices/"+url.PathEscape(dev)+"/registers", q, nil, &out)
+	return out, err
+}
+
+// ReadRegisterParams are the query parameters of ReadRegister.
+type ReadRegisterParams struct {
+	// decode the registers with the register map
+	Decode *bool
+}
+
+// ReadRegister calls GET /devices/{dev}/registers/{addr}: read a register.
+//
+// Role viewer.
+func (c *Client) ReadRegister(dev string, addr string, params *ReadRegisterParams) (json.RawMessage, error) {
+	q := url.Values{}
+	if params != nil {
+		if params.Decode != nil {
+			q.Set("decode", strconv.FormatBool(*params.Decode))
+		}
+	}
+	var out json.RawMessage
+	err := c.call("GET", "/devices/"+url.PathEscape(dev)+"/registers/"+url.PathEscape(addr), q, nil, &out)
+	return out, err
+}
+
+// WriteRegister calls PUT /devices/{dev}/registers/{addr}: write a register.
+//
+// Role operator, the register policy of the device may require more.
+func (c *Client) WriteRegister(dev string, addr string, body RegisterWrite) (*RegisterValue, error) {
+	var out RegisterValue
+	if err := c.call("PUT", "/devices/"+url.PathEscape(dev)+"/registers/"+url.PathEscape(addr), nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetRegisterMap calls GET /devices/{dev}/regmap: register map.
+//
+// Role viewer.
+func (c *Client) GetRegisterMap(dev string) (*RegisterMap, error) {
+	var out RegisterMap
+	if err := c.call("GET", "/devices/"+url.PathEscape(dev)+"/regmap", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetDriftParams are the query parameters of GetDrift.
+type GetDriftParams struct {
+	Device string
+	// channel number of the device
+	Channel *int
+	// duration like 24h
+	Since string
+}
+
+// GetDrift calls GET /drift: drift series.
+//
+// Role viewer.
+func (c *Client) GetDrift(params *GetDriftParams) ([]DriftSeries, error) {
+	q := url.Values{}
+	if params != nil {
+		if params.Device != "" {
+			q.Set("device", params.Device)
+		}
+		if params.Channel != nil {
+			q.Set("channel", strconv.Itoa(*params.Channel))
+		}
+		if params.Since != "" {
+			q.Set("since", params.Since)
+		}
+	}
+	var out []DriftSeries
+	err := c.call("GET", "/drift", q, nil, &out)
+	return out, err
+}
+
+// GetEvents calls GET /events: event stream.
+//
+// Server-sent events: the webhook events and calibration.progress with a
+// CalibrationProgress, until the client disconnects. Role viewer.
+func (c *Client) GetEvents() (io.ReadCloser, error) {
+	return c.stream("GET", "/events", nil, nil)
+}
+
+// Healthz calls GET /healthz: liveness.
+func (c *Client) Healthz() (*Health, error) {
+	var out Health
+	if err := c.call("GET", "/healthz", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetHistoryParams are the query parameters of GetHistory.
+type GetHistoryParams struct {
+	// maximum number of records, default 100
+	Limit *int
+	// only the calibrations started by api, cli, scheduled or mqtt
+	Origin string
+	// only the calibration started by the request with this X-Request-ID
+	RequestID string
+}
+
+// GetHistory calls GET /history: calibration history.
+//
+// Role viewer.
+func (c *Client) GetHistory(params *GetHistoryParams) ([]CalibrationRecord, error) {
+	q := url.Values{}
+	if params != nil {
+		if params.Limit != nil {
+			q.Set("limit", strconv.Itoa(*params.Limit))
+		}
+		if params.Origin != "" {
+			q.Set("origin", params.Origin)
+		}
+		if params.RequestID != "" {
+			q.Set("requestId", params.RequestID)
+		}
+	}
+	var out []CalibrationRecord
+	err := c.call("GET", "/history", q, nil, &out)
+	return out, err
+}
+
+// RollbackCalibration calls POST /history/{job}/rollback: restore the
+// offsets of a calibration.
+//
+// Imports the offsets recorded by a successful calibration. Role operator.
+func (c *Client) RollbackCalibration(job string) (Params, error) {
+	var out Params
+	err := c.call("POST", "/history/"+url.PathEscape(job)+"/rollback", nil, nil, &out)
+	return out, err
+}
+
+// GetMetrics calls GET /metrics: metrics for Prometheus.
+//
+// Role viewer.
+func (c *Client) GetMetrics() (string, error) {
+	_, data, err := c.do("GET", "/metrics", nil, nil)
+	return string(data), err
+}
+
+// GetOpenAPI calls GET /openapi.json: this document.
+func (c *Client) GetOpenAPI() (json.RawMessage, error) {
+	var out json.RawMessage
+	err := c.call("GET", "/openapi.json", nil, nil, &out)
+	return out, err
+}
+
+// GetParams calls GET /params: stored offsets.
+//
+// Returns the offsets of the calibration file, null if the board was never
+// calibrated. Role viewer.
+func (c *Client) GetParams() (Params, error) {
+	var out Params
+	err := c.call("GET", "/params", nil, nil, &out)
+	return out, err
+}
+
+// PutParams calls PUT /params: import offsets.
+//
+// Writes the offsets to the offset registers and the calibration file. Role
+// operator.
+func (c *Client) PutParams(body Params) (Params, error) {
+	var out Params
+	err := c.call("PUT", "/params", nil, body, &out)
+	return out, err
+}
+
+// Readyz calls GET /readyz: readiness.
+//
+// Checks the devices, the storage, the stored offsets and the backend.
+func (c *Client) Readyz() (*Health, error) {
+	var out Health
+	if err := c.call("GET", "/readyz", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RequestReboot calls POST /reboot: reboot the board.
+//
+// A request without token returns a confirmation token, repeating the
+// request with the token schedules the reboot. Refused while hardware
+// operations run. Role operator.
+func (c *Client) RequestReboot(body *RebootRequest) (*RequestRebootResult, error) {
+	var in interface{}
+	if body != nil {
+		in = body
+	}
+	status, data, err := c.do("POST", "/reboot", nil, in)
+	if err != nil {
+		return nil, err
+	}
+	var out RequestRebootResult
+	switch status {
+	case 200:
+		out.PendingReboot = new(PendingReboot)
+		err = decode(data, out.PendingReboot)
+	case 202:
+		out.RebootToken = new(RebootToken)
+		err = decode(data, out.RebootToken)
+	default:
+		err = fmt.Errorf("RequestReboot: unexpected status %d", status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RequestRebootResult is the result of RequestReboot, one of the fields is
+// set.
+type RequestRebootResult struct {
+	// status 200
+	PendingReboot *PendingReboot
+	// status 202
+	RebootToken *RebootToken
+}
+
+// CancelReboot calls DELETE /reboot: cancel the scheduled reboot.
+//
+// Role operator.
+func (c *Client) CancelReboot() error {
+	_, data, err := c.do("DELETE", "/reboot", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(data, "reboot cancelled")
+}
+
+// GetRegParams calls GET /regparams: applied offsets.
+//
+// Reads the offset registers of all channels. Role viewer.
+func (c *Client) GetRegParams() (Params, error) {
+	var out Params
+	err := c.call("GET", "/regparams", nil, nil, &out)
+	return out, err
+}
+
+// ClearRegParams calls DELETE /regparams: clear offsets.
+//
+// Sets the offset registers of all channels to 0, the calibration file is
+// kept. Role operator.
+func (c *Client) ClearRegParams() error {
+	_, data, err := c.do("DELETE", "/regparams", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(data, "ClearRegsParams done")
+}
+
+// GetSchedule calls GET /schedule: scheduled calibrations.
+//
+// Role viewer.
+func (c *Client) GetSchedule() (*Schedule, error) {
+	var out Schedule
+	if err := c.call("GET", "/schedule", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetCalibrationWindow calls PUT /schedule/window: open or close the
+// calibration window.
+//
+// Role operator.
+func (c *Client) SetCalibrationWindow(body CalibrationWindowRequest) (*CalibrationWindow, error) {
+	var out CalibrationWindow
+	if err := c.call("PUT", "/schedule/window", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListSnapshots calls GET /snapshots: register snapshots.
+//
+// Role viewer.
+func (c *Client) ListSnapshots() ([]string, error) {
+	var out []string
+	err := c.call("GET", "/snapshots", nil, nil, &out)
+	return out, err
+}
+
+// CreateSnapshot calls POST /snapshots: take a register snapshot.
+//
+// Role operator.
+func (c *Client) CreateSnapshot(body SnapshotRequest) (*Snapshot, error) {
+	var out Snapshot
+	if err := c.call("POST", "/snapshots", nil, body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetSnapshot calls GET /snapshots/{name}: register snapshot.
+//
+// Role viewer.
+func (c *Client) GetSnapshot(name string) (*Snapshot, error) {
+	var out Snapshot
+	if err := c.call("GET", "/snapshots/"+url.PathEscape(name), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteSnapshot calls DELETE /snapshots/{name}: delete a register snapshot.
+//
+// Role operator.
+func (c *Client) DeleteSnapshot(name string) error {
+	_, data, err := c.do("DELETE", "/snapshots/"+url.PathEscape(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(data, "snapshot deleted")
+}
+
+// DiffSnapshot calls GET /snapshots/{name}/diff: registers changed since a
+// snapshot.
+//
+// Role viewer.
+func (c *Client) DiffSnapshot(name string) ([]RegisterDiff, error) {
+	var out []RegisterDiff
+	err := c.call("GET", "/snapshots/"+url.PathEscape(name)+"/diff", nil, nil, &out)
+	return out, err
+}
+
+// RestoreSnapshot calls POST /snapshots/{name}/restore: restore a register
+// snapshot.
+//
+// Writes the changed registers back in the order of the register policy.
+// Role admin.
+func (c *Client) RestoreSnapshot(name string) ([]RegisterDiff, error) {
+	var out []RegisterDiff
+	err := c.call("POST", "/snapshots/"+url.PathEscape(name)+"/restore", nil, nil, &out)
+	return out, err
+}
+
+// GetStatus calls GET /status: runtime state.
+//
+// Role viewer.
+func (c *Client) GetStatus() (*Status, error) {
+	var out Status
+	if err := c.call("GET", "/status", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetWebhooks calls GET /webhooks: webhooks and undelivered events.
+//
+// Role operator.
+func (c *Client) GetWebhooks() ([]WebhookStatus, error) {
+	var out []WebhookStatus
+	err := c.call("GET", "/webhooks", nil, nil, &out)
+	return out, err
+}
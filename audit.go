@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os/user"
+
+	"github.com/plpsy/iiocalibration/api"
+	"github.com/urfave/cli"
+)
+
+// localAudit records a state changing subcommand run on the board itself.
+func localAudit(ctx *cli.Context, action string, params map[string]string, before, after interface{}, err error) {
+	api.OpenAuditLog(api.CurrentConfig().Server.AuditLog)
+	name := "cli"
+	if u, uerr := user.Current(); uerr == nil {
+		name = "cli:" + u.Username
+	}
+	e := &api.AuditEntry{
+		User:     name,
+		Role:     api.RoleAdmin,
+		Remote:   "local",
+		Endpoint: ctx.Command.HelpName,
+		Action:   action,
+		Params:   params,
+		Before:   before,
+		After:    after,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	api.Audit(e)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/plpsy/iiocalibration/api"
+	"github.com/urfave/cli"
+)
+
+var cmdAuth = cli.Command{
+	Name:  "auth",
+	Usage: "manage the API auth file",
+	Subcommands: []cli.Command{
+		{
+			Name:      "hash-password",
+			Usage:     "hash a password (read from stdin if not given) for the users of the auth file",
+			ArgsUsage: "[password]",
+			Action:    actionHashPassword,
+		},
+	},
+}
+
+func actionHashPassword(ctx *cli.Context) error {
+	password := ctx.Args().First()
+	if password == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	hash, err := api.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
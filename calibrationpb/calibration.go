@@ -0,0 +1,526 @@
+// Package calibrationpb holds the messages and the client of the gRPC API
+// defined in calibration.proto, encoded by hand with package grpc. Other
+// languages generate their stubs from calibration.proto.
+package calibrationpb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/plpsy/iiocalibration/grpc"
+)
+
+// Full method names of the Calibration service.
+const (
+	MethodCalibrate            = "/iiocalibration.v1.Calibration/Calibrate"
+	MethodGetOffsetRegisters   = "/iiocalibration.v1.Calibration/GetOffsetRegisters"
+	MethodClearOffsetRegisters = "/iiocalibration.v1.Calibration/ClearOffsetRegisters"
+	MethodGetParams            = "/iiocalibration.v1.Calibration/GetParams"
+	MethodCapture              = "/iiocalibration.v1.Calibration/Capture"
+	MethodGetStatus            = "/iiocalibration.v1.Calibration/GetStatus"
+)
+
+// decodeFields calls field for each field of a message until the end or an
+// error.
+func decodeFields(d *grpc.Decoder, field func(n int) error) error {
+	for {
+		n, err := d.Next()
+		if n == 0 || err != nil {
+			return err
+		}
+		if err := field(n); err != nil {
+			return err
+		}
+	}
+}
+
+// timestamp is a google.protobuf.Timestamp.
+type timestamp struct {
+	t time.Time
+}
+
+func (m *timestamp) MarshalProto(e *grpc.Encoder) {
+	e.Int64(1, m.t.Unix())
+	e.Int32(2, int32(m.t.Nanosecond()))
+}
+
+func (m *timestamp) UnmarshalProto(d *grpc.Decoder) error {
+	var sec int64
+	var nsec int32
+	err := decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			sec, err = d.Int64()
+		case 2:
+			nsec, err = d.Int32()
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+	m.t = time.Unix(sec, int64(nsec))
+	return err
+}
+
+// encodeTime encodes a Timestamp field, the zero time is omitted.
+func encodeTime(e *grpc.Encoder, field int, t time.Time) {
+	if !t.IsZero() {
+		e.Message(field, &timestamp{t})
+	}
+}
+
+func decodeTime(d *grpc.Decoder) (time.Time, error) {
+	var ts timestamp
+	err := d.Message(&ts)
+	return ts.t, err
+}
+
+// Empty is a google.protobuf.Empty.
+type Empty struct{}
+
+func (m *Empty) MarshalProto(e *grpc.Encoder) {}
+
+func (m *Empty) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) error { return d.Skip() })
+}
+
+type CalibrateRequest struct {
+	// global channel numbers, all channels if empty
+	Channels []int32
+}
+
+func (m *CalibrateRequest) MarshalProto(e *grpc.Encoder) {
+	e.PackedInt32(1, m.Channels)
+}
+
+func (m *CalibrateRequest) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.Channels, err = d.Int32s(m.Channels)
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+type CalibrationProgress struct {
+	JobID    string
+	Origin   string
+	Started  time.Time
+	Channels []int32
+	Done     []int32
+	// settle, capture, finished or failed
+	Step   string
+	Device string
+	Error  string
+	// offset registers after the calibration, in the last message
+	Offsets Offsets
+}
+
+func (m *CalibrationProgress) MarshalProto(e *grpc.Encoder) {
+	e.String(1, m.JobID)
+	e.String(2, m.Origin)
+	encodeTime(e, 3, m.Started)
+	e.PackedInt32(4, m.Channels)
+	e.PackedInt32(5, m.Done)
+	e.String(6, m.Step)
+	e.String(7, m.Device)
+	e.String(8, m.Error)
+	if m.Offsets != nil {
+		e.Message(9, &m.Offsets)
+	}
+}
+
+func (m *CalibrationProgress) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.JobID, err = d.String()
+		case 2:
+			m.Origin, err = d.String()
+		case 3:
+			m.Started, err = decodeTime(d)
+		case 4:
+			m.Channels, err = d.Int32s(m.Channels)
+		case 5:
+			m.Done, err = d.Int32s(m.Done)
+		case 6:
+			m.Step, err = d.String()
+		case 7:
+			m.Device, err = d.String()
+		case 8:
+			m.Error, err = d.String()
+		case 9:
+			err = d.Message(&m.Offsets)
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+// Offsets are the offsets by device and channel, encoded as the repeated
+// DeviceOffsets of the Offsets message.
+type Offsets map[string]map[int]int32
+
+func (m *Offsets) MarshalProto(e *grpc.Encoder) {
+	devices := make([]string, 0, len(*m))
+	for dev := range *m {
+		devices = append(devices, dev)
+	}
+	sort.Strings(devices)
+	for _, dev := range devices {
+		e.Message(1, &deviceOffsets{dev, (*m)[dev]})
+	}
+}
+
+func (m *Offsets) UnmarshalProto(d *grpc.Decoder) error {
+	if *m == nil {
+		*m = make(Offsets)
+	}
+	return decodeFields(d, func(n int) error {
+		if n != 1 {
+			return d.Skip()
+		}
+		dev := deviceOffsets{offsets: make(map[int]int32)}
+		if err := d.Message(&dev); err != nil {
+			return err
+		}
+		// 同一设备出现多次时合并
+		if (*m)[dev.device] == nil {
+			(*m)[dev.device] = dev.offsets
+			return nil
+		}
+		for ch, off := range dev.offsets {
+			(*m)[dev.device][ch] = off
+		}
+		return nil
+	})
+}
+
+type deviceOffsets struct {
+	device  string
+	offsets map[int]int32
+}
+
+func (m *deviceOffsets) MarshalProto(e *grpc.Encoder) {
+	e.String(1, m.device)
+	channels := make([]int, 0, len(m.offsets))
+	for ch := range m.offsets {
+		channels = append(channels, ch)
+	}
+	sort.Ints(channels)
+	for _, ch := range channels {
+		e.Message(2, &int32Entry{int32(ch), m.offsets[ch]})
+	}
+}
+
+func (m *deviceOffsets) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.device, err = d.String()
+		case 2:
+			var entry int32Entry
+			if err = d.Message(&entry); err == nil {
+				m.offsets[int(entry.key)] = entry.value
+			}
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+// int32Entry is an entry of a map<int32, int32>.
+type int32Entry struct {
+	key, value int32
+}
+
+func (m *int32Entry) MarshalProto(e *grpc.Encoder) {
+	e.Int32(1, m.key)
+	e.Int32(2, m.value)
+}
+
+func (m *int32Entry) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.key, err = d.Int32()
+		case 2:
+			m.value, err = d.Int32()
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+// stringEntry is an entry of a map<string, int32>.
+type stringEntry struct {
+	key   string
+	value int32
+}
+
+func (m *stringEntry) MarshalProto(e *grpc.Encoder) {
+	e.String(1, m.key)
+	e.Int32(2, m.value)
+}
+
+func (m *stringEntry) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.key, err = d.String()
+		case 2:
+			m.value, err = d.Int32()
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+type CaptureRequest struct {
+	Device string
+	// channels of the device, all channels if empty
+	Channels []int32
+	// samples per channel and frame, default 256
+	Samples int32
+	// number of frames, 0 until the call is canceled
+	Count      int32
+	IntervalMS int32
+}
+
+func (m *CaptureRequest) MarshalProto(e *grpc.Encoder) {
+	e.String(1, m.Device)
+	e.PackedInt32(2, m.Channels)
+	e.Int32(3, m.Samples)
+	e.Int32(4, m.Count)
+	e.Int32(5, m.IntervalMS)
+}
+
+func (m *CaptureRequest) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.Device, err = d.String()
+		case 2:
+			m.Channels, err = d.Int32s(m.Channels)
+		case 3:
+			m.Samples, err = d.Int32()
+		case 4:
+			m.Count, err = d.Int32()
+		case 5:
+			m.IntervalMS, err = d.Int32()
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+type CaptureFrame struct {
+	Device   string
+	Samples  int32
+	Sequence int32
+	Time     time.Time
+	Channels []ChannelSamples
+}
+
+func (m *CaptureFrame) MarshalProto(e *grpc.Encoder) {
+	e.String(1, m.Device)
+	e.Int32(2, m.Samples)
+	e.Int32(3, m.Sequence)
+	encodeTime(e, 4, m.Time)
+	for i := range m.Channels {
+		e.Message(5, &m.Channels[i])
+	}
+}
+
+func (m *CaptureFrame) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.Device, err = d.String()
+		case 2:
+			m.Samples, err = d.Int32()
+		case 3:
+			m.Sequence, err = d.Int32()
+		case 4:
+			m.Time, err = decodeTime(d)
+		case 5:
+			var ch ChannelSamples
+			if err = d.Message(&ch); err == nil {
+				m.Channels = append(m.Channels, ch)
+			}
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+type ChannelSamples struct {
+	Channel int32
+	// signed 24 bit samples
+	Values []int32
+}
+
+func (m *ChannelSamples) MarshalProto(e *grpc.Encoder) {
+	e.Int32(1, m.Channel)
+	e.PackedSint32(2, m.Values)
+}
+
+func (m *ChannelSamples) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.Channel, err = d.Int32()
+		case 2:
+			m.Values, err = d.Sint32s(m.Values)
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+type Status struct {
+	Version            string
+	Started            time.Time
+	Uptime             string
+	Operations         map[string]int32
+	PendingReboot      *PendingReboot
+	SupervisorRestarts int32
+	SupervisorLastExit string
+	DriftAlerts        []DriftAlert
+}
+
+func (m *Status) MarshalProto(e *grpc.Encoder) {
+	e.String(1, m.Version)
+	encodeTime(e, 2, m.Started)
+	e.String(3, m.Uptime)
+	kinds := make([]string, 0, len(m.Operations))
+	for kind := range m.Operations {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		e.Message(4, &stringEntry{kind, m.Operations[kind]})
+	}
+	if m.PendingReboot != nil {
+		e.Message(5, m.PendingReboot)
+	}
+	e.Int32(6, m.SupervisorRestarts)
+	e.String(7, m.SupervisorLastExit)
+	for i := range m.DriftAlerts {
+		e.Message(8, &m.DriftAlerts[i])
+	}
+}
+
+func (m *Status) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.Version, err = d.String()
+		case 2:
+			m.Started, err = decodeTime(d)
+		case 3:
+			m.Uptime, err = d.String()
+		case 4:
+			var entry stringEntry
+			if err = d.Message(&entry); err == nil {
+				if m.Operations == nil {
+					m.Operations = make(map[string]int32)
+				}
+				m.Operations[entry.key] = entry.value
+			}
+		case 5:
+			m.PendingReboot = new(PendingReboot)
+			err = d.Message(m.PendingReboot)
+		case 6:
+			m.SupervisorRestarts, err = d.Int32()
+		case 7:
+			m.SupervisorLastExit, err = d.String()
+		case 8:
+			var alert DriftAlert
+			if err = d.Message(&alert); err == nil {
+				m.DriftAlerts = append(m.DriftAlerts, alert)
+			}
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+type PendingReboot struct {
+	At          time.Time
+	RequestedBy string
+}
+
+func (m *PendingReboot) MarshalProto(e *grpc.Encoder) {
+	encodeTime(e, 1, m.At)
+	e.String(2, m.RequestedBy)
+}
+
+func (m *PendingReboot) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.At, err = decodeTime(d)
+		case 2:
+			m.RequestedBy, err = d.String()
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
+
+type DriftAlert struct {
+	Device  string
+	Channel int32
+	// threshold and/or slope
+	Kinds    []string
+	Residual int32
+	Slope    float64
+	Since    time.Time
+}
+
+func (m *DriftAlert) MarshalProto(e *grpc.Encoder) {
+	e.String(1, m.Device)
+	e.Int32(2, m.Channel)
+	e.Strings(3, m.Kinds)
+	e.Int32(4, m.Residual)
+	e.Double(5, m.Slope)
+	encodeTime(e, 6, m.Since)
+}
+
+func (m *DriftAlert) UnmarshalProto(d *grpc.Decoder) error {
+	return decodeFields(d, func(n int) (err error) {
+		switch n {
+		case 1:
+			m.Device, err = d.String()
+		case 2:
+			m.Channel, err = d.Int32()
+		case 3:
+			var kind string
+			if kind, err = d.String(); err == nil {
+				m.Kinds = append(m.Kinds, kind)
+			}
+		case 4:
+			m.Residual, err = d.Int32()
+		case 5:
+			m.Slope, err = d.Double()
+		case 6:
+			m.Since, err = decodeTime(d)
+		default:
+			err = d.Skip()
+		}
+		return err
+	})
+}
@@ -0,0 +1,95 @@
+package calibrationpb
+
+import (
+	"context"
+	"io"
+
+	"github.com/plpsy/iiocalibration/grpc"
+)
+
+// Client calls the Calibration service.
+type Client struct {
+	*grpc.Client
+}
+
+// NewClient returns a client of the server at baseURL, http://host:port
+// or https://host:port. apiKey is sent as x-api-key if it is not empty.
+func NewClient(baseURL, apiKey string) *Client {
+	c := grpc.NewClient(baseURL)
+	if apiKey != "" {
+		c.Header.Set("X-API-Key", apiKey)
+	}
+	return &Client{c}
+}
+
+// Calibrate calibrates the channels, all if none are given, and calls
+// progress for each progress message. It returns the last message.
+func (c *Client) Calibrate(ctx context.Context, req *CalibrateRequest, progress func(*CalibrationProgress)) (*CalibrationProgress, error) {
+	s, err := c.Stream(ctx, MethodCalibrate, req)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	var last *CalibrationProgress
+	for {
+		p := new(CalibrationProgress)
+		if err := s.Recv(p); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return last, err
+		}
+		if progress != nil {
+			progress(p)
+		}
+		last = p
+	}
+}
+
+func (c *Client) GetOffsetRegisters(ctx context.Context) (Offsets, error) {
+	var resp Offsets
+	err := c.Call(ctx, MethodGetOffsetRegisters, &Empty{}, &resp)
+	return resp, err
+}
+
+func (c *Client) ClearOffsetRegisters(ctx context.Context) (Offsets, error) {
+	var resp Offsets
+	err := c.Call(ctx, MethodClearOffsetRegisters, &Empty{}, &resp)
+	return resp, err
+}
+
+func (c *Client) GetParams(ctx context.Context) (Offsets, error) {
+	var resp Offsets
+	err := c.Call(ctx, MethodGetParams, &Empty{}, &resp)
+	return resp, err
+}
+
+// Capture calls frame for each captured frame until it returns false, the
+// count of the request is reached or the call fails.
+func (c *Client) Capture(ctx context.Context, req *CaptureRequest, frame func(*CaptureFrame) bool) error {
+	s, err := c.Stream(ctx, MethodCapture, req)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	for {
+		f := new(CaptureFrame)
+		if err := s.Recv(f); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !frame(f) {
+			return nil
+		}
+	}
+}
+
+func (c *Client) GetStatus(ctx context.Context) (*Status, error) {
+	resp := new(Status)
+	if err := c.Call(ctx, MethodGetStatus, &Empty{}, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
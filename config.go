@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/plpsy/iiocalibration/api"
+	"github.com/urfave/cli"
+)
+
+var defaultConfig = api.DefaultConfig()
+
+var cmdConfig = cli.Command{
+	Name:  "config",
+	Usage: "server configuration file",
+	Subcommands: []cli.Command{
+		{
+			Name:   "show",
+			Usage:  "print the configuration with the flag and environment overrides applied",
+			Action: actionConfigShow,
+		},
+	},
+}
+
+// isSet reports whether a flag was given before or after the command name
+// or by its environment variable.
+func isSet(ctx *cli.Context, name string) bool {
+	return ctx.IsSet(name) || ctx.GlobalIsSet(name)
+}
+
+func flagString(ctx *cli.Context, name string) string {
+	if ctx.IsSet(name) {
+		return ctx.String(name)
+	}
+	return ctx.GlobalString(name)
+}
+
+// loadConfig reads the config file and overrides its server settings and the
+// modbus listener by the flags that are set.
+func loadConfig(ctx *cli.Context) (*api.Config, error) {
+	cfg, err := api.LoadConfigFile(flagString(ctx, "config"))
+	if err != nil {
+		return nil, err
+	}
+	s := &cfg.Server
+	for name, value := range map[string]*string{
+		"listen":        &s.Listen,
+		"grpc-listen":   &s.GRPCListen,
+		"modbus-listen": &cfg.Modbus.Listen,
+		"auth-file":     &s.AuthFile,
+		"audit-log":     &s.AuditLog,
+		"tls-cert":      &s.TLSCert,
+		"tls-key":       &s.TLSKey,
+		"client-ca":     &s.ClientCA,
+		"log-format":    &s.LogFormat,
+	} {
+		if isSet(ctx, name) {
+			*value = flagString(ctx, name)
+		}
+	}
+	if isSet(ctx, "debug") {
+		s.Debug = ctx.Bool("debug") || ctx.GlobalBool("debug")
+	}
+	if isSet(ctx, "simulate") {
+		s.Simulate = ctx.Bool("simulate") || ctx.GlobalBool("simulate")
+	}
+	if isSet(ctx, "tls-generate") {
+		s.TLSGenerate = ctx.Bool("tls-generate") || ctx.GlobalBool("tls-generate")
+	}
+	if ctx.IsSet("shutdown-timeout") {
+		s.ShutdownTimeout.Duration = ctx.Duration("shutdown-timeout")
+	} else if ctx.GlobalIsSet("shutdown-timeout") {
+		s.ShutdownTimeout.Duration = ctx.GlobalDuration("shutdown-timeout")
+	}
+	return cfg, cfg.Validate()
+}
+
+// applyConfig loads and applies the configuration for the command of ctx.
+func applyConfig(ctx *cli.Context) (*api.Config, error) {
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = api.ApplyConfig(flagString(ctx, "config"), cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Server.Simulate {
+		api.SetBackend(api.NewSimBackend(time.Now().UnixNano()))
+	}
+	level := "info"
+	if cfg.Server.Debug {
+		level = "debug"
+	}
+	api.SetLogLevel("", level)
+	api.ApplyLogLevels(cfg.Server.LogLevels)
+	api.SetLogFormat(cfg.Server.LogFormat)
+	return cfg, nil
+}
+
+func actionConfigShow(ctx *cli.Context) error {
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg)
+}
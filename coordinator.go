@@ -0,0 +1,642 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/plpsy/iiocalibration/apiclient"
+	"github.com/urfave/cli"
+)
+
+// fleet is the file of the boards operated by the coordinator command.
+type fleet struct {
+	// API key of the boards without their own
+	APIKey string `json:"apiKey,omitempty"`
+	// CA certificates file to verify the https boards
+	CACert string `json:"caCert,omitempty"`
+	// boards operated at the same time, default 4
+	Concurrency int          `json:"concurrency,omitempty"`
+	Boards      []fleetBoard `json:"boards"`
+}
+
+type fleetBoard struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+const defaultConcurrency = 4
+
+// loadFleet reads a fleet file, a missing file is an empty fleet.
+func loadFleet(path string) (*fleet, error) {
+	f := &fleet{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("fleet file %s: %v", path, err)
+	}
+	if err := f.validate(); err != nil {
+		return nil, fmt.Errorf("fleet file %s: %v", path, err)
+	}
+	return f, nil
+}
+
+func (f *fleet) validate() error {
+	if f.Concurrency < 0 {
+		return fmt.Errorf("concurrency must not be negative")
+	}
+	names := make(map[string]bool)
+	for _, b := range f.Boards {
+		if b.Name == "" {
+			return fmt.Errorf("board without name")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("board %s listed twice", b.Name)
+		}
+		names[b.Name] = true
+		if u, err := url.Parse(b.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("board %s: url %q is not a http:// or https:// URL", b.Name, b.URL)
+		}
+	}
+	return nil
+}
+
+// save writes the fleet file through a temporary file.
+func (f *fleet) save(path string) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// boards returns the boards of names, all boards if names is empty.
+func (f *fleet) boards(names []string) ([]fleetBoard, error) {
+	if len(names) == 0 {
+		return f.Boards, nil
+	}
+	var boards []fleetBoard
+	for _, name := range names {
+		b, ok := f.board(name)
+		if !ok {
+			return nil, fmt.Errorf("board %s not in the fleet", name)
+		}
+		boards = append(boards, b)
+	}
+	return boards, nil
+}
+
+func (f *fleet) board(name string) (fleetBoard, bool) {
+	for _, b := range f.Boards {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return fleetBoard{}, false
+}
+
+// client returns the API client of a board.
+func (f *fleet) client(b fleetBoard) (*apiclient.Client, error) {
+	key := b.APIKey
+	if key == "" {
+		key = f.APIKey
+	}
+	c := apiclient.New(b.URL, key)
+	if f.CACert != "" {
+		pem, err := ioutil.ReadFile(f.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", f.CACert)
+		}
+		c.HTTPClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	return c, nil
+}
+
+// forEachBoard calls fn for the boards, at most concurrency at a time, and
+// waits for all calls.
+func forEachBoard(boards []fleetBoard, concurrency int, fn func(i int, b fleetBoard)) {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, b := range boards {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, b fleetBoard) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i, b)
+		}(i, b)
+	}
+	wg.Wait()
+}
+
+// boardStatus is a row of the status table.
+type boardStatus struct {
+	Name            string                       `json:"name"`
+	URL             string                       `json:"url"`
+	Version         string                       `json:"version,omitempty"`
+	Uptime          string                       `json:"uptime,omitempty"`
+	Ready           bool                         `json:"ready"`
+	Operations      map[string]int               `json:"operations,omitempty"`
+	PendingReboot   *apiclient.PendingReboot     `json:"pendingReboot,omitempty"`
+	DriftAlerts     int                          `json:"driftAlerts"`
+	LastCalibration *apiclient.CalibrationRecord `json:"lastCalibration,omitempty"`
+	Error           string                       `json:"error,omitempty"`
+}
+
+// fleetStatus queries the status, readiness and last calibration of the
+// boards.
+func fleetStatus(f *fleet, boards []fleetBoard) []boardStatus {
+	statuses := make([]boardStatus, len(boards))
+	forEachBoard(boards, f.Concurrency, func(i int, b fleetBoard) {
+		st := &statuses[i]
+		st.Name, st.URL = b.Name, b.URL
+		c, err := f.client(b)
+		if err == nil {
+			err = queryBoardStatus(c, st)
+		}
+		if err != nil {
+			st.Error = err.Error()
+		}
+	})
+	return statuses
+}
+
+func queryBoardStatus(c *apiclient.Client, st *boardStatus) error {
+	status, err := c.GetStatus()
+	if err != nil {
+		return err
+	}
+	st.Version, st.Uptime = status.Version, status.Uptime
+	st.Operations, st.PendingReboot = status.Operations, status.PendingReboot
+	st.DriftAlerts = len(status.DriftAlerts)
+	// 未就绪时返回 503
+	_, err = c.Readyz()
+	st.Ready = err == nil
+	limit := 1
+	history, err := c.GetHistory(&apiclient.GetHistoryParams{Limit: &limit})
+	if err != nil {
+		return err
+	}
+	if len(history) > 0 {
+		st.LastCalibration = &history[0]
+	}
+	return nil
+}
+
+// calibrationResult is the result of the calibration of a board.
+type calibrationResult struct {
+	Name     string           `json:"name"`
+	URL      string           `json:"url"`
+	Version  string           `json:"version,omitempty"`
+	OK       bool             `json:"ok"`
+	JobID    string           `json:"jobId,omitempty"`
+	Duration string           `json:"duration,omitempty"`
+	Offsets  apiclient.Params `json:"offsets,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// fleetCalibrate calibrates the channel, all channels if it is negative, of
+// the boards, concurrency boards at a time.
+func fleetCalibrate(f *fleet, boards []fleetBoard, channel, concurrency int) []calibrationResult {
+	results := make([]calibrationResult, len(boards))
+	forEachBoard(boards, concurrency, func(i int, b fleetBoard) {
+		res := &results[i]
+		res.Name, res.URL = b.Name, b.URL
+		c, err := f.client(b)
+		if err == nil {
+			err = calibrateBoard(c, channel, res)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		res.OK = res.Error == ""
+	})
+	return results
+}
+
+func calibrateBoard(c *apiclient.Client, channel int, res *calibrationResult) error {
+	status, err := c.GetStatus()
+	if err != nil {
+		return err
+	}
+	res.Version = status.Version
+	params := &apiclient.CalibrateParams{}
+	if channel >= 0 {
+		params.Channel = &channel
+	}
+	// 板子在校准历史中记录请求的 X-Request-ID, 据此找到这次校准
+	requestID, err := newRequestID()
+	if err != nil {
+		return err
+	}
+	req := *c
+	req.Header = http.Header{"X-Request-Id": {requestID}}
+	calErr := req.Calibrate(params)
+	history, err := c.GetHistory(&apiclient.GetHistoryParams{RequestID: requestID})
+	if err != nil {
+		if calErr != nil {
+			return calErr
+		}
+		return err
+	}
+	if len(history) == 0 {
+		if calErr != nil {
+			return calErr
+		}
+		return fmt.Errorf("calibration of request %s not in the history", requestID)
+	}
+	rec := history[0]
+	res.JobID, res.Duration, res.Offsets = rec.JobID, rec.Duration, rec.Offsets
+	if calErr != nil {
+		return calErr
+	}
+	if rec.Error != "" {
+		return errors.New(rec.Error)
+	}
+	return nil
+}
+
+// newRequestID returns a random X-Request-ID.
+func newRequestID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "coordinator-" + hex.EncodeToString(b), nil
+}
+
+// pushParams writes params to the offset registers and the calibration file
+// of a board and checks the registers.
+func pushParams(c *apiclient.Client, params apiclient.Params) error {
+	if _, err := c.PutParams(params); err != nil {
+		return err
+	}
+	regs, err := c.GetRegParams()
+	if err != nil {
+		return err
+	}
+	for devName, channels := range params {
+		for chanId, offset := range channels {
+			if v := regs[devName][chanId]; v != offset {
+				return fmt.Errorf("%s channel %d: offset register %d, pushed %d", devName, chanId, v, offset)
+			}
+		}
+	}
+	return nil
+}
+
+var fleetFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "fleet",
+		Usage:  "file with the boards of the fleet",
+		EnvVar: "IIOCALIBRATION_FLEET",
+		Value:  "fleet.json",
+	},
+	cli.StringFlag{
+		Name:  "output, o",
+		Usage: "output format, table or json",
+		Value: "table",
+	},
+}
+
+func withFleetFlags(flags ...cli.Flag) []cli.Flag {
+	return append(flags, fleetFlags...)
+}
+
+var cmdCoordinator = cli.Command{
+	Name:  "coordinator",
+	Usage: "operate a fleet of boards through their HTTP API",
+	Subcommands: []cli.Command{
+		{
+			Name:   "boards",
+			Usage:  "list the boards of the fleet",
+			Flags:  fleetFlags,
+			Action: actionFleetBoards,
+		},
+		{
+			Name:      "add",
+			Usage:     "add a board to the fleet file",
+			ArgsUsage: "<name> <url>",
+			Flags: withFleetFlags(cli.StringFlag{
+				Name:  "api-key",
+				Usage: "API key of the board, default the apiKey of the fleet",
+			}),
+			Action: actionFleetAdd,
+		},
+		{
+			Name:      "remove",
+			Usage:     "remove a board from the fleet file",
+			ArgsUsage: "<name>",
+			Flags:     fleetFlags,
+			Action:    actionFleetRemove,
+		},
+		{
+			Name:      "status",
+			Usage:     "status, version and last calibration of the boards, all if none are given",
+			ArgsUsage: "[name...]",
+			Flags:     fleetFlags,
+			Action:    actionFleetStatus,
+		},
+		{
+			Name:      "calibrate",
+			Usage:     "calibrate the boards, all if none are given",
+			ArgsUsage: "[name...]",
+			Flags: withFleetFlags(
+				cli.IntFlag{
+					Name:  "channel",
+					Usage: "channel counted over all devices, default all channels",
+					Value: -1,
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "boards calibrated at the same time, default the concurrency of the fleet",
+				},
+				cli.StringFlag{
+					Name:  "results",
+					Usage: "write the results with the offsets of the boards to this JSON file",
+				},
+			),
+			Action: actionFleetCalibrate,
+		},
+		{
+			Name:      "push",
+			Usage:     "write a known calibration set to a board, e.g. a replacement board",
+			ArgsUsage: "<name>",
+			Flags: withFleetFlags(
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "board whose stored offsets are pushed",
+				},
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "export file whose offsets are pushed",
+				},
+			),
+			Action: actionFleetPush,
+		},
+	},
+}
+
+// openFleet checks the output flag and loads the fleet file.
+func openFleet(ctx *cli.Context) (*fleet, error) {
+	if f := ctx.String("output"); f != "table" && f != "json" {
+		return nil, cli.NewExitError("--output must be table or json", 1)
+	}
+	f, err := loadFleet(ctx.String("fleet"))
+	if err != nil {
+		return nil, cli.NewExitError(err.Error(), 1)
+	}
+	return f, nil
+}
+
+func actionFleetBoards(ctx *cli.Context) error {
+	f, err := openFleet(ctx)
+	if err != nil {
+		return err
+	}
+	if ctx.String("output") == "json" {
+		return printJSON(f.Boards)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tURL\tAPI KEY")
+	for _, b := range f.Boards {
+		key := "fleet"
+		if b.APIKey != "" {
+			key = "own"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", b.Name, b.URL, key)
+	}
+	return tw.Flush()
+}
+
+func actionFleetAdd(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return cli.NewExitError("usage: "+ctx.Command.HelpName+" "+ctx.Command.ArgsUsage, 1)
+	}
+	f, err := openFleet(ctx)
+	if err != nil {
+		return err
+	}
+	name := ctx.Args().Get(0)
+	if _, ok := f.board(name); ok {
+		return cli.NewExitError("board "+name+" already in the fleet", 1)
+	}
+	f.Boards = append(f.Boards, fleetBoard{Name: name, URL: strings.TrimRight(ctx.Args().Get(1), "/"), APIKey: ctx.String("api-key")})
+	if err := f.save(ctx.String("fleet")); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return printMessage(ctx, "board "+name+" added")
+}
+
+func actionFleetRemove(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("usage: "+ctx.Command.HelpName+" "+ctx.Command.ArgsUsage, 1)
+	}
+	f, err := openFleet(ctx)
+	if err != nil {
+		return err
+	}
+	name := ctx.Args().First()
+	for i, b := range f.Boards {
+		if b.Name == name {
+			f.Boards = append(f.Boards[:i], f.Boards[i+1:]...)
+			if err := f.save(ctx.String("fleet")); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			return printMessage(ctx, "board "+name+" removed")
+		}
+	}
+	return cli.NewExitError("board "+name+" not in the fleet", 1)
+}
+
+func actionFleetStatus(ctx *cli.Context) error {
+	f, err := openFleet(ctx)
+	if err != nil {
+		return err
+	}
+	boards, err := f.boards(ctx.Args())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	statuses := fleetStatus(f, boards)
+	if ctx.String("output") == "json" {
+		return printJSON(statuses)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVERSION\tUPTIME\tREADY\tOPERATIONS\tLAST CALIBRATION\tDRIFT ALERTS\tERROR")
+	versions := make(map[string]int)
+	for _, st := range statuses {
+		if st.Error != "" {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t-\t%s\n", st.Name, st.Error)
+			continue
+		}
+		versions[st.Version]++
+		last := "never"
+		if rec := st.LastCalibration; rec != nil {
+			last = rec.Started.Local().Format(time.RFC3339) + " " + rec.Origin
+			if rec.Error != "" {
+				last += " failed"
+			}
+		}
+		ops := make([]string, 0, len(st.Operations))
+		for kind, n := range st.Operations {
+			ops = append(ops, fmt.Sprintf("%s=%d", kind, n))
+		}
+		sort.Strings(ops)
+		opsText := strings.Join(ops, ",")
+		if opsText == "" {
+			opsText = "-"
+		}
+		if st.PendingReboot != nil {
+			opsText += " reboot " + st.PendingReboot.At.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\t%s\t%d\t\n", st.Name, st.Version, st.Uptime, st.Ready, opsText, last, st.DriftAlerts)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(versions) > 1 {
+		var list []string
+		for v, n := range versions {
+			list = append(list, fmt.Sprintf("%s (%d)", v, n))
+		}
+		sort.Strings(list)
+		fmt.Fprintln(os.Stderr, "mixed versions: "+strings.Join(list, ", "))
+	}
+	return nil
+}
+
+func actionFleetCalibrate(ctx *cli.Context) error {
+	f, err := openFleet(ctx)
+	if err != nil {
+		return err
+	}
+	boards, err := f.boards(ctx.Args())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	concurrency := f.Concurrency
+	if ctx.IsSet("concurrency") {
+		concurrency = ctx.Int("concurrency")
+	}
+	results := fleetCalibrate(f, boards, ctx.Int("channel"), concurrency)
+	if path := ctx.String("results"); path != "" {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	failed := 0
+	for _, res := range results {
+		if !res.OK {
+			failed++
+		}
+	}
+	if ctx.String("output") == "json" {
+		if err := printJSON(results); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVERSION\tRESULT\tDURATION\tJOB\tERROR")
+		for _, res := range results {
+			result := "ok"
+			if !res.OK {
+				result = "failed"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", res.Name, res.Version, result, res.Duration, res.JobID, res.Error)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("calibration failed on %d of %d boards", failed, len(results)), 1)
+	}
+	return nil
+}
+
+func actionFleetPush(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("usage: "+ctx.Command.HelpName+" "+ctx.Command.ArgsUsage, 1)
+	}
+	from, file := ctx.String("from"), ctx.String("file")
+	if (from == "") == (file == "") {
+		return cli.NewExitError("either --from or --file is required", 1)
+	}
+	f, err := openFleet(ctx)
+	if err != nil {
+		return err
+	}
+	target, ok := f.board(ctx.Args().First())
+	if !ok {
+		return cli.NewExitError("board "+ctx.Args().First()+" not in the fleet", 1)
+	}
+	var params apiclient.Params
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &params); err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s: %v", file, err), 1)
+		}
+	} else {
+		source, ok := f.board(from)
+		if !ok {
+			return cli.NewExitError("board "+from+" not in the fleet", 1)
+		}
+		c, err := f.client(source)
+		if err != nil {
+			return err
+		}
+		if params, err = c.GetParams(); err != nil {
+			return cli.NewExitError(fmt.Sprintf("offsets of %s: %v", from, err), 1)
+		}
+	}
+	if len(params) == 0 {
+		return cli.NewExitError("no offsets to push", 1)
+	}
+	c, err := f.client(target)
+	if err != nil {
+		return err
+	}
+	if err := pushParams(c, params); err != nil {
+		return cli.NewExitError(fmt.Sprintf("push to %s failed: %v", target.Name, err), 1)
+	}
+	return printParams(ctx, params)
+}
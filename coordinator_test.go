@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/plpsy/iiocalibration/api"
+	"github.com/plpsy/iiocalibration/apiclient"
+)
+
+// 设置该环境变量时测试程序作为 server 运行, 每个板子一个进程
+const envTestServer = "IIOCALIBRATION_TEST_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envTestServer) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startBoard runs a server with simulated devices and the API key "fleet"
+// in a child process and returns its URL.
+func startBoard(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cfg := api.DefaultConfig()
+	cfg.Server.Listen = addr
+	cfg.Server.AuthFile = filepath.Join(dir, "auth.json")
+	cfg.Server.AuditLog = filepath.Join(dir, "audit.log")
+	cfg.Server.ShutdownTimeout = api.Duration{Duration: 5 * time.Second}
+	cfg.Server.Simulate = true
+	cfg.Server.LockFile = filepath.Join(dir, "iiocalibration.lock")
+	cfg.Storage = api.StorageConfig{
+		CalibrationFile: filepath.Join(dir, "calibration.json"),
+		RegmapDir:       filepath.Join(dir, "regmaps"),
+		SnapshotDir:     filepath.Join(dir, "snapshots"),
+		HistoryFile:     filepath.Join(dir, "history.jsonl"),
+		DriftDir:        filepath.Join(dir, "drift"),
+		OffsetTable:     filepath.Join(dir, "offset-table.json"),
+		OutboxDir:       filepath.Join(dir, "outbox"),
+	}
+	cfg.Calibration.SettleDelay = api.Duration{}
+	cfg.SyncDelay = api.Duration{}
+	data, _ := json.Marshal(cfg)
+	cfgFile := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(cfgFile, data, 0600)
+	ioutil.WriteFile(cfg.Server.AuthFile, []byte(`{"keys": [{"name": "coordinator", "key": "fleet", "role": "operator"}]}`), 0600)
+
+	out := &syncBuffer{}
+	cmd := exec.Command(os.Args[0], "--config", cfgFile, "server")
+	cmd.Env = append(os.Environ(), envTestServer+"=1")
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("board %s:\n%s", addr, out)
+		}
+	})
+	url := "http://" + addr
+	c := apiclient.New(url, "")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := c.Healthz(); err == nil {
+			return url
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("board %s not started:\n%s", addr, out)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestForEachBoard(t *testing.T) {
+	boards := make([]fleetBoard, 10)
+	var mu sync.Mutex
+	running, max := 0, 0
+	done := make([]bool, len(boards))
+	forEachBoard(boards, 3, func(i int, b fleetBoard) {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		done[i] = true
+		mu.Unlock()
+	})
+	if max != 3 {
+		t.Errorf("%d boards at a time, expected 3", max)
+	}
+	for i, ok := range done {
+		if !ok {
+			t.Errorf("board %d skipped", i)
+		}
+	}
+}
+
+func TestFleetFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fleet.json")
+	f, err := loadFleet(path)
+	if err != nil || len(f.Boards) != 0 {
+		t.Fatalf("missing fleet file: %+v, %v", f, err)
+	}
+	f.Boards = append(f.Boards, fleetBoard{Name: "a", URL: "http://10.0.0.5"}, fleetBoard{Name: "b", URL: "https://10.0.0.6", APIKey: "k"})
+	if err := f.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = loadFleet(path); err != nil || len(f.Boards) != 2 || f.Boards[1].APIKey != "k" {
+		t.Errorf("saved fleet %+v, %v", f, err)
+	}
+	if _, err := f.boards([]string{"b", "c"}); err == nil {
+		t.Error("unknown board selected")
+	}
+	f.Boards = append(f.Boards, fleetBoard{Name: "a", URL: "http://10.0.0.7"})
+	if err := f.save(path); err == nil {
+		t.Error("board listed twice saved")
+	}
+	f.Boards = []fleetBoard{{Name: "c", URL: "10.0.0.7"}}
+	if err := f.save(path); err == nil {
+		t.Error("url without scheme saved")
+	}
+}
+
+func TestCalibrateBoard(t *testing.T) {
+	var requestID string
+	busy := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(apiclient.Status{Version: "1.2.0"})
+	})
+	mux.HandleFunc("/calibration", func(w http.ResponseWriter, r *http.Request) {
+		if busy {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode("calibration already running")
+			return
+		}
+		requestID = r.Header.Get("X-Request-ID")
+		json.NewEncoder(w).Encode("Calibration done")
+	})
+	// 另一个 API 客户端的校准在历史的最前面
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		records := []apiclient.CalibrationRecord{{JobID: "other", Origin: "api", RequestID: "other-request"}}
+		if !busy {
+			records = append(records, apiclient.CalibrationRecord{JobID: "job1", Origin: "api", RequestID: requestID, Duration: "2s"})
+		}
+		result := []apiclient.CalibrationRecord{}
+		for _, rec := range records {
+			if id := r.URL.Query().Get("requestId"); id == "" || rec.RequestID == id {
+				result = append(result, rec)
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := apiclient.New(server.URL, "")
+	var res calibrationResult
+	if err := calibrateBoard(c, -1, &res); err != nil || res.JobID != "job1" || res.Version != "1.2.0" || requestID == "" {
+		t.Errorf("calibration result %+v, %v", res, err)
+	}
+	busy = true
+	res = calibrationResult{}
+	if err := calibrateBoard(c, -1, &res); err == nil || res.JobID != "" {
+		t.Errorf("refused calibration result %+v, %v", res, err)
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	f := &fleet{APIKey: "fleet", Concurrency: 2}
+	for _, name := range []string{"line1", "line2", "spare"} {
+		f.Boards = append(f.Boards, fleetBoard{Name: name, URL: startBoard(t)})
+	}
+	// 没有服务的端口
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+	f.Boards = append(f.Boards, fleetBoard{Name: "offline", URL: "http://" + ln.Addr().String()})
+
+	// 临时目录不是挂载点, 板子都未就绪
+	statuses := fleetStatus(f, f.Boards)
+	for _, st := range statuses[:3] {
+		if st.Error != "" || st.Uptime == "" || st.LastCalibration != nil {
+			t.Errorf("status %+v", st)
+		}
+	}
+	if statuses[3].Error == "" {
+		t.Errorf("status of the offline board %+v", statuses[3])
+	}
+
+	boards, _ := f.boards([]string{"line1", "line2", "offline"})
+	results := fleetCalibrate(f, boards, -1, 0)
+	for _, res := range results[:2] {
+		if !res.OK || res.JobID == "" || len(res.Offsets["cf_axi_adc"]) != 7 || len(res.Offsets["cf_axi_adc_1"]) != 8 {
+			t.Errorf("calibration result %+v", res)
+		}
+	}
+	if results[2].OK || results[2].Error == "" {
+		t.Errorf("calibration of the offline board %+v", results[2])
+	}
+	// 模拟的各通道电平随机, 两块板子的偏移量不同
+	if reflect.DeepEqual(results[0].Offsets, results[1].Offsets) {
+		t.Errorf("offsets of the simulated boards %v, %v", results[0].Offsets, results[1].Offsets)
+	}
+	statuses = fleetStatus(f, boards[:1])
+	if rec := statuses[0].LastCalibration; rec == nil || rec.JobID != results[0].JobID || rec.Origin != "api" {
+		t.Errorf("last calibration %+v", statuses[0].LastCalibration)
+	}
+
+	// 备用板替换 line1 时写入 line1 的校准参数
+	source, _ := f.client(f.Boards[0])
+	params, err := source.GetParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spare, _ := f.client(f.Boards[2])
+	if err := pushParams(spare, params); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := spare.GetParams()
+	if err != nil || stored["cf_axi_adc_1"][7] != results[0].Offsets["cf_axi_adc_1"][7] {
+		t.Errorf("stored offsets of the spare board %v, %v", stored, err)
+	}
+	unauthorized, _ := (&fleet{}).client(f.Boards[2])
+	if err := pushParams(unauthorized, params); err == nil {
+		t.Error("push without API key succeeded")
+	}
+}
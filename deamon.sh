@@ -1,19 +1,7 @@
 #!/bin/bash
 
-while true
-do
-    echo "start daemon"
-    # start iiocalibration
-    curDir=$(cd $(dirname $0);pwd)
-    echo $curDir
-    $curDir/iiocalibration server > $curDir/iiocalibration.log 2>&1 &
-    caliPid=$!
-    echo "iiocalibration pid = $caliPid"
-
-    wait $dataMixPid
-    echo "iiocalibration exit unexpected, neet restart"
-    sleep 10s
-done
-
-exit 1
-
+# 由iiocalibration自己守护: 退避重启, 日志轮转, 写pid文件
+# 在systemd下请使用iiocalibration.service
+# 参数原样传给被守护的server, 例如 ./deamon.sh --listen :8080
+curDir=$(cd $(dirname $0);pwd)
+exec $curDir/iiocalibration supervise --log-file $curDir/iiocalibration.log -- "$@"
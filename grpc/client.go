@@ -0,0 +1,161 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the methods of a server at BaseURL, http://host:port for
+// cleartext HTTP/2 or https://host:port.
+type Client struct {
+	BaseURL string
+	// metadata sent with every call, e.g. X-API-Key
+	Header     http.Header
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client of the server at baseURL.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Header:     make(http.Header),
+		HTTPClient: &http.Client{Transport: &http.Transport{Protocols: clientProtocols()}},
+	}
+}
+
+// clientProtocols uses HTTP/2 for http:// and https:// URLs.
+func clientProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// Call runs a unary call.
+func (c *Client) Call(ctx context.Context, method string, req, resp Message) error {
+	s, err := c.Stream(ctx, method, req)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.Recv(resp); err != nil {
+		if err == io.EOF {
+			return Errorf(Internal, "response message missing")
+		}
+		return err
+	}
+	if err := s.Recv(resp); err != io.EOF {
+		if err == nil {
+			return Errorf(Internal, "more than one response message")
+		}
+		return err
+	}
+	return nil
+}
+
+// Stream starts a server streaming call, the responses are read with Recv.
+func (c *Client) Stream(ctx context.Context, method string, req Message) (*ClientStream, error) {
+	var body bytes.Buffer
+	writeMessage(&body, Marshal(req))
+	r, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+method, &body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("TE", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		r.Header.Set("Grpc-Timeout", formatTimeout(time.Until(deadline)))
+	}
+	resp, err := c.HTTPClient.Do(r)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, contextStatus(ctx.Err())
+		}
+		return nil, Errorf(Unavailable, "%v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, Errorf(httpStatusCode(resp.StatusCode), "HTTP status %s", resp.Status)
+	}
+	// 只有 header 的响应也可能带状态
+	if st := headerStatus(resp.Header); st != nil && st.Code != OK {
+		resp.Body.Close()
+		return nil, st
+	}
+	return &ClientStream{ctx: ctx, resp: resp}, nil
+}
+
+// httpStatusCode maps the HTTP status of a failed call to a status code as
+// in the gRPC HTTP/2 protocol description.
+func httpStatusCode(status int) Code {
+	switch status {
+	case http.StatusBadRequest:
+		return Internal
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Unavailable
+	}
+	return Unknown
+}
+
+func headerStatus(h http.Header) *Status {
+	s := h.Get("Grpc-Status")
+	if s == "" {
+		return nil
+	}
+	code, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return &Status{Code: Internal, Message: "invalid grpc-status " + s}
+	}
+	return &Status{Code: Code(code), Message: decodeMessage(h.Get("Grpc-Message"))}
+}
+
+// ClientStream reads the responses of a call.
+type ClientStream struct {
+	ctx  context.Context
+	resp *http.Response
+}
+
+// Recv reads the next response. At the end of the responses it returns
+// io.EOF if the call succeeded and its Status otherwise.
+func (s *ClientStream) Recv(m Message) error {
+	data, err := readMessage(s.resp.Body)
+	if err == io.EOF {
+		st := headerStatus(s.resp.Trailer)
+		if st == nil {
+			return Errorf(Internal, "grpc-status missing")
+		}
+		if st.Code != OK {
+			return st
+		}
+		return io.EOF
+	}
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return contextStatus(s.ctx.Err())
+		}
+		return err
+	}
+	if err := Unmarshal(data, m); err != nil {
+		return Errorf(Internal, "%v", err)
+	}
+	return nil
+}
+
+// Close ends the call, a running call is canceled.
+func (s *ClientStream) Close() error {
+	return s.resp.Body.Close()
+}
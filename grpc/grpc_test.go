@@ -0,0 +1,233 @@
+package grpc_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/plpsy/iiocalibration/grpc"
+)
+
+type inner struct {
+	Name string
+}
+
+func (m *inner) MarshalProto(e *grpc.Encoder) {
+	e.String(1, m.Name)
+}
+
+func (m *inner) UnmarshalProto(d *grpc.Decoder) error {
+	for {
+		field, err := d.Next()
+		if field == 0 || err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			m.Name, err = d.String()
+		default:
+			err = d.Skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type testMessage struct {
+	ID     int32
+	Text   string
+	Values []int32
+	Ratio  float64
+	OK     bool
+	Time   int64
+	Inner  *inner
+	Counts []int32
+}
+
+func (m *testMessage) MarshalProto(e *grpc.Encoder) {
+	e.Int32(1, m.ID)
+	e.String(2, m.Text)
+	e.PackedSint32(3, m.Values)
+	e.Double(4, m.Ratio)
+	e.Bool(5, m.OK)
+	e.Int64(6, m.Time)
+	if m.Inner != nil {
+		e.Message(7, m.Inner)
+	}
+	e.PackedInt32(8, m.Counts)
+}
+
+func (m *testMessage) UnmarshalProto(d *grpc.Decoder) error {
+	for {
+		field, err := d.Next()
+		if field == 0 || err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			m.ID, err = d.Int32()
+		case 2:
+			m.Text, err = d.String()
+		case 3:
+			m.Values, err = d.Sint32s(m.Values)
+		case 4:
+			m.Ratio, err = d.Double()
+		case 5:
+			m.OK, err = d.Bool()
+		case 6:
+			m.Time, err = d.Int64()
+		case 7:
+			m.Inner = new(inner)
+			err = d.Message(m.Inner)
+		case 8:
+			m.Counts, err = d.Int32s(m.Counts)
+		default:
+			err = d.Skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	// 与 protobuf 文档中的编码示例对照
+	for _, c := range []struct {
+		m    testMessage
+		wire []byte
+	}{
+		{testMessage{ID: 150}, []byte{0x08, 0x96, 0x01}},
+		{testMessage{Text: "testing"}, []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{testMessage{ID: -2}, []byte{0x08, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{testMessage{Values: []int32{0, -1, 1, -2}}, []byte{0x1a, 0x04, 0x00, 0x01, 0x02, 0x03}},
+		{testMessage{Counts: []int32{3, 270}}, []byte{0x42, 0x03, 0x03, 0x8e, 0x02}},
+		{testMessage{OK: true, Inner: &inner{}}, []byte{0x28, 0x01, 0x3a, 0x00}},
+	} {
+		if wire := grpc.Marshal(&c.m); !bytes.Equal(wire, c.wire) {
+			t.Errorf("%+v encoded as % x, want % x", c.m, wire, c.wire)
+		}
+	}
+
+	in := testMessage{ID: -7, Text: "日志", Values: []int32{-8388608, 8388607, 0}, Ratio: 0.75, OK: true,
+		Time: 1700000000123, Inner: &inner{Name: "adc"}, Counts: []int32{1, -1}}
+	var out testMessage
+	if err := grpc.Unmarshal(grpc.Marshal(&in), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("decoded %+v, want %+v", out, in)
+	}
+
+	// 未知字段被跳过, 未打包的 repeated 字段也能解码
+	wire := []byte{0x48, 0x05, 0x51, 1, 2, 3, 4, 5, 6, 7, 8, 0x18, 0x03, 0x18, 0x04, 0x5d, 1, 2, 3, 4}
+	out = testMessage{}
+	if err := grpc.Unmarshal(wire, &out); err != nil || !reflect.DeepEqual(out.Values, []int32{-2, 2}) {
+		t.Errorf("decoded %+v, %v", out, err)
+	}
+	if err := grpc.Unmarshal([]byte{0x12, 0x07, 't'}, &out); err == nil {
+		t.Error("truncated message decoded")
+	}
+}
+
+func startServer(t *testing.T, s *grpc.Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: s, Protocols: grpc.Protocols()}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return "http://" + ln.Addr().String()
+}
+
+func TestCalls(t *testing.T) {
+	s := grpc.NewServer()
+	s.Handle("/test.Echo/Unary", func(s *grpc.Stream) error {
+		var req testMessage
+		if err := s.RecvRequest(&req); err != nil {
+			return err
+		}
+		req.Text = s.Request().Header.Get("X-Api-Key") + ":" + req.Text
+		return s.Send(&req)
+	})
+	s.Handle("/test.Echo/Count", func(s *grpc.Stream) error {
+		var req testMessage
+		if err := s.RecvRequest(&req); err != nil {
+			return err
+		}
+		for i := int32(0); i < req.ID; i++ {
+			if err := s.Send(&testMessage{ID: i}); err != nil {
+				return err
+			}
+		}
+		if req.Text != "" {
+			return grpc.Errorf(grpc.FailedPrecondition, "%s", req.Text)
+		}
+		return nil
+	})
+	s.Handle("/test.Echo/Wait", func(s *grpc.Stream) error {
+		<-s.Context().Done()
+		return s.Context().Err()
+	})
+	url := startServer(t, s)
+	c := grpc.NewClient(url)
+	c.Header.Set("X-API-Key", "k")
+	ctx := context.Background()
+
+	var resp testMessage
+	if err := c.Call(ctx, "/test.Echo/Unary", &testMessage{ID: 3, Text: "x"}, &resp); err != nil || resp.Text != "k:x" || resp.ID != 3 {
+		t.Errorf("unary %+v, %v", resp, err)
+	}
+
+	stream, err := c.Stream(ctx, "/test.Echo/Count", &testMessage{ID: 3, Text: "100% kaputt, 失败"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int32
+	for {
+		var m testMessage
+		if err = stream.Recv(&m); err != nil {
+			break
+		}
+		ids = append(ids, m.ID)
+	}
+	stream.Close()
+	if st := grpc.StatusOf(err); st.Code != grpc.FailedPrecondition || st.Message != "100% kaputt, 失败" || len(ids) != 3 {
+		t.Errorf("stream %v, status %v", ids, err)
+	}
+	stream, err = c.Stream(ctx, "/test.Echo/Count", &testMessage{ID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = stream.Recv(&resp)
+	}
+	if err != io.EOF {
+		t.Errorf("end of stream: %v", err)
+	}
+
+	if err := c.Call(ctx, "/test.Echo/Nope", &testMessage{}, &resp); grpc.StatusOf(err).Code != grpc.Unimplemented {
+		t.Errorf("unknown method: %v", err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := c.Call(timeout, "/test.Echo/Wait", &testMessage{}, &resp); grpc.StatusOf(err).Code != grpc.DeadlineExceeded {
+		t.Errorf("deadline: %v", err)
+	}
+
+	// HTTP/1.1 请求被拒绝
+	r, err := http.Post(url+"/test.Echo/Unary", "application/grpc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Errorf("HTTP/1.1 status %d", r.StatusCode)
+	}
+}
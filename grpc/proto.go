@@ -0,0 +1,314 @@
+// Package grpc implements the server side of gRPC over HTTP/2, cleartext or
+// TLS, with the protobuf wire format of hand-written messages, and a client
+// for tests and tools. Only the identity encoding is supported, messages are
+// not compressed.
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Message is a protobuf message encoded and decoded by hand.
+type Message interface {
+	MarshalProto(e *Encoder)
+	UnmarshalProto(d *Decoder) error
+}
+
+// Wire types of the protobuf encoding.
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+	WireFixed32 = 5
+)
+
+// Encoder appends the fields of a message. Like proto3, the scalar methods
+// omit zero values.
+type Encoder struct {
+	buf []byte
+}
+
+// Marshal encodes m.
+func Marshal(m Message) []byte {
+	var e Encoder
+	m.MarshalProto(&e)
+	return e.buf
+}
+
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+func (e *Encoder) tag(field, wireType int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (e *Encoder) Uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, WireVarint)
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+// Int64 encodes an int64 field, Int32 an int32 field, negative values take
+// ten bytes as in the protobuf encoding.
+func (e *Encoder) Int64(field int, v int64) {
+	e.Uint64(field, uint64(v))
+}
+
+func (e *Encoder) Int32(field int, v int32) {
+	e.Uint64(field, uint64(int64(v)))
+}
+
+// Sint32 encodes a sint32 field (zigzag).
+func (e *Encoder) Sint32(field int, v int32) {
+	e.Uint64(field, uint64(uint32(v<<1^v>>31)))
+}
+
+func (e *Encoder) Bool(field int, v bool) {
+	if v {
+		e.Uint64(field, 1)
+	}
+}
+
+func (e *Encoder) Double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, WireFixed64)
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+}
+
+func (e *Encoder) String(field int, v string) {
+	if v == "" {
+		return
+	}
+	e.tag(field, WireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// Strings encodes a repeated string field, empty strings included.
+func (e *Encoder) Strings(field int, v []string) {
+	for _, x := range v {
+		e.tag(field, WireBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(x)))
+		e.buf = append(e.buf, x...)
+	}
+}
+
+// Message encodes an embedded message, also if it is empty. A nil m is
+// omitted.
+func (e *Encoder) Message(field int, m Message) {
+	if m == nil {
+		return
+	}
+	var sub Encoder
+	m.MarshalProto(&sub)
+	e.tag(field, WireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(sub.buf)))
+	e.buf = append(e.buf, sub.buf...)
+}
+
+// PackedInt32 encodes a repeated int32 field.
+func (e *Encoder) PackedInt32(field int, v []int32) {
+	if len(v) == 0 {
+		return
+	}
+	var sub []byte
+	for _, x := range v {
+		sub = binary.AppendUvarint(sub, uint64(int64(x)))
+	}
+	e.tag(field, WireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(sub)))
+	e.buf = append(e.buf, sub...)
+}
+
+// PackedSint32 encodes a repeated sint32 field.
+func (e *Encoder) PackedSint32(field int, v []int32) {
+	if len(v) == 0 {
+		return
+	}
+	var sub []byte
+	for _, x := range v {
+		sub = binary.AppendUvarint(sub, uint64(uint32(x<<1^x>>31)))
+	}
+	e.tag(field, WireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(sub)))
+	e.buf = append(e.buf, sub...)
+}
+
+var errTruncated = errors.New("proto: message truncated")
+
+// Decoder reads the fields of a message in the order they were encoded.
+type Decoder struct {
+	buf []byte
+	// wire type of the field returned by Next
+	wireType int
+}
+
+// Unmarshal decodes data into m.
+func Unmarshal(data []byte, m Message) error {
+	return m.UnmarshalProto(&Decoder{buf: data})
+}
+
+// Next returns the number of the next field, 0 at the end of the message.
+// The value must be read with the method of its type or skipped with Skip.
+func (d *Decoder) Next() (field int, err error) {
+	if len(d.buf) == 0 {
+		return 0, nil
+	}
+	key, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	d.wireType = int(key & 7)
+	if key>>3 == 0 || key>>3 > math.MaxInt32 {
+		return 0, fmt.Errorf("proto: invalid field number %d", key>>3)
+	}
+	return int(key >> 3), nil
+}
+
+func (d *Decoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+func (d *Decoder) expect(wireType int) error {
+	if d.wireType != wireType {
+		return fmt.Errorf("proto: wire type %d, expected %d", d.wireType, wireType)
+	}
+	return nil
+}
+
+func (d *Decoder) Uint64() (uint64, error) {
+	if err := d.expect(WireVarint); err != nil {
+		return 0, err
+	}
+	return d.uvarint()
+}
+
+func (d *Decoder) Int64() (int64, error) {
+	v, err := d.Uint64()
+	return int64(v), err
+}
+
+func (d *Decoder) Int32() (int32, error) {
+	v, err := d.Uint64()
+	return int32(v), err
+}
+
+func (d *Decoder) Sint32() (int32, error) {
+	v, err := d.Uint64()
+	return int32(uint32(v)>>1) ^ -int32(v&1), err
+}
+
+func (d *Decoder) Bool() (bool, error) {
+	v, err := d.Uint64()
+	return v != 0, err
+}
+
+func (d *Decoder) Double() (float64, error) {
+	if err := d.expect(WireFixed64); err != nil {
+		return 0, err
+	}
+	if len(d.buf) < 8 {
+		return 0, errTruncated
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.buf))
+	d.buf = d.buf[8:]
+	return v, nil
+}
+
+// Bytes returns the value of a length delimited field, it refers to the
+// decoded data.
+func (d *Decoder) Bytes() ([]byte, error) {
+	if err := d.expect(WireBytes); err != nil {
+		return nil, err
+	}
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.buf)) {
+		return nil, errTruncated
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+func (d *Decoder) String() (string, error) {
+	v, err := d.Bytes()
+	return string(v), err
+}
+
+// Message decodes an embedded message into m.
+func (d *Decoder) Message(m Message) error {
+	v, err := d.Bytes()
+	if err != nil {
+		return err
+	}
+	return Unmarshal(v, m)
+}
+
+// Int32s appends the values of a repeated int32 field, packed or not.
+func (d *Decoder) Int32s(v []int32) ([]int32, error) {
+	return d.repeated(v, func(x uint64) int32 { return int32(x) })
+}
+
+// Sint32s appends the values of a repeated sint32 field, packed or not.
+func (d *Decoder) Sint32s(v []int32) ([]int32, error) {
+	return d.repeated(v, func(x uint64) int32 { return int32(uint32(x)>>1) ^ -int32(x&1) })
+}
+
+func (d *Decoder) repeated(v []int32, conv func(uint64) int32) ([]int32, error) {
+	if d.wireType == WireVarint {
+		x, err := d.uvarint()
+		return append(v, conv(x)), err
+	}
+	packed, err := d.Bytes()
+	if err != nil {
+		return v, err
+	}
+	sub := Decoder{buf: packed}
+	for len(sub.buf) > 0 {
+		x, err := sub.uvarint()
+		if err != nil {
+			return v, err
+		}
+		v = append(v, conv(x))
+	}
+	return v, nil
+}
+
+// Skip skips the value of an unknown field.
+func (d *Decoder) Skip() error {
+	switch d.wireType {
+	case WireVarint:
+		_, err := d.uvarint()
+		return err
+	case WireBytes:
+		_, err := d.Bytes()
+		return err
+	case WireFixed64, WireFixed32:
+		n := 8
+		if d.wireType == WireFixed32 {
+			n = 4
+		}
+		if len(d.buf) < n {
+			return errTruncated
+		}
+		d.buf = d.buf[n:]
+		return nil
+	}
+	return fmt.Errorf("proto: unsupported wire type %d", d.wireType)
+}
@@ -0,0 +1,274 @@
+package grpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxMessageSize is the largest message received, like the gRPC default.
+const MaxMessageSize = 4 << 20
+
+// Handler runs a call. It receives the request with Recv and sends the
+// responses with Send, the error is returned to the client as status.
+type Handler func(s *Stream) error
+
+// Server dispatches gRPC calls to the handlers of their methods. It is an
+// http.Handler, the http.Server must accept HTTP/2, see Protocols.
+type Server struct {
+	mu      sync.RWMutex
+	methods map[string]Handler
+}
+
+func NewServer() *Server {
+	return &Server{methods: make(map[string]Handler)}
+}
+
+// Protocols returns the protocols of an http.Server serving gRPC, HTTP/2
+// over TLS and cleartext HTTP/2 with prior knowledge. HTTP/1 requests are
+// answered with an error.
+func Protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// Handle registers the handler of a method, given as
+// "/<package>.<service>/<method>".
+func (s *Server) Handle(method string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[method] = h
+}
+
+// Methods returns the registered methods.
+func (s *Server) Methods() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	methods := make([]string, 0, len(s.methods))
+	for m := range s.methods {
+		methods = append(methods, m)
+	}
+	return methods
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "gRPC requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") &&
+		!strings.HasPrefix(ct, "application/grpc;") {
+		http.Error(w, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+
+	s.mu.RLock()
+	h := s.methods[r.URL.Path]
+	s.mu.RUnlock()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var err error
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, perr := parseTimeout(timeout)
+		if perr != nil {
+			err = Errorf(InvalidArgument, "%v", perr)
+		} else {
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+	}
+	if enc := r.Header.Get("Grpc-Encoding"); enc != "" && enc != "identity" {
+		err = Errorf(Unimplemented, "encoding %s not supported", enc)
+	}
+	if err == nil && h == nil {
+		err = Errorf(Unimplemented, "unknown method %s", r.URL.Path)
+	}
+	if err == nil {
+		err = h(&Stream{ctx: ctx, req: r.WithContext(ctx), w: w})
+	}
+	if err != nil && ctx.Err() != nil && !errors.As(err, new(*Status)) {
+		// 被客户端取消或超时的调用
+		err = contextStatus(ctx.Err())
+	}
+	st := StatusOf(err)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(st.Code)))
+	if st.Message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeMessage(st.Message))
+	}
+}
+
+func contextStatus(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Errorf(DeadlineExceeded, "%v", err)
+	}
+	return Errorf(Canceled, "%v", err)
+}
+
+// parseTimeout parses the grpc-timeout header, e.g. 100m.
+func parseTimeout(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	unit, ok := units[s[len(s)-1]]
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", s)
+	}
+	if n > int64(1<<63-1)/int64(unit) {
+		return 1<<63 - 1, nil
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func formatTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "1n"
+	}
+	// 最多8位数字
+	for _, u := range []struct {
+		unit time.Duration
+		c    string
+	}{{time.Nanosecond, "n"}, {time.Microsecond, "u"}, {time.Millisecond, "m"}, {time.Second, "S"}, {time.Minute, "M"}} {
+		if n := (d + u.unit - 1) / u.unit; n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + u.c
+		}
+	}
+	return strconv.FormatInt(int64((d+time.Hour-1)/time.Hour), 10) + "H"
+}
+
+// encodeMessage percent-encodes the grpc-message trailer.
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func decodeMessage(msg string) string {
+	var b []byte
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if v, err := strconv.ParseUint(msg[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(v))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, msg[i])
+	}
+	return string(b)
+}
+
+// Stream is a call on the server.
+type Stream struct {
+	ctx context.Context
+	req *http.Request
+	w   http.ResponseWriter
+}
+
+// Context is canceled when the client cancels the call or its deadline
+// passes.
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Request is the HTTP/2 request of the call, its header holds the metadata.
+func (s *Stream) Request() *http.Request {
+	return s.req
+}
+
+// Method returns the full method name of the call.
+func (s *Stream) Method() string {
+	return s.req.URL.Path
+}
+
+// Recv reads the next request message, io.EOF at the end of the requests.
+func (s *Stream) Recv(m Message) error {
+	data, err := readMessage(s.req.Body)
+	if err != nil {
+		return err
+	}
+	if err := Unmarshal(data, m); err != nil {
+		return Errorf(InvalidArgument, "%v", err)
+	}
+	return nil
+}
+
+// RecvRequest reads the single request of a unary or server streaming
+// call.
+func (s *Stream) RecvRequest(m Message) error {
+	err := s.Recv(m)
+	if err == io.EOF {
+		return Errorf(InvalidArgument, "request message missing")
+	}
+	return err
+}
+
+// Send sends a response message.
+func (s *Stream) Send(m Message) error {
+	if err := s.ctx.Err(); err != nil {
+		return contextStatus(err)
+	}
+	if err := writeMessage(s.w, Marshal(m)); err != nil {
+		return err
+	}
+	s.w.(http.Flusher).Flush()
+	return nil
+}
+
+// writeMessage writes a length prefixed message.
+func writeMessage(w io.Writer, data []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readMessage reads a length prefixed message, io.EOF if there is none.
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, Errorf(Internal, "message prefix truncated")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > MaxMessageSize {
+		return nil, Errorf(ResourceExhausted, "message of %d bytes larger than %d", n, MaxMessageSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, Errorf(Internal, "message truncated: %v", err)
+	}
+	return data, nil
+}
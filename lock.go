@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/plpsy/iiocalibration/api"
+)
+
+// 服务和本地子命令都读写偏移寄存器, 用文件锁互斥, 进程退出时内核释放
+var hardwareLock *os.File
+
+// lockHardware takes the exclusive lock of path until the process exits, an
+// empty path disables the lock. It fails while another process holds it.
+func lockHardware(path string) error {
+	if path == "" || hardwareLock != nil {
+		return nil
+	}
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fp.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("%s held by a running server", path)
+		}
+		return fmt.Errorf("lock %s: %v", path, err)
+	}
+	hardwareLock = fp
+	return nil
+}
+
+// lockLocal takes the hardware lock for a subcommand operating the local
+// hardware, a running server is operated with --remote instead.
+func lockLocal() error {
+	if err := lockHardware(api.CurrentConfig().Server.LockFile); err != nil {
+		return fmt.Errorf("%v, use --remote or the API of the server", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Package logfile provides an append only file which is rotated by size.
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File appends to Path and rotates it to Path.1, Path.2, ... once it grows
+// beyond MaxSize, keeping at most MaxBackups rotated files.
+type File struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	fp   *os.File
+	size int64
+}
+
+// New returns a File, the file is opened on the first write.
+func New(path string, maxSize int64, maxBackups int) *File {
+	return &File{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+}
+
+func (f *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	f.fp = fp
+	f.size = info.Size()
+	return nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fp == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.fp.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate starts a new file.
+func (f *File) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+func (f *File) rotate() error {
+	if f.fp != nil {
+		f.fp.Close()
+		f.fp = nil
+	}
+	os.Remove(f.backup(f.MaxBackups))
+	for i := f.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(f.backup(i), f.backup(i+1))
+	}
+	if f.MaxBackups > 0 {
+		if err := os.Rename(f.Path, f.backup(1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		os.Remove(f.Path)
+	}
+	return f.open()
+}
+
+func (f *File) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.Path, i)
+}
+
+// Files returns the existing files, oldest backup first and the current
+// file last.
+func (f *File) Files() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var files []string
+	for i := f.MaxBackups; i >= 1; i-- {
+		if _, err := os.Stat(f.backup(i)); err == nil {
+			files = append(files, f.backup(i))
+		}
+	}
+	if _, err := os.Stat(f.Path); err == nil {
+		files = append(files, f.Path)
+	}
+	return files
+}
+
+// Close closes the current file, a later write opens it again.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fp == nil {
+		return nil
+	}
+	err := f.fp.Close()
+	f.fp = nil
+	return err
+}
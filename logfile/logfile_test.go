@@ -0,0 +1,31 @@
+package logfile
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	f := New(path, 10, 2)
+	defer f.Close()
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := f.Files()
+	if len(files) != 3 || files[0] != path+".2" || files[2] != path {
+		t.Fatalf("unexpected files %v", files)
+	}
+	for i, expected := range []string{"bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		data, err := ioutil.ReadFile(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("%s = %q, expected %q", files[i], data, expected)
+		}
+	}
+}
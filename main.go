@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/plpsy/iiocalibration/api"
+	"github.com/plpsy/iiocalibration/grpc"
+	"github.com/plpsy/iiocalibration/ui"
 	"github.com/plpsy/iiocalibration/version"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -15,17 +24,96 @@ const ()
 
 var (
 	globalFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "configuration file, the flags set override its server settings",
+			EnvVar: "CONFIG_FILE",
+			Value:  api.DefaultConfigFile,
+		},
+
 		cli.BoolFlag{
 			Name:   "debug",
 			Usage:  "debug mode",
 			EnvVar: "DEBUG",
 		},
 
+		cli.BoolFlag{
+			Name:   "simulate",
+			Usage:  "simulate the adc devices in memory, to try the API without a board",
+			EnvVar: "IIOCALIBRATION_SIMULATE",
+		},
+
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "log output format, text or json",
+			EnvVar: "LOG_FORMAT",
+			Value:  defaultConfig.Server.LogFormat,
+		},
+
 		cli.StringFlag{
 			Name:   "listen",
 			Usage:  "The address that the listens on",
 			EnvVar: "LISTEN_ADDR",
-			Value:  ":80",
+			Value:  defaultConfig.Server.Listen,
+		},
+
+		cli.StringFlag{
+			Name:   "grpc-listen",
+			Usage:  "address of the gRPC API, e.g. :50051, disabled if empty",
+			EnvVar: "GRPC_LISTEN",
+			Value:  defaultConfig.Server.GRPCListen,
+		},
+
+		cli.StringFlag{
+			Name:   "modbus-listen",
+			Usage:  "address of the Modbus TCP listener, empty disables it",
+			EnvVar: "MODBUS_LISTEN",
+			Value:  defaultConfig.Modbus.Listen,
+		},
+
+		cli.StringFlag{
+			Name:   "auth-file",
+			Usage:  "file with the API keys and users, callers without it can only read, empty disables authentication",
+			EnvVar: "AUTH_FILE",
+			Value:  defaultConfig.Server.AuthFile,
+		},
+
+		cli.StringFlag{
+			Name:   "audit-log",
+			Usage:  "audit log of the state changing operations",
+			EnvVar: "AUDIT_LOG",
+			Value:  defaultConfig.Server.AuditLog,
+		},
+
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "certificate file, serve https instead of http",
+			EnvVar: "TLS_CERT",
+		},
+
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "private key file of --tls-cert",
+			EnvVar: "TLS_KEY",
+		},
+
+		cli.StringFlag{
+			Name:   "client-ca",
+			Usage:  "CA certificates file, require client certificates signed by it",
+			EnvVar: "TLS_CLIENT_CA",
+		},
+
+		cli.BoolFlag{
+			Name:   "tls-generate",
+			Usage:  "generate a self signed certificate if --tls-cert does not exist (default " + defaultTLSCert + ")",
+			EnvVar: "TLS_GENERATE",
+		},
+
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Usage:  "time to wait for running requests and calibrations on SIGTERM",
+			EnvVar: "SHUTDOWN_TIMEOUT",
+			Value:  defaultConfig.Server.ShutdownTimeout.Duration,
 		},
 	}
 
@@ -45,7 +133,8 @@ var (
 		},
 	}
 
-	cmds = []cli.Command{cmdServer, cmdVersion}
+	cmds = []cli.Command{cmdServer, cmdVersion, cmdRegmap, cmdSnapshot, cmdAuth, cmdSupervise, cmdConfig,
+		cmdCalibrate, cmdRegs, cmdParams, cmdCapture, cmdExport, cmdImport, cmdReboot, cmdAnalyze, cmdCoordinator}
 )
 
 func main() {
@@ -58,16 +147,18 @@ func main() {
 		app.Version += "-" + gitCommit
 	}
 
-	api.LoadAndSetOffset()
-
 	app.Author = "panling"
 	app.Email = "panling@aiclab.org"
 	app.Flags = globalFlags
 	app.Before = func(ctx *cli.Context) error {
-		if ctx.Bool("debug") {
-			logrus.SetLevel(logrus.DebugLevel)
-		} else {
-			logrus.SetLevel(logrus.InfoLevel)
+		// 本地运行的子命令也使用配置文件中的存储路径, server和config命令自己读取配置,
+		// coordinator 只访问远程的板子
+		switch ctx.Args().First() {
+		case "server", "config", "coordinator":
+			return nil
+		}
+		if _, err := applyConfig(ctx); err != nil {
+			return cli.NewExitError(err.Error(), 1)
 		}
 		return nil
 	}
@@ -75,26 +166,200 @@ func main() {
 	app.RunAndExitOnError()
 }
 
-func actionServer(ctx *cli.Context) {
+func actionServer(ctx *cli.Context) error {
+	cfg, err := applyConfig(ctx)
+	if err != nil {
+		logrus.Fatal("config: ", err)
+	}
+	if err := lockHardware(cfg.Server.LockFile); err != nil {
+		logrus.Fatal("lock: ", err)
+	}
+	api.StartWebhooks()
+	api.StartMQTT()
+	if err := api.StartModbus(); err != nil {
+		logrus.Fatal("Listen Modbus: ", err)
+	}
+	api.LoadAndSetOffset()
+	if err := api.LoadAuthFile(cfg.Server.AuthFile); err != nil {
+		logrus.Fatal("LoadAuthFile: ", err)
+	}
+	go api.WatchAuthFile(5 * time.Second)
+	api.OpenAuditLog(cfg.Server.AuditLog)
+	api.LoadRegisterMaps()
+	api.StartScheduler()
+	api.StartDriftMonitor()
+	api.StartCompensation()
+	r, _ := RegisterHandler()
+	addr := cfg.Server.Listen
+	tlsConfig, err := serverTLSConfig(cfg.Server.TLSCert, cfg.Server.TLSKey,
+		cfg.Server.ClientCA, cfg.Server.TLSGenerate)
+	if err != nil {
+		logrus.Fatal("TLS config: ", err)
+	}
+	restarts, _ := strconv.Atoi(os.Getenv(envRestarts))
+	api.SetSupervisorStatus(restarts, os.Getenv(envLastExit))
+
+	ln, err := net.Listen("tcp", addr) //设置监听的端口
+	if err != nil {
+		logrus.Fatal("Listen: ", err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	sdNotify("READY=1")
+	go sdWatchdog(func() bool { return handlerAlive(r) })
+
+	server := &http.Server{Addr: addr, Handler: r, TLSConfig: tlsConfig}
+	serveErr := make(chan error, 2)
+	go func() {
+		if tlsConfig != nil {
+			logrus.Info("listen on addr (https): ", addr)
+			serveErr <- server.ServeTLS(ln, "", "")
+		} else {
+			logrus.Info("listen on addr: ", addr)
+			serveErr <- server.Serve(ln)
+		}
+	}()
+	servers := []*http.Server{server}
+	if grpcAddr := cfg.Server.GRPCListen; grpcAddr != "" {
+		// gRPC 使用单独的端口, 明文时为 HTTP/2 prior knowledge
+		grpcLn, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			logrus.Fatal("Listen gRPC: ", err)
+		}
+		grpcServer := &http.Server{Addr: grpcAddr, Handler: api.GRPCServer(), TLSConfig: tlsConfig, Protocols: grpc.Protocols()}
+		servers = append(servers, grpcServer)
+		go func() {
+			logrus.Infof("gRPC listen on addr: %s, TLS %v", grpcAddr, tlsConfig != nil)
+			if tlsConfig != nil {
+				serveErr <- grpcServer.ServeTLS(grpcLn, "", "")
+			} else {
+				serveErr <- grpcServer.Serve(grpcLn)
+			}
+		}()
+	}
+	for {
+		select {
+		case err := <-serveErr:
+			logrus.Fatal("ListenAndServe: ", err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				sdNotify("RELOADING=1")
+				api.Reload()
+				sdNotify("READY=1")
+				continue
+			}
+			logrus.Infof("received %v, shutting down", sig)
+			return shutdownServer(servers, cfg.Server.ShutdownTimeout.Duration)
+		}
+	}
+}
 
-	r := RegisterHandler()
-	addr := ctx.GlobalString("listen")
-	if addr == "" {
-		addr = ":80"
+// shutdownServer stops accepting requests and calls and waits for the
+// running ones and the hardware operations, which finish or roll back their
+// offsets. The exit status is 1 if they did not end within timeout.
+func shutdownServer(servers []*http.Server, timeout time.Duration) error {
+	sdNotify("STOPPING=1")
+	drained := make(chan bool, 1)
+	go func() { drained <- api.Shutdown(timeout) }()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) { errs <- server.Shutdown(shutdownCtx) }(server)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	ok := <-drained
+	// 退出前把校准参数等写入sd卡
+	syscall.Sync()
+	if err != nil || !ok {
+		return cli.NewExitError(fmt.Sprintf("shutdown incomplete: %v, running operations %v", err, api.RunningOps()), 1)
 	}
-	logrus.Info("listen on addr: ", addr)
-	err := http.ListenAndServe(addr, r) //设置监听的端口
+	logrus.Info("shutdown done")
+	return nil
+}
+
+// handlerAlive runs a /healthz request through the handler.
+func handlerAlive(h http.Handler) bool {
+	req, err := http.NewRequest("GET", "/healthz", nil)
 	if err != nil {
-		logrus.Fatal("ListenAndServe: ", err)
+		return false
 	}
+	w := &probeWriter{header: make(http.Header), status: http.StatusOK}
+	h.ServeHTTP(w, req)
+	return w.status == http.StatusOK
+}
+
+type probeWriter struct {
+	header http.Header
+	status int
 }
 
-func RegisterHandler() *httprouter.Router {
+func (w *probeWriter) Header() http.Header         { return w.header }
+func (w *probeWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *probeWriter) WriteHeader(status int)      { w.status = status }
+
+// apiRoute is a registered route, the OpenAPI document must describe each
+// of them.
+type apiRoute struct {
+	method, path string
+}
+
+func RegisterHandler() (*httprouter.Router, []apiRoute) {
 	router := httprouter.New()
-	router.GET("/params", api.CalibrationParams)
-	router.GET("/regparams", api.GetRegsParams)
-	router.DELETE("/regparams", api.ClearRegsParams)
-	router.POST("/calibration", api.Calibration)
-	router.POST("/reboot", api.RestartSystem)
-	return router
+	var routes []apiRoute
+	route := func(method, path string, h httprouter.Handle) {
+		router.Handle(method, path, api.RequestID(api.Instrument(path, h)))
+		routes = append(routes, apiRoute{method, path})
+	}
+	route("GET", "/params", api.Authorize(api.RoleViewer, api.CalibrationParams))
+	route("PUT", "/params", api.Authorize(api.RoleOperator, api.Audited("params_import", api.OffsetState, api.PutParams)))
+	route("GET", "/regparams", api.Authorize(api.RoleViewer, api.GetRegsParams))
+	route("DELETE", "/regparams", api.Authorize(api.RoleOperator, api.Audited("clear_regs", api.OffsetState, api.ClearRegsParams)))
+	route("POST", "/calibration", api.Authorize(api.RoleOperator, api.Audited("calibration", api.OffsetState, api.Calibration)))
+	route("POST", "/reboot", api.Authorize(api.RoleOperator, api.Audited("reboot", nil, api.RestartSystem)))
+	route("DELETE", "/reboot", api.Authorize(api.RoleOperator, api.Audited("reboot_cancel", nil, api.CancelRestart)))
+	route("GET", "/healthz", api.Healthz)
+	route("GET", "/readyz", api.Readyz)
+	route("GET", "/status", api.Authorize(api.RoleViewer, api.GetStatus))
+	route("GET", "/events", api.Authorize(api.RoleViewer, api.GetEvents))
+	route("GET", "/calibration/progress", api.Authorize(api.RoleViewer, api.GetCalibrationProgress))
+	route("GET", "/devices", api.Authorize(api.RoleViewer, api.GetDevices))
+	// 寄存器写权限由设备的寄存器策略按角色进一步限制
+	route("GET", "/devices/:dev/registers", api.Authorize(api.RoleViewer, api.DumpRegisters))
+	route("GET", "/devices/:dev/registers/:addr", api.Authorize(api.RoleViewer, api.ReadRegister))
+	route("PUT", "/devices/:dev/registers/:addr", api.Authorize(api.RoleOperator, api.Audited("register_write", api.RegisterState, api.WriteRegister)))
+	route("GET", "/devices/:dev/regmap", api.Authorize(api.RoleViewer, api.GetRegisterMap))
+	route("GET", "/devices/:dev/capture", api.Authorize(api.RoleViewer, api.GetCapture))
+	route("GET", "/history", api.Authorize(api.RoleViewer, api.GetHistory))
+	route("POST", "/history/:job/rollback", api.Authorize(api.RoleOperator, api.Audited("calibration_rollback", api.OffsetState, api.RollbackCalibration)))
+	route("GET", "/drift", api.Authorize(api.RoleViewer, api.GetDrift))
+	route("GET", "/compensation", api.Authorize(api.RoleViewer, api.GetCompensation))
+	route("DELETE", "/compensation/table", api.Authorize(api.RoleOperator, api.Audited("offset_table_clear", nil, api.DeleteOffsetTable)))
+	route("GET", "/webhooks", api.Authorize(api.RoleOperator, api.GetWebhooks))
+	route("GET", "/schedule", api.Authorize(api.RoleViewer, api.GetSchedule))
+	route("PUT", "/schedule/window", api.Authorize(api.RoleOperator, api.Audited("calibration_window", nil, api.PutCalibrationWindow)))
+	route("GET", "/snapshots", api.Authorize(api.RoleViewer, api.GetSnapshots))
+	route("POST", "/snapshots", api.Authorize(api.RoleOperator, api.Audited("snapshot_create", nil, api.CreateSnapshot)))
+	route("GET", "/snapshots/:name", api.Authorize(api.RoleViewer, api.GetSnapshot))
+	route("DELETE", "/snapshots/:name", api.Authorize(api.RoleOperator, api.Audited("snapshot_delete", nil, api.RemoveSnapshot)))
+	route("GET", "/snapshots/:name/diff", api.Authorize(api.RoleViewer, api.GetSnapshotDiff))
+	route("POST", "/snapshots/:name/restore", api.Authorize(api.RoleAdmin, api.Audited("snapshot_restore", api.RegisterSpaceState, api.PostSnapshotRestore)))
+	route("GET", "/audit", api.Authorize(api.RoleOperator, api.GetAudit))
+	route("GET", "/auth/whoami", api.Authorize(api.RoleViewer, api.WhoAmI))
+	route("POST", "/auth/reload", api.Authorize(api.RoleAdmin, api.Audited("auth_reload", nil, api.ReloadAuthHandler)))
+	route("GET", "/metrics", api.Authorize(api.RoleViewer, api.Metrics))
+	route("GET", "/admin/log", api.Authorize(api.RoleAdmin, api.GetLogSettings))
+	route("PUT", "/admin/log", api.Authorize(api.RoleAdmin, api.Audited("log_levels", nil, api.PutLogSettings)))
+	// 操作界面的静态文件不需要认证, 界面调用的接口需要
+	route("GET", "/", func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	})
+	route("GET", "/ui/*filepath", ui.Serve)
+	route("GET", "/openapi.json", api.OpenAPI)
+	return router, routes
 }
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	Default = &Registry{}
+	requests := NewCounterVec("http_requests_total", "Requests.", "route", "code")
+	offset := NewGaugeVec("offset", "Offset.", "device")
+	duration := NewHistogramVec("duration_seconds", "Duration.", []float64{0.1, 1}, "op")
+	NewGaugeVec("unused", "Not set.", "device")
+
+	requests.Inc("/params", "200")
+	requests.Inc("/params", "200")
+	requests.Inc(`/a"b`, "500")
+	offset.Set(-12, "cf_axi_adc")
+	duration.Observe(0.05, "read")
+	duration.Observe(0.5, "read")
+
+	var buf bytes.Buffer
+	Default.Write(&buf)
+	expected := `# HELP http_requests_total Requests.
+# TYPE http_requests_total counter
+http_requests_total{route="/a\"b",code="500"} 1
+http_requests_total{route="/params",code="200"} 2
+# HELP offset Offset.
+# TYPE offset gauge
+offset{device="cf_axi_adc"} -12
+# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{op="read",le="0.1"} 1
+duration_seconds_bucket{op="read",le="1"} 2
+duration_seconds_bucket{op="read",le="+Inf"} 2
+duration_seconds_sum{op="read"} 0.55
+duration_seconds_count{op="read"} 2
+`
+	if buf.String() != expected {
+		t.Fatalf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
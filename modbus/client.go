@@ -0,0 +1,140 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client is a Modbus TCP client, its requests are sent one at a time.
+type Client struct {
+	// unit identifier of the requests
+	Unit byte
+	// timeout of a request, default 5 seconds
+	Timeout time.Duration
+
+	mu          sync.Mutex
+	conn        net.Conn
+	r           *bufio.Reader
+	transaction uint16
+}
+
+// Dial connects to the server at addr, host:port.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// call sends a request and returns the data of the response. An exception
+// response is returned as Exception.
+func (c *Client) call(function byte, data []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	c.transaction++
+	req := &frame{transaction: c.transaction, unit: c.Unit, function: function, data: data}
+	if _, err := c.conn.Write(req.bytes()); err != nil {
+		return nil, err
+	}
+	resp, err := readFrame(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.transaction != req.transaction || resp.function&0x7f != function {
+		return nil, fmt.Errorf("modbus: response of transaction %d function 0x%02x to transaction %d function 0x%02x",
+			resp.transaction, resp.function, req.transaction, function)
+	}
+	if resp.function&0x80 != 0 {
+		if len(resp.data) != 1 {
+			return nil, errMalformed
+		}
+		return nil, Exception(resp.data[0])
+	}
+	return resp.data, nil
+}
+
+func addressQuantity(addr, quantity uint16) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data, addr)
+	binary.BigEndian.PutUint16(data[2:], quantity)
+	return data
+}
+
+// read reads the response of a read request, a byte count and n bytes.
+func (c *Client) read(function byte, addr, quantity uint16, n int) ([]byte, error) {
+	data, err := c.call(function, addressQuantity(addr, quantity))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1+n || int(data[0]) != n {
+		return nil, errMalformed
+	}
+	return data[1:], nil
+}
+
+func (c *Client) ReadCoils(addr, quantity uint16) ([]bool, error) {
+	data, err := c.read(ReadCoils, addr, quantity, (int(quantity)+7)/8)
+	if err != nil {
+		return nil, err
+	}
+	return unpackBits(data, int(quantity)), nil
+}
+
+func (c *Client) ReadHoldingRegisters(addr, quantity uint16) ([]uint16, error) {
+	data, err := c.read(ReadHoldingRegisters, addr, quantity, 2*int(quantity))
+	if err != nil {
+		return nil, err
+	}
+	return unpackRegisters(data), nil
+}
+
+func (c *Client) ReadInputRegisters(addr, quantity uint16) ([]uint16, error) {
+	data, err := c.read(ReadInputRegisters, addr, quantity, 2*int(quantity))
+	if err != nil {
+		return nil, err
+	}
+	return unpackRegisters(data), nil
+}
+
+func (c *Client) WriteSingleCoil(addr uint16, value bool) error {
+	var v uint16
+	if value {
+		v = 0xff00
+	}
+	req := addressQuantity(addr, v)
+	data, err := c.call(WriteSingleCoil, req)
+	if err != nil {
+		return err
+	}
+	if string(data) != string(req) {
+		return errMalformed
+	}
+	return nil
+}
+
+func (c *Client) WriteMultipleCoils(addr uint16, values []bool) error {
+	req := addressQuantity(addr, uint16(len(values)))
+	packed := packBits(values)
+	data, err := c.call(WriteMultipleCoils, append(append(req, byte(len(packed))), packed...))
+	if err != nil {
+		return err
+	}
+	if string(data) != string(req) {
+		return errMalformed
+	}
+	return nil
+}
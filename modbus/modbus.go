@@ -0,0 +1,137 @@
+// Package modbus implements a Modbus TCP server for coils, holding and input
+// registers and a client for tests and tools. Discrete inputs and register
+// writes are not supported.
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Function codes.
+const (
+	ReadCoils            = 0x01
+	ReadHoldingRegisters = 0x03
+	ReadInputRegisters   = 0x04
+	WriteSingleCoil      = 0x05
+	WriteMultipleCoils   = 0x0f
+)
+
+// Limits of the quantity of a request, a PDU has at most 253 bytes.
+const (
+	MaxReadCoils     = 2000
+	MaxReadRegisters = 125
+	MaxWriteCoils    = 1968
+
+	maxPDU = 253
+)
+
+// Exception is the exception code of an error response. Handlers return an
+// Exception to choose the code, other errors are answered with
+// ServerDeviceFailure.
+type Exception byte
+
+const (
+	IllegalFunction     Exception = 0x01
+	IllegalDataAddress  Exception = 0x02
+	IllegalDataValue    Exception = 0x03
+	ServerDeviceFailure Exception = 0x04
+	ServerDeviceBusy    Exception = 0x06
+	GatewayTargetFailed Exception = 0x0b
+)
+
+var exceptionNames = map[Exception]string{
+	IllegalFunction:     "illegal function",
+	IllegalDataAddress:  "illegal data address",
+	IllegalDataValue:    "illegal data value",
+	ServerDeviceFailure: "server device failure",
+	ServerDeviceBusy:    "server device busy",
+	GatewayTargetFailed: "gateway target device failed to respond",
+}
+
+func (e Exception) Error() string {
+	if name, ok := exceptionNames[e]; ok {
+		return "modbus: " + name
+	}
+	return fmt.Sprintf("modbus: exception 0x%02x", byte(e))
+}
+
+var errMalformed = errors.New("modbus: malformed frame")
+
+// frame is an application data unit, the MBAP header and the PDU.
+type frame struct {
+	transaction uint16
+	unit        byte
+	function    byte
+	data        []byte
+}
+
+// readFrame reads one frame, the protocol identifier must be 0.
+func readFrame(r io.Reader) (*frame, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	protocol := binary.BigEndian.Uint16(header[2:])
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	// length 包括单元标识和功能码
+	if protocol != 0 || length < 2 || length > maxPDU+1 {
+		return nil, errMalformed
+	}
+	f := &frame{
+		transaction: binary.BigEndian.Uint16(header[0:]),
+		unit:        header[6],
+		function:    header[7],
+		data:        make([]byte, length-2),
+	}
+	if _, err := io.ReadFull(r, f.data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *frame) bytes() []byte {
+	buf := make([]byte, 8, 8+len(f.data))
+	binary.BigEndian.PutUint16(buf[0:], f.transaction)
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(f.data)+2))
+	buf[6] = f.unit
+	buf[7] = f.function
+	return append(buf, f.data...)
+}
+
+// packBits packs coils into bytes, the first coil in the low bit.
+func packBits(bits []bool) []byte {
+	buf := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b {
+			buf[i/8] |= 1 << (i % 8)
+		}
+	}
+	return buf
+}
+
+func unpackBits(buf []byte, n int) []bool {
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = buf[i/8]&(1<<(i%8)) != 0
+	}
+	return bits
+}
+
+func packRegisters(regs []uint16) []byte {
+	buf := make([]byte, 2*len(regs))
+	for i, v := range regs {
+		binary.BigEndian.PutUint16(buf[2*i:], v)
+	}
+	return buf
+}
+
+func unpackRegisters(buf []byte) []uint16 {
+	regs := make([]uint16, len(buf)/2)
+	for i := range regs {
+		regs[i] = binary.BigEndian.Uint16(buf[2*i:])
+	}
+	return regs
+}
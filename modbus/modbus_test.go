@@ -0,0 +1,158 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// memHandler keeps 200 coils and 200 registers, the holding and the input
+// registers are the same.
+type memHandler struct {
+	coils [200]bool
+	regs  [200]uint16
+}
+
+func (h *memHandler) check(r *Request) error {
+	if int(r.Address)+int(r.Quantity) > 200 {
+		return IllegalDataAddress
+	}
+	return nil
+}
+
+func (h *memHandler) ReadCoils(r *Request) ([]bool, error) {
+	if err := h.check(r); err != nil {
+		return nil, err
+	}
+	return append([]bool(nil), h.coils[r.Address:r.Address+r.Quantity]...), nil
+}
+
+func (h *memHandler) ReadHoldingRegisters(r *Request) ([]uint16, error) {
+	if err := h.check(r); err != nil {
+		return nil, err
+	}
+	return append([]uint16(nil), h.regs[r.Address:r.Address+r.Quantity]...), nil
+}
+
+func (h *memHandler) ReadInputRegisters(r *Request) ([]uint16, error) {
+	if r.Address == 199 {
+		return nil, errors.New("broken")
+	}
+	return h.ReadHoldingRegisters(r)
+}
+
+func (h *memHandler) WriteCoils(r *Request) error {
+	if err := h.check(r); err != nil {
+		return err
+	}
+	copy(h.coils[r.Address:], r.Coils)
+	return nil
+}
+
+func startServer(t *testing.T, s *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(s.Close)
+	return ln.Addr().String()
+}
+
+// TestFrames checks the examples of the Modbus application protocol
+// specification.
+func TestFrames(t *testing.T) {
+	h := &memHandler{}
+	h.regs[0x6b], h.regs[0x6c], h.regs[0x6d] = 0x022b, 0x0000, 0x0064
+	h.coils[20], h.coils[22], h.coils[27], h.coils[31] = true, true, true, true
+	addr := startServer(t, &Server{Handler: h})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, c := range []struct {
+		req, resp []byte
+	}{
+		// read holding registers 0x6b-0x6d
+		{[]byte{0, 1, 0, 0, 0, 6, 1, 0x03, 0x00, 0x6b, 0x00, 0x03},
+			[]byte{0, 1, 0, 0, 0, 9, 1, 0x03, 0x06, 0x02, 0x2b, 0x00, 0x00, 0x00, 0x64}},
+		// read 19 coils from 0x13
+		{[]byte{0, 2, 0, 0, 0, 6, 1, 0x01, 0x00, 0x13, 0x00, 0x13},
+			[]byte{0, 2, 0, 0, 0, 6, 1, 0x01, 0x03, 0x0a, 0x11, 0x00}},
+		// write single coil 0x0a on
+		{[]byte{0, 3, 0, 0, 0, 6, 1, 0x05, 0x00, 0x0a, 0xff, 0x00},
+			[]byte{0, 3, 0, 0, 0, 6, 1, 0x05, 0x00, 0x0a, 0xff, 0x00}},
+		// write 10 coils from 0x13
+		{[]byte{0, 4, 0, 0, 0, 9, 1, 0x0f, 0x00, 0x13, 0x00, 0x0a, 0x02, 0xcd, 0x01},
+			[]byte{0, 4, 0, 0, 0, 6, 1, 0x0f, 0x00, 0x13, 0x00, 0x0a}},
+		// write single register is not supported
+		{[]byte{0, 5, 0, 0, 0, 6, 1, 0x06, 0x00, 0x01, 0x00, 0x03},
+			[]byte{0, 5, 0, 0, 0, 3, 1, 0x86, 0x01}},
+		// invalid coil value
+		{[]byte{0, 6, 0, 0, 0, 6, 1, 0x05, 0x00, 0x0a, 0x12, 0x34},
+			[]byte{0, 6, 0, 0, 0, 3, 1, 0x85, 0x03}},
+	} {
+		if _, err := conn.Write(c.req); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, len(c.resp))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(resp, c.resp) {
+			t.Errorf("response to % x: % x, want % x", c.req, resp, c.resp)
+		}
+	}
+	if !h.coils[10] || !h.coils[19] || h.coils[20] || !h.coils[21] || !h.coils[27] || h.coils[28] {
+		t.Errorf("coils %v", h.coils[:30])
+	}
+}
+
+func TestClient(t *testing.T) {
+	h := &memHandler{}
+	h.regs[5] = 0xfffe
+	var logged []error
+	addr := startServer(t, &Server{Handler: h, Unit: 7, ErrorLog: func(r *Request, err error) { logged = append(logged, err) }})
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.ReadHoldingRegisters(0, 1); err != GatewayTargetFailed {
+		t.Errorf("request to unit 0: %v", err)
+	}
+	c.Unit = 7
+	if err := c.WriteMultipleCoils(3, []bool{true, false, true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteSingleCoil(4, true); err != nil {
+		t.Fatal(err)
+	}
+	coils, err := c.ReadCoils(2, 4)
+	if err != nil || len(coils) != 4 || coils[0] || !coils[1] || !coils[2] || !coils[3] {
+		t.Errorf("coils %v, %v", coils, err)
+	}
+	regs, err := c.ReadInputRegisters(4, 3)
+	if err != nil || len(regs) != 3 || regs[1] != 0xfffe {
+		t.Errorf("registers %v, %v", regs, err)
+	}
+	if _, err := c.ReadHoldingRegisters(198, 3); err != IllegalDataAddress {
+		t.Errorf("reading past the end: %v", err)
+	}
+	if _, err := c.ReadHoldingRegisters(0, MaxReadRegisters+1); err != IllegalDataValue {
+		t.Errorf("reading %d registers: %v", MaxReadRegisters+1, err)
+	}
+	if _, err := c.ReadInputRegisters(199, 1); err != ServerDeviceFailure {
+		t.Errorf("handler error: %v", err)
+	}
+	if len(logged) != 4 {
+		t.Errorf("logged errors %v", logged)
+	}
+	if err := IllegalDataAddress.Error(); err != "modbus: illegal data address" {
+		t.Errorf("error %q", err)
+	}
+}
@@ -0,0 +1,241 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Request is a read or write request of a client.
+type Request struct {
+	// address of the client
+	Remote   string
+	Unit     byte
+	Function byte
+	Address  uint16
+	Quantity uint16
+	// values of a coil write
+	Coils []bool
+}
+
+// Handler answers the requests. The returned slices must have the length of
+// the requested quantity.
+type Handler interface {
+	ReadCoils(r *Request) ([]bool, error)
+	ReadHoldingRegisters(r *Request) ([]uint16, error)
+	ReadInputRegisters(r *Request) ([]uint16, error)
+	WriteCoils(r *Request) error
+}
+
+// Server serves Modbus TCP connections. The requests of a connection are
+// answered in order.
+type Server struct {
+	Handler Handler
+	// unit identifier answered, 0 answers all units. Requests of other
+	// units get a GatewayTargetFailed exception.
+	Unit byte
+	// idle connections are closed after this time, default 5 minutes
+	IdleTimeout time.Duration
+	// called with the errors of the requests
+	ErrorLog func(r *Request, err error)
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Serve accepts connections on ln until Close.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.ln = ln
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listener, closes the connections and waits for the
+// running requests.
+func (s *Server) Close() {
+	s.mu.Lock()
+	ln := s.ln
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+	s.wg.Wait()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	idle := s.IdleTimeout
+	if idle <= 0 {
+		idle = 5 * time.Minute
+	}
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		req, err := readFrame(r)
+		if err != nil {
+			// 连接关闭, 超时或帧头错误, 无法同步到下一帧
+			return
+		}
+		resp := s.handle(conn.RemoteAddr().String(), req)
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(resp.bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a request frame, with an exception on errors.
+func (s *Server) handle(remote string, f *frame) *frame {
+	resp := &frame{transaction: f.transaction, unit: f.unit, function: f.function}
+	r := &Request{Remote: remote, Unit: f.unit, Function: f.function}
+	data, err := s.dispatch(r, f)
+	if err != nil {
+		if s.ErrorLog != nil {
+			s.ErrorLog(r, err)
+		}
+		code, ok := err.(Exception)
+		if !ok {
+			code = ServerDeviceFailure
+		}
+		resp.function |= 0x80
+		resp.data = []byte{byte(code)}
+		return resp
+	}
+	resp.data = data
+	return resp
+}
+
+func (s *Server) dispatch(r *Request, f *frame) ([]byte, error) {
+	if s.Unit != 0 && f.unit != s.Unit {
+		return nil, GatewayTargetFailed
+	}
+	switch f.function {
+	case ReadCoils, ReadHoldingRegisters, ReadInputRegisters:
+		if len(f.data) != 4 {
+			return nil, IllegalDataValue
+		}
+		r.Address = binary.BigEndian.Uint16(f.data)
+		r.Quantity = binary.BigEndian.Uint16(f.data[2:])
+		max := MaxReadRegisters
+		if f.function == ReadCoils {
+			max = MaxReadCoils
+		}
+		if r.Quantity < 1 || int(r.Quantity) > max {
+			return nil, IllegalDataValue
+		}
+		if int(r.Address)+int(r.Quantity) > 0x10000 {
+			return nil, IllegalDataAddress
+		}
+		if f.function == ReadCoils {
+			coils, err := s.Handler.ReadCoils(r)
+			if err != nil {
+				return nil, err
+			}
+			if len(coils) != int(r.Quantity) {
+				return nil, ServerDeviceFailure
+			}
+			packed := packBits(coils)
+			return append([]byte{byte(len(packed))}, packed...), nil
+		}
+		var regs []uint16
+		var err error
+		if f.function == ReadHoldingRegisters {
+			regs, err = s.Handler.ReadHoldingRegisters(r)
+		} else {
+			regs, err = s.Handler.ReadInputRegisters(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(regs) != int(r.Quantity) {
+			return nil, ServerDeviceFailure
+		}
+		packed := packRegisters(regs)
+		return append([]byte{byte(len(packed))}, packed...), nil
+
+	case WriteSingleCoil:
+		if len(f.data) != 4 {
+			return nil, IllegalDataValue
+		}
+		r.Address = binary.BigEndian.Uint16(f.data)
+		r.Quantity = 1
+		switch binary.BigEndian.Uint16(f.data[2:]) {
+		case 0xff00:
+			r.Coils = []bool{true}
+		case 0x0000:
+			r.Coils = []bool{false}
+		default:
+			return nil, IllegalDataValue
+		}
+		if err := s.Handler.WriteCoils(r); err != nil {
+			return nil, err
+		}
+		// 应答与请求相同
+		return f.data, nil
+
+	case WriteMultipleCoils:
+		if len(f.data) < 6 {
+			return nil, IllegalDataValue
+		}
+		r.Address = binary.BigEndian.Uint16(f.data)
+		r.Quantity = binary.BigEndian.Uint16(f.data[2:])
+		n := int(f.data[4])
+		if r.Quantity < 1 || r.Quantity > MaxWriteCoils || n != (int(r.Quantity)+7)/8 || len(f.data) != 5+n {
+			return nil, IllegalDataValue
+		}
+		if int(r.Address)+int(r.Quantity) > 0x10000 {
+			return nil, IllegalDataAddress
+		}
+		r.Coils = unpackBits(f.data[5:], int(r.Quantity))
+		if err := s.Handler.WriteCoils(r); err != nil {
+			return nil, err
+		}
+		return f.data[:4], nil
+	}
+	return nil, IllegalFunction
+}
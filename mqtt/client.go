@@ -0,0 +1,458 @@
+// Package mqtt implements a MQTT 3.1.1 client with QoS 0 and 1, retained
+// messages, a last will and automatic reconnection.
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotConnected is returned by Publish for a QoS 0 message while the
+	// client is disconnected.
+	ErrNotConnected = errors.New("mqtt: not connected")
+	// ErrQueueFull is returned by Publish when too many QoS 1 messages wait
+	// for their acknowledgement.
+	ErrQueueFull = errors.New("mqtt: too many unacknowledged messages")
+	// ErrClosed is returned after Close.
+	ErrClosed = errors.New("mqtt: client closed")
+)
+
+// CONNACK 返回码
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// Options configures a Client.
+type Options struct {
+	// tcp://host:port, tls://host:port or host:port
+	Broker    string
+	TLSConfig *tls.Config
+	ClientID  string
+	Username  string
+	Password  string
+	// the session and the subscriptions are kept by the broker while
+	// disconnected unless CleanSession is set
+	CleanSession bool
+	Will         *Message
+	// default 30s
+	KeepAlive time.Duration
+	// timeout of the connection, the handshake and of every write, default 10s
+	Timeout time.Duration
+	// delay between connection attempts, doubled up to MaxReconnect,
+	// default 1s and 1m
+	MinReconnect time.Duration
+	MaxReconnect time.Duration
+	// QoS 1 messages kept for retransmission, default 1000
+	MaxInflight int
+	// called after every successful connection
+	OnConnect func()
+	// called when a connection attempt fails or the connection is lost
+	OnConnectionLost func(err error)
+}
+
+// Handler receives the messages of a subscription, the handlers are called
+// one after the other in the order the messages arrive.
+type Handler func(m Message)
+
+type subscription struct {
+	qos     byte
+	handler Handler
+}
+
+// Client is a MQTT client connection, it reconnects until Close.
+type Client struct {
+	opts Options
+
+	mu       sync.Mutex
+	conn     net.Conn
+	closed   bool
+	lastID   uint16
+	inflight map[uint16]*Packet
+	order    []uint16
+	subs     map[string]subscription
+
+	wmu      sync.Mutex
+	messages chan Message
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewClient starts connecting to the broker in the background.
+func NewClient(opts Options) *Client {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = 30 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MinReconnect <= 0 {
+		opts.MinReconnect = time.Second
+	}
+	if opts.MaxReconnect < opts.MinReconnect {
+		opts.MaxReconnect = max(time.Minute, opts.MinReconnect)
+	}
+	if opts.MaxInflight <= 0 {
+		opts.MaxInflight = 1000
+	}
+	c := &Client{
+		opts:     opts,
+		inflight: make(map[uint16]*Packet),
+		subs:     make(map[string]subscription),
+		messages: make(chan Message, 64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.dispatch()
+	go c.run()
+	return c
+}
+
+// Connected reports whether the client is connected to the broker.
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Pending returns the number of QoS 1 messages not acknowledged yet.
+func (c *Client) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.inflight)
+}
+
+// Publish sends m. A QoS 1 message published while disconnected is sent
+// after the reconnection and retransmitted until the broker acknowledges
+// it. QoS 2 is not supported.
+func (c *Client) Publish(m Message) error {
+	if m.QoS > 1 {
+		return fmt.Errorf("mqtt: QoS %d not supported", m.QoS)
+	}
+	if m.Topic == "" || strings.ContainsAny(m.Topic, "+#") {
+		return fmt.Errorf("mqtt: invalid topic %q", m.Topic)
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	conn := c.conn
+	var p *Packet
+	if m.QoS == 0 {
+		if conn == nil {
+			c.mu.Unlock()
+			return ErrNotConnected
+		}
+		p = EncodePublish(m, 0, false)
+	} else {
+		if len(c.inflight) >= c.opts.MaxInflight {
+			c.mu.Unlock()
+			return ErrQueueFull
+		}
+		id := c.newID()
+		p = EncodePublish(m, id, false)
+		c.inflight[id] = p
+		c.order = append(c.order, id)
+	}
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	// 写失败时连接由读循环关闭并重连, QoS 1 的消息重连后重发
+	err := c.write(conn, p)
+	if m.QoS > 0 {
+		return nil
+	}
+	return err
+}
+
+// Subscribe adds a subscription, it is renewed on every reconnection.
+func (c *Client) Subscribe(filter string, qos byte, h Handler) error {
+	if qos > 1 {
+		return fmt.Errorf("mqtt: QoS %d not supported", qos)
+	}
+	if filter == "" {
+		return fmt.Errorf("mqtt: empty topic filter")
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.subs[filter] = subscription{qos: qos, handler: h}
+	conn := c.conn
+	var id uint16
+	if conn != nil {
+		id = c.newID()
+	}
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return c.write(conn, EncodeSubscribe(id, []Subscription{{Filter: filter, QoS: qos}}))
+}
+
+// Close disconnects from the broker, the last will is not published.
+// Unacknowledged messages are dropped.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+	close(c.stop)
+	if conn != nil {
+		c.write(conn, &Packet{Type: DISCONNECT})
+		conn.Close()
+	}
+	<-c.done
+	return nil
+}
+
+// newID returns a packet identifier not in use, c.mu must be held.
+func (c *Client) newID() uint16 {
+	for {
+		c.lastID++
+		if _, used := c.inflight[c.lastID]; c.lastID != 0 && !used {
+			return c.lastID
+		}
+	}
+}
+
+func (c *Client) write(conn net.Conn, p *Packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(c.opts.Timeout))
+	err := WritePacket(conn, p)
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	defer close(c.messages)
+	backoff := c.opts.MinReconnect
+	for {
+		conn, r, err := c.connect()
+		if err == nil {
+			backoff = c.opts.MinReconnect
+			if c.opts.OnConnect != nil {
+				c.opts.OnConnect()
+			}
+			err = c.serve(conn, r)
+		}
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		if c.opts.OnConnectionLost != nil {
+			c.opts.OnConnectionLost(err)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-c.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, c.opts.MaxReconnect)
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	addr, secure := c.opts.Broker, false
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		addr = addr[len("tcp://"):]
+	case strings.HasPrefix(addr, "tls://"), strings.HasPrefix(addr, "ssl://"):
+		addr, secure = addr[len("tls://"):], true
+	case strings.Contains(addr, "://"):
+		return nil, fmt.Errorf("mqtt: unsupported broker %q", c.opts.Broker)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if secure {
+			addr = net.JoinHostPort(addr, "8883")
+		} else {
+			addr = net.JoinHostPort(addr, "1883")
+		}
+	}
+	dialer := &net.Dialer{Timeout: c.opts.Timeout}
+	if !secure {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, c.opts.TLSConfig)
+}
+
+// connect opens the connection, renews the subscriptions and retransmits
+// the unacknowledged messages.
+func (c *Client) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.opts.Timeout))
+	connect := &Connect{
+		ClientID:     c.opts.ClientID,
+		Username:     c.opts.Username,
+		Password:     c.opts.Password,
+		CleanSession: c.opts.CleanSession,
+		KeepAlive:    uint16(c.opts.KeepAlive / time.Second),
+		Will:         c.opts.Will,
+	}
+	r := bufio.NewReader(conn)
+	if err = WritePacket(conn, connect.Encode()); err == nil {
+		var p *Packet
+		if p, err = ReadPacket(r); err == nil {
+			switch {
+			case p.Type != CONNACK || len(p.Body) != 2:
+				err = fmt.Errorf("mqtt: unexpected packet type %d", p.Type)
+			case p.Body[1] != 0:
+				err = fmt.Errorf("mqtt: connection refused, %s", connackErrors[p.Body[1]])
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return nil, nil, ErrClosed
+	}
+	c.conn = conn
+	var subs []Subscription
+	for filter, s := range c.subs {
+		subs = append(subs, Subscription{Filter: filter, QoS: s.qos})
+	}
+	var subID uint16
+	if len(subs) > 0 {
+		subID = c.newID()
+	}
+	var resend []*Packet
+	order := c.order[:0]
+	for _, id := range c.order {
+		if p, ok := c.inflight[id]; ok {
+			dup := *p
+			dup.Flags |= 0x08
+			resend = append(resend, &dup)
+			order = append(order, id)
+		}
+	}
+	c.order = order
+	c.mu.Unlock()
+
+	if len(subs) > 0 {
+		c.write(conn, EncodeSubscribe(subID, subs))
+	}
+	for _, p := range resend {
+		c.write(conn, p)
+	}
+	return conn, r, nil
+}
+
+// serve reads from the connection until it fails.
+func (c *Client) serve(conn net.Conn, r *bufio.Reader) error {
+	quit := make(chan struct{})
+	defer func() {
+		close(quit)
+		conn.Close()
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+	keepAlive := c.opts.KeepAlive
+	go func() {
+		ticker := time.NewTicker(keepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				c.write(conn, &Packet{Type: PINGREQ})
+			}
+		}
+	}()
+	for {
+		// 每半个保活周期发一次 PINGREQ, 超时没有收到任何包说明连接已断
+		conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		p, err := ReadPacket(r)
+		if err != nil {
+			return err
+		}
+		switch p.Type {
+		case PUBLISH:
+			m, id, err := DecodePublish(p)
+			if err != nil {
+				return err
+			}
+			select {
+			case c.messages <- m:
+			case <-c.stop:
+				return ErrClosed
+			}
+			if m.QoS > 0 {
+				c.write(conn, &Packet{Type: PUBACK, Body: appendUint16(nil, id)})
+			}
+		case PUBACK:
+			id, err := PacketID(p)
+			if err != nil {
+				return err
+			}
+			c.mu.Lock()
+			delete(c.inflight, id)
+			c.mu.Unlock()
+		case SUBACK:
+			id, err := PacketID(p)
+			if err != nil {
+				return err
+			}
+			for _, code := range p.Body[2:] {
+				if code == 0x80 {
+					return fmt.Errorf("mqtt: subscription %d refused", id)
+				}
+			}
+		case PINGRESP, UNSUBACK:
+		default:
+			return fmt.Errorf("mqtt: unexpected packet type %d", p.Type)
+		}
+	}
+}
+
+// dispatch calls the handlers of the received messages.
+func (c *Client) dispatch() {
+	for m := range c.messages {
+		c.mu.Lock()
+		var handlers []Handler
+		for filter, s := range c.subs {
+			if Match(filter, m.Topic) && s.handler != nil {
+				handlers = append(handlers, s.handler)
+			}
+		}
+		c.mu.Unlock()
+		for _, h := range handlers {
+			h(m)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package mqtt_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/plpsy/iiocalibration/mqtt"
+	"github.com/plpsy/iiocalibration/mqtt/mqtttest"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+	} {
+		if got := mqtt.Match(c.filter, c.topic); got != c.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.filter, c.topic, got, c.match)
+		}
+	}
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	in := &mqtt.Connect{ClientID: "dev", Username: "u", Password: "p", KeepAlive: 30,
+		Will: &mqtt.Message{Topic: "x/status", Payload: []byte("offline"), QoS: 1, Retain: true}}
+	out, err := mqtt.DecodeConnect(in.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.ClientID != "dev" || out.Username != "u" || out.Password != "p" || out.KeepAlive != 30 ||
+		out.Will == nil || string(out.Will.Payload) != "offline" || !out.Will.Retain || out.Will.QoS != 1 {
+		t.Errorf("decoded %+v, will %+v", out, out.Will)
+	}
+}
+
+func TestClient(t *testing.T) {
+	broker := mqtttest.NewServer()
+	defer broker.Close()
+
+	connects := make(chan struct{}, 10)
+	c := mqtt.NewClient(mqtt.Options{
+		Broker:       broker.URL(),
+		ClientID:     "test",
+		Will:         &mqtt.Message{Topic: "dev/status", Payload: []byte("offline"), Retain: true},
+		MinReconnect: 10 * time.Millisecond,
+		OnConnect:    func() { connects <- struct{}{} },
+	})
+	defer c.Close()
+	received := make(chan mqtt.Message, 10)
+	if err := c.Subscribe("dev/command/+", 1, func(m mqtt.Message) { received <- m }); err != nil {
+		t.Fatal(err)
+	}
+	<-connects
+
+	if err := c.Publish(mqtt.Message{Topic: "dev/status", Payload: []byte("online"), QoS: 1, Retain: true}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "retained status", func() bool {
+		m, ok := broker.Retained("dev/status")
+		return ok && string(m.Payload) == "online"
+	})
+	waitFor(t, "subscription", func() bool {
+		broker.Publish(mqtt.Message{Topic: "dev/command/calibrate", Payload: []byte("go"), QoS: 1})
+		select {
+		case m := <-received:
+			return string(m.Payload) == "go"
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	})
+
+	// 未确认的消息在重连后重发, 订阅也要恢复
+	broker.SetAcks(false)
+	if err := c.Publish(mqtt.Message{Topic: "dev/result", Payload: []byte("done"), QoS: 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "publish", func() bool { return len(broker.Published()) == 2 })
+	if c.Pending() != 1 {
+		t.Errorf("pending %d, want 1", c.Pending())
+	}
+	broker.SetAcks(true)
+	broker.DropConnections()
+	waitFor(t, "last will", func() bool {
+		m, _ := broker.Retained("dev/status")
+		return string(m.Payload) == "offline"
+	})
+	<-connects
+	waitFor(t, "retransmission", func() bool { return c.Pending() == 0 })
+	if n := len(broker.Published()); n != 4 {
+		t.Errorf("%d messages published, want 4", n)
+	}
+	if err := c.Publish(mqtt.Message{Topic: "dev/status", Payload: []byte("online"), QoS: 0, Retain: true}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "resubscription", func() bool {
+		broker.Publish(mqtt.Message{Topic: "dev/command/calibrate", Payload: []byte("again")})
+		select {
+		case m := <-received:
+			return string(m.Payload) == "again"
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	})
+
+	// 正常断开不发送遗嘱
+	c.Close()
+	waitFor(t, "disconnect", func() bool { return broker.Clients() == 0 })
+	if m, _ := broker.Retained("dev/status"); string(m.Payload) != "online" {
+		t.Errorf("status %q after close, want online", m.Payload)
+	}
+	if err := c.Publish(mqtt.Message{Topic: "dev/status", Payload: []byte("x")}); err != mqtt.ErrClosed {
+		t.Errorf("publish after close: %v", err)
+	}
+	if connects := broker.Connects(); len(connects) != 2 || connects[0].ClientID != "test" || connects[0].Will == nil {
+		t.Errorf("connects %+v", connects)
+	}
+}
+
+func TestPublishOffline(t *testing.T) {
+	c := mqtt.NewClient(mqtt.Options{Broker: "tcp://127.0.0.1:1", MinReconnect: time.Hour})
+	defer c.Close()
+	if err := c.Publish(mqtt.Message{Topic: "a", Payload: []byte("x")}); err != mqtt.ErrNotConnected {
+		t.Errorf("QoS 0 publish offline: %v", err)
+	}
+	if err := c.Publish(mqtt.Message{Topic: "a", Payload: []byte("x"), QoS: 1}); err != nil {
+		t.Errorf("QoS 1 publish offline: %v", err)
+	}
+	if c.Pending() != 1 {
+		t.Errorf("pending %d, want 1", c.Pending())
+	}
+	if err := c.Publish(mqtt.Message{Topic: "a/#", QoS: 1}); err == nil {
+		t.Error("publish to a wildcard topic accepted")
+	}
+}
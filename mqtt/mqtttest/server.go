@@ -0,0 +1,247 @@
+// Package mqtttest provides a MQTT broker for tests.
+package mqtttest
+
+import (
+	"bufio"
+	"net"
+	"sync"
+
+	"github.com/plpsy/iiocalibration/mqtt"
+)
+
+// Server is an in-process broker listening on a local port. It supports
+// QoS 0 and 1, retained messages and last wills, sessions are not kept.
+type Server struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu        sync.Mutex
+	clients   map[*client]bool
+	retained  map[string]mqtt.Message
+	published []mqtt.Message
+	connects  []mqtt.Connect
+	noAcks    bool
+}
+
+type client struct {
+	conn net.Conn
+	wmu  sync.Mutex
+	subs map[string]byte
+	id   uint16
+}
+
+func (c *client) write(p *mqtt.Packet) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	mqtt.WritePacket(c.conn, p)
+}
+
+// NewServer starts a broker, it must be closed with Close.
+func NewServer() *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("mqtttest: failed to listen: " + err.Error())
+	}
+	s := &Server{
+		ln:       ln,
+		clients:  make(map[*client]bool),
+		retained: make(map[string]mqtt.Message),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s
+}
+
+// URL returns the broker address as tcp://host:port.
+func (s *Server) URL() string {
+	return "tcp://" + s.ln.Addr().String()
+}
+
+// Close stops the broker and closes the client connections.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+// DropConnections closes the client connections without DISCONNECT, the
+// last wills are published.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// Clients returns the number of connected clients.
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// Connects returns the CONNECT packets received.
+func (s *Server) Connects() []mqtt.Connect {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]mqtt.Connect(nil), s.connects...)
+}
+
+// Retained returns the retained message of topic.
+func (s *Server) Retained(topic string) (mqtt.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.retained[topic]
+	return m, ok
+}
+
+// Published returns the messages published by the clients, including the
+// last wills, in order.
+func (s *Server) Published() []mqtt.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]mqtt.Message(nil), s.published...)
+}
+
+// SetAcks turns the PUBACK of QoS 1 messages on or off.
+func (s *Server) SetAcks(on bool) {
+	s.mu.Lock()
+	s.noAcks = !on
+	s.mu.Unlock()
+}
+
+// Publish sends m to the subscribers as if published by a client.
+func (s *Server) Publish(m mqtt.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.route(m)
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	p, err := mqtt.ReadPacket(r)
+	if err != nil || p.Type != mqtt.CONNECT {
+		return
+	}
+	connect, err := mqtt.DecodeConnect(p)
+	if err != nil {
+		return
+	}
+	c := &client{conn: conn, subs: make(map[string]byte)}
+	s.mu.Lock()
+	s.connects = append(s.connects, *connect)
+	s.clients[c] = true
+	s.mu.Unlock()
+	c.write(&mqtt.Packet{Type: mqtt.CONNACK, Body: []byte{0, 0}})
+
+	will := connect.Will
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.clients, c)
+		if will != nil {
+			s.received(*will)
+		}
+	}()
+	for {
+		p, err := mqtt.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case mqtt.PUBLISH:
+			m, id, err := mqtt.DecodePublish(p)
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.received(m)
+			ack := !s.noAcks
+			s.mu.Unlock()
+			if m.QoS > 0 && ack {
+				c.write(&mqtt.Packet{Type: mqtt.PUBACK, Body: []byte{byte(id >> 8), byte(id)}})
+			}
+		case mqtt.SUBSCRIBE:
+			id, subs, err := mqtt.DecodeSubscribe(p)
+			if err != nil {
+				return
+			}
+			body := []byte{byte(id >> 8), byte(id)}
+			s.mu.Lock()
+			for _, sub := range subs {
+				c.subs[sub.Filter] = min(sub.QoS, 1)
+				body = append(body, min(sub.QoS, 1))
+			}
+			c.write(&mqtt.Packet{Type: mqtt.SUBACK, Body: body})
+			for _, sub := range subs {
+				for topic, m := range s.retained {
+					if mqtt.Match(sub.Filter, topic) {
+						s.send(c, m, min(m.QoS, c.subs[sub.Filter]), true)
+					}
+				}
+			}
+			s.mu.Unlock()
+		case mqtt.PINGREQ:
+			c.write(&mqtt.Packet{Type: mqtt.PINGRESP})
+		case mqtt.DISCONNECT:
+			will = nil
+			return
+		case mqtt.PUBACK:
+		default:
+			return
+		}
+	}
+}
+
+// received stores and routes a message published by a client, s.mu must
+// be held.
+func (s *Server) received(m mqtt.Message) {
+	s.published = append(s.published, m)
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(s.retained, m.Topic)
+		} else {
+			s.retained[m.Topic] = m
+		}
+	}
+	s.route(m)
+}
+
+// route sends m to the subscribers, s.mu must be held.
+func (s *Server) route(m mqtt.Message) {
+	for c := range s.clients {
+		granted, matched := byte(0), false
+		for filter, qos := range c.subs {
+			if mqtt.Match(filter, m.Topic) {
+				granted, matched = max(granted, qos), true
+			}
+		}
+		if matched {
+			s.send(c, m, min(m.QoS, granted), false)
+		}
+	}
+}
+
+func (s *Server) send(c *client, m mqtt.Message, qos byte, retain bool) {
+	m.QoS, m.Retain = qos, retain
+	c.id++
+	if c.id == 0 {
+		c.id++
+	}
+	c.write(mqtt.EncodePublish(m, c.id, false))
+}
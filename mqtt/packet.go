@@ -0,0 +1,323 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types of MQTT 3.1.1.
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+// 剩余长度最多4个字节
+const maxRemainingLength = 268435455
+
+var errMalformed = errors.New("mqtt: malformed packet")
+
+// Packet is a control packet, Body is everything after the fixed header.
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// ReadPacket reads one control packet.
+func ReadPacket(r *bufio.Reader) (*Packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, mult := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMalformed
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(c&0x7f) * mult
+		if c&0x80 == 0 {
+			break
+		}
+		mult *= 128
+	}
+	p := &Packet{Type: b >> 4, Flags: b & 0x0f, Body: make([]byte, length)}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WritePacket writes p in one call of w.Write.
+func WritePacket(w io.Writer, p *Packet) error {
+	n := len(p.Body)
+	if n > maxRemainingLength {
+		return fmt.Errorf("mqtt: packet of %d bytes too large", n)
+	}
+	buf := make([]byte, 0, n+5)
+	buf = append(buf, p.Type<<4|p.Flags)
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		buf = append(buf, c)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(buf, p.Body...))
+	return err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// reader decodes the fields of a packet body.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.b) < 2 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.b) < 1 {
+		r.err = errMalformed
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) string() string {
+	n := int(r.uint16())
+	if r.err != nil || len(r.b) < n {
+		r.err = errMalformed
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// Message is an application message.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// EncodePublish returns the PUBLISH packet of m, id is ignored at QoS 0.
+func EncodePublish(m Message, id uint16, dup bool) *Packet {
+	p := &Packet{Type: PUBLISH, Flags: m.QoS << 1}
+	if m.Retain {
+		p.Flags |= 0x01
+	}
+	if dup {
+		p.Flags |= 0x08
+	}
+	body := appendString(nil, m.Topic)
+	if m.QoS > 0 {
+		body = appendUint16(body, id)
+	}
+	p.Body = append(body, m.Payload...)
+	return p
+}
+
+// DecodePublish returns the message and packet id of a PUBLISH packet.
+func DecodePublish(p *Packet) (m Message, id uint16, err error) {
+	r := &reader{b: p.Body}
+	m.Topic = r.string()
+	m.QoS = p.Flags >> 1 & 0x03
+	m.Retain = p.Flags&0x01 != 0
+	if m.QoS > 0 {
+		id = r.uint16()
+	}
+	if r.err != nil || m.QoS > 2 {
+		return m, 0, errMalformed
+	}
+	m.Payload = append([]byte(nil), r.b...)
+	return m, id, nil
+}
+
+// Connect holds the fields of a CONNECT packet.
+type Connect struct {
+	ClientID     string
+	Username     string
+	Password     string
+	CleanSession bool
+	// keep alive in seconds
+	KeepAlive uint16
+	Will      *Message
+}
+
+// Encode returns the CONNECT packet.
+func (c *Connect) Encode() *Packet {
+	body := appendString(nil, "MQTT")
+	body = append(body, 4)
+	var flags byte
+	if c.CleanSession {
+		flags |= 0x02
+	}
+	if c.Will != nil {
+		flags |= 0x04 | c.Will.QoS<<3
+		if c.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if c.Password != "" {
+		flags |= 0x40
+	}
+	if c.Username != "" {
+		flags |= 0x80
+	}
+	body = append(body, flags)
+	body = appendUint16(body, c.KeepAlive)
+	body = appendString(body, c.ClientID)
+	if c.Will != nil {
+		body = appendString(body, c.Will.Topic)
+		body = appendUint16(body, uint16(len(c.Will.Payload)))
+		body = append(body, c.Will.Payload...)
+	}
+	if c.Username != "" {
+		body = appendString(body, c.Username)
+	}
+	if c.Password != "" {
+		body = appendString(body, c.Password)
+	}
+	return &Packet{Type: CONNECT, Body: body}
+}
+
+// DecodeConnect parses a CONNECT packet.
+func DecodeConnect(p *Packet) (*Connect, error) {
+	r := &reader{b: p.Body}
+	if proto := r.string(); proto != "MQTT" && r.err == nil {
+		return nil, fmt.Errorf("mqtt: protocol %q not supported", proto)
+	}
+	if level := r.byte(); level != 4 && r.err == nil {
+		return nil, fmt.Errorf("mqtt: protocol level %d not supported", level)
+	}
+	flags := r.byte()
+	c := &Connect{CleanSession: flags&0x02 != 0, KeepAlive: r.uint16(), ClientID: r.string()}
+	if flags&0x04 != 0 {
+		c.Will = &Message{Topic: r.string(), QoS: flags >> 3 & 0x03, Retain: flags&0x20 != 0}
+		n := int(r.uint16())
+		if r.err == nil && len(r.b) >= n {
+			c.Will.Payload = append([]byte(nil), r.b[:n]...)
+			r.b = r.b[n:]
+		} else {
+			r.err = errMalformed
+		}
+	}
+	if flags&0x80 != 0 {
+		c.Username = r.string()
+	}
+	if flags&0x40 != 0 {
+		c.Password = r.string()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return c, nil
+}
+
+// Subscription is a topic filter of a SUBSCRIBE packet.
+type Subscription struct {
+	Filter string
+	QoS    byte
+}
+
+// EncodeSubscribe returns the SUBSCRIBE packet of subs.
+func EncodeSubscribe(id uint16, subs []Subscription) *Packet {
+	body := appendUint16(nil, id)
+	for _, s := range subs {
+		body = appendString(body, s.Filter)
+		body = append(body, s.QoS)
+	}
+	return &Packet{Type: SUBSCRIBE, Flags: 0x02, Body: body}
+}
+
+// DecodeSubscribe parses a SUBSCRIBE packet.
+func DecodeSubscribe(p *Packet) (id uint16, subs []Subscription, err error) {
+	r := &reader{b: p.Body}
+	id = r.uint16()
+	for r.err == nil && len(r.b) > 0 {
+		subs = append(subs, Subscription{Filter: r.string(), QoS: r.byte()})
+	}
+	if r.err != nil || len(subs) == 0 {
+		return 0, nil, errMalformed
+	}
+	return id, subs, nil
+}
+
+// PacketID returns the packet identifier at the start of the body of
+// PUBACK, SUBACK and UNSUBACK packets.
+func PacketID(p *Packet) (uint16, error) {
+	r := &reader{b: p.Body}
+	id := r.uint16()
+	return id, r.err
+}
+
+// Match reports whether topic matches the filter with the + and #
+// wildcards.
+func Match(filter, topic string) bool {
+	for {
+		var f, t string
+		f, filter = cut(filter)
+		if f == "#" {
+			return true
+		}
+		t, topic = cut(topic)
+		if f != "+" && f != t {
+			return false
+		}
+		if filter == "" || topic == "" {
+			// "a/#" 也匹配 "a"
+			return filter == "" && topic == "" || filter == "/#" && topic == ""
+		}
+		filter, topic = filter[1:], topic[1:]
+	}
+}
+
+// cut splits off the first level, rest keeps the leading separator.
+func cut(s string) (level, rest string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '/' {
+			return s[:i], s[i:]
+		}
+	}
+	return s, ""
+}
@@ -0,0 +1,540 @@
+package openapi
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// GenerateClient returns the Go source of the types and the client methods
+// of the document. The package it is generated into provides the Client
+// type with the do, call and stream methods and the decode and expect
+// functions.
+//
+// Every operation with a JSON, text/plain or text/event-stream success
+// response becomes a method named after its operationId. A response that
+// is anyOf a schema and the Error schema is a legacy response reporting
+// errors with status 200; a single string enum is the expected message of
+// an operation without result.
+func (d *Document) GenerateClient(pkg string) ([]byte, error) {
+	g := &generator{doc: d, imports: make(map[string]bool)}
+	if err := g.types(); err != nil {
+		return nil, err
+	}
+	for _, r := range d.Routes() {
+		if err := g.operation(r); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", r.Method, r.Path, err)
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by openapi/gen from openapi/openapi.json. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	if len(g.imports) > 0 {
+		imports := make([]string, 0, len(g.imports))
+		for imp := range g.imports {
+			imports = append(imports, strconv.Quote(imp))
+		}
+		sort.Strings(imports)
+		fmt.Fprintf(&out, "import (\n%s\n)\n\n", strings.Join(imports, "\n"))
+	}
+	out.Write(g.buf.Bytes())
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated client: %v", err)
+	}
+	return src, nil
+}
+
+type generator struct {
+	doc     *Document
+	imports map[string]bool
+	buf     bytes.Buffer
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// comment prints text as comment lines of at most 77 columns.
+func (g *generator) comment(text string) {
+	line := "//"
+	for _, word := range strings.Fields(text) {
+		if len(line)+1+len(word) > 77 && line != "//" {
+			g.printf("%s\n", line)
+			line = "//"
+		}
+		line += " " + word
+	}
+	if line != "//" {
+		g.printf("%s\n", line)
+	}
+}
+
+// types declares the component schemas, except the plain strings like
+// Error.
+func (g *generator) types() error {
+	names := make([]string, 0, len(g.doc.Components.Schemas))
+	for name := range g.doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := g.typeDecl(name, g.doc.Components.Schemas[name]); err != nil {
+			return fmt.Errorf("schema %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (g *generator) typeDecl(name string, s *Schema) error {
+	switch {
+	case isStruct(s):
+		if s.Description != "" {
+			g.comment(name + ": " + s.Description)
+		}
+		g.printf("type %s struct {\n", name)
+		for _, prop := range s.PropertyNames() {
+			p := s.Properties[prop]
+			required := s.isRequired(prop)
+			typ, err := g.goType(p, required)
+			if err != nil {
+				return fmt.Errorf("property %s: %v", prop, err)
+			}
+			if p.Description != "" {
+				g.comment(p.Description)
+			}
+			tag := prop
+			if !required {
+				tag += ",omitempty"
+			}
+			field := p.GoName
+			if field == "" {
+				field = goName(prop)
+			}
+			g.printf("%s %s `json:\"%s\"`\n", field, typ, tag)
+		}
+		g.printf("}\n\n")
+	case s.Type == "string" && len(s.Enum) > 0:
+		if s.Description != "" {
+			g.comment(name + ": " + s.Description)
+		}
+		g.printf("type %s string\n\nconst (\n", name)
+		for _, e := range s.Enum {
+			g.printf("%s%s %s = %q\n", name, goName(fmt.Sprint(e)), name, fmt.Sprint(e))
+		}
+		g.printf(")\n\n")
+	case isPlainString(s):
+	default:
+		plain := *s
+		plain.Nullable = false
+		typ, err := g.goType(&plain, true)
+		if err != nil {
+			return err
+		}
+		if s.Description != "" {
+			g.comment(name + ": " + s.Description)
+		}
+		g.printf("type %s %s\n\n", name, typ)
+	}
+	return nil
+}
+
+func isStruct(s *Schema) bool {
+	return s.Type == "object" && s.Properties != nil
+}
+
+func isPlainString(s *Schema) bool {
+	return s.Type == "string" && len(s.Enum) == 0 && s.Format == ""
+}
+
+// goType returns the Go type of a schema. Optional and nullable structs
+// and optional times are pointers.
+func (g *generator) goType(s *Schema, required bool) (string, error) {
+	if s.Ref != "" {
+		target := g.doc.resolve(s)
+		if isPlainString(target) {
+			return "string", nil
+		}
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		if isStruct(target) && (!required || s.Nullable || target.Nullable) {
+			return "*" + name, nil
+		}
+		return name, nil
+	}
+	if len(s.AllOf) == 1 && s.Type == "" {
+		return g.goType(s.AllOf[0], required && !s.Nullable)
+	}
+	if len(s.AllOf)+len(s.AnyOf)+len(s.OneOf) > 0 || s.isAny() {
+		g.imports["encoding/json"] = true
+		return "json.RawMessage", nil
+	}
+	switch s.Type {
+	case "string":
+		switch s.Format {
+		case "date-time":
+			g.imports["time"] = true
+			if !required {
+				return "*time.Time", nil
+			}
+			return "time.Time", nil
+		case "binary":
+			return "[]byte", nil
+		}
+		return "string", nil
+	case "integer":
+		switch s.Format {
+		case "int32", "int64":
+			return s.Format, nil
+		}
+		return "int", nil
+	case "number":
+		return "float64", nil
+	case "boolean":
+		return "bool", nil
+	case "array":
+		if s.Items == nil {
+			return "", fmt.Errorf("array without items")
+		}
+		typ, err := g.goType(s.Items, true)
+		return "[]" + typ, err
+	case "object":
+		if s.Properties != nil {
+			return "", fmt.Errorf("inline object schema, use a component schema")
+		}
+		if s.AdditionalProperties == nil {
+			g.imports["encoding/json"] = true
+			return "json.RawMessage", nil
+		}
+		key := "string"
+		if s.KeyType == "integer" {
+			key = "int"
+		}
+		typ, err := g.goType(s.AdditionalProperties, true)
+		return "map[" + key + "]" + typ, err
+	}
+	return "", fmt.Errorf("schema type %q not supported", s.Type)
+}
+
+// legacyResult returns the result schema of a legacy response, anyOf a
+// schema and the Error schema.
+func (g *generator) legacyResult(s *Schema) *Schema {
+	if len(s.AnyOf) != 2 {
+		return nil
+	}
+	for i, alt := range s.AnyOf {
+		if alt.Ref == "#/components/schemas/Error" {
+			return s.AnyOf[1-i]
+		}
+	}
+	return nil
+}
+
+// expectedMessage returns the message of a response which is a single
+// string enum.
+func expectedMessage(s *Schema) (string, bool) {
+	if s.Type == "string" && len(s.Enum) == 1 {
+		return fmt.Sprint(s.Enum[0]), true
+	}
+	return "", false
+}
+
+type successResponse struct {
+	status    int
+	mediaType string
+	schema    *Schema
+}
+
+func (g *generator) operation(r Route) error {
+	op := r.Operation
+	if op.OperationID == "" {
+		return fmt.Errorf("operationId missing")
+	}
+	var success []successResponse
+	for code, resp := range op.Responses {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 200 || status > 299 {
+			continue
+		}
+		for mediaType, mt := range g.doc.response(resp).Content {
+			switch mediaType {
+			case "application/json", "text/plain", "text/event-stream":
+				success = append(success, successResponse{status, mediaType, mt.Schema})
+			default:
+				// 静态文件等不生成客户端方法
+				return nil
+			}
+		}
+	}
+	if len(success) == 0 {
+		return nil
+	}
+	sort.Slice(success, func(i, j int) bool { return success[i].status < success[j].status })
+	name := goName(op.OperationID)
+
+	var args, pathExpr []string
+	var query []*Parameter
+	rest := r.Path
+	for _, p := range g.doc.Parameters(r.Path, r.Method) {
+		switch p.In {
+		case "path":
+			args = append(args, p.Name+" string")
+		case "query":
+			query = append(query, p)
+		default:
+			return fmt.Errorf("%s parameter %s not supported", p.In, p.Name)
+		}
+	}
+	for rest != "" {
+		i := strings.Index(rest, "{")
+		if i < 0 {
+			pathExpr = append(pathExpr, strconv.Quote(rest))
+			break
+		}
+		j := strings.Index(rest, "}")
+		if i > 0 {
+			pathExpr = append(pathExpr, strconv.Quote(rest[:i]))
+		}
+		g.imports["net/url"] = true
+		pathExpr = append(pathExpr, "url.PathEscape("+rest[i+1:j]+")")
+		rest = rest[j+1:]
+	}
+	path := strings.Join(pathExpr, " + ")
+
+	in := "nil"
+	var bodyCode string
+	if body := op.RequestBody; body != nil {
+		mt := body.Content["application/json"]
+		if mt == nil || mt.Schema == nil {
+			return fmt.Errorf("request body must be application/json")
+		}
+		typ, err := g.goType(mt.Schema, body.Required)
+		if err != nil {
+			return fmt.Errorf("request body: %v", err)
+		}
+		args = append(args, "body "+typ)
+		in = "body"
+		if strings.HasPrefix(typ, "*") {
+			// nil指针作为interface不是nil, 会发送null
+			in = "in"
+			bodyCode = "var in interface{}\nif body != nil {\nin = body\n}\n"
+		}
+	}
+
+	q := "nil"
+	var queryCode string
+	if len(query) > 0 {
+		if err := g.queryParams(name, query); err != nil {
+			return err
+		}
+		args = append(args, "params *"+name+"Params")
+		q = "q"
+		queryCode = g.queryValues(query)
+	}
+
+	summary := fmt.Sprintf("%s calls %s %s", name, r.Method, r.Path)
+	if op.Summary != "" {
+		summary += ": " + strings.ToLower(op.Summary[:1]) + op.Summary[1:]
+	}
+	g.comment(summary + ".")
+	if op.Description != "" {
+		g.printf("//\n")
+		g.comment(op.Description)
+	}
+	call := fmt.Sprintf("%q, %s, %s, %s", r.Method, path, q, in)
+	signature := fmt.Sprintf("func (c *Client) %s(%s)", name, strings.Join(args, ", "))
+
+	if len(success) > 1 {
+		return g.multiResult(name, signature, bodyCode+queryCode, call, success)
+	}
+	s := success[0]
+	switch s.mediaType {
+	case "text/plain":
+		g.printf("%s (string, error) {\n%s_, data, err := c.do(%s)\nreturn string(data), err\n}\n\n", signature, bodyCode+queryCode, call)
+		return nil
+	case "text/event-stream":
+		g.imports["io"] = true
+		g.printf("%s (io.ReadCloser, error) {\n%sreturn c.stream(%s)\n}\n\n", signature, bodyCode+queryCode, call)
+		return nil
+	}
+	schema := s.schema
+	if result := g.legacyResult(schema); result != nil {
+		schema = result
+	}
+	if msg, ok := expectedMessage(schema); ok {
+		g.printf("%s error {\n%s_, data, err := c.do(%s)\nif err != nil {\nreturn err\n}\nreturn expect(data, %q)\n}\n\n",
+			signature, bodyCode+queryCode, call, msg)
+		return nil
+	}
+	typ, err := g.goType(schema, true)
+	if err != nil {
+		return fmt.Errorf("response: %v", err)
+	}
+	if target := g.doc.resolve(schema); target != nil && isStruct(target) {
+		typ = strings.TrimPrefix(typ, "*")
+		g.printf("%s (*%s, error) {\n%svar out %s\nif err := c.call(%s, &out); err != nil {\nreturn nil, err\n}\nreturn &out, nil\n}\n\n",
+			signature, typ, bodyCode+queryCode, typ, call)
+		return nil
+	}
+	g.printf("%s (%s, error) {\n%svar out %s\nerr := c.call(%s, &out)\nreturn out, err\n}\n\n",
+		signature, typ, bodyCode+queryCode, typ, call)
+	return nil
+}
+
+// multiResult generates an operation with several success responses, its
+// result has a field for each of them.
+func (g *generator) multiResult(name, signature, prelude, call string, success []successResponse) error {
+	result := name + "Result"
+	g.printf("%s (*%s, error) {\n%sstatus, data, err := c.do(%s)\nif err != nil {\nreturn nil, err\n}\nvar out %s\nswitch status {\n",
+		signature, result, prelude, call, result)
+	var fields []string
+	for _, s := range success {
+		target := g.doc.resolve(s.schema)
+		if s.mediaType != "application/json" || s.schema.Ref == "" || !isStruct(target) {
+			return fmt.Errorf("several success responses need component object schemas")
+		}
+		typ := strings.TrimPrefix(s.schema.Ref, "#/components/schemas/")
+		fields = append(fields, fmt.Sprintf("// status %d\n%s *%s\n", s.status, typ, typ))
+		g.printf("case %d:\nout.%s = new(%s)\nerr = decode(data, out.%s)\n", s.status, typ, typ, typ)
+	}
+	g.imports["fmt"] = true
+	g.printf("default:\nerr = fmt.Errorf(\"%s: unexpected status %%d\", status)\n}\nif err != nil {\nreturn nil, err\n}\nreturn &out, nil\n}\n\n", name)
+	g.comment(fmt.Sprintf("%s is the result of %s, one of the fields is set.", result, name))
+	g.printf("type %s struct {\n%s}\n\n", result, strings.Join(fields, ""))
+	return nil
+}
+
+// queryParams declares the query parameters of an operation. Optional
+// numbers and booleans are pointers, empty strings are not sent.
+func (g *generator) queryParams(name string, query []*Parameter) error {
+	g.comment(fmt.Sprintf("%sParams are the query parameters of %s.", name, name))
+	g.printf("type %sParams struct {\n", name)
+	for _, p := range query {
+		typ, err := g.queryType(p)
+		if err != nil {
+			return fmt.Errorf("parameter %s: %v", p.Name, err)
+		}
+		if p.Description != "" {
+			g.comment(p.Description)
+		}
+		g.printf("%s %s\n", goName(p.Name), typ)
+	}
+	g.printf("}\n\n")
+	return nil
+}
+
+func (g *generator) queryType(p *Parameter) (string, error) {
+	if p.Schema == nil {
+		return "", fmt.Errorf("schema missing")
+	}
+	var typ string
+	switch p.Schema.Type {
+	case "string":
+		if p.Schema.Format != "date-time" {
+			return "string", nil
+		}
+		g.imports["time"] = true
+		typ = "time.Time"
+	case "integer":
+		typ = "int"
+	case "boolean":
+		typ = "bool"
+	default:
+		return "", fmt.Errorf("type %q not supported", p.Schema.Type)
+	}
+	if p.Required {
+		return typ, nil
+	}
+	return "*" + typ, nil
+}
+
+func (g *generator) queryValues(query []*Parameter) string {
+	g.imports["net/url"] = true
+	var b strings.Builder
+	b.WriteString("q := url.Values{}\nif params != nil {\n")
+	for _, p := range query {
+		field := "params." + goName(p.Name)
+		value := field
+		if !p.Required {
+			value = "*" + field
+		}
+		var set string
+		switch p.Schema.Type {
+		case "string":
+			if p.Schema.Format == "date-time" {
+				set = fmt.Sprintf("q.Set(%q, %s.Format(time.RFC3339Nano))", p.Name, field)
+			} else {
+				set = fmt.Sprintf("q.Set(%q, %s)", p.Name, field)
+				if !p.Required {
+					fmt.Fprintf(&b, "if %s != \"\" {\n%s\n}\n", field, set)
+					continue
+				}
+			}
+		case "integer":
+			g.imports["strconv"] = true
+			set = fmt.Sprintf("q.Set(%q, strconv.Itoa(%s))", p.Name, value)
+		case "boolean":
+			g.imports["strconv"] = true
+			set = fmt.Sprintf("q.Set(%q, strconv.FormatBool(%s))", p.Name, value)
+		}
+		if p.Required {
+			fmt.Fprintf(&b, "%s\n", set)
+		} else {
+			fmt.Fprintf(&b, "if %s != nil {\n%s\n}\n", field, set)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+var initialisms = map[string]string{
+	"Api":  "API",
+	"Gpio": "GPIO",
+	"Http": "HTTP",
+	"Id":   "ID",
+	"Json": "JSON",
+	"Ok":   "OK",
+	"Ui":   "UI",
+	"Url":  "URL",
+}
+
+// goName converts a name like "jobId" or "getOpenAPI" to an exported Go
+// name like JobID or GetOpenAPI.
+func goName(s string) string {
+	var words []string
+	var word []rune
+	runes := []rune(s)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+			continue
+		}
+		if unicode.IsUpper(r) && len(word) > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || nextLower {
+				words = append(words, string(word))
+				word = nil
+			}
+		}
+		word = append(word, r)
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	var b strings.Builder
+	for _, w := range words {
+		w = strings.ToUpper(w[:1]) + strings.ToLower(w[1:])
+		if i, ok := initialisms[w]; ok {
+			w = i
+		}
+		b.WriteString(w)
+	}
+	return b.String()
+}
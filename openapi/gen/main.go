@@ -0,0 +1,29 @@
+// Command gen writes the client of the apiclient package generated from
+// the OpenAPI document, run by go generate in apiclient.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+
+	"github.com/plpsy/iiocalibration/openapi"
+)
+
+func main() {
+	out := flag.String("o", "generated.go", "output file")
+	pkg := flag.String("package", "apiclient", "package name")
+	flag.Parse()
+
+	doc, err := openapi.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := doc.GenerateClient(*pkg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,341 @@
+// Package openapi holds the OpenAPI 3 document of the HTTP API, validates
+// responses against it and generates the Go client of the apiclient
+// package.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var document []byte
+
+// JSON returns the OpenAPI document served at /openapi.json.
+func JSON() []byte {
+	return document
+}
+
+// Document is the part of an OpenAPI 3 document used by the validator and
+// the client generator.
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	Parameters      map[string]*Parameter      `json:"parameters"`
+	Responses       map[string]*Response       `json:"responses"`
+	SecuritySchemes map[string]json.RawMessage `json:"securitySchemes"`
+}
+
+// PathItem holds the operations of a path, Parameters apply to all of them.
+type PathItem struct {
+	Parameters []*Parameter `json:"parameters,omitempty"`
+	Get        *Operation   `json:"get,omitempty"`
+	Put        *Operation   `json:"put,omitempty"`
+	Post       *Operation   `json:"post,omitempty"`
+	Delete     *Operation   `json:"delete,omitempty"`
+}
+
+type methodOperation struct {
+	method string
+	op     *Operation
+}
+
+// operations returns the operations of the path in a fixed order.
+func (p *PathItem) operations() []methodOperation {
+	var ops []methodOperation
+	for _, m := range []methodOperation{{"GET", p.Get}, {"PUT", p.Put}, {"POST", p.Post}, {"DELETE", p.Delete}} {
+		if m.op != nil {
+			ops = append(ops, m)
+		}
+	}
+	return ops
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+	// nil for the document security, empty for public operations
+	Security *[]map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Ref         string  `json:"$ref,omitempty"`
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref         string                `json:"$ref,omitempty"`
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is a JSON schema of the OpenAPI dialect. AdditionalProperties
+// must be a schema, true and false are not supported.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	// type of the keys of a map, "integer" for the channel numbers
+	KeyType string `json:"x-key-type,omitempty"`
+	// name of the struct field in the generated client
+	GoName string `json:"x-go-name,omitempty"`
+
+	// property names in the order of the document
+	order []string
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	type plain Schema
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+	var raw struct {
+		Properties json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil || raw.Properties == nil {
+		return err
+	}
+	keys, err := objectKeys(raw.Properties)
+	s.order = keys
+	return err
+}
+
+// objectKeys returns the keys of a JSON object in their order.
+func objectKeys(data []byte) ([]string, error) {
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, tok.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// PropertyNames returns the property names in the order of the document.
+func (s *Schema) PropertyNames() []string {
+	if len(s.order) == len(s.Properties) {
+		return s.order
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Schema) isRequired(name string) bool {
+	for _, r := range s.Required {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Load parses the embedded document.
+func Load() (*Document, error) {
+	return Parse(document)
+}
+
+// Parse parses an OpenAPI document and checks its references.
+func Parse(data []byte) (*Document, error) {
+	var d Document
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("openapi document: %v", err)
+	}
+	for _, r := range d.Routes() {
+		for _, p := range d.Parameters(r.Path, r.Method) {
+			if p == nil {
+				return nil, fmt.Errorf("%s %s: unresolved parameter", r.Method, r.Path)
+			}
+			if err := d.checkRefs(p.Schema); err != nil {
+				return nil, fmt.Errorf("%s %s: parameter %s: %v", r.Method, r.Path, p.Name, err)
+			}
+		}
+		if body := r.Operation.RequestBody; body != nil {
+			for _, mt := range body.Content {
+				if err := d.checkRefs(mt.Schema); err != nil {
+					return nil, fmt.Errorf("%s %s: request body: %v", r.Method, r.Path, err)
+				}
+			}
+		}
+		for code, resp := range r.Operation.Responses {
+			resp = d.response(resp)
+			if resp == nil {
+				return nil, fmt.Errorf("%s %s: response %s unresolved", r.Method, r.Path, code)
+			}
+			for _, mt := range resp.Content {
+				if err := d.checkRefs(mt.Schema); err != nil {
+					return nil, fmt.Errorf("%s %s: response %s: %v", r.Method, r.Path, code, err)
+				}
+			}
+		}
+	}
+	for name, s := range d.Components.Schemas {
+		if err := d.checkRefs(s); err != nil {
+			return nil, fmt.Errorf("schema %s: %v", name, err)
+		}
+	}
+	return &d, nil
+}
+
+func (d *Document) checkRefs(s *Schema) error {
+	if s == nil {
+		return nil
+	}
+	if s.Ref != "" && d.schemaRef(s.Ref) == nil {
+		return fmt.Errorf("unresolved reference %s", s.Ref)
+	}
+	var sub []*Schema
+	sub = append(sub, s.Items, s.AdditionalProperties)
+	sub = append(sub, s.AllOf...)
+	sub = append(sub, s.AnyOf...)
+	sub = append(sub, s.OneOf...)
+	for _, p := range s.Properties {
+		sub = append(sub, p)
+	}
+	for _, c := range sub {
+		if err := d.checkRefs(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Route is an operation of the document.
+type Route struct {
+	Method    string
+	Path      string
+	Operation *Operation
+}
+
+// Routes returns the operations sorted by path.
+func (d *Document) Routes() []Route {
+	paths := make([]string, 0, len(d.Paths))
+	for path := range d.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var routes []Route
+	for _, path := range paths {
+		for _, m := range d.Paths[path].operations() {
+			routes = append(routes, Route{Method: m.method, Path: path, Operation: m.op})
+		}
+	}
+	return routes
+}
+
+// Operation returns the operation of a path template like
+// "/devices/{dev}/capture", nil if it is not documented.
+func (d *Document) Operation(method, path string) *Operation {
+	item := d.Paths[path]
+	if item == nil {
+		return nil
+	}
+	for _, m := range item.operations() {
+		if m.method == method {
+			return m.op
+		}
+	}
+	return nil
+}
+
+// Parameters returns the resolved parameters of an operation, those of the
+// path first.
+func (d *Document) Parameters(path, method string) []*Parameter {
+	item := d.Paths[path]
+	op := d.Operation(method, path)
+	if op == nil {
+		return nil
+	}
+	var params []*Parameter
+	for _, p := range append(append([]*Parameter{}, item.Parameters...), op.Parameters...) {
+		params = append(params, d.parameter(p))
+	}
+	return params
+}
+
+func (d *Document) parameter(p *Parameter) *Parameter {
+	if p.Ref == "" {
+		return p
+	}
+	return d.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+}
+
+func (d *Document) response(r *Response) *Response {
+	if r.Ref == "" {
+		return r
+	}
+	return d.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+}
+
+func (d *Document) schemaRef(ref string) *Schema {
+	const prefix = "#/components/schemas/"
+	if !strings.HasPrefix(ref, prefix) {
+		return nil
+	}
+	return d.Components.Schemas[ref[len(prefix):]]
+}
+
+// resolve follows the reference of a schema.
+func (d *Document) resolve(s *Schema) *Schema {
+	for s != nil && s.Ref != "" {
+		s = d.schemaRef(s.Ref)
+	}
+	return s
+}
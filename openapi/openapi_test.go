@@ -0,0 +1,85 @@
+package openapi
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func decodeNumbers(t *testing.T, s string) interface{} {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestLoad(t *testing.T) {
+	doc, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Routes()) == 0 || doc.Operation("GET", "/params") == nil {
+		t.Error("routes missing")
+	}
+	if _, err := Parse([]byte(`{"openapi": "3.0.3", "paths": {"/x": {"get": {"responses": {"200": {"$ref": "#/components/responses/Nope"}}}}}}`)); err == nil {
+		t.Error("unresolved reference accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	doc, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		schema string
+		value  string
+		ok     bool
+	}{
+		{"Params", `{"cf_axi_adc": {"0": -12, "6": 40}}`, true},
+		{"Params", `null`, true},
+		{"Params", `{"cf_axi_adc": {"x": 1}}`, false},
+		{"Params", `{"cf_axi_adc": {"0": 1.5}}`, false},
+		{"RegisterValue", `{"address": 30, "value": 255}`, true},
+		{"RegisterValue", `{"address": 30, "value": 256}`, false},
+		{"RegisterValue", `{"address": 30}`, false},
+		{"RegisterValue", `{"address": 30, "value": 1, "extra": true}`, false},
+		{"Role", `"admin"`, true},
+		{"Role", `"root"`, false},
+		{"PendingReboot", `{"at": "2024-01-02T03:04:05.5+08:00", "requestedBy": "ci"}`, true},
+		{"PendingReboot", `{"at": "tomorrow", "requestedBy": "ci"}`, false},
+		{"Status", `{"pendingReboot": null}`, false},
+	}
+	for _, test := range tests {
+		err := doc.Validate(&Schema{Ref: "#/components/schemas/" + test.schema}, decodeNumbers(t, test.value))
+		if (err == nil) != test.ok {
+			t.Errorf("%s %s: %v", test.schema, test.value, err)
+		}
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	doc, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 旧接口用 200 返回错误信息
+	if err := doc.ValidateResponse("GET", "/params", 200, "application/json", []byte(`"read failed"`)); err != nil {
+		t.Error(err)
+	}
+	if err := doc.ValidateResponse("GET", "/params", 200, "application/json", []byte(`[1]`)); err == nil {
+		t.Error("array accepted as params")
+	}
+	if err := doc.ValidateResponse("GET", "/params", 418, "application/json", []byte(`""`)); err == nil {
+		t.Error("undocumented status accepted")
+	}
+	if err := doc.ValidateResponse("GET", "/params", 200, "text/html", []byte(`<p>`)); err == nil {
+		t.Error("undocumented content type accepted")
+	}
+	if err := doc.ValidateResponse("GET", "/nope", 200, "application/json", []byte(`{}`)); err == nil {
+		t.Error("undocumented path accepted")
+	}
+}
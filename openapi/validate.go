@@ -0,0 +1,234 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidateResponse checks a response of the operation of a path template
+// against the document: the status code, the content type and, for JSON,
+// the body.
+func (d *Document) ValidateResponse(method, path string, status int, contentType string, body []byte) error {
+	op := d.Operation(method, path)
+	if op == nil {
+		return fmt.Errorf("%s %s not documented", method, path)
+	}
+	resp := op.Responses[strconv.Itoa(status)]
+	if resp == nil {
+		resp = op.Responses["default"]
+	}
+	if resp == nil {
+		return fmt.Errorf("%s %s: status %d not documented", method, path, status)
+	}
+	resp = d.response(resp)
+	if len(resp.Content) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%s %s: status %d: content type %q invalid", method, path, status, contentType)
+	}
+	mt := resp.Content[mediaType]
+	if mt == nil {
+		mt = resp.Content["*/*"]
+	}
+	if mt == nil {
+		return fmt.Errorf("%s %s: status %d: content type %s not documented", method, path, status, mediaType)
+	}
+	if mediaType != "application/json" || mt.Schema == nil {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("%s %s: status %d: %v", method, path, status, err)
+	}
+	if err := d.Validate(mt.Schema, v); err != nil {
+		return fmt.Errorf("%s %s: status %d: %v", method, path, status, err)
+	}
+	return nil
+}
+
+// Validate checks a value decoded with json.Decoder.UseNumber against a
+// schema. Objects with properties and without additionalProperties must
+// not have other properties, so that undocumented fields are found.
+func (d *Document) Validate(s *Schema, v interface{}) error {
+	return d.validate(s, v, "$")
+}
+
+func (d *Document) validate(s *Schema, v interface{}, at string) error {
+	if s.Ref != "" {
+		target := d.resolve(s)
+		if target == nil {
+			return fmt.Errorf("%s: unresolved reference %s", at, s.Ref)
+		}
+		return d.validate(target, v, at)
+	}
+	if v == nil && (s.Nullable || s.isAny()) {
+		return nil
+	}
+	for _, sub := range s.AllOf {
+		if err := d.validate(sub, v, at); err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		var errs []string
+		for _, sub := range s.AnyOf {
+			err := d.validate(sub, v, at)
+			if err == nil {
+				errs = nil
+				break
+			}
+			errs = append(errs, err.Error())
+		}
+		if errs != nil {
+			return fmt.Errorf("%s: matches none of anyOf: %s", at, strings.Join(errs, "; "))
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matched := 0
+		for _, sub := range s.OneOf {
+			if d.validate(sub, v, at) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: matches %d of oneOf", at, matched)
+		}
+	}
+	if err := s.validateEnum(v, at); err != nil {
+		return err
+	}
+
+	switch s.Type {
+	case "":
+		return nil
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return typeError(at, s.Type, v)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", at, str)
+			}
+		}
+		return nil
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			return typeError(at, s.Type, v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: %v", at, err)
+		}
+		if s.Type == "integer" {
+			if _, err := n.Int64(); err != nil {
+				return fmt.Errorf("%s: %s is not an integer", at, n)
+			}
+			if s.Format == "int32" && (f < math.MinInt32 || f > math.MaxInt32) {
+				return fmt.Errorf("%s: %s out of int32 range", at, n)
+			}
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: %s below minimum %v", at, n, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s: %s above maximum %v", at, n, *s.Maximum)
+		}
+		return nil
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return typeError(at, s.Type, v)
+		}
+		return nil
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return typeError(at, s.Type, v)
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				if err := d.validate(s.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return typeError(at, s.Type, v)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: required property %s missing", at, name)
+			}
+		}
+		for name, value := range obj {
+			sub := s.Properties[name]
+			if sub == nil {
+				sub = s.AdditionalProperties
+			}
+			if sub == nil {
+				if s.Properties != nil {
+					return fmt.Errorf("%s: property %s not documented", at, name)
+				}
+				continue
+			}
+			if s.KeyType == "integer" {
+				if _, err := strconv.Atoi(name); err != nil {
+					return fmt.Errorf("%s: key %q is not an integer", at, name)
+				}
+			}
+			if err := d.validate(sub, value, at+"."+name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: unknown schema type %s", at, s.Type)
+}
+
+// isAny reports whether the schema accepts every value.
+func (s *Schema) isAny() bool {
+	return s.Type == "" && s.Ref == "" && len(s.AllOf)+len(s.AnyOf)+len(s.OneOf)+len(s.Enum) == 0
+}
+
+func (s *Schema) validateEnum(v interface{}, at string) error {
+	if len(s.Enum) == 0 {
+		return nil
+	}
+	for _, e := range s.Enum {
+		if fmt.Sprint(e) == fmt.Sprint(v) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %v not in %v", at, v, s.Enum)
+}
+
+func typeError(at, want string, v interface{}) error {
+	got := "null"
+	switch v.(type) {
+	case string:
+		got = "string"
+	case json.Number:
+		got = "number"
+	case bool:
+		got = "boolean"
+	case []interface{}:
+		got = "array"
+	case map[string]interface{}:
+		got = "object"
+	}
+	return fmt.Errorf("%s: %s instead of %s", at, got, want)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/plpsy/iiocalibration/api"
+	"github.com/plpsy/iiocalibration/apiclient"
+	"github.com/plpsy/iiocalibration/openapi"
+)
+
+// testBackend keeps the registers in memory and captures a constant level.
+type testBackend struct {
+	mu   sync.Mutex
+	regs map[string]map[int]uint8
+}
+
+func (b *testBackend) Devices() ([]string, error) {
+	return []string{"cf_axi_adc", "cf_axi_adc_1"}, nil
+}
+
+func (b *testBackend) Check() error {
+	return nil
+}
+
+func (b *testBackend) Capture(devName string, chanIds []int, samples int) ([]byte, error) {
+	points := make([]byte, 0, samples*len(chanIds)*4)
+	for i := 0; i < samples*len(chanIds); i++ {
+		points = append(points, 0x40, 0x01, 0, 0)
+	}
+	return points, nil
+}
+
+func (b *testBackend) ReadReg(devName string, off int) (uint8, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.regs[devName][off], nil
+}
+
+func (b *testBackend) WriteReg(devName string, off int, val uint8) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.regs[devName] == nil {
+		b.regs[devName] = make(map[int]uint8)
+	}
+	b.regs[devName][off] = val
+	return nil
+}
+
+// setupServer applies a config with temporary storage, an admin API key
+// and the audit log, and returns the router.
+func setupServer(t *testing.T) (*httprouter.Router, []apiRoute) {
+	api.SetBackend(&testBackend{regs: make(map[string]map[int]uint8)})
+	dir := t.TempDir()
+	cfg := api.DefaultConfig()
+	cfg.Storage = api.StorageConfig{
+		CalibrationFile: filepath.Join(dir, "calibration.json"),
+		RegmapDir:       filepath.Join(dir, "regmaps"),
+		SnapshotDir:     filepath.Join(dir, "snapshots"),
+		HistoryFile:     filepath.Join(dir, "history.jsonl"),
+		DriftDir:        filepath.Join(dir, "drift"),
+		OffsetTable:     filepath.Join(dir, "offset-table.json"),
+		OutboxDir:       filepath.Join(dir, "outbox"),
+	}
+	cfg.Calibration.SettleDelay = api.Duration{Duration: 0}
+	cfg.SyncDelay = api.Duration{Duration: 0}
+	cfg.Webhooks = []api.WebhookConfig{{Name: "mes", URL: "http://127.0.0.1:1/hook", Secret: "s"}}
+	if err := api.ApplyConfig("", cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { api.ApplyConfig("", api.DefaultConfig()) })
+
+	authFile := filepath.Join(dir, "auth.json")
+	if err := ioutil.WriteFile(authFile, []byte(`{"keys": [{"name": "ci", "key": "secret", "role": "admin"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.LoadAuthFile(authFile); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { api.LoadAuthFile("") })
+	api.OpenAuditLog(filepath.Join(dir, "audit.log"))
+	return RegisterHandler()
+}
+
+// openapiPath converts a route path like /devices/:dev/regmap to the path
+// template /devices/{dev}/regmap.
+func openapiPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") || strings.HasPrefix(p, "*") {
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func TestRoutesDocumented(t *testing.T) {
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	documented := make(map[string]bool)
+	for _, r := range doc.Routes() {
+		documented[r.Method+" "+r.Path] = true
+	}
+	_, routes := RegisterHandler()
+	for _, r := range routes {
+		key := r.method + " " + openapiPath(r.path)
+		if !documented[key] {
+			t.Errorf("route %s not documented", key)
+		}
+		delete(documented, key)
+	}
+	for key := range documented {
+		t.Errorf("%s documented but not registered", key)
+	}
+}
+
+func TestResponsesMatchDocument(t *testing.T) {
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, _ := setupServer(t)
+	admin := http.Header{"X-Api-Key": {"secret"}}
+	tested := make(map[string]bool)
+	// check sends a request of the route method template and validates
+	// the response
+	check := func(method, template, url, body string, header http.Header, status int) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if template == "/events" {
+			ctx, cancel := context.WithTimeout(req.Context(), 50*time.Millisecond)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("%s %s: status %d, want %d: %s", method, url, rec.Code, status, rec.Body)
+		}
+		if err := doc.ValidateResponse(method, template, rec.Code, rec.Header().Get("Content-Type"), rec.Body.Bytes()); err != nil {
+			t.Errorf("%v\n%s", err, rec.Body)
+		}
+		tested[method+" "+template] = true
+		return rec
+	}
+
+	check("GET", "/healthz", "/healthz", "", nil, 200)
+	// 临时目录不是挂载点, 存储检查失败
+	check("GET", "/readyz", "/readyz", "", nil, 503)
+	check("GET", "/status", "/status", "", nil, 401)
+	check("GET", "/status", "/status", "", admin, 200)
+	check("GET", "/devices", "/devices", "", admin, 200)
+	check("GET", "/params", "/params", "", admin, 200)
+	check("GET", "/regparams", "/regparams", "", admin, 200)
+	check("POST", "/calibration", "/calibration?channel=8", "", admin, 200)
+	check("POST", "/calibration", "/calibration?channel=99", "", admin, 200)
+	check("GET", "/calibration/progress", "/calibration/progress", "", admin, 200)
+	check("GET", "/params", "/params", "", admin, 200)
+	check("PUT", "/params", "/params", `{"cf_axi_adc_1": {"1": -120}}`, admin, 200)
+	check("PUT", "/params", "/params", `[]`, admin, 400)
+	check("DELETE", "/regparams", "/regparams", "", admin, 200)
+
+	rec := check("GET", "/history", "/history?limit=5", "", admin, 200)
+	var history []apiclient.CalibrationRecord
+	json.Unmarshal(rec.Body.Bytes(), &history)
+	if len(history) != 2 || history[1].Error != "" {
+		t.Fatalf("history %+v", history)
+	}
+	check("GET", "/history", "/history?limit=x", "", admin, 400)
+	check("POST", "/history/{job}/rollback", "/history/"+history[1].JobID+"/rollback", "", admin, 200)
+	check("POST", "/history/{job}/rollback", "/history/"+history[0].JobID+"/rollback", "", admin, 409)
+
+	check("GET", "/devices/{dev}/registers", "/devices/cf_axi_adc/registers?start=0x1e&end=0x20", "", admin, 200)
+	check("GET", "/devices/{dev}/registers", "/devices/cf_axi_adc/registers?decode=true", "", admin, 200)
+	check("GET", "/devices/{dev}/registers", "/devices/nope/registers", "", admin, 404)
+	check("GET", "/devices/{dev}/registers/{addr}", "/devices/cf_axi_adc/registers/0x1e", "", admin, 200)
+	check("GET", "/devices/{dev}/registers/{addr}", "/devices/cf_axi_adc/registers/0x1e?decode=true", "", admin, 200)
+	check("PUT", "/devices/{dev}/registers/{addr}", "/devices/cf_axi_adc/registers/0x1e", `{"value": 18}`, admin, 200)
+	check("PUT", "/devices/{dev}/registers/{addr}", "/devices/cf_axi_adc/registers/0x1e", `{"value": 300}`, admin, 400)
+	check("GET", "/devices/{dev}/regmap", "/devices/cf_axi_adc/regmap", "", admin, 200)
+	check("GET", "/devices/{dev}/capture", "/devices/cf_axi_adc/capture?samples=16&channels=0,1", "", admin, 200)
+	check("GET", "/devices/{dev}/capture", "/devices/cf_axi_adc/capture?samples=x", "", admin, 400)
+
+	check("GET", "/drift", "/drift", "", admin, 200)
+	check("GET", "/compensation", "/compensation", "", admin, 200)
+	check("DELETE", "/compensation/table", "/compensation/table?device=cf_axi_adc", "", admin, 200)
+	check("GET", "/webhooks", "/webhooks", "", admin, 200)
+	check("GET", "/schedule", "/schedule", "", admin, 200)
+	check("PUT", "/schedule/window", "/schedule/window", `{"open": true, "duration": "1h"}`, admin, 200)
+	check("PUT", "/schedule/window", "/schedule/window", `{"open": false, "duration": "1h"}`, admin, 400)
+
+	check("POST", "/snapshots", "/snapshots", `{"name": "before", "devices": ["cf_axi_adc"]}`, admin, 200)
+	check("POST", "/snapshots", "/snapshots", `{"name": "../x"}`, admin, 400)
+	check("GET", "/snapshots", "/snapshots", "", admin, 200)
+	check("GET", "/snapshots/{name}", "/snapshots/before", "", admin, 200)
+	check("PUT", "/devices/{dev}/registers/{addr}", "/devices/cf_axi_adc/registers/0x1e", `{"value": 20}`, admin, 200)
+	check("GET", "/snapshots/{name}/diff", "/snapshots/before/diff", "", admin, 200)
+	check("POST", "/snapshots/{name}/restore", "/snapshots/before/restore", "", admin, 200)
+	check("DELETE", "/snapshots/{name}", "/snapshots/before", "", admin, 200)
+	check("GET", "/snapshots/{name}", "/snapshots/before", "", admin, 404)
+
+	rec = check("POST", "/reboot", "/reboot", "", admin, 202)
+	var token apiclient.RebootToken
+	json.Unmarshal(rec.Body.Bytes(), &token)
+	check("POST", "/reboot", "/reboot", `{"token": "`+token.Token+`", "delay": "1h"}`, admin, 200)
+	check("DELETE", "/reboot", "/reboot", "", admin, 200)
+	check("DELETE", "/reboot", "/reboot", "", admin, 404)
+
+	check("GET", "/audit", "/audit?limit=50", "", admin, 200)
+	check("GET", "/audit", "/audit?since=yesterday", "", admin, 400)
+	check("GET", "/auth/whoami", "/auth/whoami", "", admin, 200)
+	check("POST", "/auth/reload", "/auth/reload", "", admin, 200)
+	check("GET", "/metrics", "/metrics", "", admin, 200)
+	check("GET", "/admin/log", "/admin/log", "", admin, 200)
+	check("PUT", "/admin/log", "/admin/log", `{"levels": {"http": "debug"}}`, admin, 200)
+	check("PUT", "/admin/log", "/admin/log", `{"levels": {"http": "loud"}}`, admin, 400)
+	check("GET", "/events", "/events", "", admin, 200)
+	check("GET", "/openapi.json", "/openapi.json", "", nil, 200)
+	check("GET", "/", "/", "", nil, 302)
+	check("GET", "/ui/{filepath}", "/ui/", "", nil, 200)
+	check("GET", "/ui/{filepath}", "/ui/app.js", "", nil, 200)
+	check("GET", "/ui/{filepath}", "/ui/nope", "", nil, 404)
+
+	for _, r := range doc.Routes() {
+		if !tested[r.Method+" "+r.Path] {
+			t.Errorf("%s %s not tested", r.Method, r.Path)
+		}
+	}
+}
+
+func TestGeneratedClient(t *testing.T) {
+	router, _ := setupServer(t)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	c := apiclient.New(server.URL, "secret")
+
+	devices, err := c.GetDevices()
+	if err != nil || len(devices) != 2 || devices[1].FirstChannel != 7 {
+		t.Fatalf("devices %+v, %v", devices, err)
+	}
+	channel := 8
+	if err := c.Calibrate(&apiclient.CalibrateParams{Channel: &channel}); err != nil {
+		t.Fatal(err)
+	}
+	channel = 99
+	if err := c.Calibrate(&apiclient.CalibrateParams{Channel: &channel}); err == nil || !strings.Contains(err.Error(), "99") {
+		t.Errorf("calibrating channel 99: %v", err)
+	}
+	regs, err := c.GetRegParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := c.GetParams()
+	if err != nil || stored["cf_axi_adc_1"][1] != regs["cf_axi_adc_1"][1] || regs["cf_axi_adc_1"][1] == 0 {
+		t.Errorf("stored %v, applied %v, %v", stored, regs, err)
+	}
+	limit := 1
+	history, err := c.GetHistory(&apiclient.GetHistoryParams{Limit: &limit})
+	if err != nil || len(history) != 1 || history[0].Error == "" {
+		t.Errorf("history %+v, %v", history, err)
+	}
+
+	reg, err := c.WriteRegister("cf_axi_adc", "0x1e", apiclient.RegisterWrite{Value: 7})
+	if err != nil || reg.Address != 0x1e || reg.Value != 7 {
+		t.Errorf("register %+v, %v", reg, err)
+	}
+	if _, err := c.GetRegisterMap("nope"); err == nil || err.(*apiclient.Error).StatusCode != 404 {
+		t.Errorf("register map of unknown device: %v", err)
+	}
+
+	res, err := c.RequestReboot(nil)
+	if err != nil || res.RebootToken == nil {
+		t.Fatalf("reboot token %+v, %v", res, err)
+	}
+	res, err = c.RequestReboot(&apiclient.RebootRequest{Token: res.RebootToken.Token, Delay: "1h"})
+	if err != nil || res.PendingReboot == nil || res.PendingReboot.RequestedBy != "ci" {
+		t.Fatalf("reboot %+v, %v", res, err)
+	}
+	if err := c.CancelReboot(); err != nil {
+		t.Error(err)
+	}
+	if id, err := c.WhoAmI(); err != nil || id.Role != apiclient.RoleAdmin {
+		t.Errorf("identity %+v, %v", id, err)
+	}
+	if _, err := apiclient.New(server.URL, "").GetStatus(); err == nil || err.(*apiclient.Error).StatusCode != 401 {
+		t.Errorf("status without key: %v", err)
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/plpsy/iiocalibration/api"
+	"github.com/plpsy/iiocalibration/apiclient"
+	"github.com/urfave/cli"
+)
+
+// operator runs the client subcommands on the local hardware or, with
+// --remote, on a running server.
+type operator interface {
+	Calibrate(channel int) error
+	StoredParams() (apiclient.Params, error)
+	OffsetRegs() (apiclient.Params, error)
+	ClearOffsets() error
+	ImportParams(params apiclient.Params) error
+	CaptureChannels(devName string, chanIds []int, samples int) (*apiclient.Capture, error)
+	Reboot(delay time.Duration) (*apiclient.PendingReboot, error)
+}
+
+type localOperator struct{}
+
+func (localOperator) Calibrate(channel int) error { return api.Calibrate(channel) }
+func (localOperator) ClearOffsets() error         { return api.ClearOffsets() }
+
+func (localOperator) StoredParams() (apiclient.Params, error) {
+	params, err := api.StoredParams()
+	return apiclient.Params(params), err
+}
+
+func (localOperator) OffsetRegs() (apiclient.Params, error) {
+	params, err := api.OffsetRegs()
+	return apiclient.Params(params), err
+}
+
+func (localOperator) ImportParams(params apiclient.Params) error {
+	return api.ImportParams(api.Params(params))
+}
+
+func (localOperator) CaptureChannels(devName string, chanIds []int, samples int) (*apiclient.Capture, error) {
+	c, err := api.CaptureChannels(devName, chanIds, samples)
+	return (*apiclient.Capture)(c), err
+}
+
+func (localOperator) Reboot(delay time.Duration) (*apiclient.PendingReboot, error) {
+	time.Sleep(delay)
+	return nil, api.RebootNow()
+}
+
+type remoteOperator struct {
+	*apiclient.Client
+}
+
+func (r remoteOperator) Calibrate(channel int) error {
+	params := &apiclient.CalibrateParams{}
+	if channel >= 0 {
+		params.Channel = &channel
+	}
+	return r.Client.Calibrate(params)
+}
+
+func (r remoteOperator) StoredParams() (apiclient.Params, error) {
+	params, err := r.GetParams()
+	if params == nil && err == nil {
+		params = make(apiclient.Params)
+	}
+	return params, err
+}
+
+func (r remoteOperator) OffsetRegs() (apiclient.Params, error) { return r.GetRegParams() }
+func (r remoteOperator) ClearOffsets() error                   { return r.ClearRegParams() }
+
+func (r remoteOperator) ImportParams(params apiclient.Params) error {
+	_, err := r.PutParams(params)
+	return err
+}
+
+func (r remoteOperator) CaptureChannels(devName string, chanIds []int, samples int) (*apiclient.Capture, error) {
+	ids := make([]string, len(chanIds))
+	for i, id := range chanIds {
+		ids[i] = strconv.Itoa(id)
+	}
+	return r.GetCapture(devName, &apiclient.GetCaptureParams{Samples: &samples, Channels: strings.Join(ids, ",")})
+}
+
+// Reboot requests a confirmation token and confirms the reboot after delay.
+func (r remoteOperator) Reboot(delay time.Duration) (*apiclient.PendingReboot, error) {
+	res, err := r.RequestReboot(nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.RebootToken == nil {
+		return nil, fmt.Errorf("no reboot confirmation token")
+	}
+	res, err = r.RequestReboot(&apiclient.RebootRequest{Token: res.RebootToken.Token, Delay: delay.String()})
+	if err != nil {
+		return nil, err
+	}
+	return res.PendingReboot, nil
+}
+
+var operatorFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "remote",
+		Usage:  "URL of the server to operate, e.g. http://10.0.0.5, instead of the local hardware",
+		EnvVar: "IIOCALIBRATION_REMOTE",
+	},
+	cli.StringFlag{
+		Name:   "api-key",
+		Usage:  "API key sent to --remote",
+		EnvVar: "IIOCALIBRATION_API_KEY",
+	},
+	cli.StringFlag{
+		Name:   "ca-cert",
+		Usage:  "CA certificates file to verify an https --remote",
+		EnvVar: "IIOCALIBRATION_CA_CERT",
+	},
+	cli.StringFlag{
+		Name:  "output, o",
+		Usage: "output format, table or json",
+		Value: "table",
+	},
+}
+
+func withOperatorFlags(flags ...cli.Flag) []cli.Flag {
+	return append(flags, operatorFlags...)
+}
+
+// newOperator returns the operator selected by --remote. Local operations
+// are recorded in the audit log by the caller and refused while a server
+// runs.
+func newOperator(ctx *cli.Context) (operator, error) {
+	if f := ctx.String("output"); f != "table" && f != "json" {
+		return nil, cli.NewExitError("--output must be table or json", 1)
+	}
+	remote := ctx.String("remote")
+	if remote == "" {
+		if err := lockLocal(); err != nil {
+			return nil, cli.NewExitError(err.Error(), 1)
+		}
+		return localOperator{}, nil
+	}
+	c := apiclient.New(remote, ctx.String("api-key"))
+	if caFile := ctx.String("ca-cert"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		c.HTTPClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	return remoteOperator{c}, nil
+}
+
+func isRemote(ctx *cli.Context) bool {
+	return ctx.String("remote") != ""
+}
+
+// auditLocal records a state changing subcommand unless it ran on a server,
+// which keeps its own audit log.
+func auditLocal(ctx *cli.Context, action string, params map[string]string, before, after interface{}, err error) {
+	if !isRemote(ctx) {
+		localAudit(ctx, action, params, before, after, err)
+	}
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printParams writes offsets as a table sorted by device and channel.
+func printParams(ctx *cli.Context, params apiclient.Params) error {
+	if ctx.String("output") == "json" {
+		return printJSON(params)
+	}
+	devNames := make([]string, 0, len(params))
+	for devName := range params {
+		devNames = append(devNames, devName)
+	}
+	sort.Strings(devNames)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tCHANNEL\tOFFSET")
+	for _, devName := range devNames {
+		chanIds := make([]int, 0, len(params[devName]))
+		for id := range params[devName] {
+			chanIds = append(chanIds, id)
+		}
+		sort.Ints(chanIds)
+		for _, id := range chanIds {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", devName, id, params[devName][id])
+		}
+	}
+	return tw.Flush()
+}
+
+func printMessage(ctx *cli.Context, msg string) error {
+	if ctx.String("output") == "json" {
+		return printJSON(map[string]string{"message": msg})
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+var (
+	cmdCalibrate = cli.Command{
+		Name:  "calibrate",
+		Usage: "calibrate the offsets of all channels or of one channel",
+		Flags: withOperatorFlags(cli.IntFlag{
+			Name:  "channel",
+			Usage: "channel counted over all devices, default all channels",
+			Value: -1,
+		}),
+		Action: actionCalibrate,
+	}
+
+	cmdRegs = cli.Command{
+		Name:  "regs",
+		Usage: "offset registers of the channels",
+		Subcommands: []cli.Command{
+			{
+				Name:   "get",
+				Usage:  "read the offset registers",
+				Flags:  operatorFlags,
+				Action: actionRegsGet,
+			},
+			{
+				Name:   "clear",
+				Usage:  "write 0 to the offset registers",
+				Flags:  operatorFlags,
+				Action: actionRegsClear,
+			},
+		},
+	}
+
+	cmdParams = cli.Command{
+		Name:  "params",
+		Usage: "stored calibration parameters",
+		Subcommands: []cli.Command{
+			{
+				Name:   "show",
+				Usage:  "print the offsets stored in the calibration file",
+				Flags:  operatorFlags,
+				Action: actionParamsShow,
+			},
+		},
+	}
+
+	cmdCapture = cli.Command{
+		Name:      "capture",
+		Usage:     "capture samples of the channels of a device",
+		ArgsUsage: "<device>",
+		Flags: withOperatorFlags(
+			cli.StringFlag{
+				Name:  "channels",
+				Usage: "comma separated channels, default all",
+			},
+			cli.IntFlag{
+				Name:  "samples",
+				Usage: "samples per channel",
+				Value: 16,
+			},
+		),
+		Action: actionCapture,
+	}
+
+	cmdExport = cli.Command{
+		Name:  "export",
+		Usage: "write the stored calibration parameters as JSON, to import them on another board",
+		Flags: withOperatorFlags(cli.StringFlag{
+			Name:  "file, f",
+			Usage: "output file, default stdout",
+		}),
+		Action: actionExport,
+	}
+
+	cmdImport = cli.Command{
+		Name:      "import",
+		Usage:     "write the calibration parameters of an export file to the registers and store them",
+		ArgsUsage: "<file>",
+		Flags:     operatorFlags,
+		Action:    actionImport,
+	}
+
+	cmdReboot = cli.Command{
+		Name:  "reboot",
+		Usage: "reboot the board",
+		Flags: withOperatorFlags(
+			cli.DurationFlag{
+				Name:  "delay",
+				Usage: "reboot after this delay",
+			},
+			cli.BoolFlag{
+				Name:  "yes, y",
+				Usage: "do not ask for confirmation",
+			},
+			cli.BoolFlag{
+				Name:  "cancel",
+				Usage: "cancel the reboot scheduled on --remote",
+			},
+		),
+		Action: actionReboot,
+	}
+)
+
+func actionCalibrate(ctx *cli.Context) error {
+	op, err := newOperator(ctx)
+	if err != nil {
+		return err
+	}
+	channel := ctx.Int("channel")
+	before, _ := op.OffsetRegs()
+	err = op.Calibrate(channel)
+	after, _ := op.OffsetRegs()
+	auditLocal(ctx, "calibration", map[string]string{"channel": strconv.Itoa(channel)}, before, after, err)
+	if err != nil {
+		return cli.NewExitError("calibration failed: "+err.Error(), 1)
+	}
+	return printParams(ctx, after)
+}
+
+func actionRegsGet(ctx *cli.Context) error {
+	op, err := newOperator(ctx)
+	if err != nil {
+		return err
+	}
+	params, err := op.OffsetRegs()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return printParams(ctx, params)
+}
+
+func actionRegsClear(ctx *cli.Context) error {
+	op, err := newOperator(ctx)
+	if err != nil {
+		return err
+	}
+	before, _ := op.OffsetRegs()
+	err = op.ClearOffsets()
+	auditLocal(ctx, "clear_regs", nil, before, nil, err)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return printMessage(ctx, "offset registers cleared")
+}
+
+func actionParamsShow(ctx *cli.Context) error {
+	op, err := newOperator(ctx)
+	if err != nil {
+		return err
+	}
+	params, err := op.StoredParams()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return printParams(ctx, params)
+}
+
+func parseChannels(s string) ([]int, error) {
+	var chanIds []int
+	if s == "" {
+		return chanIds, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("channel %q invalid", f)
+		}
+		chanIds = append(chanIds, id)
+	}
+	return chanIds, nil
+}
+
+func actionCapture(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("usage: "+ctx.Command.HelpName+" "+ctx.Command.ArgsUsage, 1)
+	}
+	op, err := newOperator(ctx)
+	if err != nil {
+		return err
+	}
+	chanIds, err := parseChannels(ctx.String("channels"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	c, err := op.CaptureChannels(ctx.Args().First(), chanIds, ctx.Int("samples"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if ctx.String("output") == "json" {
+		return printJSON(c)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "SAMPLE\t")
+	for _, id := range c.Channels {
+		fmt.Fprintf(tw, "voltage%d\t", id)
+	}
+	fmt.Fprintln(tw)
+	for i := 0; i < c.Samples; i++ {
+		fmt.Fprintf(tw, "%d\t", i)
+		for idx := range c.Channels {
+			fmt.Fprintf(tw, "%d\t", c.Values[idx][i])
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func actionExport(ctx *cli.Context) error {
+	op, err := newOperator(ctx)
+	if err != nil {
+		return err
+	}
+	params, err := op.StoredParams()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	var out io.Writer = os.Stdout
+	if path := ctx.String("file"); path != "" {
+		fp, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		out = fp
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(params)
+}
+
+func actionImport(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return cli.NewExitError("usage: "+ctx.Command.HelpName+" "+ctx.Command.ArgsUsage, 1)
+	}
+	data, err := ioutil.ReadFile(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	var params apiclient.Params
+	if err := json.Unmarshal(data, &params); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s: %v", ctx.Args().First(), err), 1)
+	}
+	op, err := newOperator(ctx)
+	if err != nil {
+		return err
+	}
+	before, _ := op.OffsetRegs()
+	err = op.ImportParams(params)
+	auditLocal(ctx, "params_import", map[string]string{"file": ctx.Args().First()}, before, params, err)
+	if err != nil {
+		return cli.NewExitError("import failed: "+err.Error(), 1)
+	}
+	return printParams(ctx, params)
+}
+
+// confirm asks the user on the terminal, answers other than y or yes
+// refuse.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func actionReboot(ctx *cli.Context) error {
+	op, err := newOperator(ctx)
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("cancel") {
+		remote, ok := op.(remoteOperator)
+		if !ok {
+			return cli.NewExitError("--cancel needs --remote", 1)
+		}
+		if err := remote.CancelReboot(); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return printMessage(ctx, "reboot cancelled")
+	}
+	target := "this board"
+	if isRemote(ctx) {
+		target = ctx.String("remote")
+	}
+	if !ctx.Bool("yes") && !confirm("reboot "+target+"?") {
+		return cli.NewExitError("reboot not confirmed", 1)
+	}
+	delay := ctx.Duration("delay")
+	auditLocal(ctx, "reboot", map[string]string{"delay": delay.String()}, nil, nil, nil)
+	pending, err := op.Reboot(delay)
+	if err != nil {
+		return cli.NewExitError("reboot failed: "+err.Error(), 1)
+	}
+	if pending == nil {
+		return printMessage(ctx, "rebooting")
+	}
+	if ctx.String("output") == "json" {
+		return printJSON(pending)
+	}
+	fmt.Printf("reboot of %s scheduled at %s\n", target, pending.At.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/plpsy/iiocalibration/apiclient"
+)
+
+func TestRemoteOperator(t *testing.T) {
+	var imported apiclient.Params
+	mux := http.NewServeMux()
+	mux.HandleFunc("/calibration", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("channel") == "99" {
+			// 旧接口的错误也是200
+			json.NewEncoder(w).Encode("wrong channel number")
+			return
+		}
+		json.NewEncoder(w).Encode("Calibration done")
+	})
+	mux.HandleFunc("/params", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			json.NewDecoder(r.Body).Decode(&imported)
+		}
+		json.NewEncoder(w).Encode(imported)
+	})
+	mux.HandleFunc("/devices/cf_axi_adc/capture", func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Get("channels") != "2,5" || q.Get("samples") != "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(apiclient.Capture{Device: "cf_axi_adc", Samples: 1, Channels: []int{2, 5}, Values: [][]int32{{-3}, {4}}})
+	})
+	mux.HandleFunc("/reboot", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["token"] == "" {
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]string{"token": "t1"})
+			return
+		}
+		if body["token"] != "t1" || body["delay"] != "1m0s" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(apiclient.PendingReboot{At: time.Unix(60, 0), RequestedBy: "ops"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var op operator = remoteOperator{apiclient.New(server.URL, "key")}
+	if err := op.Calibrate(-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.Calibrate(99); err == nil || err.Error() != "wrong channel number" {
+		t.Fatalf("calibrate error %v", err)
+	}
+	if params, err := op.StoredParams(); err != nil || params == nil {
+		t.Fatalf("params before import %v, %v", params, err)
+	}
+	if err := op.ImportParams(apiclient.Params{"cf_axi_adc": {3: -7}}); err != nil {
+		t.Fatal(err)
+	}
+	params, err := op.StoredParams()
+	if err != nil || params["cf_axi_adc"][3] != -7 {
+		t.Fatalf("params %v, %v", params, err)
+	}
+	capture, err := op.CaptureChannels("cf_axi_adc", []int{2, 5}, 1)
+	if err != nil || capture.Values[1][0] != 4 {
+		t.Fatalf("capture %+v, %v", capture, err)
+	}
+	pending, err := op.Reboot(time.Minute)
+	if err != nil || pending.RequestedBy != "ops" {
+		t.Fatalf("reboot %+v, %v", pending, err)
+	}
+}
+
+func TestLockHardware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iiocalibration.lock")
+	// 另一个进程持有的锁, 同一进程中另外打开的文件也互斥
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	if err := lockHardware(path); err == nil || !strings.Contains(err.Error(), "held by a running server") {
+		t.Errorf("lock held by the server: %v", err)
+	}
+	fp.Close()
+	if err := lockHardware(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		hardwareLock.Close()
+		hardwareLock = nil
+	}()
+	if err := lockHardware(path); err != nil {
+		t.Errorf("lock taken twice: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/plpsy/iiocalibration/api"
+	"github.com/urfave/cli"
+)
+
+var cmdRegmap = cli.Command{
+	Name:  "regmap",
+	Usage: "inspect and import device register maps",
+	Subcommands: []cli.Command{
+		{
+			Name:      "show",
+			Usage:     "print the register map of a device",
+			ArgsUsage: "<device>",
+			Action:    actionRegmapShow,
+		},
+		{
+			Name:      "decode",
+			Usage:     "decode a register dump (GET /devices/{dev}/registers) into named fields",
+			ArgsUsage: "<device> <dump.json>",
+			Action:    actionRegmapDecode,
+		},
+		{
+			Name:      "import",
+			Usage:     "import the register map of a device from a csv or IP-XACT xml file",
+			ArgsUsage: "<device> <file>",
+			Action:    actionRegmapImport,
+		},
+	},
+}
+
+func regmapArgs(ctx *cli.Context, n int) ([]string, error) {
+	if ctx.NArg() != n {
+		return nil, cli.NewExitError("usage: "+ctx.Command.HelpName+" "+ctx.Command.ArgsUsage, 1)
+	}
+	return ctx.Args(), nil
+}
+
+func actionRegmapShow(ctx *cli.Context) error {
+	args, err := regmapArgs(ctx, 1)
+	if err != nil {
+		return err
+	}
+	api.LoadRegisterMaps()
+	m, err := api.DeviceRegisterMap(args[0])
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	for _, d := range m.Registers {
+		fmt.Fprintf(tw, "0x%02x\t%s\t%d bits\n", d.Address, d.Name, d.Width)
+		for _, f := range d.Fields {
+			fmt.Fprintf(tw, "\t  %s\t[%d:%d]\t%s\n", f.Name, f.Msb, f.Lsb, formatEnum(f.Enum))
+		}
+	}
+	return nil
+}
+
+func formatEnum(enum map[int]string) string {
+	values := make([]int, 0, len(enum))
+	for v := range enum {
+		values = append(values, v)
+	}
+	sort.Ints(values)
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = fmt.Sprintf("%d=%s", v, enum[v])
+	}
+	return strings.Join(items, " ")
+}
+
+func actionRegmapDecode(ctx *cli.Context) error {
+	args, err := regmapArgs(ctx, 2)
+	if err != nil {
+		return err
+	}
+	api.LoadRegisterMaps()
+	m, err := api.DeviceRegisterMap(args[0])
+	if err != nil {
+		return err
+	}
+	fp, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var regs []api.RegisterValue
+	if err = json.NewDecoder(fp).Decode(&regs); err != nil {
+		return fmt.Errorf("decode %s: %v", args[1], err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	for _, reg := range m.Decode(regs) {
+		fmt.Fprintf(tw, "0x%02x\t%s\t0x%0*x\n", reg.Address, reg.Name, reg.Width/4, reg.Value)
+		for _, f := range reg.Fields {
+			if f.Label != "" {
+				fmt.Fprintf(tw, "\t  %s\t%d (%s)\n", f.Name, f.Value, f.Label)
+			} else {
+				fmt.Fprintf(tw, "\t  %s\t%d\n", f.Name, f.Value)
+			}
+		}
+	}
+	return nil
+}
+
+func actionRegmapImport(ctx *cli.Context) error {
+	args, err := regmapArgs(ctx, 2)
+	if err != nil {
+		return err
+	}
+	m, err := api.ImportRegisterMap(args[0], args[1])
+	localAudit(ctx, "regmap_import", map[string]string{"device": args[0], "file": args[1]}, nil, nil, err)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d registers for %s\n", len(m.Registers), args[0])
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/plpsy/iiocalibration/api"
+	"github.com/urfave/cli"
+)
+
+var cmdSnapshot = cli.Command{
+	Name:  "snapshot",
+	Usage: "save and restore the register space of the adc devices",
+	Subcommands: []cli.Command{
+		{
+			Name:      "save",
+			Usage:     "save the registers of the devices (default all) as snapshot <name>",
+			ArgsUsage: "<name> [device...]",
+			Action:    actionSnapshotSave,
+		},
+		{
+			Name:   "list",
+			Usage:  "list the stored snapshots",
+			Action: actionSnapshotList,
+		},
+		{
+			Name:      "diff",
+			Usage:     "show the registers differing between a snapshot and the devices",
+			ArgsUsage: "<name>",
+			Action:    actionSnapshotDiff,
+		},
+		{
+			Name:      "restore",
+			Usage:     "write back the registers differing from a snapshot",
+			ArgsUsage: "<name>",
+			Action:    actionSnapshotRestore,
+		},
+		{
+			Name:      "delete",
+			Usage:     "delete a snapshot",
+			ArgsUsage: "<name>",
+			Action:    actionSnapshotDelete,
+		},
+	},
+}
+
+func snapshotArg(ctx *cli.Context) (string, error) {
+	if ctx.NArg() < 1 {
+		return "", cli.NewExitError("usage: "+ctx.Command.HelpName+" "+ctx.Command.ArgsUsage, 1)
+	}
+	return ctx.Args().First(), nil
+}
+
+func actionSnapshotSave(ctx *cli.Context) error {
+	name, err := snapshotArg(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := api.CaptureSnapshot(name, ctx.Args().Tail())
+	if err != nil {
+		return err
+	}
+	for devName, regs := range s.Devices {
+		fmt.Printf("%s: %d registers\n", devName, len(regs))
+	}
+	return nil
+}
+
+func actionSnapshotList(ctx *cli.Context) error {
+	names, err := api.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func printRegisterDiffs(diffs []api.RegisterDiff) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "DEVICE\tADDRESS\tNAME\tSNAPSHOT\tLIVE")
+	for _, d := range diffs {
+		fmt.Fprintf(tw, "%s\t0x%02x\t%s\t0x%02x\t0x%02x\n", d.Device, d.Address, d.Name, d.Snapshot, d.Live)
+	}
+}
+
+func actionSnapshotDiff(ctx *cli.Context) error {
+	name, err := snapshotArg(ctx)
+	if err != nil {
+		return err
+	}
+	api.LoadRegisterMaps()
+	s, err := api.LoadSnapshot(name)
+	if err != nil {
+		return err
+	}
+	diffs, err := api.DiffSnapshot(s)
+	if err != nil {
+		return err
+	}
+	printRegisterDiffs(diffs)
+	return nil
+}
+
+func actionSnapshotRestore(ctx *cli.Context) error {
+	name, err := snapshotArg(ctx)
+	if err != nil {
+		return err
+	}
+	if err := lockLocal(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	api.LoadRegisterMaps()
+	s, err := api.LoadSnapshot(name)
+	if err != nil {
+		return err
+	}
+	written, err := api.RestoreSnapshot(s)
+	localAudit(ctx, "snapshot_restore", map[string]string{"name": name}, nil, written, err)
+	printRegisterDiffs(written)
+	return err
+}
+
+func actionSnapshotDelete(ctx *cli.Context) error {
+	name, err := snapshotArg(ctx)
+	if err != nil {
+		return err
+	}
+	return api.DeleteSnapshot(name)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/plpsy/iiocalibration/logfile"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	envRestarts = "IIOCALIBRATION_RESTARTS"
+	envLastExit = "IIOCALIBRATION_LAST_EXIT"
+
+	superviseMinBackoff = time.Second
+	superviseStableTime = time.Minute
+)
+
+var cmdSupervise = cli.Command{
+	Name:      "supervise",
+	Usage:     "run the server and restart it with backoff when it exits",
+	ArgsUsage: "[-- server flags...]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "log-file",
+			Usage: "file receiving the server output, rotated by size",
+			Value: "/media/sd-mmcblk1p2/log/iiocalibration.log",
+		},
+		cli.IntFlag{
+			Name:  "log-max-size",
+			Usage: "size in MB at which the log file is rotated",
+			Value: 5,
+		},
+		cli.IntFlag{
+			Name:  "log-backups",
+			Usage: "number of rotated log files kept",
+			Value: 3,
+		},
+		cli.StringFlag{
+			Name:  "pid-file",
+			Usage: "file receiving the pid of the supervisor",
+			Value: "/var/run/iiocalibration.pid",
+		},
+		cli.DurationFlag{
+			Name:  "max-backoff",
+			Usage: "maximum delay between restarts",
+			Value: time.Minute,
+		},
+	},
+	Action: actionSupervise,
+}
+
+// supervisor restarts the server process, doubling the delay after each
+// exit up to maxBackoff. The delay is reset once the server ran for
+// superviseStableTime.
+type supervisor struct {
+	exe        string
+	args       []string
+	output     io.Writer
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	restarts int
+	lastExit string
+}
+
+func (s *supervisor) start() (*exec.Cmd, error) {
+	cmd := exec.Command(s.exe, s.args...)
+	cmd.Stdout = s.output
+	cmd.Stderr = s.output
+	cmd.Env = append(os.Environ(),
+		envRestarts+"="+strconv.Itoa(s.restarts),
+		envLastExit+"="+s.lastExit)
+	return cmd, cmd.Start()
+}
+
+func (s *supervisor) run(signals <-chan os.Signal) int {
+	backoff := s.minBackoff
+	for {
+		started := time.Now()
+		cmd, err := s.start()
+		if err != nil {
+			logrus.Error("supervise: start server error: ", err)
+			return 1
+		}
+		logrus.Infof("supervise: server started, pid %d, restarts %d", cmd.Process.Pid, s.restarts)
+		fmt.Fprintf(s.output, "supervise: server started at %s, pid %d, restarts %d\n",
+			started.Format(time.RFC3339), cmd.Process.Pid, s.restarts)
+
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+
+		var exitErr error
+	wait:
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+				if sig != syscall.SIGHUP {
+					logrus.Infof("supervise: %v, waiting for server", sig)
+					<-exited
+					return 0
+				}
+			case exitErr = <-exited:
+				break wait
+			}
+		}
+
+		s.lastExit = "exit status 0"
+		if exitErr != nil {
+			s.lastExit = exitErr.Error()
+		}
+		if time.Since(started) >= superviseStableTime {
+			backoff = s.minBackoff
+		}
+		logrus.Errorf("supervise: server exited (%s), restart in %v", s.lastExit, backoff)
+		fmt.Fprintf(s.output, "supervise: server exited (%s), restart in %v\n", s.lastExit, backoff)
+
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				return 0
+			}
+		case <-time.After(backoff):
+		}
+		s.restarts++
+		if backoff *= 2; backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+func actionSupervise(ctx *cli.Context) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if pidFile := ctx.String("pid-file"); pidFile != "" {
+		if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			return err
+		}
+		defer os.Remove(pidFile)
+	}
+	log := logfile.New(ctx.String("log-file"), int64(ctx.Int("log-max-size"))<<20, ctx.Int("log-backups"))
+	defer log.Close()
+
+	s := &supervisor{
+		exe:        exe,
+		args:       append([]string{"server"}, ctx.Args()...),
+		output:     log,
+		minBackoff: superviseMinBackoff,
+		maxBackoff: ctx.Duration("max-backoff"),
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	sdNotify("READY=1")
+	if code := s.run(signals); code != 0 {
+		return cli.NewExitError("supervise failed", code)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSupervisorRestarts(t *testing.T) {
+	out := &syncBuffer{}
+	s := &supervisor{
+		exe:        "/bin/sh",
+		args:       []string{"-c", "echo restarts=$" + envRestarts + " last=[$" + envLastExit + "]; exit 3"},
+		output:     out,
+		minBackoff: 10 * time.Millisecond,
+		maxBackoff: 40 * time.Millisecond,
+	}
+	signals := make(chan os.Signal, 1)
+	done := make(chan int)
+	go func() { done <- s.run(signals) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "restarts=3 ") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	signals <- syscall.SIGTERM
+	if code := <-done; code != 0 {
+		t.Fatalf("supervisor exit code %d", code)
+	}
+	log := out.String()
+	for _, expected := range []string{
+		"restarts=0 last=[]",
+		"restarts=1 last=[exit status 3]",
+		"restart in 20ms",
+		"restart in 40ms",
+	} {
+		if !strings.Contains(log, expected) {
+			t.Errorf("output misses %q:\n%s", expected, log)
+		}
+	}
+	if strings.Contains(log, "restart in 80ms") {
+		t.Errorf("backoff exceeds maximum:\n%s", log)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sdNotify sends a state to systemd when running as a Type=notify service,
+// it does nothing otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the keep alive interval requested by
+// WatchdogSec=, zero if the watchdog is disabled.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdWatchdog keeps the systemd watchdog alive as long as alive reports ok.
+func sdWatchdog(alive func() bool) {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	logrus.Info("systemd watchdog enabled, interval ", interval)
+	for range time.Tick(interval) {
+		if !alive() {
+			logrus.Error("watchdog: service not alive, skip keep alive")
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logrus.Error("watchdog notify error: ", err)
+		}
+	}
+}
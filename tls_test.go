@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls", "server.crt")
+	keyFile := filepath.Join(dir, "tls", "server.key")
+
+	if _, err := serverTLSConfig(certFile, keyFile, "", false); err == nil {
+		t.Fatal("expected error for missing certificate")
+	}
+	if _, err := serverTLSConfig(certFile, "", "", false); err == nil {
+		t.Fatal("expected error for missing key")
+	}
+	if cfg, err := serverTLSConfig("", "", "", false); cfg != nil || err != nil {
+		t.Fatalf("expected plain http, got %v %v", cfg, err)
+	}
+
+	cfg, err := serverTLSConfig(certFile, keyFile, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pemData)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the generated certificate is kept on the next start
+	cfg2, err := serverTLSConfig(certFile, keyFile, certFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cfg2.Certificates[0].Certificate[0]) != string(cfg.Certificates[0].Certificate[0]) {
+		t.Fatal("certificate regenerated")
+	}
+	if cfg2.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatal("client certificates not required")
+	}
+	srv2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv2.TLS = cfg2
+	srv2.StartTLS()
+	defer srv2.Close()
+	if _, err = client.Get(srv2.URL); err == nil {
+		t.Fatal("request without client certificate succeeded")
+	}
+}
@@ -0,0 +1,395 @@
+'use strict';
+
+// 界面只调用 HTTP API, 权限由 API key 的角色决定
+const state = {
+  key: localStorage.getItem('iiocalibration.apiKey') || '',
+  devices: [],
+  progress: {},
+  stream: null,
+  chartTimer: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k.startsWith('on')) {
+      e.addEventListener(k.slice(2), v);
+    } else if (v !== undefined && v !== null && v !== false) {
+      e.setAttribute(k, v === true ? '' : v);
+    }
+  }
+  for (const c of children) {
+    e.append(c instanceof Node ? c : document.createTextNode(String(c)));
+  }
+  return e;
+}
+
+function showMessage(text, isError) {
+  const m = $('message');
+  m.textContent = text;
+  m.className = isError ? 'error' : '';
+  m.hidden = false;
+  clearTimeout(showMessage.timer);
+  showMessage.timer = setTimeout(() => { m.hidden = true; }, isError ? 15000 : 5000);
+}
+
+function headers() {
+  return state.key ? { 'X-API-Key': state.key } : {};
+}
+
+async function api(method, path, body) {
+  const opts = { method, headers: headers() };
+  if (body !== undefined) {
+    opts.headers['Content-Type'] = 'application/json';
+    opts.body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, opts);
+  const data = await resp.json().catch(() => null);
+  if (!resp.ok) {
+    throw new Error(typeof data === 'string' ? data : `${resp.status} ${resp.statusText}`);
+  }
+  return data;
+}
+
+// 旧接口出错时也返回200和错误字符串
+function expectObject(data) {
+  if (typeof data === 'string') {
+    throw new Error(data);
+  }
+  return data || {};
+}
+
+async function loadStatus() {
+  try {
+    const s = await api('GET', '/status');
+    const ops = Object.entries(s.operations || {}).map(([k, n]) => `${k}×${n}`).join(', ');
+    const alerts = (s.driftAlerts || []).length;
+    $('status').textContent = `${s.version || 'dev'} · up ${s.uptime}` +
+      (ops ? ` · running ${ops}` : '') + (alerts ? ` · ${alerts} drift alert(s)` : '') +
+      (s.pendingReboot ? ' · reboot pending' : '');
+  } catch (e) {
+    $('status').textContent = e.message;
+  }
+}
+
+async function loadChannels() {
+  try {
+    const [devices, current, stored] = await Promise.all([
+      api('GET', '/devices'),
+      api('GET', '/regparams').then(expectObject),
+      api('GET', '/params').then(expectObject),
+    ]);
+    state.devices = devices;
+    renderChannels(current, stored);
+    renderChartChannels();
+  } catch (e) {
+    $('devices').replaceChildren(el('p', { class: 'error' }, e.message));
+  }
+}
+
+function offsetOf(params, dev, ch) {
+  const v = params && params[dev] && params[dev][ch];
+  return v === undefined ? null : v;
+}
+
+function renderChannels(current, stored) {
+  const running = runningChannels();
+  const sections = state.devices.map((d) => {
+    const rows = [];
+    for (let ch = 0; ch < d.channels; ch++) {
+      const global = d.firstChannel + ch;
+      const cur = offsetOf(current, d.name, ch);
+      const sto = offsetOf(stored, d.name, ch);
+      let cls = cur !== sto ? 'diff' : '';
+      if (running.pending.has(global)) cls += ' running';
+      if (running.done.has(global)) cls += ' done';
+      rows.push(el('tr', { class: cls, 'data-channel': global },
+        el('td', {}, global),
+        el('td', {}, ch),
+        el('td', { class: 'num' }, cur === null ? '–' : cur),
+        el('td', { class: 'num' }, sto === null ? '–' : sto),
+        el('td', { class: 'num' }, cur === null || sto === null ? '' : cur - sto),
+        el('td', {}, el('button', { onclick: () => calibrate(global), 'data-calibrate': '' }, 'Calibrate'))));
+    }
+    return el('div', {},
+      el('h3', {}, d.name, d.temperature ? el('span', { class: 'muted' }, ' · temperature compensated') : ''),
+      el('table', {},
+        el('thead', {}, el('tr', {},
+          el('th', {}, 'Channel'), el('th', {}, 'Local'), el('th', {}, 'Applied'),
+          el('th', {}, 'Stored'), el('th', {}, 'Difference'), el('th', {}))),
+        el('tbody', {}, ...rows)));
+  });
+  $('devices').replaceChildren(...sections);
+  setCalibrating(Object.keys(state.progress).length > 0);
+}
+
+function runningChannels() {
+  const pending = new Set();
+  const done = new Set();
+  for (const p of Object.values(state.progress)) {
+    p.channels.forEach((c) => pending.add(c));
+    p.done.forEach((c) => { pending.delete(c); done.add(c); });
+  }
+  return { pending, done };
+}
+
+function setCalibrating(on) {
+  document.querySelectorAll('[data-calibrate], #calibrate-all').forEach((b) => { b.disabled = on; });
+}
+
+async function calibrate(channel) {
+  const all = channel === undefined;
+  if (all && !confirm('Calibrate all channels? The inputs must be shorted.')) {
+    return;
+  }
+  setCalibrating(true);
+  try {
+    const result = await api('POST', all ? '/calibration' : `/calibration?channel=${channel}`);
+    showMessage(result, result !== 'Calibration done');
+  } catch (e) {
+    showMessage(e.message, true);
+  }
+  setCalibrating(Object.keys(state.progress).length > 0);
+  loadChannels();
+  loadHistory();
+}
+
+function renderProgress() {
+  const jobs = Object.values(state.progress);
+  $('progress').hidden = jobs.length === 0;
+  if (jobs.length === 0) {
+    return;
+  }
+  let total = 0;
+  let done = 0;
+  const texts = [];
+  for (const p of jobs) {
+    total += p.channels.length;
+    done += p.done.length;
+    texts.push(`${p.origin} ${p.step}${p.device ? ' ' + p.device : ''}`);
+  }
+  $('progress-fill').style.width = `${total ? (100 * done) / total : 0}%`;
+  $('progress-text').textContent = `${done}/${total} channels · ${texts.join(', ')}`;
+  const running = runningChannels();
+  document.querySelectorAll('#devices tr[data-channel]').forEach((tr) => {
+    const ch = Number(tr.dataset.channel);
+    tr.classList.toggle('running', running.pending.has(ch));
+    tr.classList.toggle('done', running.done.has(ch));
+  });
+}
+
+function onEvent(event, data) {
+  switch (event) {
+    case 'calibration.progress':
+      if (data.step === 'finished' || data.step === 'failed') {
+        delete state.progress[data.jobId];
+        if (data.step === 'failed') {
+          showMessage(`calibration ${data.jobId} failed: ${data.error}`, true);
+        }
+        loadChannels();
+        loadHistory();
+      } else {
+        state.progress[data.jobId] = data;
+        setCalibrating(true);
+      }
+      renderProgress();
+      break;
+    case 'drift.alert':
+      showMessage(`drift alert ${data.device} channel ${data.channel}: ${data.kinds.join(', ')}`, true);
+      loadStatus();
+      break;
+    case 'drift.cleared':
+    case 'calibration.started':
+      loadStatus();
+      break;
+    case 'reboot':
+      showMessage('the board reboots', true);
+      break;
+    default:
+  }
+}
+
+function dispatchBlock(block) {
+  let event = 'message';
+  const data = [];
+  for (const line of block.split('\n')) {
+    if (line.startsWith('event: ')) {
+      event = line.slice(7);
+    } else if (line.startsWith('data: ')) {
+      data.push(line.slice(6));
+    }
+  }
+  if (data.length > 0) {
+    onEvent(event, JSON.parse(data.join('\n')));
+  }
+}
+
+function setLive(on) {
+  const b = $('live');
+  b.textContent = on ? 'live' : 'offline';
+  b.className = `badge ${on ? 'on' : 'off'}`;
+}
+
+// EventSource 不能带 API key, 用 fetch 读取事件流
+async function streamEvents() {
+  if (state.stream) {
+    state.stream.abort();
+  }
+  const controller = new AbortController();
+  state.stream = controller;
+  while (!controller.signal.aborted) {
+    try {
+      const resp = await fetch('/events', { headers: headers(), signal: controller.signal });
+      if (!resp.ok) {
+        throw new Error(`${resp.status}`);
+      }
+      setLive(true);
+      state.progress = {};
+      const reader = resp.body.getReader();
+      const decoder = new TextDecoder();
+      let buf = '';
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) {
+          break;
+        }
+        buf += decoder.decode(value, { stream: true });
+        let i;
+        while ((i = buf.indexOf('\n\n')) >= 0) {
+          dispatchBlock(buf.slice(0, i));
+          buf = buf.slice(i + 2);
+        }
+      }
+    } catch (e) {
+      // 断开后重连
+    }
+    setLive(false);
+    await new Promise((resolve) => { setTimeout(resolve, 3000); });
+  }
+}
+
+async function loadHistory() {
+  const origin = $('history-origin').value;
+  const tbody = $('history').tBodies[0];
+  try {
+    const records = await api('GET', `/history?limit=50${origin ? '&origin=' + origin : ''}`);
+    tbody.replaceChildren(...records.map((r) => {
+      const ok = !r.error && r.offsets && Object.keys(r.offsets).length > 0;
+      return el('tr', {},
+        el('td', { title: r.jobId }, new Date(r.started).toLocaleString()),
+        el('td', {}, r.origin + (r.schedule ? ` (${r.schedule})` : '')),
+        el('td', {}, r.channels && r.channels.length ? r.channels.join(', ') : 'all'),
+        el('td', {}, r.duration),
+        el('td', { class: r.error ? 'error' : '' }, r.error || 'ok'),
+        el('td', {}, ok ? el('button', { onclick: () => rollback(r) }, 'Roll back') : ''));
+    }));
+  } catch (e) {
+    tbody.replaceChildren(el('tr', {}, el('td', { colspan: 6, class: 'error' }, e.message)));
+  }
+}
+
+async function rollback(rec) {
+  if (!confirm(`Write back the offsets of the calibration of ${new Date(rec.started).toLocaleString()}?`)) {
+    return;
+  }
+  try {
+    await api('POST', `/history/${encodeURIComponent(rec.jobId)}/rollback`);
+    showMessage('offsets rolled back');
+  } catch (e) {
+    showMessage(e.message, true);
+  }
+  loadChannels();
+}
+
+function renderChartChannels() {
+  const select = $('chart-channel');
+  const selected = select.value;
+  select.replaceChildren(...state.devices.flatMap((d) => Array.from({ length: d.channels }, (_, ch) =>
+    el('option', { value: `${d.name}/${ch}` }, `${d.name} channel ${ch}`))));
+  if (selected) {
+    select.value = selected;
+  }
+}
+
+function drawChart(values) {
+  const canvas = $('chart');
+  const ctx = canvas.getContext('2d');
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  if (values.length === 0) {
+    return;
+  }
+  let min = Infinity;
+  let max = -Infinity;
+  let sum = 0;
+  for (const v of values) {
+    min = Math.min(min, v);
+    max = Math.max(max, v);
+    sum += v;
+  }
+  const mean = sum / values.length;
+  const span = max - min || 1;
+  const y = (v) => canvas.height - 10 - ((v - min) / span) * (canvas.height - 20);
+  const x = (i) => (i / Math.max(values.length - 1, 1)) * canvas.width;
+  ctx.strokeStyle = '#ccc';
+  ctx.beginPath();
+  ctx.moveTo(0, y(mean));
+  ctx.lineTo(canvas.width, y(mean));
+  ctx.stroke();
+  ctx.strokeStyle = '#2d6cdf';
+  ctx.beginPath();
+  values.forEach((v, i) => { if (i === 0) ctx.moveTo(x(i), y(v)); else ctx.lineTo(x(i), y(v)); });
+  ctx.stroke();
+  $('chart-info').textContent = `mean ${mean.toFixed(1)} · min ${min} · max ${max} · ${values.length} samples`;
+}
+
+async function captureOnce() {
+  const [dev, ch] = $('chart-channel').value.split('/');
+  if (!dev) {
+    return;
+  }
+  const samples = Number($('chart-samples').value) || 512;
+  try {
+    const c = await api('GET', `/devices/${encodeURIComponent(dev)}/capture?channels=${ch}&samples=${samples}`);
+    drawChart(c.values[0] || []);
+  } catch (e) {
+    $('chart-info').textContent = e.message;
+  }
+}
+
+function toggleChart() {
+  const button = $('chart-toggle');
+  if (state.chartTimer) {
+    clearInterval(state.chartTimer);
+    state.chartTimer = null;
+    button.textContent = 'Start';
+    return;
+  }
+  button.textContent = 'Stop';
+  captureOnce();
+  state.chartTimer = setInterval(captureOnce, 2000);
+}
+
+function refresh() {
+  loadStatus();
+  loadChannels();
+  loadHistory();
+}
+
+$('api-key').value = state.key;
+$('key-form').addEventListener('submit', (e) => {
+  e.preventDefault();
+  state.key = $('api-key').value;
+  localStorage.setItem('iiocalibration.apiKey', state.key);
+  refresh();
+  streamEvents();
+});
+$('refresh').addEventListener('click', refresh);
+$('calibrate-all').addEventListener('click', () => calibrate());
+$('history-origin').addEventListener('change', loadHistory);
+$('chart-toggle').addEventListener('click', toggleChart);
+
+refresh();
+streamEvents();
+setInterval(loadStatus, 10000);
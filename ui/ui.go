@@ -0,0 +1,37 @@
+// Package ui serves the operator web interface. The files are embedded in
+// the binary, the interface uses the HTTP API with the API key entered by
+// the operator.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+//go:embed static
+var static embed.FS
+
+var files = func() http.Handler {
+	sub, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}()
+
+// Serve serves the file :filepath of the interface, index.html for /.
+func Serve(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h := w.Header()
+	h.Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-Frame-Options", "DENY")
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = params.ByName("filepath")
+	r2.URL = &u
+	files.ServeHTTP(w, r2)
+}
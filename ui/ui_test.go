@@ -0,0 +1,39 @@
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestServe(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/ui/*filepath", Serve)
+	for _, c := range []struct {
+		path        string
+		status      int
+		contentType string
+		contains    string
+	}{
+		{"/ui/", http.StatusOK, "text/html", `src="app.js"`},
+		{"/ui/app.js", http.StatusOK, "javascript", "streamEvents"},
+		{"/ui/style.css", http.StatusOK, "text/css", "#progress"},
+		{"/ui/missing.js", http.StatusNotFound, "", ""},
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", c.path, nil))
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.path, rec.Code, c.status)
+			continue
+		}
+		if !strings.Contains(rec.Header().Get("Content-Type"), c.contentType) || !strings.Contains(rec.Body.String(), c.contains) {
+			t.Errorf("%s: content type %q, body %.60q", c.path, rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+		if rec.Header().Get("Content-Security-Policy") == "" {
+			t.Errorf("%s: no content security policy", c.path)
+		}
+	}
+}